@@ -12,42 +12,217 @@ const (
 	SelectKind AstKind = iota
 	CreateTableKind
 	InsertKind
+	PrepareKind
+	ExecuteKind
+	DeallocateKind
+	CopyKind
+	CreateSequenceKind
+	ExplainKind
+	AnalyzeKind
+	SetKind
+	ShowKind
 )
 
 type ExpressionKind uint
 
 const (
 	LiteralKind ExpressionKind = iota
+	PlaceholderKind
+	FunctionKind
+	BinaryKind
+	UnaryKind
+	StarKind
 )
 
+// Expression is a literal, a column reference, a placeholder, a function
+// call, an operator or the * of SELECT * and count(*). Table is the
+// qualifier of a column reference like users.id, or of users.*, nil if
+// there is none. Function calls have the function name as Literal, and
+// operators the operator, like "=", AND or NOT; their operands are in
+// Args. IS NULL and IS NOT NULL are unary operators whose Literal is the
+// IS keyword, with Not set for the latter. Alias is the AS name of a
+// SELECT item.
 type Expression struct {
 	Literal *token.Token
+	Table   *token.Token
+	Args    []*Expression
+	Not     bool
+	Alias   *token.Token
 	Kind    ExpressionKind
 }
 
 type Statement struct {
-	SelectStatement      *SelectStatement
-	CreateTableStatement *CreateTableStatement
-	InsertStatement      *InsertStatement
-	Kind                 AstKind
+	SelectStatement         *SelectStatement
+	CreateTableStatement    *CreateTableStatement
+	InsertStatement         *InsertStatement
+	PrepareStatement        *PrepareStatement
+	ExecuteStatement        *ExecuteStatement
+	DeallocateStatement     *DeallocateStatement
+	CopyStatement           *CopyStatement
+	CreateSequenceStatement *CreateSequenceStatement
+	ExplainStatement        *ExplainStatement
+	AnalyzeStatement        *AnalyzeStatement
+	SetStatement            *SetStatement
+	ShowStatement           *ShowStatement
+	Kind                    AstKind
 }
 
+// InsertStatement adds either the rows of Values or those returned by
+// Select. Columns is nil when no column list was given, and Returning is
+// nil without a RETURNING clause.
 type InsertStatement struct {
-	Table  token.Token
-	Values *[]*Expression
+	Table      token.Token
+	Columns    []token.Token
+	Values     [][]*Expression
+	Select     *SelectStatement
+	OnConflict *OnConflict
+	Returning  []*Expression
 }
 
+// OnConflict is the ON CONFLICT clause of an INSERT. Target is nil when no
+// columns were given, and Set is nil for DO NOTHING.
+type OnConflict struct {
+	Target []token.Token
+	Set    []*SetClause
+}
+
+// SetClause is one column = value assignment of DO UPDATE SET.
+type SetClause struct {
+	Column token.Token
+	Value  *Expression
+}
+
+// ColumnDefinition is a column of CREATE TABLE. Default is nil when the
+// column has no DEFAULT, and is otherwise a literal or a function call.
 type ColumnDefinition struct {
-	Name     token.Token
-	Datatype token.Token
+	Name       token.Token
+	Datatype   token.Token
+	NotNull    bool
+	Default    *Expression
+	PrimaryKey bool
+	Unique     bool
+}
+
+// TableConstraint is a PRIMARY KEY or UNIQUE constraint over columns of
+// CREATE TABLE. Name is nil when it was not given.
+type TableConstraint struct {
+	Name       *token.Token
+	PrimaryKey bool
+	Columns    []token.Token
 }
 
 type CreateTableStatement struct {
-	Name token.Token
-	Cols *[]*ColumnDefinition
+	Name        token.Token
+	Cols        *[]*ColumnDefinition
+	Constraints []*TableConstraint
+	// Options are the storage parameters given with WITH, like
+	// storage = 'columnar'.
+	Options []*TableOption
+}
+
+// TableOption is a storage parameter of CREATE TABLE, name = value.
+type TableOption struct {
+	Name  token.Token
+	Value token.Token
 }
 
+// CreateSequenceStatement creates a sequence. Start and Increment are nil
+// when not given.
+type CreateSequenceStatement struct {
+	Name      token.Token
+	Start     *token.Token
+	Increment *token.Token
+	MaxValue  *token.Token
+}
+
+// SelectStatement reads rows. From is empty for SELECT without FROM,
+// which returns a single row. Where, Having, Limit and Offset are nil when
+// not given.
 type SelectStatement struct {
-	Item []*Expression
-	From token.Token
+	Item    []*Expression
+	From    []*TableRef
+	Where   *Expression
+	GroupBy []*Expression
+	Having  *Expression
+	OrderBy []*OrderTerm
+	Limit   *Expression
+	Offset  *Expression
+}
+
+// TableRef is a table of FROM. Alias is nil when not given, and On is the
+// condition of a JOIN, nil for the first table and tables listed after a
+// comma.
+type TableRef struct {
+	Name  token.Token
+	Alias *token.Token
+	On    *Expression
+}
+
+// OrderTerm is an expression of ORDER BY.
+type OrderTerm struct {
+	Expression *Expression
+	Desc       bool
+}
+
+// ExplainStatement shows the plan of a SELECT. With Analyze the SELECT
+// also runs, and every node of the plan shows what it actually did. JSON
+// renders the plan as JSON instead of text.
+type ExplainStatement struct {
+	Statement *Statement
+	Analyze   bool
+	JSON      bool
+}
+
+// AnalyzeStatement collects the statistics of a table, or of every table
+// when Table is nil.
+type AnalyzeStatement struct {
+	Table *token.Token
+}
+
+// SetStatement changes a setting of the session, as SET name = value or
+// SET name TO value. Value is nil for SET name TO DEFAULT and RESET name,
+// which restore its default, and Name is also nil for RESET ALL.
+type SetStatement struct {
+	Name  *token.Token
+	Value *token.Token
+}
+
+// ShowStatement returns the value of a setting of the session, or of all
+// of them when Name is nil.
+type ShowStatement struct {
+	Name *token.Token
+}
+
+type PrepareStatement struct {
+	Name      token.Token
+	Types     []token.Token
+	Statement *Statement
+}
+
+type ExecuteStatement struct {
+	Name token.Token
+	Args *[]*Expression
+}
+
+// DeallocateStatement releases a prepared statement, or all of them when
+// Name is nil.
+type DeallocateStatement struct {
+	Name *token.Token
+}
+
+// CopyStatement moves rows between a table and a file, into the table when
+// From is set. Columns is nil when no column list was given.
+type CopyStatement struct {
+	Table   token.Token
+	Columns []token.Token
+	From    bool
+	File    token.Token
+	Options []*CopyOption
+}
+
+// CopyOption is one of the WITH options of COPY, like DELIMITER ';'. Value
+// is nil for options given without one, like HEADER.
+type CopyOption struct {
+	Name  token.Token
+	Value *token.Token
 }
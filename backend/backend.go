@@ -1,8 +1,16 @@
 package backend
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/buffer"
+	"github.com/nanjingblue/maydb/lsm"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
 )
 
 type ColumnType uint
@@ -10,30 +18,254 @@ type ColumnType uint
 const (
 	TextType ColumnType = iota
 	IntType
+	// BoolType is the type of conditions, like id > 1. Tables can't have
+	// bool columns.
+	BoolType
 )
 
+func (ct ColumnType) String() string {
+	switch ct {
+	case TextType:
+		return "text"
+	case IntType:
+		return "int"
+	case BoolType:
+		return "bool"
+	}
+	return "unknown"
+}
+
+// ParseColumnType maps a datatype keyword, like "int", to its ColumnType.
+func ParseColumnType(name string) (ColumnType, error) {
+	switch name {
+	case "int":
+		return IntType, nil
+	case "text":
+		return TextType, nil
+	}
+	return 0, ErrInvalidDataType
+}
+
 type Cell interface {
 	AsText() string
-	AsInt() int32
+	AsInt() (int32, error)
+	IsNull() bool
 }
 
-type Results struct {
-	Columns []struct {
-		Type ColumnType
-		Name string
+// CellValue returns the Go value of a cell of the given type: int64 for
+// IntType, string for TextType and bool for BoolType, or nil for NULL.
+func CellValue(c Cell, ct ColumnType) (interface{}, error) {
+	if c.IsNull() {
+		return nil, nil
 	}
-	Rows [][]Cell
+	switch ct {
+	case IntType:
+		i, err := c.AsInt()
+		if err != nil {
+			return nil, err
+		}
+		return int64(i), nil
+	case TextType:
+		return c.AsText(), nil
+	case BoolType:
+		return c.AsText() == "\x01", nil
+	}
+	return nil, ErrInvalidDataType
+}
+
+// Column describes a column of results or of a table. NotNull and Default,
+// an SQL literal or "" for none, are only set by DescribeTable.
+type Column struct {
+	Type    ColumnType
+	Name    string
+	NotNull bool
+	Default string
+}
+
+type Results struct {
+	Columns []Column
+	Rows    [][]Cell
+}
+
+// TableDefinition is the catalog entry of a table. Storage is
+// ColumnarStorage for columnar tables, "" for row ones.
+type TableDefinition struct {
+	Name        string
+	Columns     []Column
+	Constraints []Constraint
+	Storage     string
 }
 
 var (
-	ErrTableDoesNotExist  = errors.New("table does not exist")
-	ErrColumnDoesNotExist = errors.New("column does not exit")
-	ErrInvalidDataType    = errors.New("invalid datatype")
-	ErrMissingValues      = errors.New("missing value")
+	ErrTableDoesNotExist     = errors.New("table does not exist")
+	ErrTableAlreadyExists    = errors.New("table already exists")
+	ErrColumnDoesNotExist    = errors.New("column does not exit")
+	ErrInvalidDataType       = errors.New("invalid datatype")
+	ErrTypeMismatch          = errors.New("value does not match column type")
+	ErrIntegerOutOfRange     = errors.New("integer out of range")
+	ErrInvalidCell           = errors.New("invalid cell")
+	ErrMissingValues         = errors.New("missing value")
+	ErrDuplicateColumn       = errors.New("column specified more than once")
+	ErrTooManyValues         = errors.New("more values than columns")
+	ErrNotNullViolation      = errors.New("null value violates not-null constraint")
+	ErrUniqueViolation       = errors.New("duplicate key value violates unique constraint")
+	ErrMultiplePrimaryKeys   = errors.New("multiple primary keys are not allowed")
+	ErrNoConflictConstraint  = errors.New("no unique constraint matches the ON CONFLICT columns")
+	ErrRowAffectedTwice      = errors.New("ON CONFLICT DO UPDATE cannot affect a row a second time")
+	ErrUnsupportedExpression = errors.New("unsupported expression")
+	ErrMultipleDefaults      = errors.New("multiple default values specified for column")
+	ErrSequenceDoesNotExist  = errors.New("sequence does not exist")
+	ErrSequenceAlreadyExists = errors.New("sequence already exists")
+	ErrSequenceExhausted     = errors.New("sequence reached its limit")
+	ErrSequenceMaxValue      = errors.New("reached maximum value of sequence")
+	ErrCurrvalNotDefined     = errors.New("currval of sequence is not yet defined")
+	ErrInvalidIncrement      = errors.New("INCREMENT must not be zero")
+	ErrUndefinedFunction     = errors.New("function does not exist")
+	ErrAmbiguousColumn       = errors.New("column reference is ambiguous")
+	ErrDuplicateAlias        = errors.New("table name specified more than once")
+	ErrGroupingError         = errors.New("column must appear in the GROUP BY clause or be used in an aggregate function")
+	ErrInvalidAggregate      = errors.New("aggregate functions are not allowed here")
+	ErrInvalidOrderPosition  = errors.New("ORDER BY position is not in select list")
+	ErrNegativeLimit         = errors.New("LIMIT and OFFSET must not be negative")
+	ErrDivisionByZero        = errors.New("division by zero")
+	ErrTxInProgress          = errors.New("transaction already in progress")
+	ErrNoTx                  = errors.New("no transaction in progress")
+	ErrInvalidDSN            = errors.New(`dsn must be "memory:", "file:<path>" or "lsm:<dir>"`)
+	ErrInvalidTableOption    = errors.New("invalid table option")
+	ErrQueryCanceled         = errors.New("canceling statement due to user request")
+	ErrStatementTimeout      = errors.New("canceling statement due to statement timeout")
 )
 
+// canceledError is the error of a statement whose context is done. It is
+// ErrQueryCanceled or ErrStatementTimeout, and wraps the error of the
+// context.
+type canceledError struct {
+	reason error
+	ctxErr error
+}
+
+func (e *canceledError) Error() string { return e.reason.Error() }
+
+func (e *canceledError) Is(target error) bool { return target == e.reason }
+
+func (e *canceledError) Unwrap() error { return e.ctxErr }
+
+// ContextErr returns nil while ctx is not done. Then it returns
+// ErrStatementTimeout if its deadline passed, ErrQueryCanceled if it was
+// canceled.
+func ContextErr(ctx context.Context) error {
+	err := ctx.Err()
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return &canceledError{reason: ErrStatementTimeout, ctxErr: err}
+	}
+	return &canceledError{reason: ErrQueryCanceled, ctxErr: err}
+}
+
+// Backend stores tables and runs statements on them. The methods that may
+// run for long take the context of the statement, and stop with the error
+// of ContextErr once it is done.
 type Backend interface {
 	CreateTable(*ast.CreateTableStatement) error
-	Insert(*ast.InsertStatement) error
-	Select(*ast.SelectStatement) (*Results, error)
+	Insert(context.Context, *ast.InsertStatement) (int64, *Results, error)
+	// InsertValues appends rows of Go values, of the types CellValue
+	// returns, to the given columns of a table, the others getting their
+	// defaults. Either every row is added or none is.
+	InsertValues(ctx context.Context, table string, columns []string, rows [][]interface{}) error
+	// Select starts running a SELECT. Its rows are computed as they are
+	// read, until they are closed or ctx is done.
+	Select(context.Context, *ast.SelectStatement) (Rows, error)
+	// Explain returns the plan of a statement as a single text column,
+	// one row per line.
+	Explain(context.Context, *ast.ExplainStatement) (*Results, error)
+	// Analyze collects the statistics the planner uses.
+	Analyze(context.Context, *ast.AnalyzeStatement) error
+	ListTables() ([]string, error)
+	DescribeTable(name string) (*TableDefinition, error)
+	CreateSequence(*ast.CreateSequenceStatement) error
+	// ListSequences returns every sequence, sorted by name.
+	ListSequences() ([]Sequence, error)
+}
+
+// Buffered is implemented by backends that cache pages in a buffer pool.
+type Buffered interface {
+	BufferStats() buffer.Stats
+}
+
+// Transactor is implemented by backends that can undo the changes made
+// since Begin.
+type Transactor interface {
+	Begin() error
+	Commit() error
+	Rollback() error
+}
+
+// Open returns the backend described by dsn: "memory:" for a new in-memory
+// database, "file:<path>" for one stored in a file, or "lsm:<dir>" for one
+// stored in an LSM tree in a directory. An lsm DSN may end with
+// "?buffer_pool=<size>", the size of its buffer pool in bytes, or with a
+// kB, MB or GB suffix.
+func Open(dsn string) (Backend, error) {
+	switch {
+	case dsn == "memory:":
+		return NewMemoryBacked(), nil
+	case strings.HasPrefix(dsn, "file:"):
+		path := strings.TrimPrefix(dsn, "file:")
+		if path == "" {
+			return nil, ErrInvalidDSN
+		}
+		b, err := OpenFileBackend(path)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", path, err)
+		}
+		return b, nil
+	case strings.HasPrefix(dsn, "lsm:"):
+		dir, query, _ := strings.Cut(strings.TrimPrefix(dsn, "lsm:"), "?")
+		if dir == "" {
+			return nil, ErrInvalidDSN
+		}
+		var opts lsm.Options
+		params, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidDSN, err)
+		}
+		for name := range params {
+			if name != "buffer_pool" {
+				return nil, fmt.Errorf("%w: unknown parameter %s", ErrInvalidDSN, name)
+			}
+			if opts.BufferPoolSize, err = parseSize(params.Get(name)); err != nil {
+				return nil, fmt.Errorf("%w: buffer_pool: %v", ErrInvalidDSN, err)
+			}
+		}
+		b, err := OpenLSMBackend(dir, opts)
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", dir, err)
+		}
+		return b, nil
+	}
+	return nil, ErrInvalidDSN
+}
+
+// parseSize parses a positive number of bytes, which may be followed by
+// kB, MB or GB.
+func parseSize(s string) (int64, error) {
+	n, unit := strings.TrimRightFunc(s, unicode.IsLetter), int64(1)
+	switch strings.ToUpper(s[len(n):]) {
+	case "", "B":
+	case "KB":
+		unit = 1 << 10
+	case "MB":
+		unit = 1 << 20
+	case "GB":
+		unit = 1 << 30
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size * unit, nil
 }
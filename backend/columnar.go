@@ -0,0 +1,701 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"math"
+	"math/bits"
+	"strings"
+)
+
+// ColumnarStorage is the Storage of tables created WITH (storage =
+// 'columnar').
+const ColumnarStorage = "columnar"
+
+// segmentRows is the number of rows of a segment, a batch of the
+// vectorized operators.
+const segmentRows = batchSize
+
+// Segment holds segmentRows rows of a columnar table, column by column.
+// Segments are never changed once written, transaction snapshots share
+// them.
+type Segment struct {
+	Columns []*ColumnSegment
+}
+
+// Encoding is how the values of a ColumnSegment are stored.
+type Encoding uint8
+
+const (
+	// PlainEncoding stores every text after its length.
+	PlainEncoding Encoding = iota
+	// RLEEncoding stores runs of equal values as the value and the length
+	// of the run.
+	RLEEncoding
+	// DictionaryEncoding stores the distinct texts once, then the
+	// bit-packed position of every value among them.
+	DictionaryEncoding
+	// DeltaEncoding stores the first int, then bit-packs the difference
+	// between every int and the one before, less the least difference.
+	DeltaEncoding
+	// BitPackedEncoding bit-packs every int less the least one, in as few
+	// bits as the greatest difference takes.
+	BitPackedEncoding
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case PlainEncoding:
+		return "plain"
+	case RLEEncoding:
+		return "rle"
+	case DictionaryEncoding:
+		return "dictionary"
+	case DeltaEncoding:
+		return "delta"
+	case BitPackedEncoding:
+		return "bitpacked"
+	}
+	return "unknown"
+}
+
+// ColumnSegment is a column of a segment. Data holds the Values values
+// that aren't NULL, in the smallest of the encodings that suit the column
+// type. Nulls has a bit set for every NULL row, and is nil when there are
+// none. Min and Max are the least and greatest values, the zone map that
+// lets scans skip segments their filter rules out.
+type ColumnSegment struct {
+	Encoding Encoding
+	Data     []byte
+	Values   int
+	Nulls    []byte
+	Min      MemoryCell
+	Max      MemoryCell
+}
+
+// newSegment encodes rows, which must be segmentRows rows of a table of
+// types.
+func newSegment(rows [][]MemoryCell, types []ColumnType) *Segment {
+	s := &Segment{}
+	for c, typ := range types {
+		cs := &ColumnSegment{}
+		var values []MemoryCell
+		for i, row := range rows {
+			if row[c] == nil {
+				if cs.Nulls == nil {
+					cs.Nulls = make([]byte, (len(rows)+7)/8)
+				}
+				cs.Nulls[i/8] |= 1 << (i % 8)
+				continue
+			}
+			values = append(values, row[c])
+			if cs.Min == nil || compare(row[c], cs.Min, typ) < 0 {
+				cs.Min = row[c]
+			}
+			if cs.Max == nil || compare(row[c], cs.Max, typ) > 0 {
+				cs.Max = row[c]
+			}
+		}
+		cs.Values = len(values)
+
+		var candidates map[Encoding][]byte
+		if typ == TextType {
+			candidates = map[Encoding][]byte{
+				PlainEncoding:      encodePlain(values),
+				DictionaryEncoding: encodeDictionary(values),
+				RLEEncoding:        encodeRLE(values, typ),
+			}
+		} else {
+			ints := make([]int64, len(values))
+			for i, v := range values {
+				x, _ := v.AsInt()
+				ints[i] = int64(x)
+			}
+			candidates = map[Encoding][]byte{
+				BitPackedEncoding: encodeBitPacked(ints),
+				DeltaEncoding:     encodeDelta(ints),
+				RLEEncoding:       encodeRLE(values, typ),
+			}
+		}
+		// Prefer the encodings declared first on ties
+		cs.Encoding = math.MaxUint8
+		for e, data := range candidates {
+			if cs.Encoding == math.MaxUint8 || len(data) < len(cs.Data) || (len(data) == len(cs.Data) && e < cs.Encoding) {
+				cs.Encoding, cs.Data = e, data
+			}
+		}
+		s.Columns = append(s.Columns, cs)
+	}
+	return s
+}
+
+// bitWriter bit-packs values of up to 56 bits.
+type bitWriter struct {
+	data []byte
+	acc  uint64
+	n    uint
+}
+
+func (w *bitWriter) write(v uint64, width uint8) {
+	w.acc |= v << w.n
+	w.n += uint(width)
+	for w.n >= 8 {
+		w.data = append(w.data, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.n > 0 {
+		w.data = append(w.data, byte(w.acc))
+	}
+	return w.data
+}
+
+type bitReader struct {
+	data []byte
+	acc  uint64
+	n    uint
+}
+
+func (r *bitReader) read(width uint8) (uint64, error) {
+	if width > 56 {
+		return 0, fmt.Errorf("%w: bit width %d", ErrInvalidCell, width)
+	}
+	for r.n < uint(width) {
+		if len(r.data) == 0 {
+			return 0, errCutShort
+		}
+		r.acc |= uint64(r.data[0]) << r.n
+		r.data = r.data[1:]
+		r.n += 8
+	}
+	v := r.acc & (1<<width - 1)
+	r.acc >>= width
+	r.n -= uint(width)
+	return v, nil
+}
+
+func encodeBitPacked(values []int64) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	width := uint8(bits.Len64(uint64(max - min)))
+	w := &bitWriter{data: append(binary.AppendVarint(nil, min), width)}
+	for _, v := range values {
+		w.write(uint64(v-min), width)
+	}
+	return w.flush()
+}
+
+func encodeDelta(values []int64) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	deltas := make([]int64, len(values)-1)
+	for i := range deltas {
+		deltas[i] = values[i+1] - values[i]
+	}
+	data := binary.AppendVarint(nil, values[0])
+	if len(deltas) == 0 {
+		return data
+	}
+	return append(data, encodeBitPacked(deltas)...)
+}
+
+func encodePlain(values []MemoryCell) []byte {
+	var data []byte
+	for _, v := range values {
+		data = append(binary.AppendUvarint(data, uint64(len(v))), v...)
+	}
+	return data
+}
+
+func encodeDictionary(values []MemoryCell) []byte {
+	if len(values) == 0 {
+		return nil
+	}
+	codes := map[string]uint64{}
+	var dict []MemoryCell
+	for _, v := range values {
+		if _, ok := codes[string(v)]; !ok {
+			codes[string(v)] = uint64(len(dict))
+			dict = append(dict, v)
+		}
+	}
+	width := uint8(bits.Len64(uint64(len(dict) - 1)))
+	data := append(binary.AppendUvarint(nil, uint64(len(dict))), encodePlain(dict)...)
+	w := &bitWriter{data: append(data, width)}
+	for _, v := range values {
+		w.write(codes[string(v)], width)
+	}
+	return w.flush()
+}
+
+// encodeRLE stores runs of ints as varints, of texts as their length and
+// bytes, each followed by the length of the run.
+func encodeRLE(values []MemoryCell, typ ColumnType) []byte {
+	var data []byte
+	for i := 0; i < len(values); {
+		run := 1
+		for i+run < len(values) && bytes.Equal(values[i+run], values[i]) {
+			run++
+		}
+		if typ == TextType {
+			data = append(binary.AppendUvarint(data, uint64(len(values[i]))), values[i]...)
+		} else {
+			x, _ := values[i].AsInt()
+			data = binary.AppendVarint(data, int64(x))
+		}
+		data = binary.AppendUvarint(data, uint64(run))
+		i += run
+	}
+	return data
+}
+
+var errCutShort = fmt.Errorf("%w: segment data cut short", ErrInvalidCell)
+
+// byteReader reads the varints and texts of segment data.
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) varint() (int64, error) {
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		return 0, errCutShort
+	}
+	r.data = r.data[n:]
+	return v, nil
+}
+
+func (r *byteReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errCutShort
+	}
+	r.data = r.data[n:]
+	return v, nil
+}
+
+// text returns the next text, never nil since nil is NULL.
+func (r *byteReader) text() (MemoryCell, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)) {
+		return nil, errCutShort
+	}
+	text := MemoryCell(r.data[:n:n])
+	if text == nil {
+		text = MemoryCell{}
+	}
+	r.data = r.data[n:]
+	return text, nil
+}
+
+// ints decodes the values of cs, which are ints, into dst.
+func (cs *ColumnSegment) ints(dst []int64) error {
+	if len(dst) == 0 {
+		return nil
+	}
+	r := &byteReader{data: cs.Data}
+	switch cs.Encoding {
+	case BitPackedEncoding:
+		return unpack(r, dst)
+	case DeltaEncoding:
+		first, err := r.varint()
+		if err != nil {
+			return err
+		}
+		dst[0] = first
+		if len(dst) > 1 {
+			if err := unpack(r, dst[1:]); err != nil {
+				return err
+			}
+		}
+		for i := 1; i < len(dst); i++ {
+			dst[i] += dst[i-1]
+		}
+	case RLEEncoding:
+		for i := 0; i < len(dst); {
+			v, err := r.varint()
+			if err != nil {
+				return err
+			}
+			run, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			for ; run > 0 && i < len(dst); run-- {
+				dst[i] = v
+				i++
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s encoding of ints", ErrInvalidCell, cs.Encoding)
+	}
+	return nil
+}
+
+// unpack decodes bit-packed ints into dst.
+func unpack(r *byteReader, dst []int64) error {
+	min, err := r.varint()
+	if err != nil {
+		return err
+	}
+	if len(r.data) == 0 {
+		return errCutShort
+	}
+	width := r.data[0]
+	br := &bitReader{data: r.data[1:]}
+	for i := range dst {
+		v, err := br.read(width)
+		if err != nil {
+			return err
+		}
+		dst[i] = min + int64(v)
+	}
+	return nil
+}
+
+// texts decodes the values of cs, which are texts, into dst.
+func (cs *ColumnSegment) texts(dst []MemoryCell) error {
+	if len(dst) == 0 {
+		return nil
+	}
+	r := &byteReader{data: cs.Data}
+	switch cs.Encoding {
+	case PlainEncoding:
+		for i := range dst {
+			text, err := r.text()
+			if err != nil {
+				return err
+			}
+			dst[i] = text
+		}
+	case DictionaryEncoding:
+		n, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		// Every text takes at least a byte
+		if n > uint64(len(r.data)) {
+			return errCutShort
+		}
+		dict := make([]MemoryCell, n)
+		for i := range dict {
+			if dict[i], err = r.text(); err != nil {
+				return err
+			}
+		}
+		if len(r.data) == 0 {
+			return errCutShort
+		}
+		width := r.data[0]
+		br := &bitReader{data: r.data[1:]}
+		for i := range dst {
+			k, err := br.read(width)
+			if err != nil {
+				return err
+			}
+			if k >= uint64(len(dict)) {
+				return fmt.Errorf("%w: dictionary entry %d of %d", ErrInvalidCell, k, len(dict))
+			}
+			dst[i] = dict[k]
+		}
+	case RLEEncoding:
+		for i := 0; i < len(dst); {
+			v, err := r.text()
+			if err != nil {
+				return err
+			}
+			run, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			for ; run > 0 && i < len(dst); run-- {
+				dst[i] = v
+				i++
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s encoding of texts", ErrInvalidCell, cs.Encoding)
+	}
+	return nil
+}
+
+func (cs *ColumnSegment) isNull(i int) bool {
+	return cs.Nulls != nil && cs.Nulls[i/8]&(1<<(i%8)) != 0
+}
+
+// checkNulls tells whether the nulls of cs fit its count of values, which
+// isNull and scatter count on.
+func (cs *ColumnSegment) checkNulls() error {
+	switch {
+	case cs.Nulls == nil && cs.Values != segmentRows,
+		cs.Nulls != nil && (len(cs.Nulls) != (segmentRows+7)/8 || cs.Values < 0 || cs.Values > segmentRows):
+		return fmt.Errorf("%w: %d values of %d rows", ErrInvalidCell, cs.Values, segmentRows)
+	}
+	return nil
+}
+
+// decode decodes cs into the first segmentRows values of v.
+func (cs *ColumnSegment) decode(v *vector) error {
+	if err := cs.checkNulls(); err != nil {
+		return err
+	}
+	if v.typ == TextType {
+		values := v.texts[:segmentRows]
+		if cs.Nulls != nil {
+			values = make([]MemoryCell, cs.Values)
+		}
+		if err := cs.texts(values); err != nil {
+			return err
+		}
+		return cs.scatter(v, func(i, j int) { v.texts[i] = values[j] })
+	}
+	values := v.ints[:segmentRows]
+	if cs.Nulls != nil {
+		values = make([]int64, cs.Values)
+	}
+	if err := cs.ints(values); err != nil {
+		return err
+	}
+	return cs.scatter(v, func(i, j int) { v.ints[i] = values[j] })
+}
+
+// scatter sets the nulls of v, and moves the values decoded for the rows
+// that aren't NULL to their rows.
+func (cs *ColumnSegment) scatter(v *vector, move func(row, value int)) error {
+	if cs.Nulls == nil {
+		for i := 0; i < segmentRows; i++ {
+			v.nulls[i] = false
+		}
+		return nil
+	}
+	j := 0
+	for i := 0; i < segmentRows; i++ {
+		if v.nulls[i] = cs.isNull(i); !v.nulls[i] {
+			if j == cs.Values {
+				return fmt.Errorf("%w: more than %d values", ErrInvalidCell, cs.Values)
+			}
+			move(i, j)
+			j++
+		}
+	}
+	if j != cs.Values {
+		return fmt.Errorf("%w: %d values instead of %d", ErrInvalidCell, j, cs.Values)
+	}
+	return nil
+}
+
+// rows decodes columns of the rows of s, a table of types.
+func (s *Segment) rows(types []ColumnType, columns []int) ([][]MemoryCell, error) {
+	if err := s.checkColumns(types); err != nil {
+		return nil, err
+	}
+	rows := make([][]MemoryCell, segmentRows)
+	for i := range rows {
+		rows[i] = make([]MemoryCell, len(columns))
+	}
+	for j, c := range columns {
+		v := newVector(types[c])
+		if err := s.Columns[c].decode(v); err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			rows[i][j], _ = v.cell(i)
+		}
+	}
+	return rows, nil
+}
+
+// row decodes the row at i of s, a table of types.
+func (s *Segment) row(types []ColumnType, i int) ([]MemoryCell, error) {
+	if err := s.checkColumns(types); err != nil {
+		return nil, err
+	}
+	row := make([]MemoryCell, len(types))
+	for c, typ := range types {
+		if err := s.Columns[c].checkNulls(); err != nil {
+			return nil, err
+		}
+		if s.Columns[c].isNull(i) {
+			continue
+		}
+		v := newVector(typ)
+		if err := s.Columns[c].decode(v); err != nil {
+			return nil, err
+		}
+		row[c], _ = v.cell(i)
+	}
+	return row, nil
+}
+
+func (s *Segment) checkColumns(types []ColumnType) error {
+	if len(s.Columns) != len(types) {
+		return fmt.Errorf("%w: segment of %d columns", ErrInvalidCell, len(s.Columns))
+	}
+	return nil
+}
+
+// check decodes s, to tell whether it is valid for a table of types.
+func (s *Segment) check(types []ColumnType) error {
+	if err := s.checkColumns(types); err != nil {
+		return err
+	}
+	for c, typ := range types {
+		if err := s.Columns[c].decode(newVector(typ)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zoneCond is a condition of a scan, column op value, that zone maps can
+// rule out. value is nil for IS NULL and IS NOT NULL.
+type zoneCond struct {
+	col   int
+	op    string
+	value MemoryCell
+	typ   ColumnType
+}
+
+// mirrored gives the operator of value op column for column op value.
+var mirrored = map[string]string{"=": "=", "<>": "<>", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+// zoneConds picks the conditions of a scan of n zone maps can check, and
+// the expressions they come from.
+func zoneConds(n *scanNode, filter []*expr) ([]zoneCond, []*expr) {
+	var zones []zoneCond
+	var used []*expr
+	for _, cond := range filter {
+		args := cond.args
+		switch {
+		case cond.kind == isNullExpr && args[0].kind == columnExpr && args[0].col.rel == n.rel:
+			op := "IS NULL"
+			if cond.not {
+				op = "IS NOT NULL"
+			}
+			zones = append(zones, zoneCond{col: args[0].col.col, op: op})
+		case cond.kind != binaryExpr || mirrored[cond.op] == "":
+			continue
+		case args[0].kind == columnExpr && args[0].col.rel == n.rel && args[1].kind == constExpr && args[1].value != nil:
+			zones = append(zones, zoneCond{col: args[0].col.col, op: cond.op, value: args[1].value, typ: args[0].typ})
+		case args[1].kind == columnExpr && args[1].col.rel == n.rel && args[0].kind == constExpr && args[0].value != nil:
+			zones = append(zones, zoneCond{col: args[1].col.col, op: mirrored[cond.op], value: args[0].value, typ: args[1].typ})
+		default:
+			continue
+		}
+		used = append(used, cond)
+	}
+	return zones, used
+}
+
+// skips tells whether the zone maps of s rule out every row for one of
+// conds.
+func (s *Segment) skips(conds []zoneCond) bool {
+	for _, z := range conds {
+		cs := s.Columns[z.col]
+		if z.op == "IS NULL" {
+			if cs.Nulls == nil {
+				return true
+			}
+			continue
+		}
+		// Comparisons with NULL are never true
+		if cs.Values == 0 {
+			return true
+		}
+		if z.op == "IS NOT NULL" {
+			continue
+		}
+		min, max := compare(cs.Min, z.value, z.typ), compare(cs.Max, z.value, z.typ)
+		switch z.op {
+		case "=":
+			if min > 0 || max < 0 {
+				return true
+			}
+		case "<>":
+			if min == 0 && max == 0 {
+				return true
+			}
+		case "<":
+			if min >= 0 {
+				return true
+			}
+		case "<=":
+			if min > 0 {
+				return true
+			}
+		case ">":
+			if max <= 0 {
+				return true
+			}
+		case ">=":
+			if max < 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setOptions applies the WITH options of CREATE TABLE.
+func (t *Table) setOptions(options []*ast.TableOption) error {
+	for _, opt := range options {
+		if strings.ToLower(opt.Name.Value) != "storage" {
+			return fmt.Errorf("%w %q", ErrInvalidTableOption, opt.Name.Value)
+		}
+		switch strings.ToLower(opt.Value.Value) {
+		case "row":
+			t.Storage = ""
+		case ColumnarStorage:
+			t.Storage = ColumnarStorage
+		default:
+			return fmt.Errorf("%w: storage %q, expected row or columnar", ErrInvalidTableOption, opt.Value.Value)
+		}
+	}
+	return nil
+}
+
+// sealed is the number of rows of t in segments, which come before those
+// in Rows.
+func (t *Table) sealed() int {
+	return len(t.Segments) * segmentRows
+}
+
+// seal moves the rows of a columnar table into segments, as long as they
+// fill one.
+func (t *Table) seal() {
+	if t.Storage != ColumnarStorage || len(t.Rows) < segmentRows {
+		return
+	}
+	rows := t.Rows
+	for ; len(rows) >= segmentRows; rows = rows[segmentRows:] {
+		t.Segments = append(t.Segments, newSegment(rows[:segmentRows], t.ColumnTypes))
+	}
+	t.Rows = append([][]MemoryCell(nil), rows...)
+}
+
+func (t *Table) allColumns() []int {
+	columns := make([]int, len(t.Columns))
+	for i := range columns {
+		columns[i] = i
+	}
+	return columns
+}
@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentEncodings(t *testing.T) {
+	column := func(value func(i int) interface{}) [][]MemoryCell {
+		rows := make([][]MemoryCell, segmentRows)
+		for i := range rows {
+			switch v := value(i).(type) {
+			case int:
+				cell, err := intCell(int64(v))
+				assert.Nil(t, err)
+				rows[i] = []MemoryCell{cell}
+			case string:
+				rows[i] = []MemoryCell{MemoryCell(v)}
+			default:
+				rows[i] = []MemoryCell{nil}
+			}
+		}
+		return rows
+	}
+
+	tests := []struct {
+		name     string
+		typ      ColumnType
+		value    func(i int) interface{}
+		encoding Encoding
+	}{
+		{name: "sequence", typ: IntType, value: func(i int) interface{} { return 1000 + i }, encoding: DeltaEncoding},
+		{name: "constant", typ: IntType, value: func(i int) interface{} { return -7 }, encoding: BitPackedEncoding},
+		{name: "runs", typ: IntType, value: func(i int) interface{} { return i / 256 * 1000000 }, encoding: RLEEncoding},
+		{name: "scattered", typ: IntType, value: func(i int) interface{} { return i * 7919 % 1000 }, encoding: BitPackedEncoding},
+		{name: "extremes", typ: IntType, value: func(i int) interface{} {
+			if i%2 == 0 {
+				return math.MinInt32
+			}
+			return math.MaxInt32
+		}, encoding: BitPackedEncoding},
+		{name: "nulls", typ: IntType, value: func(i int) interface{} {
+			if i%3 == 0 {
+				return nil
+			}
+			return i
+		}, encoding: DeltaEncoding},
+		{name: "all nulls", typ: IntType, value: func(i int) interface{} { return nil }, encoding: RLEEncoding},
+		{name: "distinct", typ: TextType, value: func(i int) interface{} { return fmt.Sprintf("value-%d", i) }, encoding: PlainEncoding},
+		{name: "few", typ: TextType, value: func(i int) interface{} { return fmt.Sprintf("k%d", i%7) }, encoding: DictionaryEncoding},
+		{name: "text runs", typ: TextType, value: func(i int) interface{} { return fmt.Sprintf("%c", 'a'+i/512) }, encoding: RLEEncoding},
+		{name: "empty texts", typ: TextType, value: func(i int) interface{} {
+			if i%5 == 0 {
+				return nil
+			}
+			return []string{"", "x"}[i%2]
+		}, encoding: DictionaryEncoding},
+	}
+
+	for _, test := range tests {
+		rows := column(test.value)
+		s := newSegment(rows, []ColumnType{test.typ})
+		assert.Equal(t, test.encoding, s.Columns[0].Encoding, test.name)
+		assert.Nil(t, s.check([]ColumnType{test.typ}), test.name)
+
+		got, err := s.rows([]ColumnType{test.typ}, []int{0})
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, rows, got, test.name)
+		for i := range rows {
+			assert.Equal(t, rows[i][0] == nil, got[i][0] == nil, test.name)
+		}
+	}
+
+	s := newSegment(column(func(i int) interface{} { return fmt.Sprintf("value-%d", i) }), []ColumnType{TextType})
+	s.Columns[0].Data = s.Columns[0].Data[:100]
+	assert.ErrorIs(t, s.check([]ColumnType{TextType}), ErrInvalidCell)
+	assert.ErrorIs(t, s.check([]ColumnType{TextType, IntType}), ErrInvalidCell)
+
+	// Corrupt segments are reported by every path that decodes them
+	nulls := func(i int) interface{} {
+		if i%3 == 0 {
+			return nil
+		}
+		return i * 7919 % 1000
+	}
+	for name, corrupt := range map[string]func(cs *ColumnSegment){
+		"cut short": func(cs *ColumnSegment) { cs.Data = cs.Data[:10] },
+		"no data":   func(cs *ColumnSegment) { cs.Data = nil },
+		"width":     func(cs *ColumnSegment) { cs.Data[1] = 200 },
+		"nulls":     func(cs *ColumnSegment) { cs.Nulls = cs.Nulls[:3] },
+		"values":    func(cs *ColumnSegment) { cs.Values++ },
+		"encoding":  func(cs *ColumnSegment) { cs.Encoding = PlainEncoding },
+	} {
+		s := newSegment(column(nulls), []ColumnType{IntType})
+		assert.Equal(t, BitPackedEncoding, s.Columns[0].Encoding, name)
+		corrupt(s.Columns[0])
+		assert.ErrorIs(t, s.check([]ColumnType{IntType}), ErrInvalidCell, name)
+		_, err := s.rows([]ColumnType{IntType}, []int{0})
+		assert.ErrorIs(t, err, ErrInvalidCell, name)
+		_, err = s.row([]ColumnType{IntType}, segmentRows-2)
+		assert.ErrorIs(t, err, ErrInvalidCell, name)
+	}
+
+	s = newSegment(column(func(i int) interface{} { return fmt.Sprintf("k%d", i%7) }), []ColumnType{TextType})
+	assert.Equal(t, DictionaryEncoding, s.Columns[0].Encoding)
+	// Entries past the dictionary
+	data := s.Columns[0].Data
+	for i := len(data) - 10; i < len(data); i++ {
+		data[i] = 0xff
+	}
+	_, err := s.row([]ColumnType{TextType}, segmentRows-1)
+	assert.ErrorIs(t, err, ErrInvalidCell)
+}
+
+func TestColumnar(t *testing.T) {
+	rows := NewMemoryBacked()
+	eventsSchema(t, rows, 5000, "row")
+	columnar := NewMemoryBacked()
+	eventsSchema(t, columnar, 5000, "columnar")
+	table := columnar.Tables["events"]
+	assert.Len(t, table.Segments, 4)
+	assert.Len(t, table.Rows, 904)
+
+	tests := []string{
+		"SELECT * FROM events;",
+		"SELECT kind, count(*), sum(amount), min(kind), max(amount) FROM events GROUP BY kind;",
+		"SELECT id, kind FROM events WHERE id < 100 OR id >= 4990;",
+		"SELECT id, amount FROM events WHERE 1500 > id AND id >= 1400 AND amount IS NULL;",
+		"SELECT count(*) FROM events WHERE kind = 'k3' AND user_id <> 7;",
+		"SELECT count(*) FROM events WHERE kind IS NULL;",
+		"SELECT count(*) FROM events WHERE id > 10000 OR amount < 0;",
+		"SELECT * FROM events WHERE id = 2000;",
+		"SELECT e.id, f.kind FROM events e JOIN events f ON e.id = f.user_id WHERE e.id < 10;",
+	}
+	for _, source := range tests {
+		want, err := query(t, rows, source)
+		assert.Nil(t, err, source)
+		for _, rowAtATime := range []bool{true, false} {
+			columnar.rowAtATime = rowAtATime
+			got, err := query(t, columnar, source)
+			assert.Nil(t, err, source)
+			assert.Equal(t, want, got, source)
+		}
+	}
+
+	assert.ErrorIs(t, execAll(t, columnar, "CREATE TABLE t (id INT) WITH (storage = 'heap');"), ErrInvalidTableOption)
+	assert.ErrorIs(t, execAll(t, columnar, "CREATE TABLE t (id INT) WITH (fillfactor = 70);"), ErrInvalidTableOption)
+}
+
+func TestColumnarZoneMaps(t *testing.T) {
+	mb := NewMemoryBacked()
+	eventsSchema(t, mb, 5000, "columnar")
+	segments := mb.Tables["events"].Segments
+
+	tests := []struct {
+		conds []zoneCond
+		kept  []bool
+	}{
+		{conds: []zoneCond{{col: 0, op: "<", value: cell(t, 100), typ: IntType}}, kept: []bool{true, false, false, false}},
+		{conds: []zoneCond{{col: 0, op: ">=", value: cell(t, 2048), typ: IntType}}, kept: []bool{false, false, true, true}},
+		{conds: []zoneCond{{col: 0, op: "=", value: cell(t, 1024), typ: IntType}}, kept: []bool{false, true, false, false}},
+		{conds: []zoneCond{{col: 0, op: "<=", value: cell(t, 1023), typ: IntType}, {col: 0, op: ">", value: cell(t, 1000), typ: IntType}}, kept: []bool{true, false, false, false}},
+		{conds: []zoneCond{{col: 1, op: "=", value: MemoryCell("k9"), typ: TextType}}, kept: []bool{false, false, false, false}},
+		{conds: []zoneCond{{col: 1, op: "IS NULL"}, {col: 3, op: "IS NOT NULL"}}, kept: []bool{true, true, true, true}},
+	}
+	for _, test := range tests {
+		var kept []bool
+		for _, s := range segments {
+			kept = append(kept, !s.skips(test.conds))
+		}
+		assert.Equal(t, test.kept, kept, test.conds)
+	}
+
+	assert.Equal(t, `Project  (cost=7503.25 rows=1)
+  Output: count(*)
+  ->  Vectorized Aggregate  (cost=7503.00 rows=1)
+        ->  Vectorized Seq Scan on events  (cost=7500.00 rows=8)
+              Columns: id, amount
+              Segment Filter: (id < 100) AND amount IS NULL
+              Filter: (id < 100) AND amount IS NULL`, explain(t, mb, "EXPLAIN SELECT count(*) FROM events WHERE id < 100 AND amount IS NULL;"))
+}
+
+func cell(t *testing.T, i int64) MemoryCell {
+	c, err := intCell(i)
+	assert.Nil(t, err)
+	return c
+}
+
+func TestColumnarUpsert(t *testing.T) {
+	mb := NewMemoryBacked()
+	eventsSchema(t, mb, 2000, "columnar")
+	table := mb.Tables["events"]
+	want := tableValues(t, table)
+
+	upsert := "INSERT INTO events VALUES (5, 'x', 0, 0), (1500, 'y', 0, 0) ON CONFLICT (id) DO UPDATE SET amount = -1;"
+	assert.Nil(t, mb.Begin())
+	assert.Nil(t, execAll(t, mb, upsert))
+	for i := 2000; i < 2100; i++ {
+		assert.Nil(t, execAll(t, mb, fmt.Sprintf("INSERT INTO events VALUES (%d, 'z', 0, 0);", i)))
+	}
+	assert.Len(t, mb.Tables["events"].Segments, 2)
+	assert.Nil(t, mb.Rollback())
+
+	table = mb.Tables["events"]
+	assert.Len(t, table.Segments, 1)
+	assert.Equal(t, want, tableValues(t, table))
+
+	// Rows of segments updated by a failing INSERT are restored
+	assert.ErrorIs(t, execAll(t, mb, "INSERT INTO events VALUES (5, 'x', 0, 0), (5, 'y', 0, 0) ON CONFLICT (id) DO UPDATE SET amount = -1;"), ErrRowAffectedTwice)
+	assert.Equal(t, want, tableValues(t, table))
+
+	assert.Nil(t, execAll(t, mb, upsert))
+	got, err := query(t, mb, "SELECT id, amount FROM events WHERE amount = -1;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{int64(5), int64(-1)}, {int64(1500), int64(-1)}}, got)
+}
+
+func TestFileBackendColumnar(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	fb, err := OpenFileBackend(path)
+	assert.Nil(t, err)
+
+	asts, err := parser.Parse("CREATE TABLE t (id INT, a TEXT) WITH (storage = 'columnar');")
+	assert.Nil(t, err)
+	assert.Nil(t, fb.CreateTable(asts.Statements[0].CreateTableStatement))
+	var rows [][]interface{}
+	for i := int64(0); i < 1100; i++ {
+		rows = append(rows, []interface{}{i, []interface{}{"", nil, "x"}[i%3]})
+	}
+	assert.Nil(t, fb.InsertValues(context.Background(), "t", []string{"id", "a"}, rows))
+
+	fb, err = OpenFileBackend(path)
+	assert.Nil(t, err)
+	table := fb.Tables["t"]
+	assert.Equal(t, ColumnarStorage, table.Storage)
+	assert.Len(t, table.Segments, 1)
+	got := tableValues(t, table)
+	assert.Equal(t, len(rows), len(got))
+	for i := range rows {
+		assert.Equal(t, rows[i], got[i])
+	}
+
+	def, err := fb.DescribeTable("t")
+	assert.Nil(t, err)
+	assert.Equal(t, ColumnarStorage, def.Storage)
+}
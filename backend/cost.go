@@ -0,0 +1,359 @@
+package backend
+
+import (
+	"math"
+	"math/bits"
+)
+
+// planCost is what the planner expects of a physical node: the number of
+// rows it returns, and the cost of returning them, in units of reading
+// one row, its inputs included.
+type planCost struct {
+	rows float64
+	cost float64
+}
+
+// estimated holds the estimate of a physical node, and under EXPLAIN
+// ANALYZE what it actually did.
+type estimated struct {
+	est    planCost
+	actual *runtimeStats
+}
+
+func (e *estimated) estimate() planCost {
+	return e.est
+}
+
+const (
+	cpuTuple    = 1.0
+	cpuOperator = 0.25
+	indexLookup = 1.0
+	// hashBuild is the cost of putting a row in a hash table
+	hashBuild = 1.5
+
+	// Selectivities and distinct counts used without statistics, like
+	// PostgreSQL's
+	defaultSelectivity   = 1.0 / 3
+	defaultEqSelectivity = 0.005
+	defaultDistinct      = 200
+
+	// maxJoinSearch is the most tables whose join orders are all
+	// considered, beyond that they are joined in the order of FROM
+	maxJoinSearch = 8
+)
+
+// atLeastOne clamps a row estimate, since a wrong estimate of zero rows
+// makes everything above it look free.
+func atLeastOne(rows float64) float64 {
+	return math.Max(1, math.Round(rows))
+}
+
+func sortCost(rows float64) float64 {
+	if rows < 2 {
+		return 0
+	}
+	return rows * math.Log2(rows) * cpuOperator
+}
+
+// tableRows is the number of rows of the table n reads, as of the last
+// ANALYZE.
+func (pp *physicalPlanner) tableRows(n *scanNode) float64 {
+	if n.table.Stats != nil {
+		return float64(n.table.Stats.Rows)
+	}
+	return float64(n.table.rowCount())
+}
+
+// indexScanCost estimates looking up a row by a unique constraint.
+func (pp *physicalPlanner) indexScanCost(n *scanNode, filter []*expr) planCost {
+	rows := math.Min(1, pp.tableRows(n)) * pp.selectivity(filter...)
+	return planCost{
+		rows: atLeastOne(rows),
+		cost: indexLookup + cpuOperator*float64(len(filter)),
+	}
+}
+
+// columnStats returns the table and the statistics of e when it is a
+// column of a table, with nil statistics when there are none.
+func (pp *physicalPlanner) columnStats(e *expr) (*scanNode, *ColumnStats) {
+	if e.kind != columnExpr {
+		return nil, nil
+	}
+	n, ok := pp.scans[e.col.rel]
+	if !ok {
+		return nil, nil
+	}
+	if stats := n.table.Stats; stats != nil && e.col.col < len(stats.Columns) {
+		return n, &stats.Columns[e.col.col]
+	}
+	return n, nil
+}
+
+// distinct estimates the number of distinct values of e.
+func (pp *physicalPlanner) distinct(e *expr) float64 {
+	n, stats := pp.columnStats(e)
+	switch {
+	case stats != nil:
+		return math.Max(1, stats.Distinct)
+	case n == nil:
+		return defaultDistinct
+	}
+	rows := math.Max(1, pp.tableRows(n))
+	for _, uc := range n.table.Unique {
+		if len(uc.Columns) == 1 && uc.Columns[0] == e.col.col {
+			return rows
+		}
+	}
+	return math.Min(defaultDistinct, rows)
+}
+
+// selectivity estimates the fraction of rows for which all of conds are
+// true.
+func (pp *physicalPlanner) selectivity(conds ...*expr) float64 {
+	s := 1.0
+	for _, c := range conds {
+		s *= pp.condSelectivity(c)
+	}
+	return math.Max(0, math.Min(1, s))
+}
+
+func (pp *physicalPlanner) condSelectivity(e *expr) float64 {
+	switch e.kind {
+	case constExpr:
+		if e.value.isTrue() {
+			return 1
+		}
+		return 0
+	case isNullExpr:
+		s := defaultEqSelectivity
+		if _, stats := pp.columnStats(e.args[0]); stats != nil {
+			s = stats.NullFrac
+		}
+		if e.not {
+			return 1 - s
+		}
+		return s
+	case unaryExpr:
+		if e.op == "NOT" {
+			return 1 - pp.condSelectivity(e.args[0])
+		}
+	case binaryExpr:
+		switch e.op {
+		case "AND":
+			return pp.condSelectivity(e.args[0]) * pp.condSelectivity(e.args[1])
+		case "OR":
+			a, b := pp.condSelectivity(e.args[0]), pp.condSelectivity(e.args[1])
+			return a + b - a*b
+		}
+		return pp.comparisonSelectivity(e)
+	}
+	return defaultSelectivity
+}
+
+// comparisonSelectivity estimates column op constant from the statistics
+// of the column, and column = column from the distinct values of both.
+func (pp *physicalPlanner) comparisonSelectivity(e *expr) float64 {
+	left, right := e.args[0], e.args[1]
+	op := e.op
+	if left.kind == constExpr && right.kind != constExpr {
+		left, right = right, left
+		op = flip(op)
+	}
+
+	if left.kind == columnExpr && right.kind == columnExpr {
+		if op == "=" {
+			return 1 / math.Max(pp.distinct(left), pp.distinct(right))
+		}
+		if op == "<>" {
+			return 1 - 1/math.Max(pp.distinct(left), pp.distinct(right))
+		}
+		return defaultSelectivity
+	}
+	if left.kind != columnExpr || right.kind != constExpr {
+		if op == "=" {
+			return defaultEqSelectivity
+		}
+		return defaultSelectivity
+	}
+	if right.value == nil {
+		return 0
+	}
+
+	_, stats := pp.columnStats(left)
+	notNull := 1.0
+	if stats != nil {
+		notNull = 1 - stats.NullFrac
+	}
+	switch op {
+	case "=":
+		return notNull / pp.distinct(left)
+	case "<>":
+		return notNull * (1 - 1/pp.distinct(left))
+	}
+	if stats == nil || len(stats.Histogram) == 0 {
+		return defaultSelectivity
+	}
+	below := histogramFraction(stats.Histogram, right.value, left.typ)
+	if op == "<" || op == "<=" {
+		return notNull * below
+	}
+	return notNull * (1 - below)
+}
+
+// flip returns the operator of b op a, for a op b.
+func flip(op string) string {
+	switch op {
+	case "<":
+		return ">"
+	case "<=":
+		return ">="
+	case ">":
+		return "<"
+	case ">=":
+		return "<="
+	}
+	return op
+}
+
+// histogramFraction estimates the fraction of values below v, assuming
+// values are spread evenly within each bucket.
+func histogramFraction(bounds []MemoryCell, v MemoryCell, typ ColumnType) float64 {
+	buckets := len(bounds) - 1
+	if compare(v, bounds[0], typ) <= 0 {
+		return 0
+	}
+	if compare(v, bounds[buckets], typ) > 0 || buckets == 0 {
+		return 1
+	}
+	for i := 0; i < buckets; i++ {
+		lo, hi := bounds[i], bounds[i+1]
+		if compare(v, hi, typ) > 0 {
+			continue
+		}
+		within := 0.5
+		if typ == IntType {
+			a, _ := lo.AsInt()
+			b, _ := hi.AsInt()
+			x, _ := v.AsInt()
+			if b > a {
+				within = float64(x-a) / float64(b-a)
+			}
+		}
+		return (float64(i) + within) / float64(buckets)
+	}
+	return 1
+}
+
+// join plans a tree of inner joins. Its tables, with the conditions pushed
+// down to them, can be joined in any order: every order is tried for a
+// few tables, by dynamic programming over the sets of tables, keeping the
+// cheapest plan of each set. Pairs of sets without a condition between
+// them are only joined when there is no other way.
+func (pp *physicalPlanner) join(n *joinNode) (physicalPlan, error) {
+	var leaves []logicalPlan
+	var conds []*expr
+	var flatten func(plan logicalPlan)
+	flatten = func(plan logicalPlan) {
+		if j, ok := plan.(*joinNode); ok {
+			flatten(j.left)
+			flatten(j.right)
+			conds = append(conds, j.conds...)
+			return
+		}
+		leaves = append(leaves, plan)
+	}
+	flatten(n)
+
+	all := uint(1)<<len(leaves) - 1
+	best := map[uint]physicalPlan{}
+	for i, leaf := range leaves {
+		p, err := pp.physical(leaf)
+		if err != nil {
+			return nil, err
+		}
+		best[1<<i] = p
+	}
+
+	// Each condition goes to the join of the first set of tables that has
+	// all of its columns. Conditions that the rewrite rules left here
+	// although they read a single table, like calls of nextval, go to the
+	// last join.
+	masks := make([]uint, len(conds))
+	for i, c := range conds {
+		used := map[columnID]bool{}
+		c.columns(used)
+		for j := range leaves {
+			for _, col := range best[1<<j].schema() {
+				if used[col.id] {
+					masks[i] |= 1 << j
+					break
+				}
+			}
+		}
+		if bits.OnesCount(masks[i]) < 2 {
+			masks[i] = all
+		}
+	}
+	between := func(left, right uint) []*expr {
+		var found []*expr
+		for i, c := range conds {
+			m := masks[i]
+			if m&(left|right) == m && m&left != m && m&right != m {
+				found = append(found, c)
+			}
+		}
+		return found
+	}
+	try := func(set, left uint) error {
+		right := set &^ left
+		l, r := best[left], best[right]
+		if l == nil || r == nil {
+			return nil
+		}
+		var leaf logicalPlan
+		if bits.OnesCount(right) == 1 {
+			leaf = leaves[bits.TrailingZeros(right)]
+		}
+		p, err := pp.joinPair(l, r, leaf, between(left, right))
+		if err != nil {
+			return err
+		}
+		if current, ok := best[set]; !ok || p.estimate().cost < current.estimate().cost {
+			best[set] = p
+		}
+		return nil
+	}
+
+	if len(leaves) > maxJoinSearch {
+		set := uint(1)
+		for i := 1; i < len(leaves); i++ {
+			if err := try(set|1<<i, set); err != nil {
+				return nil, err
+			}
+			set |= 1 << i
+		}
+		return best[all], nil
+	}
+
+	for size := 2; size <= len(leaves); size++ {
+		for set := uint(1); set <= all; set++ {
+			if bits.OnesCount(set) != size {
+				continue
+			}
+			for _, crossProducts := range []bool{false, true} {
+				for left := (set - 1) & set; left > 0; left = (left - 1) & set {
+					if !crossProducts && len(between(left, set&^left)) == 0 {
+						continue
+					}
+					if err := try(set, left); err != nil {
+						return nil, err
+					}
+				}
+				if _, ok := best[set]; ok {
+					break
+				}
+			}
+		}
+	}
+	return best[all], nil
+}
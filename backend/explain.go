@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"math"
+	"strings"
+	"time"
+)
+
+// plan binds, rewrites and compiles a SELECT, whose scans stop once ctx
+// is done.
+func (mb *MemoryBackend) plan(ctx context.Context, slct *ast.SelectStatement) (physicalPlan, error) {
+	logical, err := (&planner{mb: mb}).build(slct)
+	if err != nil {
+		return nil, err
+	}
+	return mb.physical(ctx, optimize(logical))
+}
+
+// Select starts running a SELECT, whose rows are computed as they are
+// read.
+func (mb *MemoryBackend) Select(ctx context.Context, slct *ast.SelectStatement) (Rows, error) {
+	rows, err := mb.query(ctx, slct)
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (mb *MemoryBackend) query(ctx context.Context, slct *ast.SelectStatement) (*planRows, error) {
+	plan, err := mb.plan(ctx, slct)
+	if err != nil {
+		return nil, err
+	}
+	it, err := run(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &planRows{ctx: ctx, it: it}
+	for _, c := range plan.schema() {
+		rows.columns = append(rows.columns, Column{Type: c.typ, Name: c.name})
+	}
+	return rows, nil
+}
+
+// Explain returns the plan of a SELECT, one line per row, like
+// PostgreSQL:
+//
+//	Project  (cost=2.00 rows=1)
+//	  Output: name
+//	  ->  Seq Scan on users  (cost=1.25 rows=1)
+//	        Columns: id, name
+//	        Filter: (id > 1)
+//
+// With ANALYZE the SELECT runs, and every node also shows the time it
+// took per loop, its rows per loop, the number of times it ran and the
+// most memory one run held at once, then what its runs wrote to temporary
+// files, if anything. With FORMAT JSON the plan is a single JSON row
+// instead.
+func (mb *MemoryBackend) Explain(ctx context.Context, ex *ast.ExplainStatement) (*Results, error) {
+	if ex.Statement.Kind != ast.SelectKind {
+		return nil, fmt.Errorf("%w: EXPLAIN only supports SELECT", ErrUnsupportedExpression)
+	}
+	start := time.Now()
+	plan, err := mb.plan(ctx, ex.Statement.SelectStatement)
+	if err != nil {
+		return nil, err
+	}
+	planning := time.Since(start)
+
+	var execution time.Duration
+	if ex.Analyze {
+		instrument(plan)
+		start = time.Now()
+		if _, err := readAll(plan); err != nil {
+			return nil, err
+		}
+		execution = time.Since(start)
+	}
+
+	results := &Results{
+		Columns: []Column{{Type: TextType, Name: "QUERY PLAN"}},
+		Rows:    [][]Cell{},
+	}
+	if ex.JSON {
+		out := explainOutput{Plan: explainJSON(plan)}
+		if ex.Analyze {
+			p, e := milliseconds(planning), milliseconds(execution)
+			out.PlanningTime, out.ExecutionTime = &p, &e
+		}
+		// Conditions are shown as written, without escaping < and >
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode([]explainOutput{out}); err != nil {
+			return nil, err
+		}
+		results.Rows = append(results.Rows, []Cell{MemoryCell(bytes.TrimSuffix(b.Bytes(), []byte("\n")))})
+		return results, nil
+	}
+
+	lines := explainLines(plan, 0)
+	if ex.Analyze {
+		lines = append(lines,
+			fmt.Sprintf("Planning Time: %.3f ms", milliseconds(planning)),
+			fmt.Sprintf("Execution Time: %.3f ms", milliseconds(execution)))
+	}
+	for _, line := range lines {
+		results.Rows = append(results.Rows, []Cell{MemoryCell(line)})
+	}
+	return results, nil
+}
+
+// explainLines renders a node whose title starts at column indent, with
+// its details two columns further and its inputs below them behind an
+// arrow.
+func explainLines(plan physicalPlan, indent int) []string {
+	title, details, inputs := plan.explain()
+	est := plan.estimate()
+	title = fmt.Sprintf("%s  (cost=%.2f rows=%.0f)", title, est.cost, est.rows)
+	if rs := plan.runtime(); rs != nil && rs.loops == 0 {
+		title += " (never executed)"
+	} else if rs != nil {
+		disk := ""
+		if rs.disk > 0 {
+			disk = " disk=" + formatBytes(rs.disk)
+		}
+		title += fmt.Sprintf(" (actual time=%.3f ms rows=%.0f loops=%d memory=%s%s)",
+			rs.time(), rs.rowsPerLoop(), rs.loops, formatBytes(rs.memory), disk)
+	}
+
+	lines := []string{title}
+	pad := strings.Repeat(" ", indent+2)
+	for _, d := range details {
+		lines = append(lines, pad+d)
+	}
+	for _, input := range inputs {
+		sub := explainLines(input, indent+6)
+		lines = append(lines, pad+"->  "+sub[0])
+		lines = append(lines, sub[1:]...)
+	}
+	return lines
+}
+
+// explainOutput and explainNode are the JSON format of EXPLAIN, whose
+// names follow PostgreSQL's where there is one. The actual figures are
+// only there under ANALYZE.
+type explainOutput struct {
+	Plan          *explainNode `json:"Plan"`
+	PlanningTime  *float64     `json:"Planning Time,omitempty"`
+	ExecutionTime *float64     `json:"Execution Time,omitempty"`
+}
+
+type explainNode struct {
+	Node        string         `json:"Node"`
+	Details     []string       `json:"Details,omitempty"`
+	Cost        float64        `json:"Total Cost"`
+	Rows        float64        `json:"Plan Rows"`
+	ActualTime  *float64       `json:"Actual Total Time,omitempty"`
+	ActualRows  *float64       `json:"Actual Rows,omitempty"`
+	ActualLoops *int64         `json:"Actual Loops,omitempty"`
+	Memory      *int64         `json:"Memory Used,omitempty"`
+	Disk        *int64         `json:"Disk Used,omitempty"`
+	Plans       []*explainNode `json:"Plans,omitempty"`
+}
+
+func explainJSON(plan physicalPlan) *explainNode {
+	title, details, inputs := plan.explain()
+	est := plan.estimate()
+	node := &explainNode{
+		Node:    title,
+		Details: details,
+		Cost:    math.Round(est.cost*100) / 100,
+		Rows:    est.rows,
+	}
+	if rs := plan.runtime(); rs != nil {
+		t, rows := rs.time(), rs.rowsPerLoop()
+		node.ActualTime, node.ActualRows = &t, &rows
+		node.ActualLoops, node.Memory = &rs.loops, &rs.memory
+		if rs.disk > 0 {
+			node.Disk = &rs.disk
+		}
+	}
+	for _, input := range inputs {
+		node.Plans = append(node.Plans, explainJSON(input))
+	}
+	return node
+}
+
+// runtimeStats is what a node did while it ran under EXPLAIN ANALYZE.
+// Times include those of the inputs, as in PostgreSQL.
+type runtimeStats struct {
+	loops   int64
+	rows    int64
+	elapsed time.Duration
+	// memory is the most bytes a single run held at once, its current row
+	// included, and held what the current run holds besides its row
+	memory int64
+	held   int64
+	// disk is the bytes all runs wrote to temporary files
+	disk int64
+}
+
+// time is the time the node took per loop, in milliseconds.
+func (rs *runtimeStats) time() float64 {
+	if rs.loops == 0 {
+		return 0
+	}
+	return milliseconds(rs.elapsed / time.Duration(rs.loops))
+}
+
+func (rs *runtimeStats) rowsPerLoop() float64 {
+	if rs.loops == 0 {
+		return 0
+	}
+	return math.Round(float64(rs.rows) / float64(rs.loops))
+}
+
+// measure records that the current run holds row bytes besides what it
+// holds already.
+func (rs *runtimeStats) measure(row int64) {
+	if m := rs.held + row; m > rs.memory {
+		rs.memory = m
+	}
+}
+
+func (e *estimated) instrument() { e.actual = &runtimeStats{} }
+
+func (e *estimated) runtime() *runtimeStats { return e.actual }
+
+// hold records that the current run of an instrumented node keeps bytes
+// of memory besides its current row, like a hash table, or no longer keeps
+// them when bytes is negative.
+func (e *estimated) hold(bytes int) {
+	if e.actual != nil {
+		e.actual.held += int64(bytes)
+		e.actual.measure(0)
+	}
+}
+
+// instrument makes every node of plan measure its runs.
+func instrument(plan physicalPlan) {
+	plan.instrument()
+	_, _, inputs := plan.explain()
+	for _, input := range inputs {
+		instrument(input)
+	}
+}
+
+// run starts running a node, measuring it when it is instrumented.
+func run(plan physicalPlan) (rowIterator, error) {
+	rs := plan.runtime()
+	if rs == nil {
+		return plan.open()
+	}
+	rs.loops++
+	rs.held = 0
+	start := time.Now()
+	it, err := plan.open()
+	rs.elapsed += time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	return &measured{rowIterator: it, rs: rs}, nil
+}
+
+// runBatches starts running a vectorized node, measuring it when it is
+// instrumented.
+func runBatches(plan batchPlan) (batchIterator, error) {
+	rs := plan.runtime()
+	if rs == nil {
+		return plan.openBatches()
+	}
+	rs.loops++
+	rs.held = 0
+	start := time.Now()
+	it, err := plan.openBatches()
+	rs.elapsed += time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	return &measuredBatches{batchIterator: it, rs: rs}, nil
+}
+
+// measuredBatches is the iterator of an instrumented vectorized node.
+type measuredBatches struct {
+	batchIterator
+	rs *runtimeStats
+}
+
+func (m *measuredBatches) Next() bool {
+	start := time.Now()
+	ok := m.batchIterator.Next()
+	m.rs.elapsed += time.Since(start)
+	if ok {
+		m.rs.rows += int64(len(m.Batch().sel))
+		m.rs.measure(m.Batch().size())
+	}
+	return ok
+}
+
+func (m *measuredBatches) Close() error {
+	start := time.Now()
+	err := m.batchIterator.Close()
+	m.rs.elapsed += time.Since(start)
+	return err
+}
+
+// measured is the iterator of an instrumented node.
+type measured struct {
+	rowIterator
+	rs *runtimeStats
+}
+
+func (m *measured) Next() bool {
+	start := time.Now()
+	ok := m.rowIterator.Next()
+	m.rs.elapsed += time.Since(start)
+	if ok {
+		m.rs.rows++
+		m.rs.measure(rowSize(m.Row()))
+	}
+	return ok
+}
+
+func (m *measured) Close() error {
+	start := time.Now()
+	err := m.rowIterator.Close()
+	m.rs.elapsed += time.Since(start)
+	return err
+}
+
+const (
+	// sliceHeader is the size of a slice, without its elements, on 64-bit
+	// platforms
+	sliceHeader  = 24
+	aggStateSize = 16 + sliceHeader
+)
+
+// rowSize estimates the memory a row takes.
+func rowSize(row []MemoryCell) int64 {
+	size := int64(sliceHeader)
+	for _, cell := range row {
+		size += sliceHeader + int64(len(cell))
+	}
+	return size
+}
+
+func rowsSize(rows [][]MemoryCell) int64 {
+	size := int64(sliceHeader)
+	for _, row := range rows {
+		size += rowSize(row)
+	}
+	return size
+}
+
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%dkB", (n+1023)/1024)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return math.Round(float64(d)/float64(time.Microsecond)) / 1000
+}
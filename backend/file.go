@@ -0,0 +1,235 @@
+package backend
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/nanjingblue/maydb/ast"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileBackend is a MemoryBackend whose tables and sequences are written to
+// a single file after every change, and read back when the backend is
+// opened.
+type FileBackend struct {
+	*MemoryBackend
+	path string
+	inTx bool
+	// seqSaved is the sequenceChanges of the last flush.
+	seqSaved uint64
+}
+
+// database is what is saved in the file. Files written before sequences
+// existed hold only the map of tables.
+type database struct {
+	Tables    map[string]*Table
+	Sequences map[string]*Sequence
+}
+
+func OpenFileBackend(path string) (*FileBackend, error) {
+	fb := &FileBackend{
+		MemoryBackend: NewMemoryBacked(),
+		path:          path,
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fb, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var db database
+	if err := gob.NewDecoder(f).Decode(&db); err != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := gob.NewDecoder(f).Decode(&db.Tables); err != nil {
+			return nil, err
+		}
+	}
+	if db.Tables != nil {
+		fb.Tables = db.Tables
+	}
+	if db.Sequences != nil {
+		fb.Sequences = db.Sequences
+	}
+	for _, t := range fb.Tables {
+		restoreNulls(t)
+		for _, s := range t.Segments {
+			if err := s.check(t.ColumnTypes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fb, nil
+}
+
+func (fb *FileBackend) CreateTable(crt *ast.CreateTableStatement) error {
+	if err := fb.MemoryBackend.CreateTable(crt); err != nil {
+		return err
+	}
+	return fb.flush()
+}
+
+func (fb *FileBackend) Insert(ctx context.Context, inst *ast.InsertStatement) (int64, *Results, error) {
+	n, results, err := fb.MemoryBackend.Insert(ctx, inst)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, results, fb.flush()
+}
+
+func (fb *FileBackend) InsertValues(ctx context.Context, table string, columns []string, rows [][]interface{}) error {
+	if err := fb.MemoryBackend.InsertValues(ctx, table, columns, rows); err != nil {
+		return err
+	}
+	return fb.flush()
+}
+
+func (fb *FileBackend) CreateSequence(cs *ast.CreateSequenceStatement) error {
+	if err := fb.MemoryBackend.CreateSequence(cs); err != nil {
+		return err
+	}
+	return fb.flush()
+}
+
+func (fb *FileBackend) Analyze(ctx context.Context, an *ast.AnalyzeStatement) error {
+	if err := fb.MemoryBackend.Analyze(ctx, an); err != nil {
+		return err
+	}
+	return fb.flush()
+}
+
+// Select saves the sequences that SELECT nextval(...) and setval change,
+// once the rows are closed.
+func (fb *FileBackend) Select(ctx context.Context, slct *ast.SelectStatement) (Rows, error) {
+	rows, err := fb.query(ctx, slct)
+	if err != nil {
+		return nil, err
+	}
+	rows.onClose = func() error {
+		if fb.sequenceChanges() == fb.seqSaved {
+			return nil
+		}
+		return fb.flush()
+	}
+	return rows, nil
+}
+
+// Explain saves the sequences that EXPLAIN ANALYZE changes, like Select.
+func (fb *FileBackend) Explain(ctx context.Context, ex *ast.ExplainStatement) (*Results, error) {
+	results, err := fb.MemoryBackend.Explain(ctx, ex)
+	if err != nil || fb.sequenceChanges() == fb.seqSaved {
+		return results, err
+	}
+	return results, fb.flush()
+}
+
+func (fb *FileBackend) Begin() error {
+	if err := fb.MemoryBackend.Begin(); err != nil {
+		return err
+	}
+	fb.inTx = true
+	return nil
+}
+
+func (fb *FileBackend) Commit() error {
+	if err := fb.MemoryBackend.Commit(); err != nil {
+		return err
+	}
+	fb.inTx = false
+	return fb.flush()
+}
+
+func (fb *FileBackend) Rollback() error {
+	if err := fb.MemoryBackend.Rollback(); err != nil {
+		return err
+	}
+	fb.inTx = false
+	return nil
+}
+
+// flush writes all tables and sequences to a temporary file next to the
+// database and renames it into place, so a crash never leaves a
+// half-written file. Changes made inside a transaction are only written on
+// Commit.
+func (fb *FileBackend) flush() error {
+	if fb.inTx {
+		return nil
+	}
+
+	changes := fb.sequenceChanges()
+	tmp, err := os.CreateTemp(filepath.Dir(fb.path), filepath.Base(fb.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	saved := database{
+		Tables:    make(map[string]*Table, len(fb.Tables)),
+		Sequences: map[string]*Sequence{},
+	}
+	for name, t := range fb.Tables {
+		saved.Tables[name] = withNullCells(t)
+	}
+	seqs, err := fb.ListSequences()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	for i := range seqs {
+		saved.Sequences[seqs[i].Name] = &seqs[i]
+	}
+	if err := gob.NewEncoder(tmp).Encode(saved); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), fb.path); err != nil {
+		return err
+	}
+	fb.seqSaved = changes
+	return nil
+}
+
+// withNullCells returns a copy of t with NullCells set, to be saved.
+func withNullCells(t *Table) *Table {
+	c := *t
+	c.NullCells = nil
+	for i, row := range t.Rows {
+		for j, cell := range row {
+			if cell == nil {
+				c.NullCells = append(c.NullCells, [2]int{i, j})
+			}
+		}
+	}
+	return &c
+}
+
+// restoreNulls undoes withNullCells on a table that was read back: cells
+// listed in NullCells are NULL, other nil cells were empty.
+func restoreNulls(t *Table) {
+	nulls := make(map[[2]int]bool, len(t.NullCells))
+	for _, pos := range t.NullCells {
+		nulls[pos] = true
+	}
+	for i, row := range t.Rows {
+		for j, cell := range row {
+			if cell == nil && !nulls[[2]int{i, j}] {
+				row[j] = MemoryCell{}
+			}
+		}
+	}
+	t.NullCells = nil
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"encoding/gob"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBackendNulls(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	fb, err := OpenFileBackend(path)
+	assert.Nil(t, err)
+
+	asts, err := parser.Parse("CREATE TABLE t (a TEXT); INSERT INTO t VALUES (''), (NULL), ('x');")
+	assert.Nil(t, err)
+	assert.Nil(t, fb.CreateTable(asts.Statements[0].CreateTableStatement))
+	_, _, err = fb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+
+	// Empty text and NULL must not be confused once read back
+	fb, err = OpenFileBackend(path)
+	assert.Nil(t, err)
+	rows := fb.Tables["t"].Rows
+	assert.False(t, rows[0][0].IsNull())
+	assert.Equal(t, "", rows[0][0].AsText())
+	assert.True(t, rows[1][0].IsNull())
+	assert.Equal(t, "x", rows[2][0].AsText())
+	assert.Nil(t, fb.Tables["t"].NullCells)
+}
+
+func TestFileBackendSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	fb, err := OpenFileBackend(path)
+	assert.Nil(t, err)
+
+	asts, err := parser.Parse("CREATE TABLE t (id SERIAL); INSERT INTO t VALUES (DEFAULT); CREATE SEQUENCE s; SELECT nextval('s');")
+	assert.Nil(t, err)
+	assert.Nil(t, fb.CreateTable(asts.Statements[0].CreateTableStatement))
+	_, _, err = fb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+	assert.Nil(t, fb.CreateSequence(asts.Statements[2].CreateSequenceStatement))
+	_, err = selectAll(fb, asts.Statements[3].SelectStatement)
+	assert.Nil(t, err)
+
+	fb, err = OpenFileBackend(path)
+	assert.Nil(t, err)
+	v, err := fb.nextval("t_id_seq")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), v)
+	v, err = fb.nextval("s")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), v)
+}
+
+func TestFileBackendOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	f, err := os.Create(path)
+	assert.Nil(t, err)
+	tables := map[string]*Table{"t": {Columns: []string{"a"}, ColumnTypes: []ColumnType{IntType}}}
+	assert.Nil(t, gob.NewEncoder(f).Encode(tables))
+	assert.Nil(t, f.Close())
+
+	fb, err := OpenFileBackend(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, fb.Tables["t"].Columns)
+	assert.NotNil(t, fb.Sequences)
+}
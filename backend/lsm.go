@@ -0,0 +1,351 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/buffer"
+	"github.com/nanjingblue/maydb/lsm"
+)
+
+// LSMBackend is a MemoryBackend whose rows are kept in an LSM tree on disk
+// rather than in memory, for write-heavy loads. Table headers and
+// sequences are kept in memory too, and written to the tree along with the
+// rows each change adds or updates. Columnar tables are not supported.
+//
+// The tree holds, under keys starting with
+//
+//	"t" + name: the header of a table, its Rows left out,
+//	"s" + name: a sequence,
+//	"r" + uvarint(len(name)) + name + position: a row of a table.
+type LSMBackend struct {
+	*MemoryBackend
+	db *lsm.DB
+	// batch holds the writes of the current statement, or transaction, and
+	// pending their rows by key, to be read before they are written.
+	batch   lsm.Batch
+	pending map[string][]byte
+	// dirty names the tables whose header is to be written.
+	dirty map[string]bool
+	inTx  bool
+	// seqSaved is the sequenceChanges of the last save.
+	seqSaved uint64
+}
+
+// OpenLSMBackend opens the LSM tree in dir, created if needed, with opts.
+func OpenLSMBackend(dir string, opts lsm.Options) (*LSMBackend, error) {
+	db, err := lsm.Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	lb := &LSMBackend{
+		MemoryBackend: NewMemoryBacked(),
+		db:            db,
+		pending:       map[string][]byte{},
+		dirty:         map[string]bool{},
+	}
+	if err := lb.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return lb, nil
+}
+
+// load reads the table headers and the sequences.
+func (lb *LSMBackend) load() error {
+	it := lb.db.NewIterator([]byte("s"), []byte("u"))
+	defer it.Close()
+	for it.Next() {
+		name := string(it.Key()[1:])
+		dec := gob.NewDecoder(bytes.NewReader(it.Value()))
+		if it.Key()[0] == 's' {
+			var seq Sequence
+			if err := dec.Decode(&seq); err != nil {
+				return fmt.Errorf("sequence %s: %w", name, err)
+			}
+			lb.Sequences[name] = &seq
+			continue
+		}
+		var t Table
+		if err := dec.Decode(&t); err != nil {
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+		t.store = &lsmStore{lb: lb, name: name}
+		lb.Tables[name] = &t
+	}
+	return it.Err()
+}
+
+// BufferStats describes the buffer pool caching the blocks of the tree.
+func (lb *LSMBackend) BufferStats() buffer.Stats {
+	return lb.db.BufferStats()
+}
+
+// Close closes the tree. Writes are saved as they are made, those of a
+// transaction left open are lost.
+func (lb *LSMBackend) Close() error {
+	return lb.db.Close()
+}
+
+func (lb *LSMBackend) CreateTable(crt *ast.CreateTableStatement) error {
+	var opts Table
+	if err := opts.setOptions(crt.Options); err != nil {
+		return err
+	}
+	if opts.Storage == ColumnarStorage {
+		return fmt.Errorf("%w: storage %q, the lsm backend only stores rows", ErrInvalidTableOption, ColumnarStorage)
+	}
+	if err := lb.MemoryBackend.CreateTable(crt); err != nil {
+		return err
+	}
+	name := crt.Name.Value
+	lb.Tables[name].store = &lsmStore{lb: lb, name: name}
+	lb.dirty[name] = true
+	return lb.save(true)
+}
+
+func (lb *LSMBackend) Insert(ctx context.Context, inst *ast.InsertStatement) (int64, *Results, error) {
+	n, results, err := lb.MemoryBackend.Insert(ctx, inst)
+	if err != nil {
+		lb.discard()
+		return 0, nil, err
+	}
+	return n, results, lb.save(false)
+}
+
+func (lb *LSMBackend) InsertValues(ctx context.Context, table string, columns []string, rows [][]interface{}) error {
+	if err := lb.MemoryBackend.InsertValues(ctx, table, columns, rows); err != nil {
+		lb.discard()
+		return err
+	}
+	return lb.save(false)
+}
+
+func (lb *LSMBackend) CreateSequence(cs *ast.CreateSequenceStatement) error {
+	if err := lb.MemoryBackend.CreateSequence(cs); err != nil {
+		return err
+	}
+	return lb.save(true)
+}
+
+func (lb *LSMBackend) Analyze(ctx context.Context, an *ast.AnalyzeStatement) error {
+	if err := lb.MemoryBackend.Analyze(ctx, an); err != nil {
+		return err
+	}
+	for name := range lb.Tables {
+		if an.Table == nil || an.Table.Value == name {
+			lb.dirty[name] = true
+		}
+	}
+	return lb.save(false)
+}
+
+// Select saves the sequences that SELECT nextval(...) and setval change,
+// once the rows are closed.
+func (lb *LSMBackend) Select(ctx context.Context, slct *ast.SelectStatement) (Rows, error) {
+	rows, err := lb.query(ctx, slct)
+	if err != nil {
+		return nil, err
+	}
+	rows.onClose = func() error {
+		return lb.save(false)
+	}
+	return rows, nil
+}
+
+// Explain saves the sequences that EXPLAIN ANALYZE changes, like Select.
+func (lb *LSMBackend) Explain(ctx context.Context, ex *ast.ExplainStatement) (*Results, error) {
+	results, err := lb.MemoryBackend.Explain(ctx, ex)
+	if err != nil {
+		return nil, err
+	}
+	return results, lb.save(false)
+}
+
+func (lb *LSMBackend) Begin() error {
+	if err := lb.MemoryBackend.Begin(); err != nil {
+		return err
+	}
+	lb.inTx = true
+	return nil
+}
+
+func (lb *LSMBackend) Commit() error {
+	if err := lb.MemoryBackend.Commit(); err != nil {
+		return err
+	}
+	lb.inTx = false
+	return lb.save(true)
+}
+
+func (lb *LSMBackend) Rollback() error {
+	if err := lb.MemoryBackend.Rollback(); err != nil {
+		return err
+	}
+	lb.inTx = false
+	lb.discard()
+	return nil
+}
+
+// save writes the rows changed since the last save, with the headers of
+// their tables and, when they changed or when seqs is set, the sequences,
+// as a single batch. Changes made inside a transaction are only written on
+// Commit.
+func (lb *LSMBackend) save(seqs bool) error {
+	if lb.inTx {
+		return nil
+	}
+	changes := lb.sequenceChanges()
+	if lb.batch.Len() == 0 && len(lb.dirty) == 0 && !seqs && changes == lb.seqSaved {
+		return nil
+	}
+
+	for name := range lb.dirty {
+		t, ok := lb.Tables[name]
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+			return err
+		}
+		lb.batch.Put([]byte("t"+name), buf.Bytes())
+	}
+	if seqs || changes != lb.seqSaved {
+		list, err := lb.ListSequences()
+		if err != nil {
+			return err
+		}
+		for _, seq := range list {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(seq); err != nil {
+				return err
+			}
+			lb.batch.Put([]byte("s"+seq.Name), buf.Bytes())
+		}
+	}
+	err := lb.db.Write(&lb.batch)
+	lb.discard()
+	if err != nil {
+		return err
+	}
+	lb.seqSaved = changes
+	return nil
+}
+
+// discard drops the writes that were not saved.
+func (lb *LSMBackend) discard() {
+	if lb.inTx {
+		return
+	}
+	lb.batch.Reset()
+	lb.pending = map[string][]byte{}
+	lb.dirty = map[string]bool{}
+}
+
+// lsmStore is the rowStore of a table of an LSMBackend.
+type lsmStore struct {
+	lb   *LSMBackend
+	name string
+}
+
+func (s *lsmStore) key(pos int) []byte {
+	key := append([]byte{'r'}, binary.AppendUvarint(nil, uint64(len(s.name)))...)
+	key = append(key, s.name...)
+	return binary.BigEndian.AppendUint64(key, uint64(pos))
+}
+
+func (s *lsmStore) get(pos int) ([]MemoryCell, error) {
+	key := s.key(pos)
+	if value, ok := s.lb.pending[string(key)]; ok {
+		return decodeRow(value)
+	}
+	value, err := s.lb.db.Get(key)
+	if errors.Is(err, lsm.ErrNotFound) {
+		return nil, fmt.Errorf("%w: row %d of %s is missing", ErrInvalidCell, pos, s.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeRow(value)
+}
+
+func (s *lsmStore) put(pos int, row []MemoryCell) {
+	key, value := s.key(pos), []byte(encodeKey(row))
+	s.lb.batch.Put(key, value)
+	s.lb.pending[string(key)] = value
+	s.lb.dirty[s.name] = true
+}
+
+func (s *lsmStore) scan(from, to int) rowCursor {
+	return &lsmCursor{store: s, it: s.lb.db.NewIterator(s.key(from), s.key(to)), pos: from, to: to}
+}
+
+// lsmCursor reads the rows of a table in the tree, those not saved yet
+// taking the place of theirs.
+type lsmCursor struct {
+	store   *lsmStore
+	it      *lsm.Iterator
+	pos, to int
+	// ahead is set when it is on a row after pos.
+	ahead bool
+}
+
+func (c *lsmCursor) next(n int) ([][]MemoryCell, error) {
+	var rows [][]MemoryCell
+	for ; len(rows) < n && c.pos < c.to; c.pos++ {
+		key := c.store.key(c.pos)
+		if !c.ahead {
+			c.ahead = c.it.Next()
+			if err := c.it.Err(); err != nil {
+				return nil, err
+			}
+		}
+		saved := c.ahead && bytes.Equal(c.it.Key(), key)
+		value, ok := c.store.lb.pending[string(key)]
+		switch {
+		case ok:
+		case saved:
+			value = c.it.Value()
+		default:
+			return nil, fmt.Errorf("%w: row %d of %s is missing", ErrInvalidCell, c.pos, c.store.name)
+		}
+		if saved {
+			c.ahead = false
+		}
+		row, err := decodeRow(value)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (c *lsmCursor) close() error {
+	return c.it.Close()
+}
+
+// decodeRow reads back a row written by encodeKey.
+func decodeRow(data []byte) ([]MemoryCell, error) {
+	var row []MemoryCell
+	for len(data) > 0 {
+		if data[0] == 0 {
+			row = append(row, nil)
+			data = data[1:]
+			continue
+		}
+		n, size := binary.Uvarint(data[1:])
+		if data[0] != 1 || size <= 0 || uint64(len(data)-1-size) < n {
+			return nil, fmt.Errorf("%w: corrupt row", ErrInvalidCell)
+		}
+		data = data[1+size:]
+		row = append(row, MemoryCell(append([]byte{}, data[:n]...)))
+		data = data[n:]
+	}
+	return row, nil
+}
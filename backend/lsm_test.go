@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"github.com/nanjingblue/maydb/lsm"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// smallTree flushes and compacts often, for the rows of tests to spread
+// over several SSTables and levels.
+var smallTree = lsm.Options{MemtableSize: 16 << 10, BlockSize: 512, L0Tables: 2, LevelSize: 64 << 10, TableSize: 16 << 10, NoSync: true}
+
+func TestLSMBackend(t *testing.T) {
+	dir := t.TempDir()
+	lb, err := OpenLSMBackend(dir, smallTree)
+	assert.Nil(t, err)
+	mb := NewMemoryBacked()
+	for _, b := range []Backend{lb, mb} {
+		eventsSchema(t, b, 5000, "row")
+		assert.Nil(t, execAll(t, b, `
+			INSERT INTO events VALUES (7, 'new', 1, 1), (5000, NULL, 2, 2) ON CONFLICT (id) DO UPDATE SET kind = excluded.kind;
+			CREATE TABLE t (id SERIAL, a TEXT);
+			INSERT INTO t (a) VALUES (''), (NULL), ('x');
+			ANALYZE;`))
+		assert.ErrorIs(t, execAll(t, b, "INSERT INTO events VALUES (5001, 'a', 0, 0), (9, 'b', 0, 0);"), ErrUniqueViolation)
+	}
+	assert.Nil(t, lb.db.Flush())
+
+	tests := []string{
+		"SELECT * FROM events;",
+		"SELECT kind, count(*), sum(amount) FROM events GROUP BY kind;",
+		"SELECT * FROM events WHERE id = 7;",
+		"SELECT * FROM events WHERE id = 5001;",
+		"SELECT e.id, f.kind FROM events e JOIN events f ON e.id = f.user_id WHERE e.id < 10;",
+		"SELECT * FROM t;",
+	}
+	check := func() {
+		for _, source := range tests {
+			want, err := query(t, mb, source)
+			assert.Nil(t, err, source)
+			for _, rowAtATime := range []bool{true, false} {
+				lb.rowAtATime = rowAtATime
+				got, err := query(t, lb, source)
+				assert.Nil(t, err, source)
+				assert.Equal(t, want, got, source)
+			}
+		}
+	}
+	check()
+	tables := 0
+	for _, level := range lb.db.Levels() {
+		tables += level.Tables
+	}
+	assert.Greater(t, tables, 1)
+
+	// Rows stay on disk, and everything is read back
+	assert.Nil(t, lb.Tables["events"].Rows)
+	assert.Nil(t, lb.Close())
+	lb, err = OpenLSMBackend(dir, smallTree)
+	assert.Nil(t, err)
+	check()
+	assert.Equal(t, mb.Tables["events"].Stats, lb.Tables["events"].Stats)
+	v, err := lb.nextval("t_id_seq")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), v)
+
+	// Changes of a transaction are read before they are saved, and
+	// discarded on rollback
+	assert.Nil(t, lb.Begin())
+	assert.Nil(t, execAll(t, lb, "INSERT INTO t (a) VALUES ('y'); INSERT INTO events VALUES (8, 'tx', 0, 0) ON CONFLICT (id) DO UPDATE SET kind = excluded.kind;"))
+	got, err := query(t, lb, "SELECT a FROM t WHERE a = 'y';")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{"y"}}, got)
+	got, err = query(t, lb, "SELECT kind FROM events WHERE id = 8;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{"tx"}}, got)
+	assert.Nil(t, lb.Rollback())
+	check()
+
+	assert.ErrorIs(t, execAll(t, lb, "CREATE TABLE c (id INT) WITH (storage = 'columnar');"), ErrInvalidTableOption)
+	assert.Nil(t, lb.Close())
+	lb, err = OpenLSMBackend(dir, smallTree)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, lb.Close())
+}
@@ -1,157 +1,627 @@
 package backend
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/nanjingblue/maydb/ast"
 	"github.com/nanjingblue/maydb/token"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// MemoryCell is the big-endian encoding of an int, or the bytes of a text.
+// A nil MemoryCell is NULL.
 type MemoryCell []byte
 
-func (mc MemoryCell) AsInt() int32 {
-	var i int32
-	err := binary.Read(bytes.NewBuffer(mc), binary.BigEndian, &i)
-	if err != nil {
-		panic(err)
+func (mc MemoryCell) AsInt() (int32, error) {
+	if len(mc) != 4 {
+		return 0, ErrInvalidCell
 	}
-	return i
+	return int32(binary.BigEndian.Uint32(mc)), nil
 }
 
 func (mc MemoryCell) AsText() string {
 	return string(mc)
 }
 
+func (mc MemoryCell) IsNull() bool {
+	return mc == nil
+}
+
 type Table struct {
 	Columns     []string
 	ColumnTypes []ColumnType
-	Rows        [][]MemoryCell
+	// Rows holds the rows of row tables. Columnar ones keep theirs in
+	// Segments, then in Rows until they fill a segment.
+	Rows [][]MemoryCell
+
+	// Storage is ColumnarStorage for columnar tables, "" for row ones.
+	Storage  string
+	Segments []*Segment
+
+	// store keeps the rows of tables of an LSMBackend, Stored of them,
+	// in place of Rows.
+	store  rowStore
+	Stored int
+
+	// NotNull and Defaults hold the column constraints. Defaults are SQL
+	// literals, "" for none. Both are nil in files written before
+	// constraints existed.
+	NotNull  []bool
+	Defaults []string
+
+	// Unique holds the PRIMARY KEY and UNIQUE constraints.
+	Unique []UniqueConstraint
+
+	// indexes map the keys of each unique constraint to the position of
+	// their row. They are built on first use and dropped whenever rows
+	// are restored.
+	indexes []map[string]int
+
+	// Stats are collected by ANALYZE, nil before.
+	Stats *TableStats
+
+	// defaults caches the parsed Defaults.
+	defaults []*ast.Expression
+
+	// NullCells lists the row and column of every NULL cell in files,
+	// since gob reads back empty and nil slices alike. It is unused in
+	// memory.
+	NullCells [][2]int
 }
 
 type MemoryBackend struct {
-	Tables map[string]*Table
+	Tables    map[string]*Table
+	Sequences map[string]*Sequence
+
+	// seqMu guards Sequences, which nextval changes even while reading.
+	seqMu sync.Mutex
+	// seqChanges counts the calls of nextval and setval, to tell when
+	// sequences need saving.
+	seqChanges uint64
+
+	// snapshot and seqSnapshot hold the tables and sequences as they were
+	// at Begin, nil outside of a transaction.
+	snapshot    map[string]*Table
+	seqSnapshot map[string]*Sequence
+
+	// rowAtATime disables the vectorized operators, to compare them with
+	// the others.
+	rowAtATime bool
+	// parallelRows replaces the constant of the same name when not 0, for
+	// tests to plan parallel scans of small tables.
+	parallelRows int
+
+	// tempDir is where operators spill the rows that outgrow work_mem, the
+	// default directory for temporary files when empty.
+	tempDir string
 }
 
 func NewMemoryBacked() *MemoryBackend {
 	return &MemoryBackend{
-		Tables: map[string]*Table{},
+		Tables:    map[string]*Table{},
+		Sequences: map[string]*Sequence{},
 	}
 }
 
 // CreateTable 创建表
 func (mb *MemoryBackend) CreateTable(crt *ast.CreateTableStatement) error {
+	if _, ok := mb.Tables[crt.Name.Value]; ok {
+		return ErrTableAlreadyExists
+	}
+
 	t := Table{}
-	mb.Tables[crt.Name.Value] = &t
-	if crt.Cols == nil {
-		return nil
+	// serials are the sequences to create for SERIAL columns, once the
+	// table is known to be valid.
+	var serials []string
+	pending := map[string]bool{}
+	if crt.Cols != nil {
+		for _, col := range *crt.Cols {
+			t.Columns = append(t.Columns, col.Name.Value)
+
+			notNull := col.NotNull
+			def := ""
+			dt, err := ParseColumnType(col.Datatype.Value)
+			if col.Datatype.Value == string(token.SerialKeyword) || col.Datatype.Value == string(token.BigserialKeyword) {
+				// There are no 64-bit columns, BIGSERIAL is stored as INT
+				// like SERIAL.
+				if col.Default != nil {
+					return fmt.Errorf("%w: %s", ErrMultipleDefaults, col.Name.Value)
+				}
+				seq := serialSequence(crt.Name.Value, col.Name.Value)
+				serials = append(serials, seq)
+				pending[seq] = true
+				dt, err, notNull = IntType, nil, true
+				def = "nextval(" + sqlLiteral(&token.Token{Kind: token.StringKind, Value: seq}) + ")"
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %s", err, col.Datatype.Value)
+			}
+			t.ColumnTypes = append(t.ColumnTypes, dt)
+			t.NotNull = append(t.NotNull, notNull)
+
+			if col.Default != nil {
+				if err := mb.checkDefault(col.Default, dt, pending); err != nil {
+					return fmt.Errorf("%w: default of %s", err, col.Name.Value)
+				}
+				def = sqlExpression(col.Default)
+			}
+			t.Defaults = append(t.Defaults, def)
+		}
+	}
+	if err := t.addConstraints(crt.Name.Value, crt); err != nil {
+		return err
+	}
+	if err := t.setOptions(crt.Options); err != nil {
+		return err
 	}
-	for _, col := range *crt.Cols {
-		t.Columns = append(t.Columns, col.Name.Value)
 
-		var dt ColumnType
-		switch col.Datatype.Value {
-		case "int":
-			dt = IntType
-		case "text":
-			dt = TextType
-		default:
-			return ErrInvalidDataType
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	for _, seq := range serials {
+		if _, ok := mb.Sequences[seq]; ok {
+			return fmt.Errorf("%w: %s", ErrSequenceAlreadyExists, seq)
 		}
-		t.ColumnTypes = append(t.ColumnTypes, dt)
 	}
+	for _, seq := range serials {
+		// The values of the sequence have to fit the INT column
+		mb.addSequence(Sequence{Name: seq, Start: 1, Increment: 1, MaxValue: math.MaxInt32})
+	}
+	mb.Tables[crt.Name.Value] = &t
 	return nil
 }
 
-func (mb *MemoryBackend) Insert(inst *ast.InsertStatement) error {
+// Insert adds the rows of inst, filling the columns it leaves out with
+// their defaults. Rows conflicting with a unique constraint are skipped or
+// update the existing row as ON CONFLICT says. It returns the number of
+// rows added or updated and, for a RETURNING clause, their values. Either
+// every row is handled or none is.
+func (mb *MemoryBackend) Insert(ctx context.Context, inst *ast.InsertStatement) (int64, *Results, error) {
 	table, ok := mb.Tables[inst.Table.Value]
+	if !ok {
+		return 0, nil, ErrTableDoesNotExist
+	}
+
+	var targets []int
+	if inst.Columns == nil {
+		for i := range table.Columns {
+			targets = append(targets, i)
+		}
+	} else {
+		var names []string
+		for _, col := range inst.Columns {
+			names = append(names, col.Value)
+		}
+		var err error
+		if targets, err = table.columnIndexes(names); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Resolve RETURNING before adding anything
+	var returning *Results
+	var returned []int
+	if inst.Returning != nil {
+		columns, indexes, err := table.resolve(inst.Table.Value, inst.Returning)
+		if err != nil {
+			return 0, nil, err
+		}
+		returning = &Results{Columns: columns, Rows: [][]Cell{}}
+		returned = indexes
+	}
+
+	defaultCell := func(i int) (MemoryCell, error) { return mb.defaultCell(table, i) }
+	action, err := table.conflictAction(inst.Table.Value, inst.OnConflict, defaultCell)
+	if err != nil {
+		return 0, nil, err
+	}
+	newRow := func(n int) ([]MemoryCell, []bool, error) {
+		if n > len(targets) {
+			return nil, nil, ErrTooManyValues
+		}
+		if n < len(targets) && inst.Columns != nil {
+			return nil, nil, ErrMissingValues
+		}
+		return make([]MemoryCell, len(table.Columns)), make([]bool, len(table.Columns)), nil
+	}
+
+	var rows [][]MemoryCell
+	if inst.Select != nil {
+		selected, err := mb.Select(ctx, inst.Select)
+		if err != nil {
+			return 0, nil, err
+		}
+		results, err := Collect(selected)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, col := range results.Columns {
+			if i < len(targets) && col.Type != table.ColumnTypes[targets[i]] {
+				index := targets[i]
+				return 0, nil, fmt.Errorf("%w: %s is %s", ErrTypeMismatch, table.Columns[index], table.ColumnTypes[index])
+			}
+		}
+		for _, result := range results.Rows {
+			row, given, err := newRow(len(result))
+			if err != nil {
+				return 0, nil, err
+			}
+			for i, c := range result {
+				index := targets[i]
+				v, err := CellValue(c, table.ColumnTypes[index])
+				if err != nil {
+					return 0, nil, err
+				}
+				if row[index], err = valueToCell(v, table.ColumnTypes[index]); err != nil {
+					return 0, nil, err
+				}
+				given[index] = true
+			}
+			if err := mb.fillDefaults(table, row, given); err != nil {
+				return 0, nil, err
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	for _, values := range inst.Values {
+		row, given, err := newRow(len(values))
+		if err != nil {
+			return 0, nil, err
+		}
+		for i, value := range values {
+			if value.Kind == ast.LiteralKind && value.Literal.Kind == token.KeywordKind && value.Literal.Value == string(token.DefaultKeyword) {
+				continue
+			}
+
+			index := targets[i]
+			cell, err := mb.evaluate(value, table.ColumnTypes[index])
+			if errors.Is(err, ErrTypeMismatch) {
+				return 0, nil, fmt.Errorf("%w: %s is %s", err, table.Columns[index], table.ColumnTypes[index])
+			}
+			if err != nil {
+				return 0, nil, err
+			}
+			row[index] = cell
+			given[index] = true
+		}
+		if err := mb.fillDefaults(table, row, given); err != nil {
+			return 0, nil, err
+		}
+		rows = append(rows, row)
+	}
+
+	affected, err := table.insertRows(rows, action, func() { mb.ownRows(inst.Table.Value, table) })
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if returning != nil {
+		returning.Rows = project(affected, returned)
+	}
+	return int64(len(affected)), returning, nil
+}
+
+func (mb *MemoryBackend) InsertValues(ctx context.Context, name string, columns []string, rows [][]interface{}) error {
+	if err := ContextErr(ctx); err != nil {
+		return err
+	}
+	table, ok := mb.Tables[name]
 	if !ok {
 		return ErrTableDoesNotExist
 	}
-	if inst.Values == nil {
-		return nil
+	indexes, err := table.columnIndexes(columns)
+	if err != nil {
+		return err
+	}
+	given := make([]bool, len(table.Columns))
+	for _, index := range indexes {
+		given[index] = true
 	}
 
-	var row []MemoryCell
-	if len(*inst.Values) != len(table.Columns) {
-		return ErrMissingValues
+	// Convert everything before touching the table, so a bad row leaves
+	// it unchanged.
+	added := make([][]MemoryCell, 0, len(rows))
+	for _, values := range rows {
+		if len(values) != len(indexes) {
+			return ErrMissingValues
+		}
+		row := make([]MemoryCell, len(table.Columns))
+		if err := mb.fillDefaults(table, row, given); err != nil {
+			return err
+		}
+		for i, v := range values {
+			index := indexes[i]
+			cell, err := valueToCell(v, table.ColumnTypes[index])
+			if err != nil {
+				return fmt.Errorf("%w: %s is %s", err, table.Columns[index], table.ColumnTypes[index])
+			}
+			row[index] = cell
+		}
+		added = append(added, row)
 	}
-	for _, value := range *inst.Values {
-		if value.Kind != ast.LiteralKind {
-			fmt.Println("Skipping non-literal.")
+	_, err = table.insertRows(added, nil, func() { mb.ownRows(name, table) })
+	return err
+}
+
+// ownRows gives the table its own copy of its rows before they are changed
+// in place, if it still shares them with the transaction snapshot.
+func (mb *MemoryBackend) ownRows(name string, t *Table) {
+	snapshot, ok := mb.snapshot[name]
+	if !ok || len(snapshot.Rows) == 0 || &snapshot.Rows[0] != &t.Rows[0] {
+		return
+	}
+	t.Rows = append([][]MemoryCell(nil), t.Rows...)
+}
+
+// columnIndex returns the position of the named column, or -1.
+func (t *Table) columnIndex(name string) int {
+	for i, col := range t.Columns {
+		if col == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// columnIndexes returns the positions of the named columns, which must
+// all exist and be different.
+func (t *Table) columnIndexes(names []string) ([]int, error) {
+	indexes := make([]int, len(names))
+	seen := map[int]bool{}
+	for i, name := range names {
+		index := t.columnIndex(name)
+		if index < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrColumnDoesNotExist, name)
+		}
+		if seen[index] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateColumn, name)
+		}
+		seen[index] = true
+		indexes[i] = index
+	}
+	return indexes, nil
+}
+
+// resolve looks up the columns named by a list of expressions, as in the
+// items of a SELECT, where * and name.* stand for every column. Qualified
+// names must use the table name.
+func (t *Table) resolve(name string, items []*ast.Expression) ([]Column, []int, error) {
+	var columns []Column
+	var indexes []int
+	for _, exp := range items {
+		if exp.Kind == ast.StarKind {
+			if exp.Table != nil && exp.Table.Value != name {
+				return nil, nil, fmt.Errorf("%w: %s", ErrTableDoesNotExist, exp.Table.Value)
+			}
+			for i, col := range t.Columns {
+				columns = append(columns, Column{Type: t.ColumnTypes[i], Name: col})
+				indexes = append(indexes, i)
+			}
 			continue
 		}
-		row = append(row, mb.TokenToCell(value.Literal))
+		if exp.Kind != ast.LiteralKind {
+			return nil, nil, ErrUnsupportedExpression
+		}
+		lit := exp.Literal
+		if lit.Kind != token.IdentifierKind {
+			return nil, nil, ErrColumnDoesNotExist
+		}
+
+		index := t.columnIndex(lit.Value)
+		if index < 0 || (exp.Table != nil && exp.Table.Value != name) {
+			return nil, nil, ErrColumnDoesNotExist
+		}
+		columns = append(columns, Column{
+			Type: t.ColumnTypes[index],
+			Name: lit.Value,
+		})
+		indexes = append(indexes, index)
+	}
+	return columns, indexes, nil
+}
+
+// project picks the cells at indexes out of every row.
+func project(rows [][]MemoryCell, indexes []int) [][]Cell {
+	results := [][]Cell{}
+	for _, row := range rows {
+		result := make([]Cell, len(indexes))
+		for i, index := range indexes {
+			result[i] = row[index]
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (t *Table) notNull(i int) bool {
+	return i < len(t.NotNull) && t.NotNull[i]
+}
+
+// checkRow enforces the constraints of the table on a new row.
+func (t *Table) checkRow(row []MemoryCell) error {
+	for i, cell := range row {
+		if cell == nil && t.notNull(i) {
+			return fmt.Errorf("%w: %s", ErrNotNullViolation, t.Columns[i])
+		}
 	}
-	table.Rows = append(table.Rows, row)
 	return nil
 }
 
-func (mb *MemoryBackend) TokenToCell(t *token.Token) MemoryCell {
-	if t.Kind == token.NumericKind {
-		buf := new(bytes.Buffer)
-		i, err := strconv.Atoi(t.Value)
-		if err != nil {
-			panic(err)
+// valueToCell is the inverse of CellValue.
+func valueToCell(v interface{}, ct ColumnType) (MemoryCell, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch ct {
+	case IntType:
+		i, ok := v.(int64)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		if i < math.MinInt32 || i > math.MaxInt32 {
+			return nil, ErrIntegerOutOfRange
+		}
+		cell := make(MemoryCell, 4)
+		binary.BigEndian.PutUint32(cell, uint32(i))
+		return cell, nil
+	case TextType:
+		s, ok := v.(string)
+		if !ok {
+			return nil, ErrTypeMismatch
+		}
+		// Not nil, which would be NULL
+		return append(MemoryCell{}, s...), nil
+	}
+	return nil, ErrInvalidDataType
+}
+
+// literalCell converts a literal to a cell of a column of type ct.
+func literalCell(t *token.Token, ct ColumnType) (MemoryCell, error) {
+	if t.Kind == token.KeywordKind && t.Value == string(token.NullKeyword) {
+		return nil, nil
+	}
+	if !literalMatches(t, ct) {
+		return nil, ErrTypeMismatch
+	}
+	return tokenToCell(t)
+}
+
+func literalMatches(t *token.Token, ct ColumnType) bool {
+	switch ct {
+	case IntType:
+		return t.Kind == token.NumericKind
+	case TextType:
+		return t.Kind == token.StringKind
+	}
+	return false
+}
+
+// sqlLiteral renders a literal token back as SQL.
+func sqlLiteral(t *token.Token) string {
+	switch t.Kind {
+	case token.StringKind:
+		return "'" + strings.ReplaceAll(t.Value, "'", "''") + "'"
+	case token.KeywordKind:
+		if t.Value == string(token.NullKeyword) {
+			return ""
+		}
+	}
+	return t.Value
+}
+
+func (mb *MemoryBackend) TokenToCell(t *token.Token) (MemoryCell, error) {
+	return tokenToCell(t)
+}
+
+func tokenToCell(t *token.Token) (MemoryCell, error) {
+	switch t.Kind {
+	case token.NumericKind:
+		i, err := strconv.ParseInt(t.Value, 10, 32)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("%w: %s", ErrIntegerOutOfRange, t.Value)
 		}
-		err = binary.Write(buf, binary.BigEndian, int32(i))
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("%w: %s is not an integer", ErrTypeMismatch, t.Value)
 		}
-		return MemoryCell(buf.Bytes())
+		cell := make(MemoryCell, 4)
+		binary.BigEndian.PutUint32(cell, uint32(i))
+		return cell, nil
+	case token.StringKind:
+		// Not nil, which would be NULL
+		return append(MemoryCell{}, t.Value...), nil
 	}
-	if t.Kind == token.StringKind {
-		return MemoryCell(t.Value)
+	return nil, ErrUnsupportedExpression
+}
+
+// ListTables returns the names of all tables, sorted.
+func (mb *MemoryBackend) ListTables() ([]string, error) {
+	var names []string
+	for name := range mb.Tables {
+		names = append(names, name)
 	}
-	return nil
+	sort.Strings(names)
+	return names, nil
 }
 
-func (mb *MemoryBackend) Select(slct *ast.SelectStatement) (*Results, error) {
-	table, ok := mb.Tables[slct.From.Value]
+func (mb *MemoryBackend) DescribeTable(name string) (*TableDefinition, error) {
+	table, ok := mb.Tables[name]
 	if !ok {
 		return nil, ErrTableDoesNotExist
 	}
-	results := [][]Cell{}
-	var columns []struct {
-		Type ColumnType
-		Name string
-	}
-	for i, row := range table.Rows {
-		var result []Cell
-		isFirstRow := i == 0
-		for _, exp := range slct.Item {
-			if exp.Kind != ast.LiteralKind {
-				fmt.Println("skipping non-literal expression.")
-				continue
-			}
-			lit := exp.Literal
-			if lit.Kind == token.IdentifierKind {
-				found := false
-				for i, tableCol := range table.Columns {
-					if tableCol == lit.Value {
-						if isFirstRow {
-							columns = append(columns, struct {
-								Type ColumnType
-								Name string
-							}{Type: table.ColumnTypes[i], Name: lit.Value})
-						}
-						result = append(result, row[i])
-						found = true
-						break
-					}
-				}
-				if !found {
-					return nil, ErrColumnDoesNotExist
-				}
-				continue
-			}
-			return nil, ErrColumnDoesNotExist
+	def := &TableDefinition{Name: name, Storage: table.Storage}
+	for i, col := range table.Columns {
+		c := Column{
+			Type:    table.ColumnTypes[i],
+			Name:    col,
+			NotNull: table.notNull(i),
 		}
-		results = append(results, result)
+		if i < len(table.Defaults) {
+			c.Default = table.Defaults[i]
+		}
+		def.Columns = append(def.Columns, c)
+	}
+	for _, uc := range table.Unique {
+		c := Constraint{Name: uc.Name, PrimaryKey: uc.PrimaryKey}
+		for _, i := range uc.Columns {
+			c.Columns = append(c.Columns, table.Columns[i])
+		}
+		def.Constraints = append(def.Constraints, c)
 	}
-	return &Results{
-		Columns: columns,
-		Rows:    results,
-	}, nil
+	return def, nil
+}
+
+func (mb *MemoryBackend) Begin() error {
+	if mb.snapshot != nil {
+		return ErrTxInProgress
+	}
+	// Rows are only appended, or copied by ownRows before being changed in
+	// place, so copying the table headers is enough to be able to restore
+	// them later.
+	mb.snapshot = make(map[string]*Table, len(mb.Tables))
+	for name, t := range mb.Tables {
+		c := *t
+		mb.snapshot[name] = &c
+	}
+
+	// Sequence values are never rolled back, only their creation is.
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	mb.seqSnapshot = make(map[string]*Sequence, len(mb.Sequences))
+	for name, seq := range mb.Sequences {
+		mb.seqSnapshot[name] = seq
+	}
+	return nil
+}
+
+func (mb *MemoryBackend) Commit() error {
+	if mb.snapshot == nil {
+		return ErrNoTx
+	}
+	mb.snapshot = nil
+	mb.seqSnapshot = nil
+	return nil
+}
+
+func (mb *MemoryBackend) Rollback() error {
+	if mb.snapshot == nil {
+		return ErrNoTx
+	}
+	mb.Tables = mb.snapshot
+	mb.snapshot = nil
+	for _, t := range mb.Tables {
+		t.indexes = nil
+	}
+
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	mb.Sequences = mb.seqSnapshot
+	mb.seqSnapshot = nil
+	return nil
 }
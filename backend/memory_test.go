@@ -0,0 +1,156 @@
+package backend
+
+import (
+	"context"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMemoryBackendErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{source: "CREATE TABLE users (id INT);", err: ErrTableAlreadyExists},
+		{source: "INSERT INTO users VALUES ('Phil', 'Phil');", err: ErrTypeMismatch},
+		{source: "INSERT INTO users (id, name) VALUES (1);", err: ErrMissingValues},
+		{source: "INSERT INTO users VALUES (1, 'Phil', 2);", err: ErrTooManyValues},
+		{source: "INSERT INTO users (id, id) VALUES (1, 2);", err: ErrDuplicateColumn},
+		{source: "INSERT INTO users (name) VALUES ('Phil');", err: ErrNotNullViolation},
+		{source: "INSERT INTO users VALUES (1, 'Phil') RETURNING age;", err: ErrColumnDoesNotExist},
+		{source: "INSERT INTO users (name) SELECT id FROM users;", err: ErrTypeMismatch},
+		{source: "CREATE TABLE bad (id INT DEFAULT 'x');", err: ErrTypeMismatch},
+		{source: "INSERT INTO users VALUES (3000000000, 'Phil');", err: ErrIntegerOutOfRange},
+		{source: "INSERT INTO users VALUES (1.5, 'Phil');", err: ErrTypeMismatch},
+		{source: "INSERT INTO nope VALUES (1);", err: ErrTableDoesNotExist},
+		{source: "SELECT age FROM users;", err: ErrColumnDoesNotExist},
+	}
+
+	mb := NewMemoryBacked()
+	asts, err := parser.Parse("CREATE TABLE users (id INT NOT NULL, name TEXT); INSERT INTO users VALUES (1, 'Phil');")
+	assert.Nil(t, err)
+	assert.Nil(t, mb.CreateTable(asts.Statements[0].CreateTableStatement))
+	_, _, err = mb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+
+	for _, test := range tests {
+		asts, err := parser.Parse(test.source)
+		assert.Nil(t, err, test.source)
+
+		stmt := asts.Statements[0]
+		switch {
+		case stmt.CreateTableStatement != nil:
+			err = mb.CreateTable(stmt.CreateTableStatement)
+		case stmt.InsertStatement != nil:
+			_, _, err = mb.Insert(context.Background(), stmt.InsertStatement)
+		case stmt.SelectStatement != nil:
+			_, err = selectAll(mb, stmt.SelectStatement)
+		}
+		assert.ErrorIs(t, err, test.err, test.source)
+	}
+}
+
+func TestInsertValues(t *testing.T) {
+	mb := NewMemoryBacked()
+	asts, err := parser.Parse("CREATE TABLE users (id INT NOT NULL, name TEXT);")
+	assert.Nil(t, err)
+	assert.Nil(t, mb.CreateTable(asts.Statements[0].CreateTableStatement))
+
+	err = mb.InsertValues(context.Background(), "users", []string{"name", "id"}, [][]interface{}{{"Phil", int64(1)}, {"Kate", int64(2)}})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mb.Tables["users"].Rows))
+	assert.Equal(t, "Kate", mb.Tables["users"].Rows[1][1].AsText())
+
+	tests := []struct {
+		columns []string
+		rows    [][]interface{}
+		err     error
+	}{
+		{columns: []string{"id", "age"}, err: ErrColumnDoesNotExist},
+		{columns: []string{"id", "id"}, err: ErrDuplicateColumn},
+		{columns: []string{"name"}, rows: [][]interface{}{{"Jo"}}, err: ErrNotNullViolation},
+		{columns: []string{"id", "name"}, rows: [][]interface{}{{nil, "Jo"}}, err: ErrNotNullViolation},
+		{columns: []string{"id", "name"}, rows: [][]interface{}{{int64(3), "Jo"}, {int64(3)}}, err: ErrMissingValues},
+		{columns: []string{"id", "name"}, rows: [][]interface{}{{int64(3), "Jo"}, {"3", "Jo"}}, err: ErrTypeMismatch},
+		{columns: []string{"id", "name"}, rows: [][]interface{}{{int64(3000000000), "Jo"}}, err: ErrIntegerOutOfRange},
+	}
+	for _, test := range tests {
+		err := mb.InsertValues(context.Background(), "users", test.columns, test.rows)
+		assert.ErrorIs(t, err, test.err, test.columns)
+	}
+	// Failed calls add nothing, not even their valid rows
+	assert.Equal(t, 2, len(mb.Tables["users"].Rows))
+}
+
+func TestInsert(t *testing.T) {
+	mb := NewMemoryBacked()
+	asts, err := parser.Parse(`CREATE TABLE users (id INT NOT NULL, name TEXT DEFAULT 'anon', age INT);
+		INSERT INTO users (age, id) VALUES (30, 1), (NULL, 2) RETURNING name, id;
+		INSERT INTO users VALUES (3, DEFAULT);
+		INSERT INTO users (id, name) SELECT id, name FROM users RETURNING id;`)
+	assert.Nil(t, err)
+	assert.Nil(t, mb.CreateTable(asts.Statements[0].CreateTableStatement))
+
+	n, results, err := mb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, []Column{{Type: TextType, Name: "name"}, {Type: IntType, Name: "id"}}, results.Columns)
+	assert.Equal(t, "anon", results.Rows[1][0].AsText())
+
+	n, results, err = mb.Insert(context.Background(), asts.Statements[2].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Nil(t, results)
+
+	n, results, err = mb.Insert(context.Background(), asts.Statements[3].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, 3, len(results.Rows))
+
+	var got [][]interface{}
+	for _, row := range mb.Tables["users"].Rows {
+		var values []interface{}
+		for i, cell := range row {
+			v, err := CellValue(cell, mb.Tables["users"].ColumnTypes[i])
+			assert.Nil(t, err)
+			values = append(values, v)
+		}
+		got = append(got, values)
+	}
+	assert.Equal(t, [][]interface{}{
+		{int64(1), "anon", int64(30)},
+		{int64(2), "anon", nil},
+		{int64(3), "anon", nil},
+		{int64(1), "anon", nil},
+		{int64(2), "anon", nil},
+		{int64(3), "anon", nil},
+	}, got)
+}
+
+func TestInsertReturningStar(t *testing.T) {
+	mb := NewMemoryBacked()
+	asts, err := parser.Parse(`CREATE TABLE users (id INT, name TEXT DEFAULT 'anon', age INT);
+		INSERT INTO users (id, age) VALUES (1, 30) RETURNING *;
+		INSERT INTO users VALUES (2, 'Kate', NULL) RETURNING age, users.*;
+		INSERT INTO users VALUES (3, 'Dan', 1) RETURNING orders.*;`)
+	assert.Nil(t, err)
+	assert.Nil(t, mb.CreateTable(asts.Statements[0].CreateTableStatement))
+
+	_, results, err := mb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, []Column{{Type: IntType, Name: "id"}, {Type: TextType, Name: "name"}, {Type: IntType, Name: "age"}}, results.Columns)
+	assert.Equal(t, "anon", results.Rows[0][1].AsText())
+	age, err := results.Rows[0][2].AsInt()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(30), age)
+
+	_, results, err = mb.Insert(context.Background(), asts.Statements[2].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, []Column{{Type: IntType, Name: "age"}, {Type: IntType, Name: "id"}, {Type: TextType, Name: "name"}, {Type: IntType, Name: "age"}}, results.Columns)
+	assert.True(t, results.Rows[0][0].IsNull())
+	assert.Equal(t, "Kate", results.Rows[0][2].AsText())
+
+	_, _, err = mb.Insert(context.Background(), asts.Statements[3].InsertStatement)
+	assert.ErrorIs(t, err, ErrTableDoesNotExist)
+}
@@ -0,0 +1,705 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Parts of plans made of scans, filters, projections and hash joins run in
+// parallel as clones, each reading a part of the table of the first scan,
+// the driving table. A gather runs the clones in goroutines of their own
+// and returns their rows in the order of the parts, which are the rows of
+// the plan in their order. The clones of a hash join share the hash table
+// of its right side, built once, in parallel when the right side is
+// itself gathered. Aggregates over such parts run as partial aggregates of
+// the clones, whose states a finalize merges.
+//
+// Parts run in parallel when their driving table has at least
+// parallelRows rows per goroutine, on up to Settings.MaxParallelWorkers
+// goroutines. Sequence functions never run in parallel.
+
+const (
+	parallelRows = 10000
+	// A part sends its rows gatherChunk at a time, up to gatherAhead chunks
+	// ahead of those read
+	gatherChunk = 256
+	gatherAhead = 16
+	// gatherTuple is the cost of passing a row from a part to the gather
+	gatherTuple = 0.1
+)
+
+// partRows returns the rows of the table of n, or of its part-th of parts
+// when parts is more than 1.
+func partRows(n *scanNode, part, parts int) *tableRows {
+	tr := n.table.scanRows()
+	if parts > 1 {
+		return tr.part(part, parts)
+	}
+	return tr
+}
+
+func parallelTitle(parts int, title string) string {
+	if parts > 1 {
+		return "Parallel " + title
+	}
+	return title
+}
+
+// gather runs its parts, the clones of a plan, in parallel, returning the
+// rows of each part in turn. builds are the hash tables its parts share,
+// released once they end.
+type gather struct {
+	estimated
+	parts  []physicalPlan
+	builds []*sharedBuild
+}
+
+// gathered is a chunk of rows of a part, or the error that ended it.
+type gathered struct {
+	rows [][]MemoryCell
+	err  error
+}
+
+func (g *gather) schema() []planColumn { return g.parts[0].schema() }
+
+func (g *gather) open() (rowIterator, error) {
+	done := make(chan struct{})
+	outs := make([]chan gathered, len(g.parts))
+	var wg sync.WaitGroup
+	for i, part := range g.parts {
+		outs[i] = make(chan gathered, gatherAhead)
+		wg.Add(1)
+		go func(part physicalPlan, out chan<- gathered) {
+			defer wg.Done()
+			defer close(out)
+			if err := sendRows(part, out, done); err != nil {
+				select {
+				case out <- gathered{err: err}:
+				case <-done:
+				}
+			}
+		}(part, outs[i])
+	}
+
+	var rows [][]MemoryCell
+	k := 0
+	next := func() ([]MemoryCell, bool, error) {
+		for len(rows) == 0 {
+			if k == len(outs) {
+				return nil, false, nil
+			}
+			c, ok := <-outs[k]
+			switch {
+			case !ok:
+				k++
+			case c.err != nil:
+				return nil, false, c.err
+			default:
+				rows = c.rows
+			}
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, true, nil
+	}
+	// Parts still running stop at their next chunk
+	stop := func() error {
+		close(done)
+		wg.Wait()
+		return g.release()
+	}
+	return &iterator{next: next, close: stop}, nil
+}
+
+// release releases the hash tables the parts shared.
+func (g *gather) release() error {
+	var err error
+	for _, b := range g.builds {
+		if releaseErr := b.release(); err == nil {
+			err = releaseErr
+		}
+	}
+	return err
+}
+
+// sendRows runs part, sending its rows to out until they end or done is
+// closed.
+func sendRows(part physicalPlan, out chan<- gathered, done <-chan struct{}) error {
+	it, err := run(part)
+	if err != nil {
+		return err
+	}
+	send := func(rows [][]MemoryCell) bool {
+		select {
+		case out <- gathered{rows: rows}:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	var rows [][]MemoryCell
+	for it.Next() {
+		if rows = append(rows, it.Row()); len(rows) == gatherChunk {
+			if !send(rows) {
+				return it.Close()
+			}
+			rows = nil
+		}
+	}
+	err = it.Err()
+	if err == nil && len(rows) > 0 {
+		send(rows)
+	}
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// collect runs every part in parallel, fn reading the rows of each to the
+// end in the goroutine that ran it. The error is the first one in the
+// order of the parts.
+func (g *gather) collect(fn func(part int, next func() ([]MemoryCell, bool, error)) error) error {
+	start := time.Now()
+	errs := make([]error, len(g.parts))
+	counts := make([]int, len(g.parts))
+	var wg sync.WaitGroup
+	for i, part := range g.parts {
+		wg.Add(1)
+		go func(i int, part physicalPlan) {
+			defer wg.Done()
+			it, err := run(part)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			err = fn(i, func() ([]MemoryCell, bool, error) {
+				row, ok, err := pull(it)
+				if ok {
+					counts[i]++
+				}
+				return row, ok, err
+			})
+			if closeErr := it.Close(); err == nil {
+				err = closeErr
+			}
+			errs[i] = err
+		}(i, part)
+	}
+	wg.Wait()
+	if err := g.release(); err != nil {
+		return err
+	}
+
+	// Not run by run, the gather measures itself
+	if rs := g.runtime(); rs != nil {
+		rs.loops++
+		rs.elapsed += time.Since(start)
+		for _, n := range counts {
+			rs.rows += int64(n)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gather) explain() (string, []string, []physicalPlan) {
+	return "Gather", []string{fmt.Sprintf("Workers Planned: %d", len(g.parts))}, []physicalPlan{clones(g.parts)}
+}
+
+// clones shows the clones of a node as a single node, for EXPLAIN. Under
+// ANALYZE the runs of all of them add up, their memory being the most one
+// of them held.
+type clones []physicalPlan
+
+func (c clones) schema() []planColumn { return c[0].schema() }
+
+func (c clones) open() (rowIterator, error) { return c[0].open() }
+
+func (c clones) estimate() planCost { return c[0].estimate() }
+
+func (c clones) explain() (string, []string, []physicalPlan) {
+	title, details, inputs := c[0].explain()
+	var shown []physicalPlan
+	for k := range inputs {
+		// Clones share some of their inputs, like the right side of a hash
+		// join
+		var input clones
+		for _, p := range c {
+			_, _, in := p.explain()
+			if !input.has(in[k]) {
+				input = append(input, in[k])
+			}
+		}
+		if len(input) == 1 {
+			shown = append(shown, input[0])
+		} else {
+			shown = append(shown, input)
+		}
+	}
+	return title, details, shown
+}
+
+func (c clones) has(plan physicalPlan) bool {
+	for _, p := range c {
+		if p == plan {
+			return true
+		}
+	}
+	return false
+}
+
+func (c clones) instrument() {
+	for _, p := range c {
+		p.instrument()
+	}
+}
+
+func (c clones) runtime() *runtimeStats {
+	var sum *runtimeStats
+	for _, p := range c {
+		rs := p.runtime()
+		if rs == nil {
+			continue
+		}
+		if sum == nil {
+			sum = &runtimeStats{}
+		}
+		sum.loops += rs.loops
+		sum.rows += rs.rows
+		sum.elapsed += rs.elapsed
+		sum.disk += rs.disk
+		if rs.memory > sum.memory {
+			sum.memory = rs.memory
+		}
+	}
+	return sum
+}
+
+// sharedBuild is the hash table of the right side of the clones of a hash
+// join, built by the first of them to need it, and kept until the gather
+// of the clones releases it.
+type sharedBuild struct {
+	input physicalPlan
+	keys  []evaluator
+	mem   workMem
+
+	once  sync.Once
+	files *spillFiles
+	table *hashTable
+	err   error
+}
+
+// get returns the hash table of the right side, and the bytes building it
+// wrote to temporary files when this call built it.
+func (b *sharedBuild) get() (*hashTable, int64, error) {
+	var spilled int64
+	b.once.Do(func() {
+		b.build()
+		b.files.mu.Lock()
+		spilled = b.files.written
+		b.files.mu.Unlock()
+	})
+	return b.table, spilled, b.err
+}
+
+func (b *sharedBuild) build() {
+	b.files = &spillFiles{dir: b.mem.dir}
+	g, ok := b.input.(*gather)
+	if !ok {
+		var it rowIterator
+		if it, b.err = run(b.input); b.err != nil {
+			return
+		}
+		b.table, b.err = buildHash(keyedRows(func() ([]MemoryCell, bool, error) { return pull(it) }, b.keys), b.mem, b.files, 0)
+		if err := it.Close(); b.err == nil {
+			b.err = err
+		}
+		return
+	}
+
+	// Every part hashes its rows, up to work_mem each, then their tables
+	// are merged in the order of the parts
+	tables := make([]*hashTable, len(g.parts))
+	b.err = g.collect(func(i int, next func() ([]MemoryCell, bool, error)) (err error) {
+		tables[i], err = buildHash(keyedRows(next, b.keys), b.mem, b.files, 0)
+		return err
+	})
+	if b.err == nil {
+		b.table, b.err = mergeTables(tables, b.files)
+	}
+}
+
+// release drops the hash table and removes its files, for the next run of
+// the clones to build it again.
+func (b *sharedBuild) release() error {
+	var err error
+	if b.files != nil {
+		_, err = b.files.remove()
+	}
+	b.once, b.files, b.table, b.err = sync.Once{}, nil, nil, nil
+	return err
+}
+
+// finalize merges the states of the partial aggregates that its input
+// gathers into the values of the aggregates.
+type finalize struct {
+	estimated
+	node  *aggregateNode
+	input physicalPlan
+	mem   workMem
+}
+
+func (f *finalize) schema() []planColumn { return f.node.schema() }
+
+func (f *finalize) open() (rowIterator, error) {
+	input, err := run(f.input)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	spill := newAggSpill(f.node, f.mem)
+	it, err := f.merge(input, spill)
+	if err != nil {
+		f.removeSpill(spill.files)
+		return nil, err
+	}
+	return it, nil
+}
+
+func (f *finalize) merge(input rowIterator, spill *aggSpill) (rowIterator, error) {
+	groups := newAggGroups(f.node)
+	var size int64
+	for input.Next() {
+		n, err := groups.merge(input.Row())
+		if err != nil {
+			return nil, err
+		}
+		f.hold(n)
+		if size += int64(n); f.mem.exceeded(size) {
+			states, err := groups.rows(true)
+			if err == nil {
+				err = spill.write(states)
+			}
+			if err != nil {
+				return nil, err
+			}
+			groups = newAggGroups(f.node)
+			f.hold(int(-size))
+			size = 0
+		}
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	return spill.finish(groups.rows, size, false, &f.estimated)
+}
+
+func (f *finalize) explain() (string, []string, []physicalPlan) {
+	title, details := aggregateTitle(f.node, "Finalize ")
+	return title, details, []physicalPlan{f.input}
+}
+
+// encode writes the state as a cell: its count and sum as varints, then
+// its value, if any, after a 1.
+func (s aggState) encode() MemoryCell {
+	cell := binary.AppendVarint(nil, s.count)
+	cell = binary.AppendVarint(cell, s.sum)
+	if s.value != nil {
+		cell = append(append(cell, 1), s.value...)
+	}
+	return cell
+}
+
+func decodeState(cell MemoryCell) (aggState, error) {
+	var s aggState
+	var n int
+	if s.count, n = binary.Varint(cell); n <= 0 {
+		return aggState{}, ErrInvalidCell
+	}
+	cell = cell[n:]
+	if s.sum, n = binary.Varint(cell); n <= 0 {
+		return aggState{}, ErrInvalidCell
+	}
+	cell = cell[n:]
+	if len(cell) > 0 {
+		if cell[0] != 1 {
+			return aggState{}, ErrInvalidCell
+		}
+		s.value = cell[1:]
+	}
+	return s, nil
+}
+
+// merge merges a row of GROUP BY values and states of aggregates into its
+// group, returning the memory the group took when it is new.
+func (gs *aggGroups) merge(row []MemoryCell) (int, error) {
+	n := len(gs.node.groups)
+	g, size := gs.get(row[:n])
+	for i, agg := range gs.node.aggs {
+		state, err := decodeState(row[n+i])
+		if err != nil {
+			return 0, err
+		}
+		g.states[i].merge(agg, state)
+	}
+	return size, nil
+}
+
+// merge adds to s the state of agg over other rows.
+func (s *aggState) merge(agg *expr, other aggState) {
+	s.count += other.count
+	s.sum += other.sum
+	switch {
+	case other.value == nil:
+	case s.value == nil:
+		s.value = other.value
+	default:
+		c := compare(other.value, s.value, agg.typ)
+		if (agg.op == "min" && c < 0) || (agg.op == "max" && c > 0) {
+			s.value = other.value
+		}
+	}
+}
+
+// parallel returns plan with the parts worth running in parallel made to.
+func (pp *physicalPlanner) parallel(plan physicalPlan) (physicalPlan, error) {
+	var err error
+	switch n := plan.(type) {
+	case *aggregate:
+		if workers := pp.workers(n.input); workers > 1 && !volatileExprs(n.node.groups) && !volatileExprs(n.node.aggs) {
+			return pp.finalize(n.node, n.input, n.est, workers, func(input physicalPlan, est planCost) (physicalPlan, error) {
+				return &aggregate{estimated: estimated{est: est}, node: n.node, input: input, groups: n.groups, args: n.args, partial: true, mem: n.mem}, nil
+			})
+		}
+		n.input, err = pp.parallelInput(&n.estimated, n.input)
+	case *vecAggregate:
+		if workers := pp.workers(n.input); workers > 1 {
+			return pp.finalize(n.node, n.input, n.est, workers, func(input physicalPlan, est planCost) (physicalPlan, error) {
+				va, err := pp.vecAggregate(n.node, input.(batchPlan))
+				if err != nil {
+					return nil, err
+				}
+				va.est, va.partial = est, true
+				return va, nil
+			})
+		}
+	case *filter:
+		if workers := pp.workers(plan); workers > 1 {
+			return pp.gather(plan, workers)
+		}
+		n.input, err = pp.parallelInput(&n.estimated, n.input)
+	case *projection:
+		if workers := pp.workers(plan); workers > 1 {
+			return pp.gather(plan, workers)
+		}
+		n.input, err = pp.parallelInput(&n.estimated, n.input)
+	case *hashJoin:
+		if workers := pp.workers(plan); workers > 1 {
+			return pp.gather(plan, workers)
+		}
+		if n.left, err = pp.parallelInput(&n.estimated, n.left); err == nil {
+			n.right, err = pp.parallelInput(&n.estimated, n.right)
+		}
+	case *nestedLoop:
+		if n.left, err = pp.parallelInput(&n.estimated, n.left); err == nil {
+			n.right, err = pp.parallelInput(&n.estimated, n.right)
+		}
+	case *indexJoin:
+		n.left, err = pp.parallelInput(&n.estimated, n.left)
+	case *sorter:
+		n.input, err = pp.parallelInput(&n.estimated, n.input)
+	case *limit:
+		n.input, err = pp.parallelInput(&n.estimated, n.input)
+	default:
+		if workers := pp.workers(plan); workers > 1 {
+			return pp.gather(plan, workers)
+		}
+	}
+	return plan, err
+}
+
+// parallelInput returns input with the parts worth it made parallel, taking
+// the cost that saves off e, the estimate of the node reading it.
+func (pp *physicalPlanner) parallelInput(e *estimated, input physicalPlan) (physicalPlan, error) {
+	before := input.estimate().cost
+	input, err := pp.parallel(input)
+	if err != nil {
+		return nil, err
+	}
+	e.est.cost += input.estimate().cost - before
+	return input, nil
+}
+
+// workers is the number of goroutines to run plan on, less than 2 when it
+// is to run on a single one.
+func (pp *physicalPlanner) workers(plan physicalPlan) int {
+	scan := driver(plan)
+	if scan == nil {
+		return 0
+	}
+	perWorker := parallelRows
+	if pp.mb.parallelRows > 0 {
+		perWorker = pp.mb.parallelRows
+	}
+	n := scan.table.rowCount() / perWorker
+	if max := pp.settings.MaxParallelWorkers; n > max {
+		n = max
+	}
+	return n
+}
+
+// driver returns the scan that clones of plan would read parts of, nil
+// when plan can't run as clones.
+func driver(plan physicalPlan) *scanNode {
+	switch n := plan.(type) {
+	case *seqScan:
+		if !volatileExprs(n.filter) {
+			return n.scan
+		}
+	case *vecScan:
+		return n.scan
+	case *filter:
+		if !volatileExprs(n.conds) {
+			return driver(n.input)
+		}
+	case *projection:
+		if !volatileExprs(n.node.exprs) {
+			return driver(n.input)
+		}
+	case *vecProject:
+		return driver(n.input)
+	case *hashJoin:
+		if !volatileExprs(n.keys) && !volatileExprs(n.residual) {
+			return driver(n.left)
+		}
+	}
+	return nil
+}
+
+func volatileExprs(exprs []*expr) bool {
+	for _, e := range exprs {
+		if e.volatile() {
+			return true
+		}
+	}
+	return false
+}
+
+// gather runs plan as clones on workers parts of its driving table.
+func (pp *physicalPlanner) gather(plan physicalPlan, workers int) (*gather, error) {
+	g := &gather{}
+	builds := map[*hashJoin]*sharedBuild{}
+	for i := 0; i < workers; i++ {
+		c, err := pp.clone(plan, i, workers, builds)
+		if err != nil {
+			return nil, err
+		}
+		g.parts = append(g.parts, c)
+	}
+	g.builds = sharedBuilds(builds)
+	in := plan.estimate()
+	g.est = planCost{rows: in.rows, cost: in.cost/float64(workers) + in.rows*gatherTuple}
+	return g, nil
+}
+
+func sharedBuilds(builds map[*hashJoin]*sharedBuild) []*sharedBuild {
+	var list []*sharedBuild
+	for _, b := range builds {
+		list = append(list, b)
+	}
+	return list
+}
+
+// finalize runs the aggregate of node over input as the partial aggregates
+// that partial makes of clones of input, on workers parts of its driving
+// table, whose states a finalize merges. est is that of the aggregate.
+func (pp *physicalPlanner) finalize(node *aggregateNode, input physicalPlan, est planCost, workers int, partial func(physicalPlan, planCost) (physicalPlan, error)) (physicalPlan, error) {
+	g := &gather{}
+	builds := map[*hashJoin]*sharedBuild{}
+	partialEst := planCost{rows: est.rows, cost: est.cost / float64(workers)}
+	for i := 0; i < workers; i++ {
+		c, err := pp.clone(input, i, workers, builds)
+		if err != nil {
+			return nil, err
+		}
+		p, err := partial(c, partialEst)
+		if err != nil {
+			return nil, err
+		}
+		g.parts = append(g.parts, p)
+	}
+	g.est = planCost{rows: est.rows * float64(workers)}
+	g.est.cost = partialEst.cost + g.est.rows*gatherTuple
+	g.builds = sharedBuilds(builds)
+	f := &finalize{node: node, input: g, mem: pp.workMem()}
+	f.est = planCost{rows: est.rows, cost: g.est.cost + g.est.rows*cpuOperator*float64(len(node.aggs))}
+	return f, nil
+}
+
+// share is the estimate of a clone running a part of parts of a plan.
+func share(est planCost, parts int) planCost {
+	return planCost{rows: atLeastOne(est.rows / float64(parts)), cost: est.cost / float64(parts)}
+}
+
+// clone returns a copy of plan reading the part-th of parts of its driving
+// table. Clones of a hash join share the hash table in builds.
+func (pp *physicalPlanner) clone(plan physicalPlan, part, parts int, builds map[*hashJoin]*sharedBuild) (physicalPlan, error) {
+	var err error
+	switch n := plan.(type) {
+	case *seqScan:
+		c := *n
+		c.part, c.parts, c.est = part, parts, share(n.est, parts)
+		return &c, nil
+	case *vecScan:
+		c := *n
+		c.part, c.parts, c.est = part, parts, share(n.est, parts)
+		// Vectorized conditions keep their results from call to call, every
+		// clone needs its own
+		c.pred, err = pp.mb.compileVectorConds(n.filter, n.scan.schema())
+		return &c, err
+	case *filter:
+		c := *n
+		c.est = share(n.est, parts)
+		c.input, err = pp.clone(n.input, part, parts, builds)
+		return &c, err
+	case *projection:
+		c := *n
+		c.est = share(n.est, parts)
+		c.input, err = pp.clone(n.input, part, parts, builds)
+		return &c, err
+	case *vecProject:
+		input, err := pp.clone(n.input, part, parts, builds)
+		if err != nil {
+			return nil, err
+		}
+		c, err := pp.vecProject(n.node, input.(batchPlan))
+		if err != nil {
+			return nil, err
+		}
+		c.est = share(n.est, parts)
+		return c, nil
+	case *hashJoin:
+		build, ok := builds[n]
+		if !ok {
+			input, err := pp.parallel(n.right)
+			if err != nil {
+				return nil, err
+			}
+			build = &sharedBuild{input: input, keys: n.rightKeys, mem: n.mem}
+			builds[n] = build
+		}
+		c := *n
+		c.shared, c.est = build, share(n.est, parts)
+		c.left, err = pp.clone(n.left, part, parts, builds)
+		return &c, err
+	}
+	return nil, fmt.Errorf("%w: %T can't run in parallel", ErrUnsupportedExpression, plan)
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+func TestParallel(t *testing.T) {
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{source: "SELECT * FROM events WHERE amount > 90;"},
+		{source: "SELECT id, amount * 2 - user_id FROM events WHERE kind = 'k3';"},
+		{source: "SELECT kind, count(*), count(amount), sum(amount), min(amount), max(amount), min(kind), max(kind) FROM events GROUP BY kind;"},
+		{source: "SELECT count(*), sum(amount), min(kind) FROM events WHERE id < 0;"},
+		{source: "SELECT user_id % 7, count(*) FROM events GROUP BY user_id % 7 HAVING count(*) > 10;"},
+		{source: "SELECT e.id, f.kind FROM events e JOIN events f ON e.user_id = f.id WHERE e.amount < 3;"},
+		{source: "SELECT e.kind, count(*), max(f.amount) FROM events e JOIN events f ON e.user_id = f.amount GROUP BY e.kind;"},
+		{source: "SELECT id, kind FROM events WHERE amount > 90 ORDER BY id DESC LIMIT 5;"},
+		{source: "SELECT id FROM events LIMIT 3;"},
+		{source: "SELECT 1000 / amount FROM events;", err: ErrDivisionByZero},
+	}
+
+	for _, storage := range []string{"row", "columnar"} {
+		// A worker per thousand rows, for a few thousand rows to span
+		// several workers and chunks
+		mb := NewMemoryBacked()
+		mb.parallelRows = 1000
+		eventsSchema(t, mb, 5000, storage)
+		for _, test := range tests {
+			for _, rowAtATime := range []bool{true, false} {
+				mb.rowAtATime = rowAtATime
+				serial := WithSettings(context.Background(), Settings{MaxParallelWorkers: 1})
+				want, err := queryContext(t, serial, mb, test.source)
+				assert.ErrorIs(t, err, test.err, test.source)
+
+				parallel := WithSettings(context.Background(), Settings{MaxParallelWorkers: 4})
+				got, err := queryContext(t, parallel, mb, test.source)
+				assert.ErrorIs(t, err, test.err, test.source)
+				assert.Equal(t, want, got, storage+": "+test.source)
+			}
+		}
+	}
+}
+
+func TestParallelExplain(t *testing.T) {
+	mb := NewMemoryBacked()
+	mb.parallelRows = 1000
+	eventsSchema(t, mb, 5000, "row")
+	ctx := WithSettings(context.Background(), Settings{MaxParallelWorkers: 4})
+
+	assert.Equal(t, `Project  (cost=2200.88 rows=200)
+  Output: kind, count(*)
+  ->  Finalize Hash Aggregate  (cost=2100.88 rows=200)
+        Group Key: kind
+        ->  Gather  (cost=1900.88 rows=800)
+              Workers Planned: 4
+              ->  Partial Vectorized Hash Aggregate  (cost=1820.88 rows=200)
+                    Group Key: kind
+                    ->  Parallel Vectorized Seq Scan on events  (cost=1562.50 rows=417)
+                          Columns: kind, amount
+                          Filter: (amount > 50)`, explainContext(t, ctx, mb, "EXPLAIN SELECT kind, count(*) FROM events WHERE amount > 50 GROUP BY kind;"))
+
+	// Workers are bounded by the setting and by the size of the table
+	more := WithSettings(context.Background(), Settings{MaxParallelWorkers: 8})
+	assert.Regexp(t, `Workers Planned: 5\n`, explainContext(t, more, mb, "EXPLAIN SELECT id FROM events WHERE amount > 50;"))
+	serial := WithSettings(context.Background(), Settings{MaxParallelWorkers: 1})
+	assert.NotContains(t, explainContext(t, serial, mb, "EXPLAIN SELECT id FROM events WHERE amount > 50;"), "Gather")
+
+	// The clones of a hash join share the table of its right side, built
+	// in parallel too
+	plan := explainContext(t, ctx, mb, "EXPLAIN SELECT e.id, f.kind FROM events e JOIN events f ON e.user_id = f.amount;")
+	assert.Regexp(t, `^Gather .*\n  Workers Planned: 4\n  ->  Project .*\n.*\n        ->  Parallel Hash Join `, plan)
+	assert.Regexp(t, `\n              ->  Gather .*\n                    Workers Planned: 4\n                    ->  Parallel Vectorized Seq Scan on events e `, plan)
+
+	// Sequence functions are called above the gather
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE ids;"))
+	assert.Regexp(t, `^Project .*\n  Output: \(id \+ nextval\('ids'\)\)\n  ->  Gather `, explainContext(t, ctx, mb, "EXPLAIN SELECT id + nextval('ids') FROM events;"))
+
+	// The clones add up their runs
+	plan = explainContext(t, ctx, mb, "EXPLAIN ANALYZE SELECT count(*) FROM events WHERE kind = 'k1';")
+	assert.Regexp(t, regexp.MustCompile(`Finalize Aggregate .* rows=1 loops=1 `), plan)
+	assert.Regexp(t, regexp.MustCompile(`Gather .* rows=4 loops=1 `), plan)
+	assert.Regexp(t, regexp.MustCompile(`Partial Vectorized Aggregate .* rows=1 loops=4 `), plan)
+	assert.Regexp(t, regexp.MustCompile(`Parallel Vectorized Seq Scan on events .* rows=165 loops=4 `), plan)
+}
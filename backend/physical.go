@@ -0,0 +1,1609 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// physicalPlan is a node of the plan that runs. open starts running it,
+// its rows being computed as they are read from the iterator; their cells
+// are in the order of schema.
+type physicalPlan interface {
+	schema() []planColumn
+	open() (rowIterator, error)
+	// explain describes the node for EXPLAIN: a title, detail lines, and
+	// its inputs.
+	explain() (string, []string, []physicalPlan)
+	// estimate is what the planner expects running the node to take.
+	estimate() planCost
+	// instrument makes run measure the node, and runtime returns what it
+	// measured, nil when the node isn't instrumented.
+	instrument()
+	runtime() *runtimeStats
+}
+
+// evaluator computes an expression on a row of the schema it was compiled
+// for.
+type evaluator func(row []MemoryCell) (MemoryCell, error)
+
+var (
+	trueCell  = MemoryCell{1}
+	falseCell = MemoryCell{0}
+)
+
+func boolCell(b bool) MemoryCell {
+	if b {
+		return trueCell
+	}
+	return falseCell
+}
+
+func (mc MemoryCell) isTrue() bool {
+	return len(mc) == 1 && mc[0] == 1
+}
+
+func intCell(i int64) (MemoryCell, error) {
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return nil, ErrIntegerOutOfRange
+	}
+	cell := make(MemoryCell, 4)
+	binary.BigEndian.PutUint32(cell, uint32(i))
+	return cell, nil
+}
+
+// compare orders two cells of type typ, which must not be NULL.
+func compare(a, b MemoryCell, typ ColumnType) int {
+	if typ == IntType {
+		x, _ := a.AsInt()
+		y, _ := b.AsInt()
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return bytes.Compare(a, b)
+}
+
+// encodeKey encodes cells into a map key, for hashing.
+func encodeKey(cells []MemoryCell) string {
+	var key []byte
+	for _, c := range cells {
+		if c == nil {
+			key = append(key, 0)
+			continue
+		}
+		key = append(key, 1)
+		key = binary.AppendUvarint(key, uint64(len(c)))
+		key = append(key, c...)
+	}
+	return string(key)
+}
+
+// position returns the position of column id in schema.
+func position(schema []planColumn, id columnID) (int, error) {
+	for i, c := range schema {
+		if c.id == id {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: column %d.%d is not in the plan", ErrInvalidCell, id.rel, id.col)
+}
+
+// compileExpr turns e into a function of the rows of schema.
+func (mb *MemoryBackend) compileExpr(e *expr, schema []planColumn) (evaluator, error) {
+	var args []evaluator
+	for _, arg := range e.args {
+		ev, err := mb.compileExpr(arg, schema)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, ev)
+	}
+
+	switch e.kind {
+	case columnExpr:
+		i, err := position(schema, e.col)
+		if err != nil {
+			return nil, err
+		}
+		return func(row []MemoryCell) (MemoryCell, error) { return row[i], nil }, nil
+	case constExpr:
+		return func([]MemoryCell) (MemoryCell, error) { return e.value, nil }, nil
+	case callExpr:
+		return func([]MemoryCell) (MemoryCell, error) {
+			v, err := mb.call(e.call)
+			if err != nil {
+				return nil, err
+			}
+			return intCell(v)
+		}, nil
+	case isNullExpr:
+		return func(row []MemoryCell) (MemoryCell, error) {
+			v, err := args[0](row)
+			if err != nil {
+				return nil, err
+			}
+			return boolCell((v == nil) != e.not), nil
+		}, nil
+	case unaryExpr:
+		return func(row []MemoryCell) (MemoryCell, error) {
+			v, err := args[0](row)
+			if err != nil || v == nil {
+				return nil, err
+			}
+			if e.op == "NOT" {
+				return boolCell(!v.isTrue()), nil
+			}
+			i, err := v.AsInt()
+			if err != nil {
+				return nil, err
+			}
+			return intCell(-int64(i))
+		}, nil
+	case binaryExpr:
+		if e.op == "AND" || e.op == "OR" {
+			return logical(e.op == "AND", args[0], args[1]), nil
+		}
+		operandType := e.args[0].typ
+		return func(row []MemoryCell) (MemoryCell, error) {
+			l, err := args[0](row)
+			if err != nil {
+				return nil, err
+			}
+			r, err := args[1](row)
+			if err != nil || l == nil || r == nil {
+				return nil, err
+			}
+			return binaryValue(e.op, l, r, operandType)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedExpression, e)
+}
+
+// logical evaluates AND or OR in three-valued logic: NULL is unknown.
+func logical(and bool, left, right evaluator) evaluator {
+	return func(row []MemoryCell) (MemoryCell, error) {
+		l, err := left(row)
+		if err != nil {
+			return nil, err
+		}
+		// false AND x is false, true OR x is true
+		if l != nil && l.isTrue() != and {
+			return l, nil
+		}
+		r, err := right(row)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil && r.isTrue() != and {
+			return r, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return l, nil
+	}
+}
+
+func binaryValue(op string, l, r MemoryCell, typ ColumnType) (MemoryCell, error) {
+	switch op {
+	case "=":
+		return boolCell(compare(l, r, typ) == 0), nil
+	case "<>":
+		return boolCell(compare(l, r, typ) != 0), nil
+	case "<":
+		return boolCell(compare(l, r, typ) < 0), nil
+	case "<=":
+		return boolCell(compare(l, r, typ) <= 0), nil
+	case ">":
+		return boolCell(compare(l, r, typ) > 0), nil
+	case ">=":
+		return boolCell(compare(l, r, typ) >= 0), nil
+	}
+
+	x, err := l.AsInt()
+	if err != nil {
+		return nil, err
+	}
+	y, err := r.AsInt()
+	if err != nil {
+		return nil, err
+	}
+	a, b := int64(x), int64(y)
+	switch op {
+	case "+":
+		return intCell(a + b)
+	case "-":
+		return intCell(a - b)
+	case "*":
+		return intCell(a * b)
+	case "/", "%":
+		if b == 0 {
+			return nil, ErrDivisionByZero
+		}
+		if op == "/" {
+			return intCell(a / b)
+		}
+		return intCell(a % b)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedExpression, op)
+}
+
+// compileConds turns conditions into a predicate that holds when all of
+// them are true, nil when there are none.
+func (mb *MemoryBackend) compileConds(conds []*expr, schema []planColumn) (func([]MemoryCell) (bool, error), error) {
+	if len(conds) == 0 {
+		return nil, nil
+	}
+	var evs []evaluator
+	for _, c := range conds {
+		ev, err := mb.compileExpr(c, schema)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	return func(row []MemoryCell) (bool, error) {
+		for _, ev := range evs {
+			v, err := ev(row)
+			if err != nil || !v.isTrue() {
+				return false, err
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+// rowIterator runs a physical node in the Volcano style: every call of
+// Next computes one more row, pulling as few rows from the inputs as that
+// takes. Row returns the current row, which the node doesn't change
+// afterwards, and Err the error that ended the rows. Close stops the node
+// and its inputs.
+type rowIterator interface {
+	Next() bool
+	Row() []MemoryCell
+	Err() error
+	Close() error
+}
+
+// iterator is a rowIterator whose next returns the next row, false when
+// there are no more, and whose close closes the inputs.
+type iterator struct {
+	next  func() ([]MemoryCell, bool, error)
+	close func() error
+	row   []MemoryCell
+	err   error
+	done  bool
+}
+
+func (it *iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	row, ok, err := it.next()
+	if err != nil || !ok {
+		it.row, it.err, it.done = nil, err, true
+		return false
+	}
+	it.row = row
+	return true
+}
+
+func (it *iterator) Row() []MemoryCell { return it.row }
+
+func (it *iterator) Err() error { return it.err }
+
+func (it *iterator) Close() error {
+	it.done = true
+	if it.close == nil {
+		return nil
+	}
+	close := it.close
+	it.close = nil
+	return close()
+}
+
+// rowsIterator returns rows computed in advance.
+func rowsIterator(rows [][]MemoryCell, close func() error) *iterator {
+	i := 0
+	return &iterator{
+		next: func() ([]MemoryCell, bool, error) {
+			if i >= len(rows) {
+				return nil, false, nil
+			}
+			i++
+			return rows[i-1], true, nil
+		},
+		close: close,
+	}
+}
+
+// pull returns the next row of it, false at the end of its rows.
+func pull(it rowIterator) ([]MemoryCell, bool, error) {
+	if it.Next() {
+		return it.Row(), true, nil
+	}
+	return nil, false, it.Err()
+}
+
+// drain returns all the remaining rows of it.
+func drain(it rowIterator) ([][]MemoryCell, error) {
+	var rows [][]MemoryCell
+	for it.Next() {
+		rows = append(rows, it.Row())
+	}
+	return rows, it.Err()
+}
+
+// holds tells whether pred holds for row, true when pred is nil.
+func holds(pred func([]MemoryCell) (bool, error), row []MemoryCell) (bool, error) {
+	if pred == nil {
+		return true, nil
+	}
+	return pred(row)
+}
+
+// concat returns the row of a join.
+func concat(left, right []MemoryCell) []MemoryCell {
+	return append(append(make([]MemoryCell, 0, len(left)+len(right)), left...), right...)
+}
+
+func exprList(exprs []*expr, sep string) string {
+	var parts []string
+	for _, e := range exprs {
+		parts = append(parts, e.String())
+	}
+	return strings.Join(parts, sep)
+}
+
+// conds renders conditions as a detail line of EXPLAIN, none when there
+// are no conditions.
+func conds(title string, exprs []*expr) []string {
+	if len(exprs) == 0 {
+		return nil
+	}
+	return []string{title + ": " + exprList(exprs, " AND ")}
+}
+
+// filtered returns the rows of next for which pred holds, all of them when
+// pred is nil.
+func filtered(next func() ([]MemoryCell, bool, error), pred func([]MemoryCell) (bool, error)) func() ([]MemoryCell, bool, error) {
+	if pred == nil {
+		return next
+	}
+	return func() ([]MemoryCell, bool, error) {
+		for {
+			row, ok, err := next()
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			if ok, err := pred(row); err != nil || ok {
+				return row, ok, err
+			}
+		}
+	}
+}
+
+// readAll runs plan to the end of its rows.
+func readAll(plan physicalPlan) ([][]MemoryCell, error) {
+	it, err := run(plan)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := drain(it)
+	if closeErr := it.Close(); err == nil {
+		err = closeErr
+	}
+	return rows, err
+}
+
+// seqScan reads every row of a table. Segments of columnar tables that
+// zones rule out are skipped. The scans of parallel plans read the part-th
+// of parts of the table. Scans stop once ctx is done, which ends the rows
+// of every node above them.
+type seqScan struct {
+	estimated
+	ctx         context.Context
+	scan        *scanNode
+	filter      []*expr
+	zones       []zoneCond
+	pred        func([]MemoryCell) (bool, error)
+	part, parts int
+}
+
+func (s *seqScan) schema() []planColumn { return s.scan.schema() }
+
+func (s *seqScan) open() (rowIterator, error) {
+	// Rows added while the scan runs are not returned
+	tr := partRows(s.scan, s.part, s.parts)
+	var rows [][]MemoryCell
+	// Rows of segments are narrowed as they are decoded
+	decoded := false
+	i := 0
+	next := func() ([]MemoryCell, bool, error) {
+		for i >= len(rows) {
+			if err := ContextErr(s.ctx); err != nil {
+				return nil, false, err
+			}
+			seg, chunk, err := tr.next(s.zones)
+			switch {
+			case err != nil:
+				return nil, false, err
+			case seg != nil:
+				if rows, err = seg.rows(tr.types, s.scan.columns); err != nil {
+					return nil, false, err
+				}
+				decoded = true
+			case len(chunk) == 0:
+				return nil, false, tr.close()
+			default:
+				rows, decoded = chunk, false
+			}
+			i = 0
+		}
+		i++
+		if decoded {
+			return rows[i-1], true, nil
+		}
+		return narrow(rows[i-1], s.scan.columns), true, nil
+	}
+	return &iterator{next: filtered(next, s.pred), close: tr.close}, nil
+}
+
+// narrow picks the cells of columns out of a table row.
+func narrow(row []MemoryCell, columns []int) []MemoryCell {
+	cells := make([]MemoryCell, len(columns))
+	for i, c := range columns {
+		cells[i] = row[c]
+	}
+	return cells
+}
+
+func (s *seqScan) explain() (string, []string, []physicalPlan) {
+	return parallelTitle(s.parts, "Seq Scan on ") + scanName(s.scan), scanDetails(s.scan, s.filter), nil
+}
+
+func scanName(n *scanNode) string {
+	if n.alias != n.name {
+		return n.name + " " + n.alias
+	}
+	return n.name
+}
+
+func scanDetails(n *scanNode, filter []*expr) []string {
+	var names []string
+	for _, c := range n.columns {
+		names = append(names, n.table.Columns[c])
+	}
+	details := []string{"Columns: " + strings.Join(names, ", ")}
+	if n.table.Storage == ColumnarStorage {
+		_, used := zoneConds(n, filter)
+		details = append(details, conds("Segment Filter", used)...)
+	}
+	return append(details, conds("Filter", filter)...)
+}
+
+// indexScan looks up the row of a table whose unique constraint columns
+// have the values of key.
+type indexScan struct {
+	estimated
+	scan       *scanNode
+	constraint int
+	key        []MemoryCell
+	cond       []*expr
+	filter     []*expr
+	pred       func([]MemoryCell) (bool, error)
+}
+
+func (s *indexScan) schema() []planColumn { return s.scan.schema() }
+
+func (s *indexScan) open() (rowIterator, error) {
+	t := s.scan.table
+	key, ok := t.key(s.constraint, s.key)
+	if !ok {
+		return rowsIterator(nil, nil), nil
+	}
+	idx, err := t.index(s.constraint)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := idx[key]
+	if !ok {
+		return rowsIterator(nil, nil), nil
+	}
+	row, err := t.row(i)
+	if err != nil {
+		return nil, err
+	}
+	row = narrow(row, s.scan.columns)
+	if ok, err := holds(s.pred, row); err != nil || !ok {
+		return rowsIterator(nil, nil), err
+	}
+	return rowsIterator([][]MemoryCell{row}, nil), nil
+}
+
+func (s *indexScan) explain() (string, []string, []physicalPlan) {
+	t := s.scan.table
+	title := "Index Scan using " + t.Unique[s.constraint].Name + " on " + scanName(s.scan)
+	details := append(conds("Index Cond", s.cond), scanDetails(s.scan, s.filter)...)
+	return title, details, nil
+}
+
+// filter drops the rows of its input for which a condition isn't true.
+type filter struct {
+	estimated
+	input physicalPlan
+	conds []*expr
+	pred  func([]MemoryCell) (bool, error)
+}
+
+func (f *filter) schema() []planColumn { return f.input.schema() }
+
+func (f *filter) open() (rowIterator, error) {
+	input, err := run(f.input)
+	if err != nil {
+		return nil, err
+	}
+	next := func() ([]MemoryCell, bool, error) { return pull(input) }
+	return &iterator{next: filtered(next, f.pred), close: input.Close}, nil
+}
+
+func (f *filter) explain() (string, []string, []physicalPlan) {
+	return "Filter", conds("Filter", f.conds), []physicalPlan{f.input}
+}
+
+// nestedLoop joins by comparing every pair of rows. The rows of right are
+// read once, when there is a row of left to join them with. As its rows
+// come from pairs rather than scans, it stops at ctx itself.
+type nestedLoop struct {
+	estimated
+	ctx         context.Context
+	left, right physicalPlan
+	conds       []*expr
+	pred        func([]MemoryCell) (bool, error)
+}
+
+func (j *nestedLoop) schema() []planColumn {
+	return append(append([]planColumn(nil), j.left.schema()...), j.right.schema()...)
+}
+
+func (j *nestedLoop) open() (rowIterator, error) {
+	left, err := run(j.left)
+	if err != nil {
+		return nil, err
+	}
+	var right [][]MemoryCell
+	var l []MemoryCell
+	read := false
+	i := 0
+	next := func() ([]MemoryCell, bool, error) {
+		for l == nil || i >= len(right) {
+			if read && len(right) == 0 {
+				return nil, false, nil
+			}
+			if err := ContextErr(j.ctx); err != nil {
+				return nil, false, err
+			}
+			row, ok, err := pull(left)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			if !read {
+				if right, err = readAll(j.right); err != nil {
+					return nil, false, err
+				}
+				read = true
+				j.hold(int(rowsSize(right)))
+			}
+			l, i = row, 0
+		}
+		i++
+		return concat(l, right[i-1]), true, nil
+	}
+	return &iterator{next: filtered(next, j.pred), close: left.Close}, nil
+}
+
+func (j *nestedLoop) explain() (string, []string, []physicalPlan) {
+	return "Nested Loop", conds("Join Filter", j.conds), []physicalPlan{j.left, j.right}
+}
+
+// hashJoin joins on equalities between the two sides: the rows of right
+// are put in a hash table by their keys, which the rows of left look up.
+// When they outgrow mem, both sides are partitioned to temporary files.
+type hashJoin struct {
+	estimated
+	left, right         physicalPlan
+	keys                []*expr
+	leftKeys, rightKeys []evaluator
+	residual            []*expr
+	pred                func([]MemoryCell) (bool, error)
+	mem                 workMem
+	// shared is the hash table of right that the clones of a parallel plan
+	// build together, nil otherwise.
+	shared *sharedBuild
+}
+
+func (j *hashJoin) schema() []planColumn {
+	return append(append([]planColumn(nil), j.left.schema()...), j.right.schema()...)
+}
+
+// rowKey evaluates the keys of row, false when one is NULL, which never
+// equals anything.
+func rowKey(row []MemoryCell, keys []evaluator) (string, bool, error) {
+	cells := make([]MemoryCell, len(keys))
+	for i, ev := range keys {
+		v, err := ev(row)
+		if err != nil || v == nil {
+			return "", false, err
+		}
+		cells[i] = v
+	}
+	return encodeKey(cells), true, nil
+}
+
+func (j *hashJoin) open() (rowIterator, error) {
+	files := &spillFiles{dir: j.mem.dir}
+	it, err := j.openSpilling(files)
+	if err != nil {
+		j.removeSpill(files)
+		return nil, err
+	}
+	return it, nil
+}
+
+func (j *hashJoin) openSpilling(files *spillFiles) (rowIterator, error) {
+	var table *hashTable
+	if j.shared != nil {
+		var spilled int64
+		var err error
+		if table, spilled, err = j.shared.get(); err != nil {
+			return nil, err
+		}
+		j.spilled(spilled)
+	} else {
+		right, err := run(j.right)
+		if err != nil {
+			return nil, err
+		}
+		table, err = buildHash(keyedRows(func() ([]MemoryCell, bool, error) { return pull(right) }, j.rightKeys), j.mem, files, 0)
+		if closeErr := right.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	j.hold(int(table.size))
+
+	left, err := run(j.left)
+	if err != nil {
+		return nil, err
+	}
+	next, err := j.join(table, keyedRows(func() ([]MemoryCell, bool, error) { return pull(left) }, j.leftKeys), files)
+	if err != nil {
+		left.Close()
+		return nil, err
+	}
+	close := func() error {
+		err := left.Close()
+		if removeErr := j.removeSpill(files); err == nil {
+			err = removeErr
+		}
+		return err
+	}
+	return &iterator{next: filtered(next, j.pred), close: close}, nil
+}
+
+func (j *hashJoin) explain() (string, []string, []physicalPlan) {
+	details := append(conds("Hash Cond", j.keys), conds("Join Filter", j.residual)...)
+	if j.shared != nil {
+		return "Parallel Hash Join", details, []physicalPlan{j.left, j.shared.input}
+	}
+	return "Hash Join", details, []physicalPlan{j.left, j.right}
+}
+
+// aggregate computes aggregates over groups of rows, kept in a hash table
+// by their GROUP BY values. Without GROUP BY, all rows are a single group,
+// even when there are none. A partial aggregate returns the states of the
+// aggregates rather than their values, for finalize to merge.
+type aggregate struct {
+	estimated
+	node    *aggregateNode
+	input   physicalPlan
+	groups  []evaluator
+	args    []evaluator
+	partial bool
+	mem     workMem
+}
+
+// aggState accumulates an aggregate over the rows of a group.
+type aggState struct {
+	count int64
+	sum   int64
+	value MemoryCell
+}
+
+// aggGroup is a group of rows, with the states of its aggregates.
+type aggGroup struct {
+	values []MemoryCell
+	states []aggState
+}
+
+// aggGroups holds the groups of an aggregate in the order their first rows
+// came in.
+type aggGroups struct {
+	node  *aggregateNode
+	list  []*aggGroup
+	byKey map[string]*aggGroup
+}
+
+func newAggGroups(node *aggregateNode) *aggGroups {
+	gs := &aggGroups{node: node, byKey: map[string]*aggGroup{}}
+	if len(node.groups) == 0 {
+		gs.list = append(gs.list, &aggGroup{states: make([]aggState, len(node.aggs))})
+	}
+	return gs
+}
+
+// get returns the group of the GROUP BY values, and the memory it took
+// when it is new.
+func (gs *aggGroups) get(values []MemoryCell) (*aggGroup, int) {
+	if len(gs.node.groups) == 0 {
+		return gs.list[0], 0
+	}
+	key := encodeKey(values)
+	if g := gs.byKey[key]; g != nil {
+		return g, 0
+	}
+	g := &aggGroup{values: values, states: make([]aggState, len(gs.node.aggs))}
+	gs.byKey[key] = g
+	gs.list = append(gs.list, g)
+	return g, len(key) + len(g.states)*aggStateSize
+}
+
+// rows returns a row per group, its values then those of its aggregates,
+// or their states when partial is set.
+func (gs *aggGroups) rows(partial bool) ([][]MemoryCell, error) {
+	var results [][]MemoryCell
+	for _, g := range gs.list {
+		row := append([]MemoryCell(nil), g.values...)
+		for i, agg := range gs.node.aggs {
+			if partial {
+				row = append(row, g.states[i].encode())
+				continue
+			}
+			cell, err := g.states[i].result(agg)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, cell)
+		}
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+func (a *aggregate) schema() []planColumn { return a.node.schema() }
+
+func (a *aggregate) open() (rowIterator, error) {
+	input, err := run(a.input)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	spill := newAggSpill(a.node, a.mem)
+	it, err := a.aggregate(input, spill)
+	if err != nil {
+		a.removeSpill(spill.files)
+		return nil, err
+	}
+	return it, nil
+}
+
+// aggregate accumulates the rows of input into their groups, writing the
+// groups to spill whenever they outgrow work_mem.
+func (a *aggregate) aggregate(input rowIterator, spill *aggSpill) (rowIterator, error) {
+	groups := newAggGroups(a.node)
+	var size int64
+	for input.Next() {
+		row := input.Row()
+		values := make([]MemoryCell, len(a.groups))
+		for i, ev := range a.groups {
+			var err error
+			if values[i], err = ev(row); err != nil {
+				return nil, err
+			}
+		}
+		g, n := groups.get(values)
+		a.hold(n)
+		for i, agg := range a.node.aggs {
+			if err := a.accumulate(&g.states[i], agg, a.args[i], row); err != nil {
+				return nil, err
+			}
+		}
+		if size += int64(n); a.mem.exceeded(size) {
+			states, err := groups.rows(true)
+			if err == nil {
+				err = spill.write(states)
+			}
+			if err != nil {
+				return nil, err
+			}
+			groups = newAggGroups(a.node)
+			a.hold(int(-size))
+			size = 0
+		}
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	return spill.finish(groups.rows, size, a.partial, &a.estimated)
+}
+
+// accumulate adds a row to the state of agg. arg is nil for count(*).
+func (a *aggregate) accumulate(s *aggState, agg *expr, arg evaluator, row []MemoryCell) error {
+	if arg == nil {
+		s.count++
+		return nil
+	}
+	v, err := arg(row)
+	if err != nil || v == nil {
+		return err
+	}
+	s.count++
+	switch agg.op {
+	case "sum":
+		i, err := v.AsInt()
+		if err != nil {
+			return err
+		}
+		s.sum += int64(i)
+	case "min", "max":
+		if s.value == nil {
+			s.value = v
+			break
+		}
+		c := compare(v, s.value, agg.typ)
+		if (agg.op == "min" && c < 0) || (agg.op == "max" && c > 0) {
+			s.value = v
+		}
+	}
+	return nil
+}
+
+// result is the value of agg for the group. Aggregates of no values are
+// NULL, except for count.
+func (s *aggState) result(agg *expr) (MemoryCell, error) {
+	switch agg.op {
+	case "count":
+		return intCell(s.count)
+	case "sum":
+		if s.count == 0 {
+			return nil, nil
+		}
+		return intCell(s.sum)
+	}
+	return s.value, nil
+}
+
+func (a *aggregate) explain() (string, []string, []physicalPlan) {
+	title, details := aggregateTitle(a.node, "")
+	if a.partial {
+		title = "Partial " + title
+	}
+	return title, details, []physicalPlan{a.input}
+}
+
+// aggregateTitle names an aggregate node for EXPLAIN, prefix naming its
+// kind, and gives its group key.
+func aggregateTitle(node *aggregateNode, prefix string) (string, []string) {
+	if len(node.groups) == 0 {
+		return prefix + "Aggregate", nil
+	}
+	return prefix + "Hash Aggregate", []string{"Group Key: " + exprList(node.groups, ", ")}
+}
+
+// sorter sorts rows by keys, with NULLs last in ascending order and first
+// in descending order, like PostgreSQL. Rows that outgrow mem are sorted
+// in runs written to temporary files, then merged.
+type sorter struct {
+	estimated
+	input physicalPlan
+	keys  []sortKey
+	evs   []evaluator
+	mem   workMem
+}
+
+func (s *sorter) schema() []planColumn { return s.input.schema() }
+
+func (s *sorter) open() (rowIterator, error) {
+	input, err := run(s.input)
+	if err != nil {
+		return nil, err
+	}
+	files := &spillFiles{dir: s.mem.dir}
+	it, err := s.sortRows(input, files)
+	if closeErr := input.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		s.removeSpill(files)
+		return nil, err
+	}
+	return it, nil
+}
+
+// sortRows sorts the rows of input, in memory unless they outgrow
+// work_mem.
+func (s *sorter) sortRows(input rowIterator, files *spillFiles) (rowIterator, error) {
+	var rows [][]MemoryCell
+	var runs []*spillFile
+	var size int64
+	for input.Next() {
+		row, err := s.keyed(input.Row())
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+		n := rowSize(row)
+		s.hold(int(n))
+		if size += n; s.mem.exceeded(size) {
+			sorted, err := s.writeRun(files, rows)
+			if err != nil {
+				return nil, err
+			}
+			runs = append(runs, sorted)
+			rows = nil
+			s.hold(int(-size))
+			size = 0
+		}
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+
+	width := len(s.keys)
+	if runs == nil {
+		s.sort(rows)
+		for i, row := range rows {
+			rows[i] = row[:len(row)-width]
+		}
+		return rowsIterator(rows, nil), nil
+	}
+
+	if len(rows) > 0 {
+		sorted, err := s.writeRun(files, rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, sorted)
+		s.hold(int(-size))
+	}
+	for len(runs) > sortFanIn {
+		var err error
+		if runs, err = s.mergeRuns(files, runs); err != nil {
+			return nil, err
+		}
+	}
+	merged, err := s.merge(runs)
+	if err != nil {
+		return nil, err
+	}
+	next := func() ([]MemoryCell, bool, error) {
+		row, ok, err := merged()
+		if !ok {
+			return nil, ok, err
+		}
+		return row[:len(row)-width], true, nil
+	}
+	return &iterator{next: next, close: func() error { return s.removeSpill(files) }}, nil
+}
+
+// keyed returns row with the values of the sort keys after its cells.
+func (s *sorter) keyed(row []MemoryCell) ([]MemoryCell, error) {
+	keyed := append(make([]MemoryCell, 0, len(row)+len(s.evs)), row...)
+	for _, ev := range s.evs {
+		v, err := ev(row)
+		if err != nil {
+			return nil, err
+		}
+		keyed = append(keyed, v)
+	}
+	return keyed, nil
+}
+
+func (s *sorter) sort(rows [][]MemoryCell) {
+	sort.SliceStable(rows, func(x, y int) bool {
+		return s.compare(rows[x], rows[y]) < 0
+	})
+}
+
+// compare orders two keyed rows by their sort keys.
+func (s *sorter) compare(a, b []MemoryCell) int {
+	a, b = a[len(a)-len(s.keys):], b[len(b)-len(s.keys):]
+	for j, k := range s.keys {
+		var c int
+		switch {
+		case a[j] == nil && b[j] == nil:
+			continue
+		case a[j] == nil:
+			c = 1
+		case b[j] == nil:
+			c = -1
+		default:
+			c = compare(a[j], b[j], k.e.typ)
+		}
+		if c == 0 {
+			continue
+		}
+		if k.desc {
+			return -c
+		}
+		return c
+	}
+	return 0
+}
+
+func (s *sorter) explain() (string, []string, []physicalPlan) {
+	var keys []string
+	for _, k := range s.keys {
+		key := k.e.String()
+		if k.desc {
+			key += " DESC"
+		}
+		keys = append(keys, key)
+	}
+	return "Sort", []string{"Sort Key: " + strings.Join(keys, ", ")}, []physicalPlan{s.input}
+}
+
+// projection computes the items of a SELECT.
+type projection struct {
+	estimated
+	node  *projectNode
+	input physicalPlan
+	evs   []evaluator
+}
+
+func (p *projection) schema() []planColumn { return p.node.schema() }
+
+func (p *projection) open() (rowIterator, error) {
+	input, err := run(p.input)
+	if err != nil {
+		return nil, err
+	}
+	next := func() ([]MemoryCell, bool, error) {
+		row, ok, err := pull(input)
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		result := make([]MemoryCell, len(p.evs))
+		for i, ev := range p.evs {
+			if result[i], err = ev(row); err != nil {
+				return nil, false, err
+			}
+		}
+		return result, true, nil
+	}
+	return &iterator{next: next, close: input.Close}, nil
+}
+
+func (p *projection) explain() (string, []string, []physicalPlan) {
+	return "Project", []string{"Output: " + exprList(p.node.exprs, ", ")}, []physicalPlan{p.input}
+}
+
+// limit skips the first rows of its input, and stops reading it once it
+// returned enough rows.
+type limit struct {
+	estimated
+	node  *limitNode
+	input physicalPlan
+}
+
+func (l *limit) schema() []planColumn { return l.input.schema() }
+
+func (l *limit) open() (rowIterator, error) {
+	if l.node.limit == 0 {
+		return rowsIterator(nil, nil), nil
+	}
+	input, err := run(l.input)
+	if err != nil {
+		return nil, err
+	}
+	var skipped, returned int64
+	next := func() ([]MemoryCell, bool, error) {
+		for ; skipped < l.node.offset; skipped++ {
+			if _, ok, err := pull(input); err != nil || !ok {
+				return nil, false, err
+			}
+		}
+		if l.node.limit >= 0 && returned >= l.node.limit {
+			return nil, false, nil
+		}
+		returned++
+		return pull(input)
+	}
+	return &iterator{next: next, close: input.Close}, nil
+}
+
+func (l *limit) explain() (string, []string, []physicalPlan) {
+	var details []string
+	if l.node.limit >= 0 {
+		details = append(details, fmt.Sprintf("Limit: %d", l.node.limit))
+	}
+	if l.node.offset > 0 {
+		details = append(details, fmt.Sprintf("Offset: %d", l.node.offset))
+	}
+	return "Limit", details, []physicalPlan{l.input}
+}
+
+type result struct {
+	estimated
+}
+
+func (r *result) schema() []planColumn { return nil }
+
+func (r *result) open() (rowIterator, error) { return rowsIterator([][]MemoryCell{{}}, nil), nil }
+
+func (r *result) explain() (string, []string, []physicalPlan) { return "Result", nil, nil }
+
+// indexJoin looks up, for every row of left, the row of a table whose
+// unique constraint columns equal the keys computed from it.
+type indexJoin struct {
+	estimated
+	left     physicalPlan
+	inner    *indexScan
+	keys     []*expr
+	leftKeys []evaluator
+	// columns are the constraint columns the keys are for
+	columns  []int
+	residual []*expr
+	pred     func([]MemoryCell) (bool, error)
+}
+
+func (j *indexJoin) schema() []planColumn {
+	return append(append([]planColumn(nil), j.left.schema()...), j.inner.schema()...)
+}
+
+func (j *indexJoin) open() (rowIterator, error) {
+	left, err := run(j.left)
+	if err != nil {
+		return nil, err
+	}
+	j.inner.key = make([]MemoryCell, len(j.inner.scan.table.Columns))
+	var l []MemoryCell
+	var inner rowIterator
+	next := func() ([]MemoryCell, bool, error) {
+		for {
+			if inner != nil {
+				r, ok, err := pull(inner)
+				if err != nil {
+					return nil, false, err
+				}
+				if ok {
+					return concat(l, r), true, nil
+				}
+				if err := inner.Close(); err != nil {
+					return nil, false, err
+				}
+				inner = nil
+			}
+
+			row, ok, err := pull(left)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			for i, ev := range j.leftKeys {
+				if j.inner.key[j.columns[i]], err = ev(row); err != nil {
+					return nil, false, err
+				}
+			}
+			if inner, err = run(j.inner); err != nil {
+				return nil, false, err
+			}
+			l = row
+		}
+	}
+	close := func() error {
+		if inner != nil {
+			inner.Close()
+		}
+		return left.Close()
+	}
+	return &iterator{next: filtered(next, j.pred), close: close}, nil
+}
+
+func (j *indexJoin) explain() (string, []string, []physicalPlan) {
+	return "Nested Loop", conds("Join Filter", j.residual), []physicalPlan{j.left, j.inner}
+}
+
+// physicalPlanner picks an implementation for every node of a logical
+// plan, the cheapest one by the estimates of cost.go.
+type physicalPlanner struct {
+	mb *MemoryBackend
+	// ctx is the context of the statement, which the scans stop at
+	ctx context.Context
+	// settings are those of the session running the statement
+	settings Settings
+	// scans are the scans of the plan by relation, to find the statistics
+	// of columns
+	scans map[int]*scanNode
+}
+
+func (mb *MemoryBackend) physical(ctx context.Context, plan logicalPlan) (physicalPlan, error) {
+	pp := &physicalPlanner{mb: mb, ctx: ctx, settings: settingsOf(ctx), scans: map[int]*scanNode{}}
+	var collect func(plan logicalPlan)
+	collect = func(plan logicalPlan) {
+		switch n := plan.(type) {
+		case *scanNode:
+			pp.scans[n.rel] = n
+		case *filterNode:
+			collect(n.input)
+		case *joinNode:
+			collect(n.left)
+			collect(n.right)
+		case *aggregateNode:
+			collect(n.input)
+		case *sortNode:
+			collect(n.input)
+		case *projectNode:
+			collect(n.input)
+		case *limitNode:
+			collect(n.input)
+		}
+	}
+	collect(plan)
+	best, err := pp.physical(plan)
+	if err != nil {
+		return nil, err
+	}
+	return pp.parallel(best)
+}
+
+func (pp *physicalPlanner) physical(plan logicalPlan) (physicalPlan, error) {
+	mb := pp.mb
+	switch n := plan.(type) {
+	case *scanNode:
+		return pp.scan(n, nil)
+	case *filterNode:
+		if scan, ok := n.input.(*scanNode); ok {
+			return pp.scan(scan, n.conds)
+		}
+		input, err := pp.physical(n.input)
+		if err != nil {
+			return nil, err
+		}
+		pred, err := mb.compileConds(n.conds, input.schema())
+		if err != nil {
+			return nil, err
+		}
+		f := &filter{input: input, conds: n.conds, pred: pred}
+		in := input.estimate()
+		f.est = planCost{
+			rows: atLeastOne(in.rows * pp.selectivity(n.conds...)),
+			cost: in.cost + in.rows*cpuOperator*float64(len(n.conds)),
+		}
+		return f, nil
+	case *joinNode:
+		return pp.join(n)
+	case *aggregateNode:
+		input, err := pp.physical(n.input)
+		if err != nil {
+			return nil, err
+		}
+		a := &aggregate{node: n, input: input, mem: pp.workMem()}
+		for _, g := range n.groups {
+			ev, err := mb.compileExpr(g, input.schema())
+			if err != nil {
+				return nil, err
+			}
+			a.groups = append(a.groups, ev)
+		}
+		for _, agg := range n.aggs {
+			var ev evaluator
+			if len(agg.args) > 0 {
+				if ev, err = mb.compileExpr(agg.args[0], input.schema()); err != nil {
+					return nil, err
+				}
+			}
+			a.args = append(a.args, ev)
+		}
+		in := input.estimate()
+		groups := 1.0
+		for _, g := range n.groups {
+			groups *= pp.distinct(g)
+		}
+		if len(n.groups) > 0 {
+			groups = atLeastOne(math.Min(groups, in.rows))
+		}
+		a.est = planCost{
+			rows: groups,
+			cost: in.cost + in.rows*cpuOperator*float64(len(n.groups)+len(n.aggs)) + groups*cpuTuple,
+		}
+		return pp.vectorizeAggregate(a)
+	case *sortNode:
+		input, err := pp.physical(n.input)
+		if err != nil {
+			return nil, err
+		}
+		s := &sorter{input: input, keys: n.keys, mem: pp.workMem()}
+		for _, k := range n.keys {
+			ev, err := mb.compileExpr(k.e, input.schema())
+			if err != nil {
+				return nil, err
+			}
+			s.evs = append(s.evs, ev)
+		}
+		in := input.estimate()
+		s.est = planCost{rows: in.rows, cost: in.cost + sortCost(in.rows)}
+		return s, nil
+	case *projectNode:
+		input, err := pp.physical(n.input)
+		if err != nil {
+			return nil, err
+		}
+		p := &projection{node: n, input: input}
+		for _, e := range n.exprs {
+			ev, err := mb.compileExpr(e, input.schema())
+			if err != nil {
+				return nil, err
+			}
+			p.evs = append(p.evs, ev)
+		}
+		in := input.estimate()
+		p.est = planCost{rows: in.rows, cost: in.cost + in.rows*cpuOperator*float64(len(n.exprs))}
+		return pp.vectorizeProjection(p)
+	case *limitNode:
+		input, err := pp.physical(n.input)
+		if err != nil {
+			return nil, err
+		}
+		in := input.estimate()
+		rows := math.Max(in.rows-float64(n.offset), 0)
+		if n.limit >= 0 {
+			rows = math.Min(rows, float64(n.limit))
+		}
+		return &limit{node: n, input: input, estimated: estimated{est: planCost{rows: rows, cost: in.cost}}}, nil
+	}
+	return &result{estimated{est: planCost{rows: 1}}}, nil
+}
+
+// scan reads a table filtered by conds, through the index of a unique
+// constraint when conds give a value to all of its columns and that is
+// cheaper.
+func (pp *physicalPlanner) scan(n *scanNode, conds []*expr) (physicalPlan, error) {
+	pred, err := pp.mb.compileConds(conds, n.schema())
+	if err != nil {
+		return nil, err
+	}
+	rows := pp.tableRows(n)
+	seq := &seqScan{
+		ctx:    pp.ctx,
+		scan:   n,
+		filter: conds,
+		pred:   pred,
+		estimated: estimated{est: planCost{
+			rows: atLeastOne(rows * pp.selectivity(conds...)),
+			cost: rows*cpuTuple + rows*cpuOperator*float64(len(conds)),
+		}},
+	}
+	if n.table.Storage == ColumnarStorage {
+		seq.zones, _ = zoneConds(n, conds)
+	}
+	best, err := pp.vectorizeScan(seq, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	t := n.table
+	for c, uc := range t.Unique {
+		key := make([]MemoryCell, len(t.Columns))
+		used := map[*expr]bool{}
+		for _, col := range uc.Columns {
+			for _, cond := range conds {
+				if v := equalsConst(cond, columnID{n.rel, col}); v != nil && !used[cond] {
+					key[col] = v
+					used[cond] = true
+					break
+				}
+			}
+		}
+		if len(used) != len(uc.Columns) {
+			continue
+		}
+
+		s := &indexScan{scan: n, constraint: c, key: key}
+		for _, cond := range conds {
+			if used[cond] {
+				s.cond = append(s.cond, cond)
+			} else {
+				s.filter = append(s.filter, cond)
+			}
+		}
+		if s.pred, err = pp.mb.compileConds(s.filter, n.schema()); err != nil {
+			return nil, err
+		}
+		s.est = pp.indexScanCost(n, s.filter)
+		if s.est.cost < best.estimate().cost {
+			best = s
+		}
+	}
+	return best, nil
+}
+
+// equalsConst returns the value v when cond is column = v, v not being
+// NULL.
+func equalsConst(cond *expr, column columnID) MemoryCell {
+	if cond.kind != binaryExpr || cond.op != "=" {
+		return nil
+	}
+	for i, arg := range cond.args {
+		other := cond.args[1-i]
+		if arg.kind == columnExpr && arg.col == column && other.kind == constExpr && other.typ == arg.typ {
+			return other.value
+		}
+	}
+	return nil
+}
+
+// joinPair joins two plans on conds, by whichever of a hash join, an index
+// lookup of the right side and a nested loop is cheapest. leaf is the
+// logical plan of right when it is a table, to look for an index.
+func (pp *physicalPlanner) joinPair(left, right physicalPlan, leaf logicalPlan, conds []*expr) (physicalPlan, error) {
+	mb := pp.mb
+	schema := append(append([]planColumn(nil), left.schema()...), right.schema()...)
+	l, r := left.estimate(), right.estimate()
+	rows := atLeastOne(l.rows * r.rows * pp.selectivity(conds...))
+
+	pred, err := mb.compileConds(conds, schema)
+	if err != nil {
+		return nil, err
+	}
+	var best physicalPlan = &nestedLoop{
+		ctx:   pp.ctx,
+		left:  left,
+		right: right,
+		conds: conds,
+		pred:  pred,
+		estimated: estimated{est: planCost{
+			rows: rows,
+			cost: l.cost + r.cost + l.rows*r.rows*cpuOperator*math.Max(1, float64(len(conds))) + rows*cpuTuple,
+		}},
+	}
+
+	// Equalities between an expression of each side
+	type equality struct {
+		cond        *expr
+		left, right *expr
+	}
+	var equalities []equality
+	var others []*expr
+	for _, cond := range conds {
+		if cond.kind == binaryExpr && cond.op == "=" && !cond.volatile() {
+			a, b := cond.args[0], cond.args[1]
+			if sided(right.schema(), a) && sided(left.schema(), b) {
+				a, b = b, a
+			}
+			if sided(left.schema(), a) && sided(right.schema(), b) {
+				equalities = append(equalities, equality{cond, a, b})
+				continue
+			}
+		}
+		others = append(others, cond)
+	}
+	if len(equalities) == 0 {
+		return best, nil
+	}
+
+	j := &hashJoin{left: left, right: right, mem: pp.workMem()}
+	for _, eq := range equalities {
+		lev, err := mb.compileExpr(eq.left, left.schema())
+		if err != nil {
+			return nil, err
+		}
+		rev, err := mb.compileExpr(eq.right, right.schema())
+		if err != nil {
+			return nil, err
+		}
+		j.keys = append(j.keys, eq.cond)
+		j.leftKeys = append(j.leftKeys, lev)
+		j.rightKeys = append(j.rightKeys, rev)
+	}
+	j.residual = others
+	if j.pred, err = mb.compileConds(others, schema); err != nil {
+		return nil, err
+	}
+	j.est = planCost{rows: rows, cost: l.cost + r.cost + r.rows*hashBuild + l.rows*cpuTuple + rows*cpuTuple}
+	if j.est.cost < best.estimate().cost {
+		best = j
+	}
+
+	// An index of the right table whose columns all equal something of
+	// the left side
+	var scan *scanNode
+	var filter []*expr
+	switch n := leaf.(type) {
+	case *scanNode:
+		scan = n
+	case *filterNode:
+		scan, _ = n.input.(*scanNode)
+		filter = n.conds
+	}
+	if scan == nil {
+		return best, nil
+	}
+	t := scan.table
+	for c, uc := range t.Unique {
+		ij := &indexJoin{left: left, inner: &indexScan{scan: scan, constraint: c, filter: filter}}
+		used := map[*expr]bool{}
+		for _, col := range uc.Columns {
+			for _, eq := range equalities {
+				if eq.right.kind != columnExpr || eq.right.col != (columnID{scan.rel, col}) || eq.left.typ != eq.right.typ || used[eq.cond] {
+					continue
+				}
+				lev, err := mb.compileExpr(eq.left, left.schema())
+				if err != nil {
+					return nil, err
+				}
+				used[eq.cond] = true
+				ij.keys = append(ij.keys, eq.cond)
+				ij.leftKeys = append(ij.leftKeys, lev)
+				ij.columns = append(ij.columns, col)
+				break
+			}
+		}
+		if len(used) != len(uc.Columns) {
+			continue
+		}
+
+		ij.inner.cond = ij.keys
+		if ij.inner.pred, err = mb.compileConds(filter, scan.schema()); err != nil {
+			return nil, err
+		}
+		ij.inner.est = pp.indexScanCost(scan, filter)
+		for _, cond := range conds {
+			if !used[cond] {
+				ij.residual = append(ij.residual, cond)
+			}
+		}
+		if ij.pred, err = mb.compileConds(ij.residual, schema); err != nil {
+			return nil, err
+		}
+		ij.est = planCost{
+			rows: atLeastOne(math.Min(rows, l.rows)),
+			cost: l.cost + l.rows*ij.inner.est.cost + rows*cpuTuple,
+		}
+		if ij.est.cost < best.estimate().cost {
+			best = ij
+		}
+	}
+	return best, nil
+}
+
+// sided tells whether e reads columns of schema, and only of schema.
+func sided(schema []planColumn, e *expr) bool {
+	used := map[columnID]bool{}
+	e.columns(used)
+	return len(used) > 0 && coversSchema(schema, used)
+}
+
+func coversSchema(schema []planColumn, used map[columnID]bool) bool {
+	outputs := map[columnID]bool{}
+	for _, c := range schema {
+		outputs[c.id] = true
+	}
+	for id := range used {
+		if !outputs[id] {
+			return false
+		}
+	}
+	return true
+}
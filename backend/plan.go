@@ -0,0 +1,788 @@
+package backend
+
+import (
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/token"
+	"strconv"
+	"strings"
+)
+
+// A SELECT is run in three steps. It is first bound into a logical plan, a
+// tree of relational operators whose expressions refer to columns by
+// columnID. Rewrite rules then turn the logical plan into a cheaper one
+// with the same results (see rewrite.go), and each logical operator is
+// finally given a physical implementation, which is what runs (see
+// physical.go).
+
+// columnID identifies a column of a plan: column col of relation rel,
+// where relations are the tables of FROM and the outputs of aggregates
+// and projections.
+type columnID struct {
+	rel, col int
+}
+
+// planColumn is a column of the output of a plan. table is the name or
+// alias of the table it comes from, "" for computed columns.
+type planColumn struct {
+	id    columnID
+	table string
+	name  string
+	typ   ColumnType
+}
+
+type exprKind uint
+
+const (
+	columnExpr exprKind = iota
+	constExpr
+	binaryExpr
+	unaryExpr
+	isNullExpr
+	callExpr
+	aggregateExpr
+)
+
+// expr is a bound expression: its columns are resolved and its type is
+// known. Operators, NOT and unary minus keep their operator in op and
+// their operands in args; aggregates keep the function name in op and
+// have no args for count(*).
+type expr struct {
+	kind exprKind
+	typ  ColumnType
+
+	// col and name, which is how it is shown, are set for columns
+	col  columnID
+	name string
+
+	// value is the value of a constant, nil for NULL
+	value MemoryCell
+
+	op   string
+	args []*expr
+	// not is set for IS NOT NULL
+	not bool
+	// call is a call of a sequence function
+	call *ast.Expression
+}
+
+func (e *expr) String() string {
+	switch e.kind {
+	case columnExpr:
+		return e.name
+	case constExpr:
+		return cellString(e.value, e.typ)
+	case binaryExpr:
+		return "(" + e.args[0].String() + " " + e.op + " " + e.args[1].String() + ")"
+	case unaryExpr:
+		if e.op == "NOT" {
+			return "NOT " + e.args[0].String()
+		}
+		return e.op + e.args[0].String()
+	case isNullExpr:
+		if e.not {
+			return e.args[0].String() + " IS NOT NULL"
+		}
+		return e.args[0].String() + " IS NULL"
+	case callExpr:
+		return sqlExpression(e.call)
+	case aggregateExpr:
+		if len(e.args) == 0 {
+			return e.op + "(*)"
+		}
+		return e.op + "(" + e.args[0].String() + ")"
+	}
+	return "?"
+}
+
+// cellString renders a cell as an SQL literal.
+func cellString(c MemoryCell, typ ColumnType) string {
+	if c == nil {
+		return "NULL"
+	}
+	switch typ {
+	case IntType:
+		i, err := c.AsInt()
+		if err != nil {
+			return "?"
+		}
+		return strconv.Itoa(int(i))
+	case BoolType:
+		if c.isTrue() {
+			return "true"
+		}
+		return "false"
+	}
+	return "'" + strings.ReplaceAll(c.AsText(), "'", "''") + "'"
+}
+
+// isNull tells whether e is the NULL literal, which takes the type of
+// what it is compared or combined with.
+func (e *expr) isNull() bool {
+	return e.kind == constExpr && e.value == nil
+}
+
+// columns adds the columns used by e to ids.
+func (e *expr) columns(ids map[columnID]bool) {
+	if e.kind == columnExpr {
+		ids[e.col] = true
+	}
+	for _, arg := range e.args {
+		arg.columns(ids)
+	}
+}
+
+// volatile tells whether evaluating e has side effects, like nextval.
+func (e *expr) volatile() bool {
+	if e.kind == callExpr {
+		return true
+	}
+	for _, arg := range e.args {
+		if arg.volatile() {
+			return true
+		}
+	}
+	return false
+}
+
+// conjuncts splits a condition on its ANDs.
+func conjuncts(e *expr) []*expr {
+	if e.kind == binaryExpr && e.op == "AND" {
+		return append(conjuncts(e.args[0]), conjuncts(e.args[1])...)
+	}
+	return []*expr{e}
+}
+
+func isAggregate(exp *ast.Expression) bool {
+	if exp.Kind != ast.FunctionKind {
+		return false
+	}
+	switch exp.Literal.Value {
+	case "count", "sum", "min", "max":
+		return true
+	}
+	return false
+}
+
+func containsAggregate(exp *ast.Expression) bool {
+	if isAggregate(exp) {
+		return true
+	}
+	for _, arg := range exp.Args {
+		if containsAggregate(arg) {
+			return true
+		}
+	}
+	return false
+}
+
+// binder binds expressions to the columns in scope. Above an aggregate,
+// agg is set and columns can only be used through the GROUP BY
+// expressions or inside aggregates.
+type binder struct {
+	mb    *MemoryBackend
+	scope []planColumn
+	// qualify shows columns as table.column, when there are several
+	// tables
+	qualify bool
+	agg     *aggregation
+}
+
+// aggregation collects the groups and aggregates of a query. Its output
+// is the groups followed by the aggregates, as relation rel.
+type aggregation struct {
+	input  *binder
+	rel    int
+	groups []*expr
+	aggs   []*expr
+}
+
+func (b *binder) bind(exp *ast.Expression) (*expr, error) {
+	if b.agg != nil {
+		return b.bindAggregated(exp)
+	}
+	return b.bindWith(exp, b.bind)
+}
+
+// bindBool binds a condition, like a WHERE.
+func (b *binder) bindBool(exp *ast.Expression, clause string) (*expr, error) {
+	e, err := b.bind(exp)
+	if err != nil {
+		return nil, err
+	}
+	if e.isNull() {
+		e.typ = BoolType
+	}
+	if e.typ != BoolType {
+		return nil, fmt.Errorf("%w: argument of %s must be bool, not %s", ErrTypeMismatch, clause, e.typ)
+	}
+	return e, nil
+}
+
+// bindWith binds exp, binding its operands with operand.
+func (b *binder) bindWith(exp *ast.Expression, operand func(*ast.Expression) (*expr, error)) (*expr, error) {
+	switch exp.Kind {
+	case ast.LiteralKind:
+		return b.literal(exp)
+	case ast.FunctionKind:
+		if isAggregate(exp) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidAggregate, exp.Literal.Value)
+		}
+		if _, _, err := callArgs(exp); err != nil {
+			return nil, err
+		}
+		return &expr{kind: callExpr, typ: IntType, call: exp}, nil
+	case ast.UnaryKind:
+		arg, err := operand(exp.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		switch token.Keyword(exp.Literal.Value) {
+		case token.IsKeyword:
+			return &expr{kind: isNullExpr, typ: BoolType, not: exp.Not, args: []*expr{arg}}, nil
+		case token.NotKeyword:
+			if err := expectType(arg, BoolType, "NOT"); err != nil {
+				return nil, err
+			}
+			return &expr{kind: unaryExpr, typ: BoolType, op: "NOT", args: []*expr{arg}}, nil
+		}
+		if err := expectType(arg, IntType, exp.Literal.Value); err != nil {
+			return nil, err
+		}
+		return &expr{kind: unaryExpr, typ: IntType, op: exp.Literal.Value, args: []*expr{arg}}, nil
+	case ast.BinaryKind:
+		left, err := operand(exp.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		right, err := operand(exp.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return binaryOperator(exp.Literal.Value, left, right)
+	case ast.StarKind:
+		return nil, fmt.Errorf("%w: * is only allowed as a SELECT item or in count(*)", ErrUnsupportedExpression)
+	}
+	return nil, ErrUnsupportedExpression
+}
+
+func (b *binder) literal(exp *ast.Expression) (*expr, error) {
+	lit := exp.Literal
+	switch lit.Kind {
+	case token.IdentifierKind:
+		return b.column(exp.Table, lit.Value)
+	case token.NumericKind, token.StringKind:
+		cell, err := tokenToCell(lit)
+		if err != nil {
+			return nil, err
+		}
+		typ := TextType
+		if lit.Kind == token.NumericKind {
+			typ = IntType
+		}
+		return &expr{kind: constExpr, typ: typ, value: cell}, nil
+	case token.KeywordKind:
+		if lit.Value == string(token.NullKeyword) {
+			return &expr{kind: constExpr, typ: TextType}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedExpression, lit.Value)
+}
+
+// column resolves a column reference, qualified by table when it is not
+// nil.
+func (b *binder) column(table *token.Token, name string) (*expr, error) {
+	var found *planColumn
+	for i := range b.scope {
+		c := &b.scope[i]
+		if c.name != name || (table != nil && c.table != table.Value) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%w: %s", ErrAmbiguousColumn, name)
+		}
+		found = c
+	}
+	if found == nil {
+		if table != nil {
+			name = table.Value + "." + name
+		}
+		return nil, fmt.Errorf("%w: %s", ErrColumnDoesNotExist, name)
+	}
+
+	display := name
+	if b.qualify && found.table != "" {
+		display = found.table + "." + name
+	}
+	return &expr{kind: columnExpr, typ: found.typ, col: found.id, name: display}, nil
+}
+
+// expectType checks that the operand of op is of type typ, giving the
+// NULL literal that type.
+func expectType(e *expr, typ ColumnType, op string) error {
+	if e.isNull() {
+		e.typ = typ
+	}
+	if e.typ != typ {
+		return fmt.Errorf("%w: %s %s", ErrTypeMismatch, op, e.typ)
+	}
+	return nil
+}
+
+func binaryOperator(op string, left, right *expr) (*expr, error) {
+	switch op {
+	case string(token.BangEqualsSymbol):
+		op = string(token.NotEqualsSymbol)
+	case string(token.AndKeyword), string(token.OrKeyword):
+		op = strings.ToUpper(op)
+	}
+
+	e := &expr{kind: binaryExpr, typ: BoolType, op: op, args: []*expr{left, right}}
+	switch op {
+	case "AND", "OR":
+		if left.isNull() {
+			left.typ = BoolType
+		}
+		if right.isNull() {
+			right.typ = BoolType
+		}
+		if left.typ != BoolType || right.typ != BoolType {
+			break
+		}
+		return e, nil
+	case "+", "-", "*", "/", "%":
+		if left.isNull() {
+			left.typ = IntType
+		}
+		if right.isNull() {
+			right.typ = IntType
+		}
+		if left.typ != IntType || right.typ != IntType {
+			break
+		}
+		e.typ = IntType
+		return e, nil
+	default:
+		if left.isNull() {
+			left.typ = right.typ
+		}
+		if right.isNull() {
+			right.typ = left.typ
+		}
+		if left.typ != right.typ {
+			break
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("%w: %s %s %s", ErrTypeMismatch, left.typ, op, right.typ)
+}
+
+// bindAggregated binds an expression above an aggregate: it must be an
+// aggregate, one of the GROUP BY expressions, or made of them.
+func (b *binder) bindAggregated(exp *ast.Expression) (*expr, error) {
+	if isAggregate(exp) {
+		return b.agg.aggregate(exp)
+	}
+	if !containsAggregate(exp) {
+		e, err := b.agg.input.bind(exp)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range b.agg.groups {
+			if g.String() == e.String() {
+				return b.agg.ref(i, g), nil
+			}
+		}
+		if e.kind == columnExpr {
+			return nil, fmt.Errorf("%w: %s", ErrGroupingError, e)
+		}
+	}
+	return b.bindWith(exp, b.bindAggregated)
+}
+
+// ref refers to column i of the output of the aggregation.
+func (g *aggregation) ref(i int, e *expr) *expr {
+	return &expr{kind: columnExpr, typ: e.typ, col: columnID{g.rel, i}, name: e.String()}
+}
+
+// aggregate binds a call of an aggregate function, computing each
+// distinct one only once.
+func (g *aggregation) aggregate(exp *ast.Expression) (*expr, error) {
+	name := exp.Literal.Value
+	e := &expr{kind: aggregateExpr, typ: IntType, op: name}
+	if len(exp.Args) != 1 {
+		return nil, fmt.Errorf("%w: %s", ErrUndefinedFunction, signature(exp))
+	}
+	arg := exp.Args[0]
+	switch {
+	case arg.Kind == ast.StarKind && arg.Table == nil:
+		if name != "count" {
+			return nil, fmt.Errorf("%w: %s(*)", ErrUndefinedFunction, name)
+		}
+	case containsAggregate(arg):
+		return nil, fmt.Errorf("%w: aggregate calls cannot be nested", ErrInvalidAggregate)
+	default:
+		a, err := g.input.bind(arg)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "sum":
+			if err := expectType(a, IntType, name); err != nil {
+				return nil, err
+			}
+		case "min", "max":
+			e.typ = a.typ
+		}
+		e.args = []*expr{a}
+	}
+
+	for i, agg := range g.aggs {
+		if agg.String() == e.String() {
+			return g.ref(len(g.groups)+i, agg), nil
+		}
+	}
+	g.aggs = append(g.aggs, e)
+	return g.ref(len(g.groups)+len(g.aggs)-1, e), nil
+}
+
+// logicalPlan is a node of a logical plan.
+type logicalPlan interface {
+	schema() []planColumn
+}
+
+// scanNode reads a table, keeping only columns.
+type scanNode struct {
+	rel     int
+	table   *Table
+	name    string
+	alias   string
+	columns []int
+}
+
+// filterNode keeps the rows for which all conds are true.
+type filterNode struct {
+	input logicalPlan
+	conds []*expr
+}
+
+// joinNode pairs every row of left with every row of right for which all
+// conds are true.
+type joinNode struct {
+	left, right logicalPlan
+	conds       []*expr
+}
+
+// aggregateNode groups its input by groups, every row when there are
+// none, and computes aggs for each group.
+type aggregateNode struct {
+	input  logicalPlan
+	rel    int
+	groups []*expr
+	aggs   []*expr
+}
+
+type sortKey struct {
+	e    *expr
+	desc bool
+}
+
+type sortNode struct {
+	input logicalPlan
+	keys  []sortKey
+}
+
+// projectNode computes the items of a SELECT.
+type projectNode struct {
+	input logicalPlan
+	rel   int
+	exprs []*expr
+	names []string
+}
+
+// limitNode skips offset rows and returns at most limit rows, all of them
+// when limit is negative.
+type limitNode struct {
+	input         logicalPlan
+	limit, offset int64
+}
+
+// resultNode is a single row without columns, what SELECT without FROM
+// reads from.
+type resultNode struct{}
+
+func (n *scanNode) schema() []planColumn {
+	var columns []planColumn
+	for _, c := range n.columns {
+		columns = append(columns, planColumn{
+			id:    columnID{n.rel, c},
+			table: n.alias,
+			name:  n.table.Columns[c],
+			typ:   n.table.ColumnTypes[c],
+		})
+	}
+	return columns
+}
+
+func (n *filterNode) schema() []planColumn { return n.input.schema() }
+
+func (n *joinNode) schema() []planColumn {
+	return append(append([]planColumn(nil), n.left.schema()...), n.right.schema()...)
+}
+
+func (n *aggregateNode) schema() []planColumn {
+	var columns []planColumn
+	for i, e := range append(append([]*expr(nil), n.groups...), n.aggs...) {
+		columns = append(columns, planColumn{id: columnID{n.rel, i}, name: e.String(), typ: e.typ})
+	}
+	return columns
+}
+
+func (n *sortNode) schema() []planColumn { return n.input.schema() }
+
+func (n *projectNode) schema() []planColumn {
+	var columns []planColumn
+	for i, e := range n.exprs {
+		columns = append(columns, planColumn{id: columnID{n.rel, i}, name: n.names[i], typ: e.typ})
+	}
+	return columns
+}
+
+func (n *limitNode) schema() []planColumn { return n.input.schema() }
+
+func (n *resultNode) schema() []planColumn { return nil }
+
+// planner builds the logical plan of a SELECT.
+type planner struct {
+	mb   *MemoryBackend
+	rels int
+}
+
+func (p *planner) newRel() int {
+	p.rels++
+	return p.rels
+}
+
+// build plans a SELECT as scans and joins of FROM, a filter for WHERE, an
+// aggregate and a filter for HAVING, a sort, the projection of the items,
+// and a limit.
+func (p *planner) build(slct *ast.SelectStatement) (logicalPlan, error) {
+	var input logicalPlan = &resultNode{}
+	b := &binder{mb: p.mb, qualify: len(slct.From) > 1}
+	names := map[string]bool{}
+	for i, ref := range slct.From {
+		t, ok := p.mb.Tables[ref.Name.Value]
+		if !ok {
+			return nil, ErrTableDoesNotExist
+		}
+		alias := ref.Name.Value
+		if ref.Alias != nil {
+			alias = ref.Alias.Value
+		}
+		if names[alias] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateAlias, alias)
+		}
+		names[alias] = true
+
+		scan := &scanNode{rel: p.newRel(), table: t, name: ref.Name.Value, alias: alias}
+		for c := range t.Columns {
+			scan.columns = append(scan.columns, c)
+		}
+		b.scope = append(b.scope, scan.schema()...)
+		if i == 0 {
+			input = scan
+			continue
+		}
+
+		join := &joinNode{left: input, right: scan}
+		if ref.On != nil {
+			on, err := b.bindBool(ref.On, "JOIN/ON")
+			if err != nil {
+				return nil, err
+			}
+			join.conds = conjuncts(on)
+		}
+		input = join
+	}
+
+	if slct.Where != nil {
+		where, err := b.bindBool(slct.Where, "WHERE")
+		if err != nil {
+			return nil, err
+		}
+		input = &filterNode{input: input, conds: conjuncts(where)}
+	}
+
+	items, itemNames, err := expandItems(slct.Item, b.scope)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregated := len(slct.GroupBy) > 0 || slct.Having != nil
+	for _, exp := range items {
+		aggregated = aggregated || containsAggregate(exp)
+	}
+	for _, term := range slct.OrderBy {
+		aggregated = aggregated || containsAggregate(term.Expression)
+	}
+	out := b
+	var agg *aggregation
+	if aggregated {
+		agg = &aggregation{input: b, rel: p.newRel()}
+		for _, exp := range slct.GroupBy {
+			if containsAggregate(exp) {
+				return nil, fmt.Errorf("%w: in GROUP BY", ErrInvalidAggregate)
+			}
+			g, err := b.bind(exp)
+			if err != nil {
+				return nil, err
+			}
+			agg.groups = append(agg.groups, g)
+		}
+		out = &binder{mb: p.mb, qualify: b.qualify, agg: agg}
+	}
+
+	var exprs []*expr
+	for _, exp := range items {
+		e, err := out.bind(exp)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	var having *expr
+	if slct.Having != nil {
+		if having, err = out.bindBool(slct.Having, "HAVING"); err != nil {
+			return nil, err
+		}
+	}
+	var keys []sortKey
+	for _, term := range slct.OrderBy {
+		e, err := orderKey(term.Expression, items, exprs, out)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sortKey{e: e, desc: term.Desc})
+	}
+
+	if agg != nil {
+		input = &aggregateNode{input: input, rel: agg.rel, groups: agg.groups, aggs: agg.aggs}
+		if having != nil {
+			input = &filterNode{input: input, conds: conjuncts(having)}
+		}
+	}
+	if len(keys) > 0 {
+		input = &sortNode{input: input, keys: keys}
+	}
+	input = &projectNode{input: input, rel: p.newRel(), exprs: exprs, names: itemNames}
+
+	if slct.Limit != nil || slct.Offset != nil {
+		limit := &limitNode{input: input, limit: -1}
+		if slct.Limit != nil {
+			if limit.limit, err = p.count(slct.Limit, "LIMIT"); err != nil {
+				return nil, err
+			}
+		}
+		if slct.Offset != nil {
+			if limit.offset, err = p.count(slct.Offset, "OFFSET"); err != nil {
+				return nil, err
+			}
+			if limit.offset < 0 {
+				limit.offset = 0
+			}
+		}
+		input = limit
+	}
+	return input, nil
+}
+
+// expandItems replaces * and table.* by the columns they stand for, and
+// names every item: by its alias, its column, its function, or else
+// ?column?.
+func expandItems(items []*ast.Expression, scope []planColumn) ([]*ast.Expression, []string, error) {
+	var expanded []*ast.Expression
+	var names []string
+	for _, exp := range items {
+		if exp.Kind != ast.StarKind {
+			expanded = append(expanded, exp)
+			name := "?column?"
+			switch {
+			case exp.Alias != nil:
+				name = exp.Alias.Value
+			case exp.Kind == ast.LiteralKind && exp.Literal.Kind == token.IdentifierKind,
+				exp.Kind == ast.FunctionKind:
+				name = exp.Literal.Value
+			}
+			names = append(names, name)
+			continue
+		}
+
+		if len(scope) == 0 && exp.Table == nil {
+			return nil, nil, fmt.Errorf("%w: SELECT * without tables", ErrUnsupportedExpression)
+		}
+		found := false
+		for _, c := range scope {
+			if exp.Table != nil && c.table != exp.Table.Value {
+				continue
+			}
+			found = true
+			expanded = append(expanded, &ast.Expression{
+				Literal: &token.Token{Value: c.name, Kind: token.IdentifierKind, Loc: exp.Literal.Loc},
+				Table:   &token.Token{Value: c.table, Kind: token.IdentifierKind, Loc: exp.Literal.Loc},
+				Kind:    ast.LiteralKind,
+			})
+			names = append(names, c.name)
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("%w: %s", ErrTableDoesNotExist, exp.Table.Value)
+		}
+	}
+	return expanded, names, nil
+}
+
+// orderKey binds an ORDER BY expression, which may also be the position
+// or the alias of a SELECT item.
+func orderKey(exp *ast.Expression, items []*ast.Expression, exprs []*expr, b *binder) (*expr, error) {
+	if exp.Kind == ast.LiteralKind && exp.Literal.Kind == token.NumericKind {
+		n, err := strconv.Atoi(exp.Literal.Value)
+		if err != nil || n < 1 || n > len(exprs) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidOrderPosition, exp.Literal.Value)
+		}
+		return exprs[n-1], nil
+	}
+	if exp.Kind == ast.LiteralKind && exp.Literal.Kind == token.IdentifierKind && exp.Table == nil {
+		for i, item := range items {
+			if item.Alias != nil && item.Alias.Value == exp.Literal.Value {
+				return exprs[i], nil
+			}
+		}
+	}
+	return b.bind(exp)
+}
+
+// count evaluates the constant of a LIMIT or an OFFSET. NULL means no
+// limit.
+func (p *planner) count(exp *ast.Expression, clause string) (int64, error) {
+	e, err := (&binder{mb: p.mb}).bind(exp)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectType(e, IntType, clause); err != nil {
+		return 0, err
+	}
+	e = fold(e)
+	if e.kind != constExpr {
+		return 0, fmt.Errorf("%w: %s must be a constant", ErrUnsupportedExpression, clause)
+	}
+	if e.value == nil {
+		return -1, nil
+	}
+	n, err := e.value.AsInt()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%w: %s %d", ErrNegativeLimit, clause, n)
+	}
+	return int64(n), nil
+}
@@ -0,0 +1,376 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const planSchema = `CREATE TABLE users (id INT PRIMARY KEY, name TEXT, age INT);
+	CREATE TABLE orders (id INT PRIMARY KEY, user_id INT, total INT);
+	INSERT INTO users VALUES (1, 'Phil', 30), (2, 'Kate', 25), (3, 'Dan', NULL), (4, 'Ann', 25);
+	INSERT INTO orders VALUES (10, 1, 5), (11, 1, 7), (12, 2, 3), (13, NULL, 9);`
+
+// selectAll runs a SELECT to the end of its rows.
+func selectAll(b Backend, slct *ast.SelectStatement) (*Results, error) {
+	return selectAllContext(context.Background(), b, slct)
+}
+
+func selectAllContext(ctx context.Context, b Backend, slct *ast.SelectStatement) (*Results, error) {
+	rows, err := b.Select(ctx, slct)
+	if err != nil {
+		return nil, err
+	}
+	return Collect(rows)
+}
+
+// query runs a SELECT and returns the Go values of its rows.
+func query(t *testing.T, b Backend, source string) ([][]interface{}, error) {
+	return queryContext(t, context.Background(), b, source)
+}
+
+// queryContext is query with ctx, which may carry settings.
+func queryContext(t *testing.T, ctx context.Context, b Backend, source string) ([][]interface{}, error) {
+	asts, err := parser.Parse(source)
+	assert.Nil(t, err, source)
+	results, err := selectAllContext(ctx, b, asts.Statements[0].SelectStatement)
+	if err != nil {
+		return nil, err
+	}
+	got := [][]interface{}{}
+	for _, row := range results.Rows {
+		var values []interface{}
+		for i, cell := range row {
+			v, err := CellValue(cell, results.Columns[i].Type)
+			assert.Nil(t, err)
+			values = append(values, v)
+		}
+		got = append(got, values)
+	}
+	return got, nil
+}
+
+func TestSelectPlans(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, planSchema))
+
+	tests := []struct {
+		source string
+		rows   [][]interface{}
+	}{
+		{
+			source: "SELECT name FROM users WHERE age = 25 AND id > 1 ORDER BY name;",
+			rows:   [][]interface{}{{"Ann"}, {"Kate"}},
+		},
+		{
+			source: "SELECT u.name, o.total FROM users u JOIN orders o ON u.id = o.user_id WHERE o.total > 4 ORDER BY o.total DESC;",
+			rows:   [][]interface{}{{"Phil", int64(7)}, {"Phil", int64(5)}},
+		},
+		{
+			source: "SELECT users.name, orders.id FROM users, orders WHERE users.id = orders.user_id AND users.id = 2;",
+			rows:   [][]interface{}{{"Kate", int64(12)}},
+		},
+		{
+			source: "SELECT age, count(*) AS n, min(name) FROM users GROUP BY age HAVING count(*) > 0 ORDER BY age;",
+			rows:   [][]interface{}{{int64(25), int64(2), "Ann"}, {int64(30), int64(1), "Phil"}, {nil, int64(1), "Dan"}},
+		},
+		{
+			source: "SELECT count(*), count(age), sum(age), max(age) FROM users WHERE id > 100;",
+			rows:   [][]interface{}{{int64(0), int64(0), nil, nil}},
+		},
+		{
+			source: "SELECT id * 10 + 1 AS x FROM users ORDER BY x DESC LIMIT 2 OFFSET 1;",
+			rows:   [][]interface{}{{int64(31)}, {int64(21)}},
+		},
+		{
+			source: "SELECT name FROM users WHERE age IS NULL OR NOT age < 30 ORDER BY 1;",
+			rows:   [][]interface{}{{"Dan"}, {"Phil"}},
+		},
+		{
+			source: "SELECT * FROM users WHERE id = 3;",
+			rows:   [][]interface{}{{int64(3), "Dan", nil}},
+		},
+		{
+			source: "SELECT 1 + 2 * 3, -(7 % 4), 'a' = 'a', NULL IS NULL;",
+			rows:   [][]interface{}{{int64(7), int64(-3), true, true}},
+		},
+		{
+			source: "SELECT name FROM users WHERE age = NULL;",
+			rows:   [][]interface{}{},
+		},
+	}
+
+	for _, test := range tests {
+		rows, err := query(t, mb, test.source)
+		assert.Nil(t, err, test.source)
+		assert.Equal(t, test.rows, rows, test.source)
+	}
+}
+
+func TestSelectPlanErrors(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, planSchema))
+
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{"SELECT id FROM users, orders;", ErrAmbiguousColumn},
+		{"SELECT id FROM users u JOIN users u ON u.id = u.id;", ErrDuplicateAlias},
+		{"SELECT name, count(*) FROM users;", ErrGroupingError},
+		{"SELECT name FROM users WHERE count(*) > 1;", ErrInvalidAggregate},
+		{"SELECT name FROM users WHERE age;", ErrTypeMismatch},
+		{"SELECT name + 1 FROM users;", ErrTypeMismatch},
+		{"SELECT name FROM users ORDER BY 2;", ErrInvalidOrderPosition},
+		{"SELECT name FROM users LIMIT -1;", ErrNegativeLimit},
+		{"SELECT id / 0 FROM users;", ErrDivisionByZero},
+		{"SELECT 2147483647 + 1;", ErrIntegerOutOfRange},
+		{"SELECT nope.* FROM users;", ErrTableDoesNotExist},
+	}
+
+	for _, test := range tests {
+		_, err := query(t, mb, test.source)
+		assert.ErrorIs(t, err, test.err, test.source)
+	}
+}
+
+func explain(t *testing.T, mb *MemoryBackend, source string) string {
+	return explainContext(t, context.Background(), mb, source)
+}
+
+// explainContext is explain with ctx, which may carry settings.
+func explainContext(t *testing.T, ctx context.Context, mb *MemoryBackend, source string) string {
+	asts, err := parser.Parse(source)
+	assert.Nil(t, err, source)
+	results, err := mb.Explain(ctx, asts.Statements[0].ExplainStatement)
+	assert.Nil(t, err, source)
+	var lines []string
+	for _, row := range results.Rows {
+		lines = append(lines, row[0].AsText())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestExplain(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, planSchema))
+
+	tests := []struct {
+		source string
+		plan   string
+	}{
+		{
+			// Conditions move below the join, constants are folded, and
+			// scans only read the columns that are used. Few orders are
+			// left, so their users are looked up by the primary key
+			source: `EXPLAIN SELECT u.name FROM users u JOIN orders o ON u.id = o.user_id
+				WHERE o.total > 2 * 2 AND u.age = 30 AND 1 = 1 ORDER BY o.total LIMIT 5;`,
+			plan: `Limit  (cost=7.50 rows=1)
+  Limit: 5
+  ->  Project  (cost=7.50 rows=1)
+        Output: u.name
+        ->  Sort  (cost=7.25 rows=1)
+              Sort Key: o.total
+              ->  Nested Loop  (cost=7.25 rows=1)
+                    ->  Seq Scan on orders o  (cost=5.00 rows=1)
+                          Columns: user_id, total
+                          Filter: (o.total > 4)
+                    ->  Index Scan using users_pkey on users u  (cost=1.25 rows=1)
+                          Index Cond: (u.id = o.user_id)
+                          Columns: id, name, age
+                          Filter: (u.age = 30)`,
+		},
+		{
+			source: "EXPLAIN SELECT name FROM users WHERE id = 2 AND age > 1;",
+			plan: `Project  (cost=1.50 rows=1)
+  Output: name
+  ->  Index Scan using users_pkey on users  (cost=1.25 rows=1)
+        Index Cond: (id = 2)
+        Columns: id, name, age
+        Filter: (age > 1)`,
+		},
+		{
+			source: "EXPLAIN SELECT age, count(*) FROM users, orders WHERE users.age < orders.total GROUP BY age;",
+			plan: `Project  (cost=25.50 rows=4)
+  Output: users.age, count(*)
+  ->  Hash Aggregate  (cost=23.50 rows=4)
+        Group Key: users.age
+        ->  Nested Loop  (cost=17.00 rows=5)
+              Join Filter: (users.age < orders.total)
+              ->  Seq Scan on orders  (cost=4.00 rows=4)
+                    Columns: total
+              ->  Seq Scan on users  (cost=4.00 rows=4)
+                    Columns: age`,
+		},
+		{
+			source: "EXPLAIN SELECT 1;",
+			plan: `Project  (cost=0.25 rows=1)
+  Output: 1
+  ->  Result  (cost=0.00 rows=1)`,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.plan, explain(t, mb, test.source), test.source)
+	}
+}
+
+func TestExplainAnalyze(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, planSchema))
+
+	// Times vary from run to run
+	times := regexp.MustCompile(`[0-9]+\.[0-9]{3} ms`)
+	plan := times.ReplaceAllString(explain(t, mb, `EXPLAIN ANALYZE SELECT u.name FROM orders o
+		JOIN users u ON u.id = o.user_id WHERE o.total > 4 ORDER BY u.name LIMIT 5;`), "T ms")
+	assert.Equal(t, `Limit  (cost=7.25 rows=1) (actual time=T ms rows=2 loops=1 memory=52B)
+  Limit: 5
+  ->  Project  (cost=7.25 rows=1) (actual time=T ms rows=2 loops=1 memory=52B)
+        Output: u.name
+        ->  Sort  (cost=7.00 rows=1) (actual time=T ms rows=2 loops=1 memory=464B)
+              Sort Key: u.name
+              ->  Nested Loop  (cost=7.00 rows=1) (actual time=T ms rows=2 loops=1 memory=136B)
+                    ->  Seq Scan on orders o  (cost=5.00 rows=1) (actual time=T ms rows=3 loops=1 memory=80B)
+                          Columns: user_id, total
+                          Filter: (o.total > 4)
+                    ->  Index Scan using users_pkey on users u  (cost=1.00 rows=1) (actual time=T ms rows=1 loops=3 memory=80B)
+                          Index Cond: (u.id = o.user_id)
+                          Columns: id, name
+Planning Time: T ms
+Execution Time: T ms`, plan)
+
+	// Nodes whose rows aren't needed don't run, and scans stop once LIMIT
+	// has enough rows
+	plan = explain(t, mb, "EXPLAIN ANALYZE SELECT name FROM users LIMIT 0;")
+	assert.Contains(t, plan, "Seq Scan on users  (cost=4.00 rows=4) (never executed)")
+	plan = explain(t, mb, "EXPLAIN ANALYZE SELECT name FROM users WHERE age > 20 LIMIT 1;")
+	assert.Regexp(t, `Seq Scan on users  \(cost=5\.00 rows=1\) \(actual time=\S+ ms rows=1 loops=1`, plan)
+
+	var out []struct {
+		Plan struct {
+			Node        string
+			ActualRows  float64 `json:"Actual Rows"`
+			ActualLoops int64   `json:"Actual Loops"`
+			Plans       []struct {
+				Node string
+				Rows float64 `json:"Plan Rows"`
+			}
+		}
+		ExecutionTime *float64 `json:"Execution Time"`
+	}
+	source := "EXPLAIN (ANALYZE, FORMAT JSON) SELECT age, count(*) FROM users GROUP BY age;"
+	assert.Nil(t, json.Unmarshal([]byte(explain(t, mb, source)), &out))
+	assert.Len(t, out, 1)
+	assert.Equal(t, "Project", out[0].Plan.Node)
+	assert.Equal(t, 3.0, out[0].Plan.ActualRows)
+	assert.Equal(t, int64(1), out[0].Plan.ActualLoops)
+	assert.Equal(t, "Hash Aggregate", out[0].Plan.Plans[0].Node)
+	assert.NotNil(t, out[0].ExecutionTime)
+
+	// Conditions are not HTML-escaped
+	filtered := explain(t, mb, "EXPLAIN (FORMAT JSON) SELECT name FROM users WHERE age > 1 AND age <> 3;")
+	assert.Contains(t, filtered, "(age > 1)")
+	assert.Contains(t, filtered, "<>")
+	assert.NotContains(t, filtered, `\u003`)
+
+	// Without ANALYZE nothing runs
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE s;"))
+	assert.NotContains(t, explain(t, mb, "EXPLAIN (FORMAT JSON) SELECT nextval('s');"), "Actual")
+	rows, err := query(t, mb, "SELECT nextval('s');")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{int64(1)}}, rows)
+}
+
+func TestSelectRows(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, planSchema))
+
+	asts, err := parser.Parse("SELECT id, 10 / (id - 3) FROM users ORDER BY id;")
+	assert.Nil(t, err)
+	rows, err := mb.Select(context.Background(), asts.Statements[0].SelectStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, []Column{{Type: IntType, Name: "id"}, {Type: IntType, Name: "?column?"}}, rows.Columns())
+
+	// Rows come one at a time, until one fails
+	var ids []int32
+	for rows.Next() {
+		id, err := rows.Row()[0].AsInt()
+		assert.Nil(t, err)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []int32{1, 2}, ids)
+	assert.ErrorIs(t, rows.Err(), ErrDivisionByZero)
+	assert.Nil(t, rows.Close())
+
+	// Closing early stops the query
+	rows, err = mb.Select(context.Background(), asts.Statements[0].SelectStatement)
+	assert.Nil(t, err)
+	assert.True(t, rows.Next())
+	assert.Nil(t, rows.Close())
+	assert.False(t, rows.Next())
+	assert.Nil(t, rows.Err())
+}
+
+func TestSelectCanceled(t *testing.T) {
+	mb := NewMemoryBacked()
+	eventsSchema(t, mb, 5000, "row")
+
+	// selectErr runs a SELECT to the end of its rows, with ctx
+	selectErr := func(ctx context.Context, source string) error {
+		asts, err := parser.Parse(source)
+		assert.Nil(t, err, source)
+		rows, err := mb.Select(ctx, asts.Statements[0].SelectStatement)
+		if err != nil {
+			return err
+		}
+		_, err = Collect(rows)
+		return err
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	for _, source := range []string{
+		"SELECT id FROM events;",
+		"SELECT kind, count(*) FROM events GROUP BY kind;",
+		"SELECT e.id FROM events e JOIN events f ON e.id = f.user_id ORDER BY e.id;",
+	} {
+		err := selectErr(canceled, source)
+		assert.ErrorIs(t, err, ErrQueryCanceled, source)
+		assert.ErrorIs(t, err, context.Canceled, source)
+		assert.Equal(t, "canceling statement due to user request", err.Error())
+		err = selectErr(expired, source)
+		assert.ErrorIs(t, err, ErrStatementTimeout, source)
+		assert.ErrorIs(t, err, context.DeadlineExceeded, source)
+	}
+
+	// Rows computed in advance end too
+	ctx, cancel := context.WithCancel(context.Background())
+	asts, err := parser.Parse("SELECT id FROM events ORDER BY amount;")
+	assert.Nil(t, err)
+	rows, err := mb.Select(ctx, asts.Statements[0].SelectStatement)
+	assert.Nil(t, err)
+	assert.True(t, rows.Next())
+	cancel()
+	assert.False(t, rows.Next())
+	assert.ErrorIs(t, rows.Err(), ErrQueryCanceled)
+	assert.Nil(t, rows.Close())
+
+	// A query that would take long, in parallel or not, stops soon after
+	for _, workers := range []int{0, 2} {
+		settings := WithSettings(context.Background(), Settings{MaxParallelWorkers: workers})
+		ctx, cancel := context.WithTimeout(settings, 20*time.Millisecond)
+		start := time.Now()
+		err := selectErr(ctx, "SELECT count(*) FROM events e, events f, events g WHERE e.amount + f.amount = g.amount;")
+		cancel()
+		assert.ErrorIs(t, err, ErrStatementTimeout)
+		assert.Less(t, time.Since(start), 2*time.Second)
+	}
+}
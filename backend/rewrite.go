@@ -0,0 +1,222 @@
+package backend
+
+// optimize rewrites a logical plan into one with the same results that is
+// cheaper to run: constants are folded, conditions are moved down to the
+// tables they read, and scans only read the columns that are used.
+func optimize(plan logicalPlan) logicalPlan {
+	plan = foldPlan(plan)
+	plan = pushDown(plan)
+	prune(plan, nil)
+	return plan
+}
+
+// foldPlan folds the constants of every expression of plan, and drops the
+// conditions that are always true.
+func foldPlan(plan logicalPlan) logicalPlan {
+	switch n := plan.(type) {
+	case *filterNode:
+		n.input = foldPlan(n.input)
+		n.conds = foldConds(n.conds)
+		if len(n.conds) == 0 {
+			return n.input
+		}
+	case *joinNode:
+		n.left = foldPlan(n.left)
+		n.right = foldPlan(n.right)
+		n.conds = foldConds(n.conds)
+	case *aggregateNode:
+		n.input = foldPlan(n.input)
+		for _, agg := range n.aggs {
+			foldArgs(agg)
+		}
+	case *sortNode:
+		n.input = foldPlan(n.input)
+		for i := range n.keys {
+			n.keys[i].e = fold(n.keys[i].e)
+		}
+	case *projectNode:
+		n.input = foldPlan(n.input)
+		for i, e := range n.exprs {
+			n.exprs[i] = fold(e)
+		}
+	case *limitNode:
+		n.input = foldPlan(n.input)
+	}
+	return plan
+}
+
+func foldConds(conds []*expr) []*expr {
+	var folded []*expr
+	for _, c := range conds {
+		for _, c := range conjuncts(fold(c)) {
+			if c.kind == constExpr && c.value.isTrue() {
+				continue
+			}
+			folded = append(folded, c)
+		}
+	}
+	return folded
+}
+
+func foldArgs(e *expr) {
+	for i, arg := range e.args {
+		e.args[i] = fold(arg)
+	}
+}
+
+// fold evaluates the parts of e that don't depend on any row. Function
+// calls are never folded, since nextval returns a new value every time.
+func fold(e *expr) *expr {
+	switch e.kind {
+	case binaryExpr, unaryExpr, isNullExpr:
+	default:
+		return e
+	}
+	foldArgs(e)
+
+	constant := true
+	for _, arg := range e.args {
+		constant = constant && arg.kind == constExpr
+	}
+	if constant {
+		v, err := evalConst(e)
+		if err != nil {
+			// Left for the query to fail when it runs, like 1 / 0
+			return e
+		}
+		return &expr{kind: constExpr, typ: e.typ, value: v}
+	}
+
+	// x AND true is x, x OR false is x, and x AND false is false
+	if e.kind == binaryExpr && (e.op == "AND" || e.op == "OR") {
+		for i, arg := range e.args {
+			if arg.kind != constExpr || arg.value == nil {
+				continue
+			}
+			other := e.args[1-i]
+			if arg.value.isTrue() == (e.op == "AND") {
+				return other
+			}
+			return arg
+		}
+	}
+	return e
+}
+
+// evalConst evaluates an expression without columns.
+func evalConst(e *expr) (MemoryCell, error) {
+	ev, err := (*MemoryBackend)(nil).compileExpr(e, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ev(nil)
+}
+
+// pushDown moves the conditions of filters and joins as far down the plan
+// as the columns they read allow, so that rows are dropped as early as
+// possible. Conditions on a single side of a join go below it, and those
+// comparing both sides become conditions of the join.
+func pushDown(plan logicalPlan) logicalPlan {
+	switch n := plan.(type) {
+	case *filterNode:
+		return pushFilter(pushDown(n.input), n.conds)
+	case *joinNode:
+		n.left = pushDown(n.left)
+		n.right = pushDown(n.right)
+		conds := n.conds
+		n.conds = nil
+		return pushFilter(n, conds)
+	case *aggregateNode:
+		n.input = pushDown(n.input)
+	case *sortNode:
+		n.input = pushDown(n.input)
+	case *projectNode:
+		n.input = pushDown(n.input)
+	case *limitNode:
+		n.input = pushDown(n.input)
+	}
+	return plan
+}
+
+// pushFilter filters the rows of plan by conds, as deep in plan as
+// possible.
+func pushFilter(plan logicalPlan, conds []*expr) logicalPlan {
+	if len(conds) == 0 {
+		return plan
+	}
+	switch n := plan.(type) {
+	case *filterNode:
+		return pushFilter(n.input, append(n.conds, conds...))
+	case *joinNode:
+		var left, right []*expr
+		for _, c := range conds {
+			switch {
+			case c.volatile():
+				// Keep calls like nextval where they were written
+				n.conds = append(n.conds, c)
+			case covers(n.left, c):
+				left = append(left, c)
+			case covers(n.right, c):
+				right = append(right, c)
+			default:
+				n.conds = append(n.conds, c)
+			}
+		}
+		n.left = pushFilter(n.left, left)
+		n.right = pushFilter(n.right, right)
+		return n
+	}
+	return &filterNode{input: plan, conds: conds}
+}
+
+// covers tells whether plan outputs all the columns e reads.
+func covers(plan logicalPlan, e *expr) bool {
+	used := map[columnID]bool{}
+	e.columns(used)
+	return coversSchema(plan.schema(), used)
+}
+
+// prune makes the scans under plan read only the columns that plan, and
+// what is above it, requires.
+func prune(plan logicalPlan, required map[columnID]bool) {
+	switch n := plan.(type) {
+	case *scanNode:
+		var columns []int
+		for _, c := range n.columns {
+			if required[columnID{n.rel, c}] {
+				columns = append(columns, c)
+			}
+		}
+		n.columns = columns
+	case *filterNode:
+		prune(n.input, with(required, n.conds))
+	case *joinNode:
+		required = with(required, n.conds)
+		prune(n.left, required)
+		prune(n.right, required)
+	case *aggregateNode:
+		prune(n.input, with(with(nil, n.groups), n.aggs))
+	case *sortNode:
+		var keys []*expr
+		for _, k := range n.keys {
+			keys = append(keys, k.e)
+		}
+		prune(n.input, with(required, keys))
+	case *projectNode:
+		prune(n.input, with(nil, n.exprs))
+	case *limitNode:
+		prune(n.input, required)
+	}
+}
+
+// with returns the columns of required and those read by exprs.
+func with(required map[columnID]bool, exprs []*expr) map[columnID]bool {
+	ids := map[columnID]bool{}
+	for id := range required {
+		ids[id] = true
+	}
+	for _, e := range exprs {
+		e.columns(ids)
+	}
+	return ids
+}
@@ -0,0 +1,125 @@
+package backend
+
+import "context"
+
+// Rows iterates over the rows of a query, which are computed as they are
+// read, so that a client can stop early without the rest being computed:
+//
+//	for rows.Next() {
+//		row := rows.Row()
+//		...
+//	}
+//	if err := rows.Err(); err != nil {
+//		...
+//	}
+//
+// Row returns the current row, valid until the next call of Next. Err
+// returns the error that ended the iteration, nil at the end of the rows.
+// Close must be called when done, even after an error, and stops the
+// iteration.
+type Rows interface {
+	Columns() []Column
+	Next() bool
+	Row() []Cell
+	Err() error
+	Close() error
+}
+
+// ResultsRows iterates over results computed in advance.
+func ResultsRows(results *Results) Rows {
+	return &resultsRows{results: results}
+}
+
+type resultsRows struct {
+	results *Results
+	next    int
+	row     []Cell
+}
+
+func (r *resultsRows) Columns() []Column { return r.results.Columns }
+
+func (r *resultsRows) Next() bool {
+	if r.next >= len(r.results.Rows) {
+		r.row = nil
+		return false
+	}
+	r.row = r.results.Rows[r.next]
+	r.next++
+	return true
+}
+
+func (r *resultsRows) Row() []Cell { return r.row }
+
+func (r *resultsRows) Err() error { return nil }
+
+func (r *resultsRows) Close() error {
+	r.next = len(r.results.Rows)
+	return nil
+}
+
+// Collect reads the remaining rows into Results, and closes rows.
+func Collect(rows Rows) (*Results, error) {
+	defer rows.Close()
+	results := &Results{Columns: rows.Columns(), Rows: [][]Cell{}}
+	for rows.Next() {
+		results.Rows = append(results.Rows, append([]Cell(nil), rows.Row()...))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return results, rows.Close()
+}
+
+// planRows are the rows of a running plan. They end once ctx is done,
+// even those that the plan computed before, like the rows of a sort.
+type planRows struct {
+	ctx     context.Context
+	columns []Column
+	it      rowIterator
+	row     []Cell
+	err     error
+	// onClose runs once, when the rows are closed
+	onClose func() error
+}
+
+func (r *planRows) Columns() []Column { return r.columns }
+
+func (r *planRows) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.err = ContextErr(r.ctx); r.err != nil {
+		return false
+	}
+	if !r.it.Next() {
+		return false
+	}
+	cells := r.it.Row()
+	if r.row == nil {
+		r.row = make([]Cell, len(cells))
+	}
+	for i, cell := range cells {
+		r.row[i] = cell
+	}
+	return true
+}
+
+func (r *planRows) Row() []Cell { return r.row }
+
+func (r *planRows) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.it.Err()
+}
+
+func (r *planRows) Close() error {
+	err := r.it.Close()
+	if r.onClose != nil {
+		if closeErr := r.onClose(); err == nil {
+			err = closeErr
+		}
+		r.onClose = nil
+	}
+	return err
+}
@@ -0,0 +1,314 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/nanjingblue/maydb/token"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sequence generates integers, for surrogate keys. Last is the value last
+// returned by nextval or given to setval, and Called is false until then,
+// when nextval returns Start. MaxValue, when not 0, is the largest value
+// nextval returns.
+type Sequence struct {
+	Name      string
+	Start     int64
+	Increment int64
+	MaxValue  int64
+	Last      int64
+	Called    bool
+}
+
+// serialSequence names the sequence behind a SERIAL column, like
+// PostgreSQL does.
+func serialSequence(table, column string) string {
+	return table + "_" + column + "_seq"
+}
+
+func (mb *MemoryBackend) CreateSequence(cs *ast.CreateSequenceStatement) error {
+	seq := Sequence{Name: cs.Name.Value, Start: 1, Increment: 1}
+	for _, n := range []struct {
+		t     *token.Token
+		value *int64
+	}{{cs.Start, &seq.Start}, {cs.Increment, &seq.Increment}, {cs.MaxValue, &seq.MaxValue}} {
+		if n.t == nil {
+			continue
+		}
+		v, err := strconv.ParseInt(n.t.Value, 10, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			return fmt.Errorf("%w: %s", ErrIntegerOutOfRange, n.t.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s is not an integer", ErrTypeMismatch, n.t.Value)
+		}
+		*n.value = v
+	}
+	if seq.Increment == 0 {
+		return ErrInvalidIncrement
+	}
+
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	return mb.addSequence(seq)
+}
+
+// addSequence must be called with seqMu held.
+func (mb *MemoryBackend) addSequence(seq Sequence) error {
+	if _, ok := mb.Sequences[seq.Name]; ok {
+		return fmt.Errorf("%w: %s", ErrSequenceAlreadyExists, seq.Name)
+	}
+	mb.Sequences[seq.Name] = &seq
+	return nil
+}
+
+// ListSequences returns a copy of every sequence, sorted by name.
+func (mb *MemoryBackend) ListSequences() ([]Sequence, error) {
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+
+	seqs := []Sequence{}
+	for _, seq := range mb.Sequences {
+		seqs = append(seqs, *seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i].Name < seqs[j].Name })
+	return seqs, nil
+}
+
+// sequenceChanges returns the number of times sequences were advanced or
+// set.
+func (mb *MemoryBackend) sequenceChanges() uint64 {
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	return mb.seqChanges
+}
+
+// sequence must be called with seqMu held.
+func (mb *MemoryBackend) sequence(name string) (*Sequence, error) {
+	seq, ok := mb.Sequences[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrSequenceDoesNotExist, name)
+	}
+	return seq, nil
+}
+
+// nextval advances the sequence and returns its new value. Like in
+// PostgreSQL, this is never undone, not even by Rollback.
+func (mb *MemoryBackend) nextval(name string) (int64, error) {
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+
+	seq, err := mb.sequence(name)
+	if err != nil {
+		return 0, err
+	}
+	next := seq.Start
+	if seq.Called {
+		next = seq.Last + seq.Increment
+		if (seq.Increment > 0) != (next > seq.Last) {
+			return 0, fmt.Errorf("%w: %s", ErrSequenceExhausted, name)
+		}
+	}
+	if seq.MaxValue != 0 && next > seq.MaxValue {
+		return 0, fmt.Errorf("%w: %s (%d)", ErrSequenceMaxValue, name, seq.MaxValue)
+	}
+	mb.seqChanges++
+	seq.Last = next
+	seq.Called = true
+	return seq.Last, nil
+}
+
+// currval returns the value last returned by nextval. It is shared by all
+// users of the backend, rather than kept per session as in PostgreSQL.
+func (mb *MemoryBackend) currval(name string) (int64, error) {
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+
+	seq, err := mb.sequence(name)
+	if err != nil {
+		return 0, err
+	}
+	if !seq.Called {
+		return 0, fmt.Errorf("%w: %s", ErrCurrvalNotDefined, name)
+	}
+	return seq.Last, nil
+}
+
+// setval makes the next nextval return value + increment.
+func (mb *MemoryBackend) setval(name string, value int64) (int64, error) {
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+
+	seq, err := mb.sequence(name)
+	if err != nil {
+		return 0, err
+	}
+	mb.seqChanges++
+	seq.Last = value
+	seq.Called = true
+	return value, nil
+}
+
+// callArgs checks a call to one of the sequence functions and returns the
+// sequence name and, for setval, the value.
+func callArgs(exp *ast.Expression) (string, int64, error) {
+	name := exp.Literal.Value
+	arity := 1
+	switch name {
+	case "nextval", "currval":
+	case "setval":
+		arity = 2
+	default:
+		return "", 0, fmt.Errorf("%w: %s", ErrUndefinedFunction, name)
+	}
+
+	args := exp.Args
+	if len(args) != arity || args[0].Kind != ast.LiteralKind || args[0].Literal.Kind != token.StringKind {
+		return "", 0, fmt.Errorf("%w: %s", ErrUndefinedFunction, signature(exp))
+	}
+	if arity == 1 {
+		return args[0].Literal.Value, 0, nil
+	}
+
+	if args[1].Kind != ast.LiteralKind || args[1].Literal.Kind != token.NumericKind {
+		return "", 0, fmt.Errorf("%w: %s", ErrUndefinedFunction, signature(exp))
+	}
+	v, err := strconv.ParseInt(args[1].Literal.Value, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return "", 0, fmt.Errorf("%w: %s", ErrIntegerOutOfRange, args[1].Literal.Value)
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: %s is not an integer", ErrTypeMismatch, args[1].Literal.Value)
+	}
+	return args[0].Literal.Value, v, nil
+}
+
+// signature renders a call the way it is shown in errors, like
+// nextval(int).
+func signature(exp *ast.Expression) string {
+	var types []string
+	for _, arg := range exp.Args {
+		t := "unknown"
+		if arg.Kind == ast.LiteralKind {
+			switch arg.Literal.Kind {
+			case token.StringKind:
+				t = "text"
+			case token.NumericKind:
+				t = "int"
+			}
+		}
+		types = append(types, t)
+	}
+	return exp.Literal.Value + "(" + strings.Join(types, ", ") + ")"
+}
+
+// call evaluates a function call. All functions return integers.
+func (mb *MemoryBackend) call(exp *ast.Expression) (int64, error) {
+	name, value, err := callArgs(exp)
+	if err != nil {
+		return 0, err
+	}
+	switch exp.Literal.Value {
+	case "nextval":
+		return mb.nextval(name)
+	case "currval":
+		return mb.currval(name)
+	}
+	return mb.setval(name, value)
+}
+
+// evaluate returns the value of an expression without columns, like a
+// VALUES item or a default, as a cell of type ct.
+func (mb *MemoryBackend) evaluate(exp *ast.Expression, ct ColumnType) (MemoryCell, error) {
+	e, err := (&binder{mb: mb}).bind(exp)
+	if err != nil {
+		return nil, err
+	}
+	if e.isNull() {
+		return nil, nil
+	}
+	if e.typ != ct {
+		return nil, ErrTypeMismatch
+	}
+	ev, err := mb.compileExpr(e, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ev(nil)
+}
+
+// checkDefault checks the DEFAULT of a column of type ct, without calling
+// it. Function calls must name an existing sequence, unless it is in
+// pending.
+func (mb *MemoryBackend) checkDefault(exp *ast.Expression, ct ColumnType, pending map[string]bool) error {
+	if exp.Kind != ast.FunctionKind {
+		_, err := literalCell(exp.Literal, ct)
+		return err
+	}
+
+	name, _, err := callArgs(exp)
+	if err != nil {
+		return err
+	}
+	if ct != IntType {
+		return ErrTypeMismatch
+	}
+	if pending[name] {
+		return nil
+	}
+	mb.seqMu.Lock()
+	defer mb.seqMu.Unlock()
+	_, err = mb.sequence(name)
+	return err
+}
+
+// defaultCell evaluates the default of column i of t, calling nextval for
+// SERIAL columns.
+func (mb *MemoryBackend) defaultCell(t *Table, i int) (MemoryCell, error) {
+	if i >= len(t.Defaults) || t.Defaults[i] == "" {
+		return nil, nil
+	}
+	if t.defaults == nil {
+		t.defaults = make([]*ast.Expression, len(t.Columns))
+	}
+	if t.defaults[i] == nil {
+		exp, err := parser.ParseExpression(t.Defaults[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w: default of %s", ErrInvalidCell, t.Columns[i])
+		}
+		t.defaults[i] = exp
+	}
+	return mb.evaluate(t.defaults[i], t.ColumnTypes[i])
+}
+
+// fillDefaults sets the columns of row that were not given to their
+// defaults.
+func (mb *MemoryBackend) fillDefaults(t *Table, row []MemoryCell, given []bool) error {
+	for i := range row {
+		if given[i] {
+			continue
+		}
+		cell, err := mb.defaultCell(t, i)
+		if err != nil {
+			return err
+		}
+		row[i] = cell
+	}
+	return nil
+}
+
+// sqlExpression renders a literal or a function call as SQL, "" for NULL.
+func sqlExpression(exp *ast.Expression) string {
+	if exp.Kind != ast.FunctionKind {
+		return sqlLiteral(exp.Literal)
+	}
+	var args []string
+	for _, arg := range exp.Args {
+		args = append(args, sqlExpression(arg))
+	}
+	return exp.Literal.Value + "(" + strings.Join(args, ", ") + ")"
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func selectValue(t *testing.T, mb *MemoryBackend, source string) (int32, error) {
+	asts, err := parser.Parse(source)
+	assert.Nil(t, err, source)
+	results, err := selectAll(mb, asts.Statements[0].SelectStatement)
+	if err != nil {
+		return 0, err
+	}
+	return results.Rows[0][0].AsInt()
+}
+
+func TestSerial(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, `CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT);
+		INSERT INTO users (name) VALUES ('a'), ('b');
+		INSERT INTO users VALUES (10, 'c');
+		INSERT INTO users (name) SELECT name FROM users;`))
+
+	assert.Equal(t, [][]interface{}{
+		{int64(1), "a"},
+		{int64(2), "b"},
+		{int64(10), "c"},
+		{int64(3), "a"},
+		{int64(4), "b"},
+		{int64(5), "c"},
+	}, tableValues(t, mb.Tables["users"]))
+
+	def, err := mb.DescribeTable("users")
+	assert.Nil(t, err)
+	assert.Equal(t, Column{Type: IntType, Name: "id", NotNull: true, Default: "nextval('users_id_seq')"}, def.Columns[0])
+
+	// Explicit values don't use up the sequence
+	n, err := selectValue(t, mb, "SELECT currval('users_id_seq');")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(5), n)
+
+	// The sequence stops at the largest INT
+	_, err = selectValue(t, mb, "SELECT setval('users_id_seq', 2147483646);")
+	assert.Nil(t, err)
+	assert.Nil(t, execAll(t, mb, "INSERT INTO users (name) VALUES ('d');"))
+	err = execAll(t, mb, "INSERT INTO users (name) VALUES ('e');")
+	assert.ErrorIs(t, err, ErrSequenceMaxValue)
+	assert.EqualError(t, err, "reached maximum value of sequence: users_id_seq (2147483647)")
+
+	assert.ErrorIs(t, execAll(t, mb, "CREATE TABLE users2 (id BIGSERIAL DEFAULT 1);"), ErrMultipleDefaults)
+	assert.ErrorIs(t, execAll(t, mb, "CREATE SEQUENCE other_id_seq; CREATE TABLE other (id SERIAL);"), ErrSequenceAlreadyExists)
+	_, ok := mb.Tables["other"]
+	assert.False(t, ok)
+}
+
+func TestSequenceFunctions(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE down START WITH 10 INCREMENT BY -5;"))
+
+	_, err := selectValue(t, mb, "SELECT currval('down');")
+	assert.ErrorIs(t, err, ErrCurrvalNotDefined)
+
+	for _, want := range []int32{10, 5, 0} {
+		n, err := selectValue(t, mb, "SELECT nextval('down');")
+		assert.Nil(t, err)
+		assert.Equal(t, want, n)
+	}
+
+	n, err := selectValue(t, mb, "SELECT setval('down', 100);")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(100), n)
+	n, err = selectValue(t, mb, "SELECT nextval('down');")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(95), n)
+
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE few MAXVALUE 2;"))
+	for _, want := range []int32{1, 2} {
+		n, err := selectValue(t, mb, "SELECT nextval('few');")
+		assert.Nil(t, err)
+		assert.Equal(t, want, n)
+	}
+	_, err = selectValue(t, mb, "SELECT nextval('few');")
+	assert.ErrorIs(t, err, ErrSequenceMaxValue)
+	n, err = selectValue(t, mb, "SELECT currval('few');")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), n)
+
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{source: "SELECT nextval('nope');", err: ErrSequenceDoesNotExist},
+		{source: "SELECT nextval(1);", err: ErrUndefinedFunction},
+		{source: "SELECT lower('x');", err: ErrUndefinedFunction},
+		{source: "SELECT setval('down', 'x');", err: ErrUndefinedFunction},
+		{source: "SELECT id;", err: ErrColumnDoesNotExist},
+		{source: "CREATE SEQUENCE down;", err: ErrSequenceAlreadyExists},
+		{source: "CREATE SEQUENCE zero INCREMENT 0;", err: ErrInvalidIncrement},
+		{source: "CREATE TABLE t (id INT DEFAULT nextval('nope'));", err: ErrSequenceDoesNotExist},
+		{source: "CREATE TABLE t (id TEXT DEFAULT nextval('down'));", err: ErrTypeMismatch},
+		{source: "CREATE TABLE t (id INT); INSERT INTO t VALUES (nextval('nope'));", err: ErrSequenceDoesNotExist},
+	}
+	for _, test := range tests {
+		assert.ErrorIs(t, execAll(t, mb, test.source), test.err, test.source)
+	}
+}
+
+func TestSequenceConcurrent(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE ids;"))
+
+	var wg sync.WaitGroup
+	values := make([][]int64, 8)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				v, err := mb.nextval("ids")
+				assert.Nil(t, err)
+				values[i] = append(values[i], v)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{}
+	for _, vs := range values {
+		for _, v := range vs {
+			assert.False(t, seen[v], v)
+			seen[v] = true
+		}
+	}
+	assert.Equal(t, 800, len(seen))
+}
+
+func TestSequenceRollback(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE kept;"))
+
+	assert.Nil(t, mb.Begin())
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE dropped; SELECT nextval('kept');"))
+	assert.Nil(t, mb.Rollback())
+
+	seqs, err := mb.ListSequences()
+	assert.Nil(t, err)
+	assert.Equal(t, []Sequence{{Name: "kept", Start: 1, Increment: 1, Last: 1, Called: true}}, seqs)
+}
@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrUnknownSetting = errors.New("unrecognized configuration parameter")
+	ErrInvalidSetting = errors.New("invalid value for parameter")
+)
+
+// Settings change how the statements of a session run. Sessions change
+// theirs with SET, and pass them to the backend with each statement, in
+// its context.
+type Settings struct {
+	// MaxParallelWorkers is the most goroutines a query runs on at once,
+	// 0 or 1 running it on a single one.
+	MaxParallelWorkers int
+	// WorkMem is the most bytes of memory a sort, aggregate or hash join
+	// holds before it spills to temporary files, 0 for no limit.
+	WorkMem int64
+	// StatementTimeout is how long a statement may run, its rows being
+	// read included, before it is canceled, 0 for no limit.
+	StatementTimeout time.Duration
+}
+
+// DefaultSettings are the settings sessions start with.
+func DefaultSettings() Settings {
+	return Settings{MaxParallelWorkers: 2, WorkMem: 4 << 20}
+}
+
+type settingsKey struct{}
+
+// WithSettings returns a copy of ctx that makes the statements run with it
+// follow settings, rather than DefaultSettings.
+func WithSettings(ctx context.Context, settings Settings) context.Context {
+	return context.WithValue(ctx, settingsKey{}, settings)
+}
+
+// settingsOf returns the settings the statements run with ctx follow.
+func settingsOf(ctx context.Context) Settings {
+	if settings, ok := ctx.Value(settingsKey{}).(Settings); ok {
+		return settings
+	}
+	return DefaultSettings()
+}
+
+// setting is a field of Settings as SET and SHOW name it.
+type setting struct {
+	name string
+	get  func(*Settings) string
+	set  func(*Settings, string) error
+}
+
+var settings = []setting{
+	{
+		name: "max_parallel_workers",
+		get:  func(s *Settings) string { return strconv.Itoa(s.MaxParallelWorkers) },
+		set: func(s *Settings, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > 1024 {
+				return fmt.Errorf("%w max_parallel_workers: %q, must be an integer from 0 to 1024", ErrInvalidSetting, value)
+			}
+			s.MaxParallelWorkers = n
+			return nil
+		},
+	},
+	{
+		name: "work_mem",
+		get:  func(s *Settings) string { return formatSize(s.WorkMem) },
+		set: func(s *Settings, value string) error {
+			// Plain numbers are kilobytes, as in PostgreSQL
+			if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+				value += "kB"
+			}
+			n, err := parseSize(value)
+			if err != nil || n < 64<<10 {
+				return fmt.Errorf("%w work_mem: %q, must be a size of at least 64kB", ErrInvalidSetting, value)
+			}
+			s.WorkMem = n
+			return nil
+		},
+	},
+	{
+		name: "statement_timeout",
+		get:  func(s *Settings) string { return formatDuration(s.StatementTimeout) },
+		set: func(s *Settings, value string) error {
+			d, err := parseDuration(value)
+			if err != nil {
+				return fmt.Errorf("%w statement_timeout: %q, must be a duration such as 500ms, 30s or 5min", ErrInvalidSetting, value)
+			}
+			s.StatementTimeout = d
+			return nil
+		},
+	},
+}
+
+// durationUnits are the units of durations settings take, from the
+// largest.
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"min", time.Minute}, {"s", time.Second}, {"ms", time.Millisecond}}
+
+// parseDuration parses a number of milliseconds, or of one of
+// durationUnits, as PostgreSQL does.
+func parseDuration(s string) (time.Duration, error) {
+	n, unit := strings.TrimRightFunc(s, unicode.IsLetter), time.Millisecond
+	if suffix := s[len(n):]; suffix != "" {
+		unit = 0
+		for _, u := range durationUnits {
+			if u.suffix == suffix {
+				unit = u.unit
+			}
+		}
+		if unit == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	d, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+	if err != nil || d < 0 || d > int64(math.MaxInt64/unit) {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return time.Duration(d) * unit, nil
+}
+
+// formatDuration writes a duration in the largest unit of durationUnits
+// that divides it.
+func formatDuration(d time.Duration) string {
+	for _, u := range durationUnits {
+		if d != 0 && d%u.unit == 0 {
+			return strconv.FormatInt(int64(d/u.unit), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// formatSize writes a number of bytes in the largest unit of parseSize that
+// divides it.
+func formatSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"kB", 1 << 10}} {
+		if n != 0 && n%unit.size == 0 {
+			return strconv.FormatInt(n/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10) + "B"
+}
+
+func findSetting(name string) (*setting, error) {
+	for i := range settings {
+		if settings[i].name == name {
+			return &settings[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownSetting, name)
+}
+
+// SettingNames lists the names of the settings, in the order SHOW ALL
+// shows them.
+func SettingNames() []string {
+	var names []string
+	for _, st := range settings {
+		names = append(names, st.name)
+	}
+	return names
+}
+
+// Set changes the setting name to value.
+func (s *Settings) Set(name, value string) error {
+	st, err := findSetting(name)
+	if err != nil {
+		return err
+	}
+	return st.set(s, value)
+}
+
+// Reset gives the setting name back its default value.
+func (s *Settings) Reset(name string) error {
+	st, err := findSetting(name)
+	if err != nil {
+		return err
+	}
+	def := DefaultSettings()
+	return st.set(s, st.get(&def))
+}
+
+// Show returns the value of the setting name, as SET takes it.
+func (s *Settings) Show(name string) (string, error) {
+	st, err := findSetting(name)
+	if err != nil {
+		return "", err
+	}
+	return st.get(s), nil
+}
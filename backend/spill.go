@@ -0,0 +1,780 @@
+package backend
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sorts, aggregates and hash joins hold up to work_mem bytes of rows, then
+// spill them to temporary files, which they remove once their iterator is
+// closed, whether all their rows were read or not, or when they fail.
+//
+// A sort writes sorted runs of rows, then merges them, sortFanIn runs at a
+// time. An aggregate writes the states of its groups to spillPartitions
+// partitions by their GROUP BY values, then merges the states of each
+// partition in turn. A hash join whose right side outgrows work_mem
+// partitions both sides by their keys, then joins each partition in turn,
+// as a grace hash join does. Partitions that still outgrow work_mem are
+// partitioned again, up to maxSpillDepth times.
+
+const (
+	sortFanIn       = 64
+	spillPartitions = 16
+	maxSpillDepth   = 4
+)
+
+// workMem is the memory an operator may hold, as Settings.WorkMem, and the
+// directory it spills to.
+type workMem struct {
+	limit int64
+	dir   string
+}
+
+func (pp *physicalPlanner) workMem() workMem {
+	return workMem{limit: pp.settings.WorkMem, dir: pp.mb.tempDir}
+}
+
+// exceeded tells whether holding size bytes is more than allowed.
+func (m workMem) exceeded(size int64) bool {
+	return m.limit > 0 && size > m.limit
+}
+
+// spilled records that the current run of an instrumented node wrote bytes
+// to temporary files.
+func (e *estimated) spilled(bytes int64) {
+	if e.actual != nil {
+		e.actual.disk += bytes
+	}
+}
+
+// removeSpill removes files, recording what was written to them.
+func (e *estimated) removeSpill(files *spillFiles) error {
+	n, err := files.remove()
+	e.spilled(n)
+	return err
+}
+
+// spillFiles are the temporary files of a run of an operator, which the
+// goroutines of a parallel plan may share.
+type spillFiles struct {
+	dir string
+
+	mu sync.Mutex
+	// open are the files open for writing or reading, names all those to
+	// remove
+	open    map[*os.File]bool
+	names   map[string]bool
+	written int64
+}
+
+// spillFile is a temporary file of rows. Once written, it is read by as
+// many readers as needed, in parallel.
+type spillFile struct {
+	files *spillFiles
+	name  string
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+	buf   []byte
+}
+
+func (sf *spillFiles) create() (*spillFile, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	f, err := os.CreateTemp(sf.dir, "maydb-spill-")
+	if err != nil {
+		return nil, err
+	}
+	if sf.names == nil {
+		sf.open, sf.names = map[*os.File]bool{}, map[string]bool{}
+	}
+	sf.open[f], sf.names[f.Name()] = true, true
+	return &spillFile{files: sf, name: f.Name(), f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// partition writes row to the i-th of parts, creating it for its first
+// row. Partitions without rows are nil.
+func (sf *spillFiles) partition(parts []*spillFile, i int, row []MemoryCell) error {
+	if parts[i] == nil {
+		var err error
+		if parts[i], err = sf.create(); err != nil {
+			return err
+		}
+	}
+	return parts[i].write(row)
+}
+
+func (sf *spillFiles) reopen(name string) (*os.File, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	sf.open[f] = true
+	return f, nil
+}
+
+func (sf *spillFiles) close(f *os.File) error {
+	sf.mu.Lock()
+	delete(sf.open, f)
+	sf.mu.Unlock()
+	return f.Close()
+}
+
+// remove closes and removes every file, returning the bytes written to
+// them since the last time.
+func (sf *spillFiles) remove() (int64, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	var err error
+	for f := range sf.open {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	for name := range sf.names {
+		if removeErr := os.Remove(name); err == nil {
+			err = removeErr
+		}
+	}
+	written := sf.written
+	sf.open, sf.names, sf.written = nil, nil, 0
+	return written, err
+}
+
+// write appends row to f: its number of cells, then every cell as its
+// length plus one, 0 for NULL, and its bytes.
+func (f *spillFile) write(row []MemoryCell) error {
+	f.buf = binary.AppendUvarint(f.buf[:0], uint64(len(row)))
+	for _, cell := range row {
+		if cell == nil {
+			f.buf = append(f.buf, 0)
+			continue
+		}
+		f.buf = binary.AppendUvarint(f.buf, uint64(len(cell))+1)
+		f.buf = append(f.buf, cell...)
+	}
+	f.size += int64(len(f.buf))
+	_, err := f.w.Write(f.buf)
+	return err
+}
+
+// finish ends the writes to f, for it to be read.
+func (f *spillFile) finish() error {
+	if f.w == nil {
+		return nil
+	}
+	err := f.w.Flush()
+	if closeErr := f.files.close(f.f); err == nil {
+		err = closeErr
+	}
+	f.files.mu.Lock()
+	f.files.written += f.size
+	f.files.mu.Unlock()
+	f.f, f.w = nil, nil
+	return err
+}
+
+// drop removes f before the other files, once it was read.
+func (f *spillFile) drop() error {
+	if err := f.finish(); err != nil {
+		return err
+	}
+	f.files.mu.Lock()
+	delete(f.files.names, f.name)
+	f.files.mu.Unlock()
+	return os.Remove(f.name)
+}
+
+// reader returns the rows of f one at a time, from the first.
+func (f *spillFile) reader() (func() ([]MemoryCell, bool, error), error) {
+	if err := f.finish(); err != nil {
+		return nil, err
+	}
+	file, err := f.files.reopen(f.name)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	return func() ([]MemoryCell, bool, error) {
+		if file == nil {
+			return nil, false, nil
+		}
+		row, err := readRow(r)
+		if err == io.EOF {
+			err, file = f.files.close(file), nil
+			return nil, false, err
+		}
+		return row, err == nil, err
+	}, nil
+}
+
+func readRow(r *bufio.Reader) ([]MemoryCell, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]MemoryCell, n)
+	for i := range row {
+		l, err := binary.ReadUvarint(r)
+		if err == nil && l > 0 {
+			row[i] = make(MemoryCell, l-1)
+			_, err = io.ReadFull(r, row[i])
+		}
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// readFiles returns the rows of files, one file after the other. nil
+// files have no rows.
+func readFiles(files []*spillFile) func() ([]MemoryCell, bool, error) {
+	var next func() ([]MemoryCell, bool, error)
+	return func() ([]MemoryCell, bool, error) {
+		for {
+			if next == nil {
+				if len(files) == 0 {
+					return nil, false, nil
+				}
+				file := files[0]
+				files = files[1:]
+				if file == nil {
+					continue
+				}
+				var err error
+				if next, err = file.reader(); err != nil {
+					return nil, false, err
+				}
+			}
+			row, ok, err := next()
+			if err != nil || ok {
+				return row, ok, err
+			}
+			next = nil
+		}
+	}
+}
+
+// partitionOf returns the partition of key when partitioning for the
+// depth-th time. Every depth takes other bits of its hash, for the keys of
+// a partition to spread over the partitions of the next depth.
+func partitionOf(key string, depth int) int {
+	// FNV-1a, whose low bits are mixed by the finalizer of MurmurHash3
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= 1099511628211
+	}
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return int((h >> (4 * uint(depth))) % spillPartitions)
+}
+
+// writeRun sorts rows, keyed by sorter.keyed, and writes them to a new file.
+func (s *sorter) writeRun(files *spillFiles, rows [][]MemoryCell) (*spillFile, error) {
+	s.sort(rows)
+	f, err := files.create()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if err := f.write(row); err != nil {
+			return nil, err
+		}
+	}
+	return f, f.finish()
+}
+
+// mergeRuns merges runs sortFanIn at a time, into fewer runs in the same
+// order.
+func (s *sorter) mergeRuns(files *spillFiles, runs []*spillFile) ([]*spillFile, error) {
+	var merged []*spillFile
+	for len(runs) > 0 {
+		n := sortFanIn
+		if n > len(runs) {
+			n = len(runs)
+		}
+		group := runs[:n]
+		runs = runs[n:]
+		if n == 1 {
+			merged = append(merged, group[0])
+			continue
+		}
+
+		out, err := files.create()
+		if err != nil {
+			return nil, err
+		}
+		next, err := s.merge(group)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			row, ok, err := next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				break
+			}
+			if err := out.write(row); err != nil {
+				return nil, err
+			}
+		}
+		if err := out.finish(); err != nil {
+			return nil, err
+		}
+		for _, r := range group {
+			if err := r.drop(); err != nil {
+				return nil, err
+			}
+		}
+		merged = append(merged, out)
+	}
+	return merged, nil
+}
+
+// merge returns the rows of the sorted runs in order. Rows that sort the
+// same come in the order of their runs, for the sort to be stable.
+func (s *sorter) merge(runs []*spillFile) (func() ([]MemoryCell, bool, error), error) {
+	h := &mergeHeap{sorter: s}
+	for i, r := range runs {
+		next, err := r.reader()
+		if err != nil {
+			return nil, err
+		}
+		row, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			h.heads = append(h.heads, &mergeHead{row: row, run: i, next: next})
+		}
+	}
+	heap.Init(h)
+	return func() ([]MemoryCell, bool, error) {
+		if len(h.heads) == 0 {
+			return nil, false, nil
+		}
+		head := h.heads[0]
+		row := head.row
+		next, ok, err := head.next()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			head.row = next
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		return row, true, nil
+	}, nil
+}
+
+// mergeHead is the next row of a run being merged.
+type mergeHead struct {
+	row  []MemoryCell
+	run  int
+	next func() ([]MemoryCell, bool, error)
+}
+
+// mergeHeap orders the heads of the runs being merged, implementing
+// heap.Interface.
+type mergeHeap struct {
+	sorter *sorter
+	heads  []*mergeHead
+}
+
+func (h *mergeHeap) Len() int { return len(h.heads) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := h.sorter.compare(h.heads[i].row, h.heads[j].row); c != 0 {
+		return c < 0
+	}
+	return h.heads[i].run < h.heads[j].run
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.heads = append(h.heads, x.(*mergeHead)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	head := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return head
+}
+
+// aggSpill holds the groups that an aggregate wrote out as they outgrew
+// work_mem, as rows of their values and states, in partitions by their
+// values.
+type aggSpill struct {
+	node  *aggregateNode
+	mem   workMem
+	files *spillFiles
+	depth int
+	parts []*spillFile
+}
+
+func newAggSpill(node *aggregateNode, mem workMem) *aggSpill {
+	return &aggSpill{node: node, mem: mem, files: &spillFiles{dir: mem.dir}}
+}
+
+// write adds rows of group values and states to their partitions.
+func (s *aggSpill) write(rows [][]MemoryCell) error {
+	if s.parts == nil {
+		s.parts = make([]*spillFile, spillPartitions)
+	}
+	n := len(s.node.groups)
+	for _, row := range rows {
+		if err := s.files.partition(s.parts, partitionOf(encodeKey(row[:n]), s.depth), row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish returns the rows that states gives, as aggGroups.rows does,
+// unless groups were written out already. Then those states are written
+// out too, and the rows are those of the partitions in turn, which
+// closing removes. size is the memory the states took.
+func (s *aggSpill) finish(states func(partial bool) ([][]MemoryCell, error), size int64, partial bool, e *estimated) (rowIterator, error) {
+	if s.parts == nil {
+		rows, err := states(partial)
+		if err != nil {
+			return nil, err
+		}
+		return rowsIterator(rows, nil), nil
+	}
+
+	rows, err := states(true)
+	if err == nil {
+		err = s.write(rows)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.hold(int(-size))
+	close := func() error { return e.removeSpill(s.files) }
+	return &iterator{next: s.merged(partial, e), close: close}, nil
+}
+
+// merged returns the rows of the groups of every partition in turn.
+func (s *aggSpill) merged(partial bool, e *estimated) func() ([]MemoryCell, bool, error) {
+	var rows [][]MemoryCell
+	var sub func() ([]MemoryCell, bool, error)
+	k := 0
+	return func() ([]MemoryCell, bool, error) {
+		for {
+			if sub != nil {
+				row, ok, err := sub()
+				if err != nil || ok {
+					return row, ok, err
+				}
+				sub = nil
+			}
+			if len(rows) > 0 {
+				row := rows[0]
+				rows = rows[1:]
+				return row, true, nil
+			}
+			if k == len(s.parts) {
+				return nil, false, nil
+			}
+			if part := s.parts[k]; part != nil {
+				var err error
+				if rows, sub, err = s.mergePart(part, partial, e); err != nil {
+					return nil, false, err
+				}
+			}
+			k++
+		}
+	}
+}
+
+// mergePart merges the states of the groups of part, returning their rows,
+// or those of the partitions of part when its groups outgrow work_mem.
+func (s *aggSpill) mergePart(part *spillFile, partial bool, e *estimated) ([][]MemoryCell, func() ([]MemoryCell, bool, error), error) {
+	next, err := part.reader()
+	if err != nil {
+		return nil, nil, err
+	}
+	groups := newAggGroups(s.node)
+	sub := &aggSpill{node: s.node, mem: s.mem, files: s.files, depth: s.depth + 1}
+	var size int64
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			break
+		}
+		n, err := groups.merge(row)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.hold(n)
+		if size += int64(n); s.mem.exceeded(size) && sub.depth < maxSpillDepth {
+			states, err := groups.rows(true)
+			if err == nil {
+				err = sub.write(states)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			groups = newAggGroups(s.node)
+			e.hold(int(-size))
+			size = 0
+		}
+	}
+	if err := part.drop(); err != nil {
+		return nil, nil, err
+	}
+
+	defer e.hold(int(-size))
+	if sub.parts == nil {
+		rows, err := groups.rows(partial)
+		return rows, nil, err
+	}
+	states, err := groups.rows(true)
+	if err == nil {
+		err = sub.write(states)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, sub.merged(partial, e), nil
+}
+
+// hashTable holds the rows of the right side of a hash join by their keys,
+// rows keyed by keyedRows. Once they outgrow work_mem, they are written to
+// partitions by their keys instead, parts holding the files of every
+// partition, to be read in order.
+type hashTable struct {
+	rows  [][]MemoryCell
+	table map[string][]int
+	size  int64
+	parts [][]*spillFile
+	depth int
+}
+
+// keyedRows returns the rows of next with the value of their keys, as
+// rowKey encodes them, as their last cell. Rows with a NULL key are left
+// out, since they match nothing.
+func keyedRows(next func() ([]MemoryCell, bool, error), keys []evaluator) func() ([]MemoryCell, bool, error) {
+	return func() ([]MemoryCell, bool, error) {
+		for {
+			row, ok, err := next()
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			key, ok, err := rowKey(row, keys)
+			if err != nil {
+				return nil, false, err
+			}
+			if ok {
+				return append(row[:len(row):len(row)], MemoryCell(key)), true, nil
+			}
+		}
+	}
+}
+
+// buildHash puts the keyed rows of next in a hash table, partitioned for
+// the depth-th time once they outgrow mem.
+func buildHash(next func() ([]MemoryCell, bool, error), mem workMem, files *spillFiles, depth int) (*hashTable, error) {
+	ht := &hashTable{table: map[string][]int{}, depth: depth}
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return ht, ht.finish()
+		}
+		if ht.parts != nil {
+			if err := ht.partition(files, row); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		key := string(row[len(row)-1])
+		ht.table[key] = append(ht.table[key], len(ht.rows))
+		ht.rows = append(ht.rows, row)
+		ht.size += rowSize(row) + 8
+		if mem.exceeded(ht.size) && depth < maxSpillDepth {
+			if err := ht.spill(files); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// spill writes the rows of ht to partitions, where the next ones go too.
+func (ht *hashTable) spill(files *spillFiles) error {
+	ht.parts = make([][]*spillFile, spillPartitions)
+	for i := range ht.parts {
+		ht.parts[i] = make([]*spillFile, 1)
+	}
+	for _, row := range ht.rows {
+		if err := ht.partition(files, row); err != nil {
+			return err
+		}
+	}
+	ht.rows, ht.table, ht.size = nil, nil, 0
+	return nil
+}
+
+func (ht *hashTable) partition(files *spillFiles, row []MemoryCell) error {
+	return files.partition(ht.parts[partitionOf(string(row[len(row)-1]), ht.depth)], 0, row)
+}
+
+// finish ends the writes to the partitions of ht.
+func (ht *hashTable) finish() error {
+	for _, part := range ht.parts {
+		for _, f := range part {
+			if f == nil {
+				continue
+			}
+			if err := f.finish(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTables merges the hash tables of the parts of a side of a join, in
+// the order of the parts. When some of them are partitioned, all of them
+// are, each partition being those of the parts one after the other.
+func mergeTables(tables []*hashTable, files *spillFiles) (*hashTable, error) {
+	merged := &hashTable{table: map[string][]int{}}
+	partitioned := false
+	for _, t := range tables {
+		partitioned = partitioned || t.parts != nil
+	}
+	if !partitioned {
+		for _, t := range tables {
+			offset := len(merged.rows)
+			for key, positions := range t.table {
+				for _, pos := range positions {
+					merged.table[key] = append(merged.table[key], offset+pos)
+				}
+			}
+			merged.rows = append(merged.rows, t.rows...)
+			merged.size += t.size
+		}
+		return merged, nil
+	}
+
+	merged.table = nil
+	merged.parts = make([][]*spillFile, spillPartitions)
+	for _, t := range tables {
+		if t.parts == nil {
+			if err := t.spill(files); err != nil {
+				return nil, err
+			}
+			if err := t.finish(); err != nil {
+				return nil, err
+			}
+		}
+		for i, part := range t.parts {
+			merged.parts[i] = append(merged.parts[i], part...)
+		}
+	}
+	return merged, nil
+}
+
+// probe joins the keyed rows of next with those of ht, which are in
+// memory.
+func probe(ht *hashTable, next func() ([]MemoryCell, bool, error)) func() ([]MemoryCell, bool, error) {
+	var l []MemoryCell
+	var matches []int
+	return func() ([]MemoryCell, bool, error) {
+		for len(matches) == 0 {
+			row, ok, err := next()
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			l, matches = row[:len(row)-1], ht.table[string(row[len(row)-1])]
+		}
+		r := ht.rows[matches[0]]
+		matches = matches[1:]
+		return concat(l, r[:len(r)-1]), true, nil
+	}
+}
+
+// join joins the keyed rows of next with those of ht. When ht is
+// partitioned, the rows of next are partitioned alike, then every
+// partition of ht is read into a hash table in turn, for the rows of the
+// same partition of next to probe.
+func (j *hashJoin) join(ht *hashTable, next func() ([]MemoryCell, bool, error), files *spillFiles) (func() ([]MemoryCell, bool, error), error) {
+	if ht.parts == nil {
+		return probe(ht, next), nil
+	}
+
+	parts := make([]*spillFile, spillPartitions)
+	for {
+		row, ok, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		if err := files.partition(parts, partitionOf(string(row[len(row)-1]), ht.depth), row); err != nil {
+			return nil, err
+		}
+	}
+
+	var joined func() ([]MemoryCell, bool, error)
+	var held int64
+	k := 0
+	return func() ([]MemoryCell, bool, error) {
+		for {
+			if joined != nil {
+				row, ok, err := joined()
+				if err != nil || ok {
+					return row, ok, err
+				}
+				joined = nil
+			}
+			if k == len(parts) {
+				j.hold(int(-held))
+				held = 0
+				return nil, false, nil
+			}
+
+			sub, err := buildHash(readFiles(ht.parts[k]), j.mem, files, ht.depth+1)
+			if err != nil {
+				return nil, false, err
+			}
+			j.hold(int(sub.size - held))
+			held = sub.size
+			if parts[k] != nil && (len(sub.rows) > 0 || sub.parts != nil) {
+				probeRows, err := parts[k].reader()
+				if err != nil {
+					return nil, false, err
+				}
+				if joined, err = j.join(sub, probeRows, files); err != nil {
+					return nil, false, err
+				}
+			}
+			k++
+		}
+	}, nil
+}
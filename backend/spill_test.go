@@ -0,0 +1,150 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+// sortedRows orders rows by their printed values, for plans whose rows
+// come in no particular order.
+func sortedRows(rows [][]interface{}) [][]interface{} {
+	printed := make([]string, len(rows))
+	order := make([]int, len(rows))
+	for i, row := range rows {
+		printed[i] = fmt.Sprint(row)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return printed[order[i]] < printed[order[j]]
+	})
+	sorted := make([][]interface{}, len(rows))
+	for i, k := range order {
+		sorted[i] = rows[k]
+	}
+	return sorted
+}
+
+func assertNoSpill(t *testing.T, dir string, msg string) {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, entries, msg)
+}
+
+func TestSpill(t *testing.T) {
+	tests := []struct {
+		source  string
+		ordered bool
+	}{
+		{source: "SELECT id, kind, amount FROM events ORDER BY amount DESC, kind;", ordered: true},
+		{source: "SELECT kind, user_id FROM events ORDER BY kind LIMIT 30;", ordered: true},
+		{source: "SELECT id, count(*), min(kind), max(amount), sum(amount) FROM events GROUP BY id;"},
+		{source: "SELECT user_id, kind, count(amount) FROM events GROUP BY user_id, kind HAVING count(*) > 1;"},
+		{source: "SELECT count(*), sum(amount), min(kind) FROM events;"},
+		{source: "SELECT e.id, f.id FROM events e JOIN events f ON e.user_id = f.amount WHERE e.amount = 1;"},
+		{source: "SELECT e.kind, count(*), max(f.id) FROM events e JOIN events f ON e.kind = f.kind AND e.user_id = f.amount GROUP BY e.kind;"},
+	}
+
+	for _, storage := range []string{"row", "columnar"} {
+		mb := NewMemoryBacked()
+		mb.tempDir = t.TempDir()
+		mb.parallelRows = 1250
+		eventsSchema(t, mb, 2500, storage)
+		for _, test := range tests {
+			for _, run := range []struct {
+				workers    int
+				rowAtATime bool
+			}{{1, true}, {1, false}, {2, false}} {
+				mb.rowAtATime = run.rowAtATime
+				ctx := WithSettings(context.Background(), Settings{MaxParallelWorkers: run.workers})
+				want, err := queryContext(t, ctx, mb, test.source)
+				assert.Nil(t, err, test.source)
+
+				// Small enough for partitions to be partitioned again, and
+				// for runs to be merged in several passes
+				ctx = WithSettings(context.Background(), Settings{MaxParallelWorkers: run.workers, WorkMem: 3 << 10})
+				got, err := queryContext(t, ctx, mb, test.source)
+				assert.Nil(t, err, test.source)
+				if !test.ordered {
+					want, got = sortedRows(want), sortedRows(got)
+				}
+				assert.Equal(t, want, got, storage+": "+test.source)
+				assertNoSpill(t, mb.tempDir, test.source)
+			}
+		}
+	}
+}
+
+func TestSpillExplain(t *testing.T) {
+	mb := NewMemoryBacked()
+	mb.tempDir = t.TempDir()
+	eventsSchema(t, mb, 5000, "row")
+	ctx := WithSettings(context.Background(), Settings{WorkMem: 64 << 10})
+
+	plan := explainContext(t, ctx, mb, "EXPLAIN ANALYZE SELECT id FROM events ORDER BY amount;")
+	assert.Regexp(t, regexp.MustCompile(`Sort .* memory=\d+kB disk=\d+kB\)`), plan)
+	plan = explainContext(t, ctx, mb, "EXPLAIN ANALYZE SELECT id, count(*) FROM events GROUP BY id;")
+	assert.Regexp(t, regexp.MustCompile(`Hash Aggregate .* disk=\d+kB\)`), plan)
+	plan = explainContext(t, ctx, mb, "EXPLAIN ANALYZE SELECT e.id FROM events e JOIN events f ON e.user_id = f.amount;")
+	assert.Regexp(t, regexp.MustCompile(`Hash Join .* disk=\d+kB\)`), plan)
+
+	// Within work_mem nothing is written
+	plan = explainContext(t, ctx, mb, "EXPLAIN ANALYZE SELECT kind, count(*) FROM events GROUP BY kind;")
+	assert.NotContains(t, plan, "disk=")
+	assertNoSpill(t, mb.tempDir, "")
+}
+
+func TestSpillCleanup(t *testing.T) {
+	mb := NewMemoryBacked()
+	mb.tempDir = t.TempDir()
+	eventsSchema(t, mb, 5000, "row")
+	ctx := WithSettings(context.Background(), Settings{WorkMem: 64 << 10})
+
+	// Rows closed before they are all read
+	for _, source := range []string{
+		"SELECT id FROM events ORDER BY amount;",
+		"SELECT id, count(*) FROM events GROUP BY id;",
+		"SELECT e.id FROM events e JOIN events f ON e.user_id = f.amount;",
+	} {
+		asts, err := parser.Parse(source)
+		assert.Nil(t, err)
+		rows, err := mb.Select(ctx, asts.Statements[0].SelectStatement)
+		assert.Nil(t, err, source)
+		assert.True(t, rows.Next(), source)
+		entries, err := os.ReadDir(mb.tempDir)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, entries, source)
+		assert.Nil(t, rows.Close(), source)
+		assertNoSpill(t, mb.tempDir, source)
+	}
+
+	// Rows canceled before they are all read
+	for _, source := range []string{
+		"SELECT id FROM events ORDER BY amount;",
+		"SELECT e.id FROM events e JOIN events f ON e.user_id = f.amount;",
+	} {
+		ctx, cancel := context.WithCancel(ctx)
+		asts, err := parser.Parse(source)
+		assert.Nil(t, err)
+		rows, err := mb.Select(ctx, asts.Statements[0].SelectStatement)
+		assert.Nil(t, err, source)
+		assert.True(t, rows.Next(), source)
+		cancel()
+		assert.False(t, rows.Next(), source)
+		assert.ErrorIs(t, rows.Err(), ErrQueryCanceled, source)
+		assert.Nil(t, rows.Close(), source)
+		assertNoSpill(t, mb.tempDir, source)
+	}
+
+	// Runs that fail
+	_, err := queryContext(t, ctx, mb, "SELECT id FROM events ORDER BY 1000 / amount;")
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+	_, err = queryContext(t, ctx, mb, "SELECT id, count(*) FROM events GROUP BY id HAVING 1000 / min(amount) > 0;")
+	assert.ErrorIs(t, err, ErrDivisionByZero)
+	assertNoSpill(t, mb.tempDir, "")
+}
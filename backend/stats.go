@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"context"
+	"github.com/nanjingblue/maydb/ast"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// TableStats are the statistics ANALYZE collects about a table, which the
+// planner uses to estimate how many rows each part of a plan returns. They
+// are not updated by later changes, until the next ANALYZE.
+type TableStats struct {
+	Rows    int64
+	Columns []ColumnStats
+}
+
+// ColumnStats describe the values of a column. Distinct is an estimate of
+// the number of distinct values, NULL aside. Histogram holds the bounds of
+// buckets that each hold about as many of the values, from the smallest to
+// the largest; it is empty when the column is all NULL.
+type ColumnStats struct {
+	NullFrac  float64
+	Distinct  float64
+	Histogram []MemoryCell
+}
+
+// histogramBuckets is the number of buckets of a histogram, fewer for
+// columns with fewer values.
+const histogramBuckets = 10
+
+// Analyze collects the statistics of a table, or of every table.
+func (mb *MemoryBackend) Analyze(ctx context.Context, an *ast.AnalyzeStatement) error {
+	if an.Table == nil {
+		for _, t := range mb.Tables {
+			if err := t.analyze(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t, ok := mb.Tables[an.Table.Value]
+	if !ok {
+		return ErrTableDoesNotExist
+	}
+	return t.analyze(ctx)
+}
+
+func (t *Table) analyze(ctx context.Context) error {
+	rows, err := t.allRows()
+	if err != nil {
+		return err
+	}
+	stats := &TableStats{Rows: int64(len(rows))}
+	for i := range t.Columns {
+		if err := ContextErr(ctx); err != nil {
+			return err
+		}
+		var values []MemoryCell
+		hll := newHyperLogLog()
+		nulls := 0
+		for _, row := range rows {
+			if row[i] == nil {
+				nulls++
+				continue
+			}
+			values = append(values, row[i])
+			hll.add(row[i])
+		}
+
+		var cs ColumnStats
+		if len(rows) > 0 {
+			cs.NullFrac = float64(nulls) / float64(len(rows))
+		}
+		if len(values) > 0 {
+			cs.Distinct = math.Min(math.Round(hll.estimate()), float64(len(values)))
+			cs.Histogram = histogram(values, t.ColumnTypes[i])
+		}
+		stats.Columns = append(stats.Columns, cs)
+	}
+	t.Stats = stats
+	return nil
+}
+
+// histogram returns the bounds of equi-depth buckets of values.
+func histogram(values []MemoryCell, typ ColumnType) []MemoryCell {
+	sorted := append([]MemoryCell(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return compare(sorted[i], sorted[j], typ) < 0 })
+
+	buckets := histogramBuckets
+	if len(sorted)-1 < buckets {
+		buckets = len(sorted) - 1
+	}
+	if buckets == 0 {
+		return []MemoryCell{sorted[0]}
+	}
+	bounds := make([]MemoryCell, buckets+1)
+	for i := range bounds {
+		bounds[i] = sorted[i*(len(sorted)-1)/buckets]
+	}
+	return bounds
+}
+
+// hyperLogLog estimates the number of distinct values it was given, in a
+// fixed amount of memory, by keeping in each register the longest run of
+// leading zeros among the hashes that map to it.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+// hllPrecision makes 2^10 registers, for a standard error of about 3%.
+const hllPrecision = 10
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(value []byte) {
+	f := fnv.New64a()
+	f.Write(value)
+	x := mix(f.Sum64())
+
+	register := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[register] {
+		h.registers[register] = rank
+	}
+}
+
+// mix spreads the bits of a hash, which FNV doesn't do well for short
+// inputs.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Small cardinalities are better estimated by linear counting
+	if e <= 2.5*m && zeros > 0 {
+		return m * math.Log(m/float64(zeros))
+	}
+	return e
+}
@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func shopSchema(t *testing.T, mb *MemoryBackend) {
+	assert.Nil(t, execAll(t, mb, `CREATE TABLE regions (id INT PRIMARY KEY, name TEXT);
+		CREATE TABLE customers (id INT PRIMARY KEY, region INT);
+		CREATE TABLE orders (id INT PRIMARY KEY, customer_id INT, amount INT);`))
+	var regions, customers, orders [][]interface{}
+	for i := int64(0); i < 5; i++ {
+		regions = append(regions, []interface{}{i, fmt.Sprintf("r%d", i)})
+	}
+	for i := int64(0); i < 200; i++ {
+		customers = append(customers, []interface{}{i, i % 5})
+	}
+	for i := int64(0); i < 2000; i++ {
+		var amount interface{} = i % 100
+		if i%4 == 0 {
+			amount = nil
+		}
+		orders = append(orders, []interface{}{i, i % 200, amount})
+	}
+	assert.Nil(t, mb.InsertValues(context.Background(), "regions", []string{"id", "name"}, regions))
+	assert.Nil(t, mb.InsertValues(context.Background(), "customers", []string{"id", "region"}, customers))
+	assert.Nil(t, mb.InsertValues(context.Background(), "orders", []string{"id", "customer_id", "amount"}, orders))
+}
+
+func TestAnalyze(t *testing.T) {
+	mb := NewMemoryBacked()
+	shopSchema(t, mb)
+	assert.Nil(t, execAll(t, mb, "ANALYZE orders;"))
+	assert.Nil(t, mb.Tables["customers"].Stats)
+
+	stats := mb.Tables["orders"].Stats
+	assert.Equal(t, int64(2000), stats.Rows)
+	assert.Equal(t, 0.0, stats.Columns[0].NullFrac)
+	assert.InDelta(t, 2000, stats.Columns[0].Distinct, 100)
+	assert.InDelta(t, 200, stats.Columns[1].Distinct, 10)
+
+	amount := stats.Columns[2]
+	assert.Equal(t, 0.25, amount.NullFrac)
+	assert.InDelta(t, 75, amount.Distinct, 4)
+	assert.Len(t, amount.Histogram, histogramBuckets+1)
+	first, _ := amount.Histogram[0].AsInt()
+	last, _ := amount.Histogram[histogramBuckets].AsInt()
+	assert.Equal(t, int32(1), first)
+	assert.Equal(t, int32(99), last)
+
+	assert.ErrorIs(t, execAll(t, mb, "ANALYZE nope;"), ErrTableDoesNotExist)
+}
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			// Every value twice
+			h.add([]byte(fmt.Sprintf("value %d", i%n)))
+			h.add([]byte(fmt.Sprintf("value %d", i%n)))
+		}
+		assert.InEpsilon(t, float64(n), h.estimate(), 0.1, n)
+	}
+}
+
+func TestJoinOrder(t *testing.T) {
+	mb := NewMemoryBacked()
+	shopSchema(t, mb)
+	assert.Nil(t, execAll(t, mb, "ANALYZE;"))
+
+	tests := []struct {
+		source string
+		plan   string
+	}{
+		{
+			// The selective table is read first, and the large one is hashed
+			// against the few customers left
+			source: `EXPLAIN SELECT count(*) FROM orders o JOIN customers c ON o.customer_id = c.id
+				JOIN regions r ON c.region = r.id WHERE r.name = 'r1';`,
+			plan: `Project  (cost=4862.50 rows=1)
+  Output: count(*)
+  ->  Aggregate  (cost=4862.25 rows=1)
+        ->  Hash Join  (cost=4760.25 rows=404)
+              Hash Cond: (o.customer_id = c.id)
+              ->  Vectorized Seq Scan on orders o  (cost=2000.00 rows=2000)
+                    Columns: customer_id
+              ->  Nested Loop  (cost=296.25 rows=40)
+                    Join Filter: (c.region = r.id)
+                    ->  Seq Scan on regions r  (cost=6.25 rows=1)
+                          Columns: id, name
+                          Filter: (r.name = 'r1')
+                    ->  Seq Scan on customers c  (cost=200.00 rows=200)
+                          Columns: id, region`,
+		},
+		{
+			// A single order looks its customer up by the primary key
+			source: "EXPLAIN SELECT o.id FROM orders o JOIN customers c ON o.customer_id = c.id WHERE o.id = 7;",
+			plan: `Project  (cost=3.25 rows=1)
+  Output: o.id
+  ->  Nested Loop  (cost=3.00 rows=1)
+        ->  Index Scan using orders_pkey on orders o  (cost=1.00 rows=1)
+              Index Cond: (o.id = 7)
+              Columns: id, customer_id
+        ->  Index Scan using customers_pkey on customers c  (cost=1.00 rows=1)
+              Index Cond: (o.customer_id = c.id)
+              Columns: id`,
+		},
+		{
+			// The histogram estimates a range
+			source: "EXPLAIN SELECT id FROM orders WHERE amount < 10;",
+			plan: `Vectorized Project  (cost=2537.50 rows=150)
+  Output: id
+  ->  Vectorized Seq Scan on orders  (cost=2500.00 rows=150)
+        Columns: id, amount
+        Filter: (amount < 10)`,
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.plan, explain(t, mb, test.source), test.source)
+	}
+
+	rows, err := query(t, mb, `SELECT count(*) FROM orders o JOIN customers c ON o.customer_id = c.id
+		JOIN regions r ON c.region = r.id WHERE r.name = 'r1';`)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{int64(400)}}, rows)
+	rows, err = query(t, mb, "SELECT c.region FROM orders o JOIN customers c ON o.customer_id = c.id WHERE o.id = 7;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]interface{}{{int64(2)}}, rows)
+}
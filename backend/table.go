@@ -0,0 +1,198 @@
+package backend
+
+// rowStore keeps the rows of a table out of memory, like the tables of an
+// LSMBackend. Rows are numbered from 0 and never removed.
+type rowStore interface {
+	get(pos int) ([]MemoryCell, error)
+	put(pos int, row []MemoryCell)
+	// scan reads the rows from position from up to to, excluded.
+	scan(from, to int) rowCursor
+}
+
+// rowCursor reads rows in order.
+type rowCursor interface {
+	// next returns up to n more rows, none at the end.
+	next(n int) ([][]MemoryCell, error)
+	close() error
+}
+
+// Rows of a table are numbered in order: those of its segments, then
+// those of Rows, or those of its store.
+
+func (t *Table) rowCount() int {
+	if t.store != nil {
+		return t.Stored
+	}
+	return t.sealed() + len(t.Rows)
+}
+
+// row returns the row at pos.
+func (t *Table) row(pos int) ([]MemoryCell, error) {
+	sealed := t.sealed()
+	switch {
+	case t.store != nil:
+		return t.store.get(pos)
+	case pos >= sealed:
+		return t.Rows[pos-sealed], nil
+	}
+	return t.Segments[pos/segmentRows].row(t.ColumnTypes, pos%segmentRows)
+}
+
+// appendRow adds row after the others.
+func (t *Table) appendRow(row []MemoryCell) {
+	if t.store != nil {
+		t.store.put(t.Stored, row)
+		t.Stored++
+		return
+	}
+	t.Rows = append(t.Rows, row)
+}
+
+// setRow replaces the row at pos. A segment holding it is written anew.
+func (t *Table) setRow(pos int, row []MemoryCell) error {
+	sealed := t.sealed()
+	switch {
+	case t.store != nil:
+		t.store.put(pos, row)
+		return nil
+	case pos >= sealed:
+		t.Rows[pos-sealed] = row
+		return nil
+	}
+	k := pos / segmentRows
+	rows, err := t.Segments[k].rows(t.ColumnTypes, t.allColumns())
+	if err != nil {
+		return err
+	}
+	rows[pos%segmentRows] = row
+	t.Segments = append([]*Segment(nil), t.Segments...)
+	t.Segments[k] = newSegment(rows, t.ColumnTypes)
+	return nil
+}
+
+// truncate drops the rows after the first n, which must not be in
+// segments.
+func (t *Table) truncate(n int) {
+	if t.store != nil {
+		t.Stored = n
+		return
+	}
+	t.Rows = t.Rows[:n-t.sealed()]
+}
+
+// allRows returns every row of t, decoding its segments.
+func (t *Table) allRows() ([][]MemoryCell, error) {
+	if len(t.Segments) == 0 && t.store == nil {
+		return t.Rows, nil
+	}
+	var rows [][]MemoryCell
+	tr := t.scanRows()
+	defer tr.close()
+	for {
+		seg, chunk, err := tr.next(nil)
+		switch {
+		case err != nil:
+			return nil, err
+		case seg != nil:
+			segRows, err := seg.rows(t.ColumnTypes, t.allColumns())
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, segRows...)
+		case len(chunk) == 0:
+			return rows, tr.close()
+		default:
+			rows = append(rows, chunk...)
+		}
+	}
+}
+
+// scanRows returns the rows of t as of now: rows added later are not
+// part of them.
+func (t *Table) scanRows() *tableRows {
+	return &tableRows{types: t.ColumnTypes, segments: t.Segments, rows: t.Rows, store: t.store, stored: t.Stored}
+}
+
+// tableRows reads the segments and the other rows of a table, or of a
+// part of it. Those of a store are the ones from position from up to
+// stored.
+type tableRows struct {
+	types    []ColumnType
+	segments []*Segment
+	rows     [][]MemoryCell
+	store    rowStore
+	from     int
+	stored   int
+	cursor   rowCursor
+}
+
+// part narrows tr to the i-th of n parts of about as many rows each, which
+// read one after the other are the rows of tr. Segments are not split, a
+// part holding those that start in it.
+func (tr *tableRows) part(i, n int) *tableRows {
+	sealed := len(tr.segments) * segmentRows
+	total := sealed + len(tr.rows) + tr.stored - tr.from
+	bound := func(i int) int {
+		pos := total * i / n
+		if pos < sealed {
+			pos = (pos + segmentRows - 1) / segmentRows * segmentRows
+		}
+		return pos
+	}
+	// within clamps pos to the positions from lo up to hi, then makes it
+	// relative to lo
+	within := func(pos, lo, hi int) int {
+		if pos < lo {
+			return 0
+		}
+		if pos > hi {
+			return hi - lo
+		}
+		return pos - lo
+	}
+	from, to := bound(i), bound(i+1)
+	p := *tr
+	p.segments = tr.segments[within(from, 0, sealed)/segmentRows : within(to, 0, sealed)/segmentRows]
+	p.rows = tr.rows[within(from, sealed, sealed+len(tr.rows)):within(to, sealed, sealed+len(tr.rows))]
+	if tr.store != nil {
+		p.from, p.stored = tr.from+from, tr.from+to
+	}
+	return &p
+}
+
+// next returns the next segment that zones don't rule out, or else up to
+// a batch of the other rows. There are neither at the end.
+func (tr *tableRows) next(zones []zoneCond) (*Segment, [][]MemoryCell, error) {
+	for len(tr.segments) > 0 {
+		seg := tr.segments[0]
+		tr.segments = tr.segments[1:]
+		if !seg.skips(zones) {
+			return seg, nil, nil
+		}
+	}
+	if len(tr.rows) > 0 {
+		chunk := tr.rows
+		if len(chunk) > batchSize {
+			chunk = chunk[:batchSize]
+		}
+		tr.rows = tr.rows[len(chunk):]
+		return nil, chunk, nil
+	}
+	if tr.store == nil {
+		return nil, nil, nil
+	}
+	if tr.cursor == nil {
+		tr.cursor = tr.store.scan(tr.from, tr.stored)
+	}
+	rows, err := tr.cursor.next(batchSize)
+	return nil, rows, err
+}
+
+func (tr *tableRows) close() error {
+	if tr.cursor == nil {
+		return nil
+	}
+	cursor := tr.cursor
+	tr.cursor, tr.store = nil, nil
+	return cursor.close()
+}
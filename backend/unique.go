@@ -0,0 +1,409 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/token"
+	"strings"
+)
+
+// UniqueConstraint is a PRIMARY KEY or UNIQUE constraint, over the columns
+// at the given positions of its table.
+type UniqueConstraint struct {
+	Name       string
+	PrimaryKey bool
+	Columns    []int
+}
+
+// Constraint describes a PRIMARY KEY or UNIQUE constraint in a
+// TableDefinition.
+type Constraint struct {
+	Name       string
+	PrimaryKey bool
+	Columns    []string
+}
+
+// excludedTable is the pseudo-table holding the proposed row in ON CONFLICT
+// DO UPDATE.
+const excludedTable = "excluded"
+
+// addConstraints sets up the PRIMARY KEY and UNIQUE constraints of a new
+// table, named like PostgreSQL does when no name is given.
+func (t *Table) addConstraints(name string, crt *ast.CreateTableStatement) error {
+	var constraints []*ast.TableConstraint
+	if crt.Cols != nil {
+		for _, col := range *crt.Cols {
+			if col.PrimaryKey || col.Unique {
+				constraints = append(constraints, &ast.TableConstraint{
+					PrimaryKey: col.PrimaryKey,
+					Columns:    []token.Token{col.Name},
+				})
+			}
+		}
+	}
+	constraints = append(constraints, crt.Constraints...)
+
+	hasPrimaryKey := false
+	for _, tc := range constraints {
+		var names []string
+		for _, col := range tc.Columns {
+			names = append(names, col.Value)
+		}
+		columns, err := t.columnIndexes(names)
+		if err != nil {
+			return err
+		}
+
+		uc := UniqueConstraint{PrimaryKey: tc.PrimaryKey, Columns: columns}
+		switch {
+		case tc.Name != nil:
+			uc.Name = tc.Name.Value
+		case tc.PrimaryKey:
+			uc.Name = name + "_pkey"
+		default:
+			uc.Name = name + "_" + strings.Join(names, "_") + "_key"
+		}
+
+		if tc.PrimaryKey {
+			if hasPrimaryKey {
+				return ErrMultiplePrimaryKeys
+			}
+			hasPrimaryKey = true
+			for _, i := range columns {
+				t.NotNull[i] = true
+			}
+		}
+		t.Unique = append(t.Unique, uc)
+	}
+	return nil
+}
+
+// key encodes the values of the columns of constraint c in row. Rows with a
+// NULL in any of them have no key, and never conflict.
+func (t *Table) key(c int, row []MemoryCell) (string, bool) {
+	return uniqueKey(row, t.Unique[c].Columns)
+}
+
+// uniqueKey encodes the values of columns in row, see Table.key.
+func uniqueKey(row []MemoryCell, columns []int) (string, bool) {
+	var b []byte
+	for _, i := range columns {
+		if row[i] == nil {
+			return "", false
+		}
+		b = binary.AppendUvarint(b, uint64(len(row[i])))
+		b = append(b, row[i]...)
+	}
+	return string(b), true
+}
+
+// index returns the position of the row holding each key of constraint c,
+// building it on first use. Rows are read a batch at a time, so that only
+// their keys are held in memory.
+func (t *Table) index(c int) (map[string]int, error) {
+	if t.indexes == nil {
+		t.indexes = make([]map[string]int, len(t.Unique))
+	}
+	if t.indexes[c] != nil {
+		return t.indexes[c], nil
+	}
+
+	columns := t.Unique[c].Columns
+	// Segments are decoded narrowed to columns, which then come first
+	narrowed := make([]int, len(columns))
+	for i := range narrowed {
+		narrowed[i] = i
+	}
+	idx := map[string]int{}
+	tr := t.scanRows()
+	defer tr.close()
+	for pos := 0; ; {
+		seg, chunk, err := tr.next(nil)
+		switch {
+		case err != nil:
+			return nil, err
+		case seg != nil:
+			rows, err := seg.rows(t.ColumnTypes, columns)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				if k, ok := uniqueKey(row, narrowed); ok {
+					idx[k] = pos
+				}
+				pos++
+			}
+		case len(chunk) == 0:
+			if err := tr.close(); err != nil {
+				return nil, err
+			}
+			t.indexes[c] = idx
+			return idx, nil
+		default:
+			for _, row := range chunk {
+				if k, ok := uniqueKey(row, columns); ok {
+					idx[k] = pos
+				}
+				pos++
+			}
+		}
+	}
+}
+
+// conflicts returns, for each constraint, the position of the row that row
+// would duplicate, or -1. The row at position self is not a conflict.
+func (t *Table) conflicts(row []MemoryCell, self int) ([]int, error) {
+	positions := make([]int, len(t.Unique))
+	for c := range t.Unique {
+		positions[c] = -1
+		if k, ok := t.key(c, row); ok {
+			idx, err := t.index(c)
+			if err != nil {
+				return nil, err
+			}
+			if pos, found := idx[k]; found && pos != self {
+				positions[c] = pos
+			}
+		}
+	}
+	return positions, nil
+}
+
+// conflictAction is what to do with rows that conflict with a unique
+// constraint, from ON CONFLICT.
+type conflictAction struct {
+	// arbiters are the constraints whose conflicts are handled, all of
+	// them when nil.
+	arbiters map[int]bool
+	// set is nil for DO NOTHING.
+	set []setter
+}
+
+// setter assigns a column of a row updated by DO UPDATE.
+type setter struct {
+	index int
+	value func(existing, excluded []MemoryCell) (MemoryCell, error)
+}
+
+func (a *conflictAction) handles(c int) bool {
+	return a != nil && (a.arbiters == nil || a.arbiters[c])
+}
+
+// conflictAction resolves an ON CONFLICT clause against the table.
+func (t *Table) conflictAction(name string, oc *ast.OnConflict, defaultCell func(int) (MemoryCell, error)) (*conflictAction, error) {
+	if oc == nil {
+		return nil, nil
+	}
+
+	action := &conflictAction{}
+	if oc.Target != nil {
+		var names []string
+		for _, col := range oc.Target {
+			names = append(names, col.Value)
+		}
+		target, err := t.columnIndexes(names)
+		if err != nil {
+			return nil, err
+		}
+
+		action.arbiters = map[int]bool{}
+		for c, uc := range t.Unique {
+			if sameColumns(uc.Columns, target) {
+				action.arbiters[c] = true
+			}
+		}
+		if len(action.arbiters) == 0 {
+			return nil, ErrNoConflictConstraint
+		}
+	}
+
+	seen := map[int]bool{}
+	for _, clause := range oc.Set {
+		index := t.columnIndex(clause.Column.Value)
+		if index < 0 {
+			return nil, fmt.Errorf("%w: %s", ErrColumnDoesNotExist, clause.Column.Value)
+		}
+		if seen[index] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateColumn, clause.Column.Value)
+		}
+		seen[index] = true
+
+		value, err := t.setValue(name, index, clause.Value, defaultCell)
+		if err != nil {
+			return nil, err
+		}
+		action.set = append(action.set, setter{index: index, value: value})
+	}
+	return action, nil
+}
+
+// setValue resolves the value assigned to column index by DO UPDATE SET: a
+// literal, DEFAULT, a column of the existing row or one of EXCLUDED.
+func (t *Table) setValue(name string, index int, exp *ast.Expression, defaultCell func(int) (MemoryCell, error)) (func(existing, excluded []MemoryCell) (MemoryCell, error), error) {
+	if exp.Kind != ast.LiteralKind {
+		return nil, ErrUnsupportedExpression
+	}
+	lit := exp.Literal
+
+	if lit.Kind == token.IdentifierKind {
+		from := t.columnIndex(lit.Value)
+		qualifier := name
+		if exp.Table != nil {
+			qualifier = exp.Table.Value
+		}
+		if from < 0 || (qualifier != name && qualifier != excludedTable) {
+			return nil, fmt.Errorf("%w: %s.%s", ErrColumnDoesNotExist, qualifier, lit.Value)
+		}
+		if t.ColumnTypes[from] != t.ColumnTypes[index] {
+			return nil, fmt.Errorf("%w: %s is %s", ErrTypeMismatch, t.Columns[index], t.ColumnTypes[index])
+		}
+		if qualifier == excludedTable {
+			return func(_, excluded []MemoryCell) (MemoryCell, error) { return excluded[from], nil }, nil
+		}
+		return func(existing, _ []MemoryCell) (MemoryCell, error) { return existing[from], nil }, nil
+	}
+
+	if lit.Kind == token.KeywordKind && lit.Value == string(token.DefaultKeyword) {
+		return func(_, _ []MemoryCell) (MemoryCell, error) { return defaultCell(index) }, nil
+	}
+	cell, err := literalCell(lit, t.ColumnTypes[index])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s is %s", err, t.Columns[index], t.ColumnTypes[index])
+	}
+	return func(_, _ []MemoryCell) (MemoryCell, error) { return cell, nil }, nil
+}
+
+func sameColumns(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[int]bool{}
+	for _, i := range a {
+		set[i] = true
+	}
+	for _, i := range b {
+		if !set[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// insertRows adds rows to the table, enforcing its constraints, and
+// returns the rows that were inserted or updated. Either all of it happens
+// or nothing does. own is called before rows are modified in place.
+func (t *Table) insertRows(rows [][]MemoryCell, action *conflictAction, own func()) ([][]MemoryCell, error) {
+	oldLen := t.rowCount()
+	undo := map[int][]MemoryCell{}
+	touched := map[int]bool{}
+	fail := func(err error) ([][]MemoryCell, error) {
+		t.truncate(oldLen)
+		// The rows to restore were decoded before, so this does not fail
+		for pos, row := range undo {
+			t.setRow(pos, row)
+		}
+		// Cheaper to rebuild than to undo
+		t.indexes = nil
+		return nil, err
+	}
+	violation := func(c int) error {
+		return fmt.Errorf("%w %q", ErrUniqueViolation, t.Unique[c].Name)
+	}
+
+	var affected [][]MemoryCell
+	for _, row := range rows {
+		if err := t.checkRow(row); err != nil {
+			return fail(err)
+		}
+
+		positions, err := t.conflicts(row, -1)
+		if err != nil {
+			return fail(err)
+		}
+		arbiter, other := -1, -1
+		for c, pos := range positions {
+			switch {
+			case pos < 0:
+			case action.handles(c) && arbiter < 0:
+				arbiter = c
+			case other < 0:
+				other = c
+			}
+		}
+
+		switch {
+		case arbiter < 0 && other >= 0:
+			return fail(violation(other))
+		case arbiter < 0:
+			pos := t.rowCount()
+			t.appendRow(row)
+			for c := range t.Unique {
+				if k, ok := t.key(c, row); ok {
+					idx, err := t.index(c)
+					if err != nil {
+						return fail(err)
+					}
+					idx[k] = pos
+				}
+			}
+			touched[pos] = true
+			affected = append(affected, row)
+			continue
+		case action.set == nil:
+			// DO NOTHING
+			continue
+		}
+
+		pos := positions[arbiter]
+		if touched[pos] {
+			return fail(ErrRowAffectedTwice)
+		}
+		existing, err := t.row(pos)
+		if err != nil {
+			return fail(err)
+		}
+		updated := append([]MemoryCell(nil), existing...)
+		for _, s := range action.set {
+			cell, err := s.value(existing, row)
+			if err != nil {
+				return fail(err)
+			}
+			updated[s.index] = cell
+		}
+		if err := t.checkRow(updated); err != nil {
+			return fail(err)
+		}
+		conflicts, err := t.conflicts(updated, pos)
+		if err != nil {
+			return fail(err)
+		}
+		for c, conflict := range conflicts {
+			if conflict >= 0 {
+				return fail(violation(c))
+			}
+		}
+
+		for c := range t.Unique {
+			idx, err := t.index(c)
+			if err != nil {
+				return fail(err)
+			}
+			if k, ok := t.key(c, existing); ok && idx[k] == pos {
+				delete(idx, k)
+			}
+			if k, ok := t.key(c, updated); ok {
+				idx[k] = pos
+			}
+		}
+		own()
+		if err := t.setRow(pos, updated); err != nil {
+			return fail(err)
+		}
+		undo[pos] = existing
+		touched[pos] = true
+		affected = append(affected, updated)
+	}
+	t.seal()
+	return affected, nil
+}
@@ -0,0 +1,168 @@
+package backend
+
+import (
+	"context"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func execAll(t testing.TB, b Backend, source string) error {
+	asts, err := parser.Parse(source)
+	assert.Nil(t, err, source)
+	for _, stmt := range asts.Statements {
+		switch stmt.Kind {
+		case ast.CreateTableKind:
+			err = b.CreateTable(stmt.CreateTableStatement)
+		case ast.CreateSequenceKind:
+			err = b.CreateSequence(stmt.CreateSequenceStatement)
+		case ast.InsertKind:
+			_, _, err = b.Insert(context.Background(), stmt.InsertStatement)
+		case ast.SelectKind:
+			_, err = selectAll(b, stmt.SelectStatement)
+		case ast.AnalyzeKind:
+			err = b.Analyze(context.Background(), stmt.AnalyzeStatement)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tableValues(t *testing.T, table *Table) [][]interface{} {
+	rows, err := table.allRows()
+	assert.Nil(t, err)
+	var got [][]interface{}
+	for _, row := range rows {
+		var values []interface{}
+		for i, cell := range row {
+			v, err := CellValue(cell, table.ColumnTypes[i])
+			assert.Nil(t, err)
+			values = append(values, v)
+		}
+		got = append(got, values)
+	}
+	return got
+}
+
+func TestUpsert(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, `CREATE TABLE counts (id INT PRIMARY KEY, name TEXT UNIQUE, n INT DEFAULT 0);
+		INSERT INTO counts VALUES (1, 'a', 1), (2, 'b', 1), (3, NULL, 1), (4, NULL, 1);`))
+
+	asts, err := parser.Parse(`INSERT INTO counts VALUES (1, 'x', 5), (5, 'e', 5)
+			ON CONFLICT (id) DO UPDATE SET n = excluded.n, name = counts.name RETURNING id, n;
+		INSERT INTO counts VALUES (2, 'z', 9), (6, 'a', 9) ON CONFLICT DO NOTHING;`)
+	assert.Nil(t, err)
+
+	n, results, err := mb.Insert(context.Background(), asts.Statements[0].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, int32(1), mustInt(t, results.Rows[0][0]))
+	assert.Equal(t, int32(5), mustInt(t, results.Rows[0][1]))
+
+	n, _, err = mb.Insert(context.Background(), asts.Statements[1].InsertStatement)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	assert.Equal(t, [][]interface{}{
+		{int64(1), "a", int64(5)},
+		{int64(2), "b", int64(1)},
+		{int64(3), nil, int64(1)},
+		{int64(4), nil, int64(1)},
+		{int64(5), "e", int64(5)},
+	}, tableValues(t, mb.Tables["counts"]))
+
+	def, err := mb.DescribeTable("counts")
+	assert.Nil(t, err)
+	assert.Equal(t, []Constraint{
+		{Name: "counts_pkey", PrimaryKey: true, Columns: []string{"id"}},
+		{Name: "counts_name_key", Columns: []string{"name"}},
+	}, def.Constraints)
+	assert.True(t, def.Columns[0].NotNull)
+}
+
+func mustInt(t *testing.T, c Cell) int32 {
+	i, err := c.AsInt()
+	assert.Nil(t, err)
+	return i
+}
+
+func TestUniqueErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{source: "INSERT INTO pairs VALUES (1, 1, 9);", err: ErrUniqueViolation},
+		{source: "INSERT INTO pairs VALUES (5, 5, 9), (5, 5, 8);", err: ErrUniqueViolation},
+		{source: "INSERT INTO pairs VALUES (1, 1, 5) ON CONFLICT (a) DO NOTHING;", err: ErrNoConflictConstraint},
+		{source: "INSERT INTO pairs VALUES (1, 1, 5) ON CONFLICT (b, a) DO UPDATE SET c = 2;", err: ErrUniqueViolation},
+		{source: "INSERT INTO pairs VALUES (1, 1, 0), (1, 1, 0) ON CONFLICT (a, b) DO UPDATE SET c = 7;", err: ErrRowAffectedTwice},
+		{source: "INSERT INTO pairs VALUES (1, 1, 0) ON CONFLICT (a, b) DO UPDATE SET c = 'x';", err: ErrTypeMismatch},
+		{source: "INSERT INTO pairs VALUES (1, 1, 0) ON CONFLICT (a, b) DO UPDATE SET c = other.c;", err: ErrColumnDoesNotExist},
+		{source: "INSERT INTO pairs VALUES (1, 1, 0) ON CONFLICT (a, b) DO UPDATE SET c = 1, c = 2;", err: ErrDuplicateColumn},
+		{source: "INSERT INTO pairs VALUES (1, 1, 0) ON CONFLICT (a, b) DO UPDATE SET a = NULL;", err: ErrNotNullViolation},
+		{source: "CREATE TABLE two (a INT PRIMARY KEY, b INT, PRIMARY KEY (b));", err: ErrMultiplePrimaryKeys},
+		{source: "CREATE TABLE bad (a INT, UNIQUE (z));", err: ErrColumnDoesNotExist},
+	}
+
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, `CREATE TABLE pairs (a INT, b INT, c INT, CONSTRAINT pairs_pk PRIMARY KEY (a, b), UNIQUE (c));
+		INSERT INTO pairs VALUES (1, 1, 1), (1, 2, 2);`))
+
+	for _, test := range tests {
+		assert.ErrorIs(t, execAll(t, mb, test.source), test.err, test.source)
+	}
+
+	// Failed statements leave the table as it was
+	assert.Equal(t, [][]interface{}{
+		{int64(1), int64(1), int64(1)},
+		{int64(1), int64(2), int64(2)},
+	}, tableValues(t, mb.Tables["pairs"]))
+	assert.Nil(t, execAll(t, mb, "INSERT INTO pairs VALUES (1, 1, 3) ON CONFLICT (a, b) DO UPDATE SET c = excluded.c;"))
+	assert.Nil(t, execAll(t, mb, "INSERT INTO pairs VALUES (2, 2, 1);"))
+}
+
+func TestUpsertRollback(t *testing.T) {
+	mb := NewMemoryBacked()
+	assert.Nil(t, execAll(t, mb, "CREATE TABLE kv (k TEXT PRIMARY KEY, v INT); INSERT INTO kv VALUES ('a', 1);"))
+
+	assert.Nil(t, mb.Begin())
+	assert.Nil(t, execAll(t, mb, "INSERT INTO kv VALUES ('a', 2), ('b', 2) ON CONFLICT (k) DO UPDATE SET v = excluded.v;"))
+	assert.Nil(t, mb.Rollback())
+
+	assert.Equal(t, [][]interface{}{{"a", int64(1)}}, tableValues(t, mb.Tables["kv"]))
+	assert.ErrorIs(t, execAll(t, mb, "INSERT INTO kv VALUES ('a', 3);"), ErrUniqueViolation)
+	assert.Nil(t, execAll(t, mb, "INSERT INTO kv VALUES ('b', 3);"))
+}
+
+func TestUniqueIndex(t *testing.T) {
+	lb, err := OpenLSMBackend(t.TempDir(), smallTree)
+	assert.Nil(t, err)
+	defer lb.Close()
+	rows, columnar := NewMemoryBacked(), NewMemoryBacked()
+	eventsSchema(t, rows, 5000, "row")
+	eventsSchema(t, columnar, 5000, "columnar")
+	eventsSchema(t, lb, 5000, "row")
+	assert.Len(t, columnar.Tables["events"].Segments, 4)
+
+	var want map[string]int
+	for _, b := range []*MemoryBackend{rows, columnar, lb.MemoryBackend} {
+		// Built anew from the stored rows
+		table := b.Tables["events"]
+		table.indexes = nil
+		idx, err := table.index(0)
+		assert.Nil(t, err)
+		assert.Len(t, idx, 5000)
+		if want == nil {
+			want = idx
+		}
+		assert.Equal(t, want, idx)
+	}
+	cell, err := intCell(4321)
+	assert.Nil(t, err)
+	k, _ := uniqueKey([]MemoryCell{cell}, []int{0})
+	assert.Equal(t, 4321, want[k])
+}
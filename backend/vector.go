@@ -0,0 +1,902 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// batchSize is the number of rows the vectorized operators process at a
+// time. Scans of tables smaller than a batch are not vectorized.
+const batchSize = 1024
+
+// identity selects every row of a batch.
+var identity = func() []int {
+	sel := make([]int, batchSize)
+	for i := range sel {
+		sel[i] = i
+	}
+	return sel
+}()
+
+// vector holds the values of a column for a batch of rows, decoded: ints
+// for INT and BOOL columns, bools being 0 or 1, texts for TEXT ones.
+type vector struct {
+	typ   ColumnType
+	ints  []int64
+	texts []MemoryCell
+	nulls []bool
+}
+
+func newVector(typ ColumnType) *vector {
+	v := &vector{typ: typ, nulls: make([]bool, batchSize)}
+	if typ == TextType {
+		v.texts = make([]MemoryCell, batchSize)
+	} else {
+		v.ints = make([]int64, batchSize)
+	}
+	return v
+}
+
+// load decodes column c of rows into the first values of v.
+func (v *vector) load(rows [][]MemoryCell, c int) error {
+	for i, row := range rows {
+		cell := row[c]
+		v.nulls[i] = cell == nil
+		switch {
+		case cell == nil:
+		case v.typ == TextType:
+			v.texts[i] = cell
+		case len(cell) != 4:
+			return ErrInvalidCell
+		default:
+			v.ints[i] = int64(int32(binary.BigEndian.Uint32(cell)))
+		}
+	}
+	return nil
+}
+
+// cell encodes the value at i.
+func (v *vector) cell(i int) (MemoryCell, error) {
+	switch {
+	case v.nulls[i]:
+		return nil, nil
+	case v.typ == TextType:
+		return v.texts[i], nil
+	case v.typ == BoolType:
+		return boolCell(v.ints[i] == 1), nil
+	}
+	return intCell(v.ints[i])
+}
+
+// appendKey appends the value at i to a hash key, like encodeKey.
+func (v *vector) appendKey(key []byte, i int) []byte {
+	switch {
+	case v.nulls[i]:
+		return append(key, 0)
+	case v.typ == TextType:
+		key = binary.AppendUvarint(append(key, 1), uint64(len(v.texts[i])))
+		return append(key, v.texts[i]...)
+	}
+	return binary.AppendVarint(append(key, 1), v.ints[i])
+}
+
+// batch is up to batchSize rows, a vector per column. sel lists the rows
+// in use in order: filters drop rows from it rather than moving values.
+type batch struct {
+	vecs []*vector
+	n    int
+	sel  []int
+}
+
+// size estimates the memory the vectors of b take, besides the texts
+// they share with tables.
+func (b *batch) size() int64 {
+	size := int64(sliceHeader)
+	for _, v := range b.vecs {
+		size += 3*sliceHeader + int64(len(v.nulls)+8*len(v.ints)+sliceHeader*len(v.texts))
+	}
+	return size
+}
+
+// batchIterator runs a vectorized node: every call of Next computes the
+// next batch of rows, which is valid until the following call. Batches
+// aren't empty.
+type batchIterator interface {
+	Next() bool
+	Batch() *batch
+	Err() error
+	Close() error
+}
+
+// batches is a batchIterator whose next returns the next batch, false when
+// there are no more, and whose close closes the inputs.
+type batches struct {
+	next  func() (*batch, bool, error)
+	close func() error
+	b     *batch
+	err   error
+	done  bool
+}
+
+func (bs *batches) Next() bool {
+	if bs.done {
+		return false
+	}
+	b, ok, err := bs.next()
+	if err != nil || !ok {
+		bs.b, bs.err, bs.done = nil, err, true
+		return false
+	}
+	bs.b = b
+	return true
+}
+
+func (bs *batches) Batch() *batch { return bs.b }
+
+func (bs *batches) Err() error { return bs.err }
+
+func (bs *batches) Close() error {
+	bs.done = true
+	if bs.close == nil {
+		return nil
+	}
+	close := bs.close
+	bs.close = nil
+	return close()
+}
+
+// batchPlan is a physical node that runs vectorized, computing batches of
+// rows a column at a time. Its open returns the rows of the batches one at
+// a time, for the nodes above that aren't vectorized.
+type batchPlan interface {
+	physicalPlan
+	openBatches() (batchIterator, error)
+}
+
+// openRows runs plan, returning its rows one at a time.
+func openRows(plan batchPlan) (rowIterator, error) {
+	it, err := plan.openBatches()
+	if err != nil {
+		return nil, err
+	}
+
+	var b *batch
+	pos := 0
+	next := func() ([]MemoryCell, bool, error) {
+		for b == nil || pos >= len(b.sel) {
+			if !it.Next() {
+				return nil, false, it.Err()
+			}
+			b, pos = it.Batch(), 0
+		}
+		i := b.sel[pos]
+		pos++
+		row := make([]MemoryCell, len(b.vecs))
+		for j, v := range b.vecs {
+			var err error
+			if row[j], err = v.cell(i); err != nil {
+				return nil, false, err
+			}
+		}
+		return row, true, nil
+	}
+	return &iterator{next: next, close: it.Close}, nil
+}
+
+// vecEvaluator computes an expression on the rows sel of a batch of the
+// schema it was compiled for. The vector it returns is only valid at sel,
+// until the next call.
+type vecEvaluator func(b *batch, sel []int) (*vector, error)
+
+// vectorizable tells whether exprs can be computed on batches. Sequence
+// functions can't, their calls must follow the rows.
+func vectorizable(exprs ...*expr) bool {
+	for _, e := range exprs {
+		if e.kind == callExpr || e.kind == aggregateExpr || !vectorizable(e.args...) {
+			return false
+		}
+	}
+	return true
+}
+
+// comparisons give the result of each operator when the left operand is
+// less than, equal to or greater than the right one.
+var comparisons = map[string][3]int64{
+	"=":  {0, 1, 0},
+	"<>": {1, 0, 1},
+	"<":  {1, 0, 0},
+	"<=": {1, 1, 0},
+	">":  {0, 0, 1},
+	">=": {0, 1, 1},
+}
+
+// compileVector turns e into a function of the batches of schema. It
+// computes the same values as compileExpr.
+func (mb *MemoryBackend) compileVector(e *expr, schema []planColumn) (vecEvaluator, error) {
+	var args []vecEvaluator
+	for _, arg := range e.args {
+		ev, err := mb.compileVector(arg, schema)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, ev)
+	}
+
+	switch e.kind {
+	case columnExpr:
+		i, err := position(schema, e.col)
+		if err != nil {
+			return nil, err
+		}
+		return func(b *batch, _ []int) (*vector, error) { return b.vecs[i], nil }, nil
+	case constExpr:
+		v := newVector(e.typ)
+		for i := range v.nulls {
+			v.nulls[i] = e.value == nil
+		}
+		if e.value != nil {
+			rows := make([][]MemoryCell, batchSize)
+			for i := range rows {
+				rows[i] = []MemoryCell{e.value}
+			}
+			if e.typ == BoolType {
+				for i := range v.ints {
+					v.ints[i] = int64(e.value[0])
+				}
+			} else if err := v.load(rows, 0); err != nil {
+				return nil, err
+			}
+		}
+		return func(*batch, []int) (*vector, error) { return v, nil }, nil
+	case isNullExpr:
+		out := newVector(BoolType)
+		return func(b *batch, sel []int) (*vector, error) {
+			v, err := args[0](b, sel)
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range sel {
+				out.ints[i] = 0
+				if v.nulls[i] != e.not {
+					out.ints[i] = 1
+				}
+			}
+			return out, nil
+		}, nil
+	case unaryExpr:
+		out := newVector(e.typ)
+		return func(b *batch, sel []int) (*vector, error) {
+			v, err := args[0](b, sel)
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range sel {
+				if out.nulls[i] = v.nulls[i]; v.nulls[i] {
+					continue
+				}
+				if e.op == "NOT" {
+					out.ints[i] = 1 - v.ints[i]
+				} else if out.ints[i] = -v.ints[i]; out.ints[i] > math.MaxInt32 {
+					return nil, ErrIntegerOutOfRange
+				}
+			}
+			return out, nil
+		}, nil
+	case binaryExpr:
+		if e.op == "AND" || e.op == "OR" {
+			return vectorLogical(e.op == "AND", args[0], args[1]), nil
+		}
+		if results, ok := comparisons[e.op]; ok {
+			return vectorCompare(results, e.args[0].typ, args[0], args[1]), nil
+		}
+		switch e.op {
+		case "+", "-", "*", "/", "%":
+			return vectorArithmetic(e.op[0], args[0], args[1]), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedExpression, e)
+}
+
+// vectorLogical evaluates AND or OR in three-valued logic. Like logical,
+// it only evaluates the right operand on rows the left one doesn't decide.
+func vectorLogical(and bool, left, right vecEvaluator) vecEvaluator {
+	out := newVector(BoolType)
+	// decisive is false for AND, true for OR
+	var decisive int64
+	if !and {
+		decisive = 1
+	}
+	undecided := make([]int, 0, batchSize)
+	return func(b *batch, sel []int) (*vector, error) {
+		l, err := left(b, sel)
+		if err != nil {
+			return nil, err
+		}
+		undecided = undecided[:0]
+		for _, i := range sel {
+			if !l.nulls[i] && l.ints[i] == decisive {
+				out.nulls[i], out.ints[i] = false, decisive
+				continue
+			}
+			undecided = append(undecided, i)
+		}
+		if len(undecided) == 0 {
+			return out, nil
+		}
+
+		r, err := right(b, undecided)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range undecided {
+			switch {
+			case !r.nulls[i] && r.ints[i] == decisive:
+				out.nulls[i], out.ints[i] = false, decisive
+			case l.nulls[i] || r.nulls[i]:
+				out.nulls[i] = true
+			default:
+				out.nulls[i], out.ints[i] = false, 1-decisive
+			}
+		}
+		return out, nil
+	}
+}
+
+// vectorCompare compares operands of type typ, results giving the result
+// for less, equal and greater.
+func vectorCompare(results [3]int64, typ ColumnType, left, right vecEvaluator) vecEvaluator {
+	out := newVector(BoolType)
+	return func(b *batch, sel []int) (*vector, error) {
+		l, err := left(b, sel)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(b, sel)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range sel {
+			if out.nulls[i] = l.nulls[i] || r.nulls[i]; out.nulls[i] {
+				continue
+			}
+			var c int
+			switch {
+			case typ == TextType:
+				c = bytes.Compare(l.texts[i], r.texts[i])
+			case l.ints[i] < r.ints[i]:
+				c = -1
+			case l.ints[i] > r.ints[i]:
+				c = 1
+			}
+			out.ints[i] = results[c+1]
+		}
+		return out, nil
+	}
+}
+
+func vectorArithmetic(op byte, left, right vecEvaluator) vecEvaluator {
+	out := newVector(IntType)
+	return func(b *batch, sel []int) (*vector, error) {
+		l, err := left(b, sel)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(b, sel)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range sel {
+			if out.nulls[i] = l.nulls[i] || r.nulls[i]; out.nulls[i] {
+				continue
+			}
+			x, y := l.ints[i], r.ints[i]
+			var z int64
+			switch op {
+			case '+':
+				z = x + y
+			case '-':
+				z = x - y
+			case '*':
+				z = x * y
+			default:
+				if y == 0 {
+					return nil, ErrDivisionByZero
+				}
+				if z = x / y; op == '%' {
+					z = x % y
+				}
+			}
+			if z < math.MinInt32 || z > math.MaxInt32 {
+				return nil, ErrIntegerOutOfRange
+			}
+			out.ints[i] = z
+		}
+		return out, nil
+	}
+}
+
+// compileVectorConds turns conditions into a filter of the rows sel of a
+// batch, keeping those for which all of them are true, nil when there are
+// none. Like compileConds, a condition is only evaluated on the rows that
+// passed the ones before it.
+func (mb *MemoryBackend) compileVectorConds(conds []*expr, schema []planColumn) (func(*batch, []int) ([]int, error), error) {
+	if len(conds) == 0 {
+		return nil, nil
+	}
+	var evs []vecEvaluator
+	for _, c := range conds {
+		ev, err := mb.compileVector(c, schema)
+		if err != nil {
+			return nil, err
+		}
+		evs = append(evs, ev)
+	}
+	kept := make([]int, 0, batchSize)
+	return func(b *batch, sel []int) ([]int, error) {
+		for _, ev := range evs {
+			v, err := ev(b, sel)
+			if err != nil {
+				return nil, err
+			}
+			// After the first condition sel is kept itself, which is safe
+			// to compact in place
+			n := kept[:0]
+			for _, i := range sel {
+				if !v.nulls[i] && v.ints[i] == 1 {
+					n = append(n, i)
+				}
+			}
+			kept, sel = n, n
+		}
+		return sel, nil
+	}, nil
+}
+
+// vecScan reads every row of a table a batch at a time, decoding the
+// segments of columnar tables that zones don't rule out straight into
+// vectors.
+type vecScan struct {
+	estimated
+	ctx         context.Context
+	scan        *scanNode
+	filter      []*expr
+	zones       []zoneCond
+	pred        func(*batch, []int) ([]int, error)
+	part, parts int
+}
+
+func (s *vecScan) schema() []planColumn { return s.scan.schema() }
+
+func (s *vecScan) open() (rowIterator, error) { return openRows(s) }
+
+func (s *vecScan) openBatches() (batchIterator, error) {
+	// Rows added while the scan runs are not returned
+	tr := partRows(s.scan, s.part, s.parts)
+	b := &batch{}
+	for _, c := range s.scan.schema() {
+		b.vecs = append(b.vecs, newVector(c.typ))
+	}
+	next := func() (*batch, bool, error) {
+		for {
+			if err := ContextErr(s.ctx); err != nil {
+				return nil, false, err
+			}
+			seg, chunk, err := tr.next(s.zones)
+			switch {
+			case err != nil:
+				return nil, false, err
+			case seg != nil:
+				if err := seg.checkColumns(tr.types); err != nil {
+					return nil, false, err
+				}
+				for j, c := range s.scan.columns {
+					if err := seg.Columns[c].decode(b.vecs[j]); err != nil {
+						return nil, false, err
+					}
+				}
+				b.n = segmentRows
+			case len(chunk) == 0:
+				return nil, false, tr.close()
+			default:
+				for j, c := range s.scan.columns {
+					if err := b.vecs[j].load(chunk, c); err != nil {
+						return nil, false, err
+					}
+				}
+				b.n = len(chunk)
+			}
+			b.sel = identity[:b.n]
+			if s.pred != nil {
+				if b.sel, err = s.pred(b, b.sel); err != nil {
+					return nil, false, err
+				}
+			}
+			if len(b.sel) > 0 {
+				return b, true, nil
+			}
+		}
+	}
+	return &batches{next: next, close: tr.close}, nil
+}
+
+func (s *vecScan) explain() (string, []string, []physicalPlan) {
+	return parallelTitle(s.parts, "Vectorized Seq Scan on ") + scanName(s.scan), scanDetails(s.scan, s.filter), nil
+}
+
+// vecProject computes the items of a SELECT on batches.
+type vecProject struct {
+	estimated
+	node  *projectNode
+	input batchPlan
+	evs   []vecEvaluator
+}
+
+func (p *vecProject) schema() []planColumn { return p.node.schema() }
+
+func (p *vecProject) open() (rowIterator, error) { return openRows(p) }
+
+func (p *vecProject) openBatches() (batchIterator, error) {
+	input, err := runBatches(p.input)
+	if err != nil {
+		return nil, err
+	}
+	out := &batch{vecs: make([]*vector, len(p.evs))}
+	next := func() (*batch, bool, error) {
+		if !input.Next() {
+			return nil, false, input.Err()
+		}
+		in := input.Batch()
+		for j, ev := range p.evs {
+			var err error
+			if out.vecs[j], err = ev(in, in.sel); err != nil {
+				return nil, false, err
+			}
+		}
+		out.n, out.sel = in.n, in.sel
+		return out, true, nil
+	}
+	return &batches{next: next, close: input.Close}, nil
+}
+
+func (p *vecProject) explain() (string, []string, []physicalPlan) {
+	return "Vectorized Project", []string{"Output: " + exprList(p.node.exprs, ", ")}, []physicalPlan{p.input}
+}
+
+// vecAggregate computes aggregates over groups of rows like aggregate,
+// updating the states of a whole batch one aggregate at a time.
+type vecAggregate struct {
+	estimated
+	node    *aggregateNode
+	input   batchPlan
+	groups  []vecEvaluator
+	args    []vecEvaluator
+	partial bool
+	mem     workMem
+}
+
+// vecGroups are the groups of a vecAggregate: their GROUP BY values, and
+// the states of each aggregate.
+type vecGroups struct {
+	values [][]MemoryCell
+	states []aggColumn
+	byKey  map[string]int
+}
+
+func (a *vecAggregate) newGroups() *vecGroups {
+	gs := &vecGroups{states: make([]aggColumn, len(a.node.aggs)), byKey: map[string]int{}}
+	if len(a.groups) == 0 {
+		gs.add(nil)
+	}
+	return gs
+}
+
+func (gs *vecGroups) add(cells []MemoryCell) int {
+	gs.values = append(gs.values, cells)
+	for j := range gs.states {
+		gs.states[j].grow()
+	}
+	return len(gs.values) - 1
+}
+
+// aggColumn holds the states of an aggregate, a value per group. counts
+// are those of the values aggregated, so a group has a min or max once it
+// counted one.
+type aggColumn struct {
+	counts []int64
+	sums   []int64
+	ints   []int64
+	texts  []MemoryCell
+}
+
+func (c *aggColumn) grow() {
+	c.counts = append(c.counts, 0)
+	c.sums = append(c.sums, 0)
+	c.ints = append(c.ints, 0)
+	c.texts = append(c.texts, nil)
+}
+
+func (a *vecAggregate) schema() []planColumn { return a.node.schema() }
+
+func (a *vecAggregate) open() (rowIterator, error) {
+	input, err := runBatches(a.input)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	spill := newAggSpill(a.node, a.mem)
+	it, err := a.aggregate(input, spill)
+	if err != nil {
+		a.removeSpill(spill.files)
+		return nil, err
+	}
+	return it, nil
+}
+
+// aggregate accumulates the batches of input into their groups, writing
+// the groups to spill whenever they outgrow work_mem.
+func (a *vecAggregate) aggregate(input batchIterator, spill *aggSpill) (rowIterator, error) {
+	groups := a.newGroups()
+	var size int64
+	groupOf := make([]int, batchSize)
+	vecs := make([]*vector, len(a.groups))
+	var key []byte
+	var err error
+	for input.Next() {
+		b := input.Batch()
+		for j, ev := range a.groups {
+			if vecs[j], err = ev(b, b.sel); err != nil {
+				return nil, err
+			}
+		}
+		if len(a.groups) > 0 {
+			for _, i := range b.sel {
+				key = key[:0]
+				for _, v := range vecs {
+					key = v.appendKey(key, i)
+				}
+				g, ok := groups.byKey[string(key)]
+				if !ok {
+					cells := make([]MemoryCell, len(vecs))
+					for j, v := range vecs {
+						if cells[j], err = v.cell(i); err != nil {
+							return nil, err
+						}
+					}
+					g = groups.add(cells)
+					groups.byKey[string(key)] = g
+					n := len(key) + len(groups.states)*aggStateSize
+					a.hold(n)
+					size += int64(n)
+				}
+				groupOf[i] = g
+			}
+		}
+
+		for j, agg := range a.node.aggs {
+			var arg *vector
+			if a.args[j] != nil {
+				if arg, err = a.args[j](b, b.sel); err != nil {
+					return nil, err
+				}
+			}
+			groups.states[j].accumulate(agg.op, arg, b.sel, groupOf)
+		}
+
+		// Groups are only written out between batches, which add them
+		if a.mem.exceeded(size) {
+			states, err := a.rows(groups, true)
+			if err == nil {
+				err = spill.write(states)
+			}
+			if err != nil {
+				return nil, err
+			}
+			groups = a.newGroups()
+			a.hold(int(-size))
+			size = 0
+		}
+	}
+	if err := input.Err(); err != nil {
+		return nil, err
+	}
+	rows := func(partial bool) ([][]MemoryCell, error) { return a.rows(groups, partial) }
+	return spill.finish(rows, size, a.partial, &a.estimated)
+}
+
+// rows returns a row per group, as aggGroups.rows does.
+func (a *vecAggregate) rows(groups *vecGroups, partial bool) ([][]MemoryCell, error) {
+	var results [][]MemoryCell
+	for g, cells := range groups.values {
+		row := append([]MemoryCell(nil), cells...)
+		for j, agg := range a.node.aggs {
+			var typ ColumnType
+			if len(agg.args) > 0 {
+				typ = agg.args[0].typ
+			}
+			if partial {
+				state, err := groups.states[j].state(agg.op, typ, g)
+				if err != nil {
+					return nil, err
+				}
+				row = append(row, state.encode())
+				continue
+			}
+			cell, err := groups.states[j].result(agg.op, typ, g)
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, cell)
+		}
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+// accumulate adds the rows sel of a batch, of the groups groupOf, to the
+// states. arg is nil for count(*).
+func (c *aggColumn) accumulate(op string, arg *vector, sel []int, groupOf []int) {
+	if arg == nil {
+		for _, i := range sel {
+			c.counts[groupOf[i]]++
+		}
+		return
+	}
+
+	// sign makes the comparison of min and max the same
+	sign := 1
+	if op == "min" {
+		sign = -1
+	}
+	for _, i := range sel {
+		if arg.nulls[i] {
+			continue
+		}
+		g := groupOf[i]
+		c.counts[g]++
+		switch {
+		case op == "sum":
+			c.sums[g] += arg.ints[i]
+		case op == "count":
+		case arg.typ == TextType:
+			if c.counts[g] == 1 || bytes.Compare(arg.texts[i], c.texts[g])*sign > 0 {
+				c.texts[g] = arg.texts[i]
+			}
+		default:
+			if c.counts[g] == 1 || (arg.ints[i]-c.ints[g])*int64(sign) > 0 {
+				c.ints[g] = arg.ints[i]
+			}
+		}
+	}
+}
+
+// result is the value of the aggregate op of values of type typ for group
+// g, like aggState.result.
+func (c *aggColumn) result(op string, typ ColumnType, g int) (MemoryCell, error) {
+	switch {
+	case op == "count":
+		return intCell(c.counts[g])
+	case c.counts[g] == 0:
+		return nil, nil
+	case op == "sum":
+		return intCell(c.sums[g])
+	case typ == TextType:
+		return c.texts[g], nil
+	case typ == BoolType:
+		return boolCell(c.ints[g] == 1), nil
+	}
+	return intCell(c.ints[g])
+}
+
+// state is the state of the aggregate op for group g, as aggregate keeps
+// it.
+func (c *aggColumn) state(op string, typ ColumnType, g int) (aggState, error) {
+	s := aggState{count: c.counts[g], sum: c.sums[g]}
+	if (op == "min" || op == "max") && c.counts[g] > 0 {
+		var err error
+		if s.value, err = c.result(op, typ, g); err != nil {
+			return aggState{}, err
+		}
+	}
+	return s, nil
+}
+
+func (a *vecAggregate) explain() (string, []string, []physicalPlan) {
+	prefix := "Vectorized "
+	if a.partial {
+		prefix = "Partial " + prefix
+	}
+	title, details := aggregateTitle(a.node, prefix)
+	return title, details, []physicalPlan{a.input}
+}
+
+// vectorizeScan returns s vectorized when its table is columnar or has at
+// least a batch of rows, and its filter can be computed on batches, s
+// otherwise.
+func (pp *physicalPlanner) vectorizeScan(s *seqScan, rows float64) (physicalPlan, error) {
+	small := rows < batchSize && s.scan.table.Storage != ColumnarStorage
+	if pp.mb.rowAtATime || small || !vectorizable(s.filter...) {
+		return s, nil
+	}
+	pred, err := pp.mb.compileVectorConds(s.filter, s.scan.schema())
+	if err != nil {
+		return nil, err
+	}
+	return &vecScan{estimated: estimated{est: s.est}, ctx: s.ctx, scan: s.scan, filter: s.filter, zones: s.zones, pred: pred}, nil
+}
+
+// vectorizeProjection returns p vectorized when its input is and its items
+// can be computed on batches, p otherwise.
+func (pp *physicalPlanner) vectorizeProjection(p *projection) (physicalPlan, error) {
+	input, ok := p.input.(batchPlan)
+	if !ok || !vectorizable(p.node.exprs...) {
+		return p, nil
+	}
+	vp, err := pp.vecProject(p.node, input)
+	if err != nil {
+		return nil, err
+	}
+	vp.est = p.est
+	return vp, nil
+}
+
+// vecProject compiles the items of node on the batches of input.
+func (pp *physicalPlanner) vecProject(node *projectNode, input batchPlan) (*vecProject, error) {
+	vp := &vecProject{node: node, input: input}
+	for _, e := range node.exprs {
+		ev, err := pp.mb.compileVector(e, input.schema())
+		if err != nil {
+			return nil, err
+		}
+		vp.evs = append(vp.evs, ev)
+	}
+	return vp, nil
+}
+
+// vectorizeAggregate returns a vectorized when its input is and its groups
+// and arguments can be computed on batches, a otherwise.
+func (pp *physicalPlanner) vectorizeAggregate(a *aggregate) (physicalPlan, error) {
+	input, ok := a.input.(batchPlan)
+	if !ok || !vectorizable(a.node.groups...) {
+		return a, nil
+	}
+	for _, agg := range a.node.aggs {
+		if !vectorizable(agg.args...) {
+			return a, nil
+		}
+	}
+
+	va, err := pp.vecAggregate(a.node, input)
+	if err != nil {
+		return nil, err
+	}
+	va.est = a.est
+	return va, nil
+}
+
+// vecAggregate compiles the groups and arguments of node on the batches of
+// input.
+func (pp *physicalPlanner) vecAggregate(node *aggregateNode, input batchPlan) (*vecAggregate, error) {
+	va := &vecAggregate{node: node, input: input, mem: pp.workMem()}
+	for _, g := range node.groups {
+		ev, err := pp.mb.compileVector(g, input.schema())
+		if err != nil {
+			return nil, err
+		}
+		va.groups = append(va.groups, ev)
+	}
+	for _, agg := range node.aggs {
+		var ev vecEvaluator
+		if len(agg.args) > 0 {
+			var err error
+			if ev, err = pp.mb.compileVector(agg.args[0], input.schema()); err != nil {
+				return nil, err
+			}
+		}
+		va.args = append(va.args, ev)
+	}
+	return va, nil
+}
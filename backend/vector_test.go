@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+// eventsSchema creates a table of n events, with NULL amounts and kinds,
+// stored as storage.
+func eventsSchema(t testing.TB, b Backend, n int64, storage string) {
+	assert.Nil(t, execAll(t, b, "CREATE TABLE events (id INT PRIMARY KEY, kind TEXT, user_id INT, amount INT) WITH (storage = '"+storage+"');"))
+	var rows [][]interface{}
+	for i := int64(0); i < n; i++ {
+		var kind, amount interface{} = fmt.Sprintf("k%d", i%7), i % 97
+		if i%10 == 3 {
+			amount = nil
+		}
+		if i%13 == 5 {
+			kind = nil
+		}
+		rows = append(rows, []interface{}{i, kind, i % 500, amount})
+	}
+	assert.Nil(t, b.InsertValues(context.Background(), "events", []string{"id", "kind", "user_id", "amount"}, rows))
+}
+
+func TestVectorized(t *testing.T) {
+	mb := NewMemoryBacked()
+	eventsSchema(t, mb, 5000, "row")
+
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{source: "SELECT kind, count(*), count(amount), sum(amount), min(amount), max(amount), min(kind), max(kind) FROM events GROUP BY kind;"},
+		{source: "SELECT user_id % 7, count(*) FROM events WHERE amount IS NOT NULL GROUP BY user_id % 7;"},
+		{source: "SELECT id, amount * 2 - user_id, -amount, amount IS NULL FROM events WHERE amount > 50 AND kind <> 'k3';"},
+		{source: "SELECT count(*) FROM events WHERE amount <> 0 AND 1000 / amount > 20;"},
+		{source: "SELECT sum(amount) FROM events WHERE NOT (user_id < 100 OR amount IS NULL);"},
+		{source: "SELECT count(*), sum(amount), min(kind) FROM events WHERE id < 0;"},
+		{source: "SELECT id, kind FROM events WHERE amount > 90 ORDER BY id DESC LIMIT 5;"},
+		{source: "SELECT 1000 / amount FROM events;", err: ErrDivisionByZero},
+		{source: "SELECT amount * 100000000 FROM events;", err: ErrIntegerOutOfRange},
+	}
+
+	for _, test := range tests {
+		mb.rowAtATime = true
+		want, err := query(t, mb, test.source)
+		assert.ErrorIs(t, err, test.err, test.source)
+
+		mb.rowAtATime = false
+		got, err := query(t, mb, test.source)
+		assert.ErrorIs(t, err, test.err, test.source)
+		assert.Equal(t, want, got, test.source)
+	}
+}
+
+func TestVectorizedExplain(t *testing.T) {
+	mb := NewMemoryBacked()
+	eventsSchema(t, mb, 5000, "row")
+
+	assert.Equal(t, `Project  (cost=7383.50 rows=200)
+  Output: kind, count(*)
+  ->  Vectorized Hash Aggregate  (cost=7283.50 rows=200)
+        Group Key: kind
+        ->  Vectorized Seq Scan on events  (cost=6250.00 rows=1667)
+              Columns: kind, amount
+              Filter: (amount > 50)`, explain(t, mb, "EXPLAIN SELECT kind, count(*) FROM events WHERE amount > 50 GROUP BY kind;"))
+
+	// Sequence functions are called row by row
+	assert.Nil(t, execAll(t, mb, "CREATE SEQUENCE ids;"))
+	assert.Regexp(t, `^Project .*\n.*\n  ->  Vectorized Seq Scan on events `, explain(t, mb, "EXPLAIN SELECT id + nextval('ids') FROM events;"))
+
+	// Vectorized nodes count the rows of their batches
+	plan := explain(t, mb, "EXPLAIN ANALYZE SELECT count(*) FROM events WHERE kind = 'k1';")
+	assert.Regexp(t, regexp.MustCompile(`Vectorized Aggregate .* rows=1 loops=1 `), plan)
+	assert.Regexp(t, regexp.MustCompile(`Vectorized Seq Scan on events .* rows=660 loops=1 memory=[0-9]+kB\)`), plan)
+}
+
+// BenchmarkSelect compares the vectorized operators with the row at a time
+// ones, and with columnar storage, on analytical queries.
+func BenchmarkSelect(b *testing.B) {
+	mb := NewMemoryBacked()
+	eventsSchema(b, mb, 100000, "row")
+	columnar := NewMemoryBacked()
+	eventsSchema(b, columnar, 100000, "columnar")
+
+	queries := []struct {
+		name   string
+		source string
+	}{
+		{name: "scan", source: "SELECT id, amount FROM events;"},
+		{name: "filter", source: "SELECT count(*) FROM events WHERE amount > 50 AND kind <> 'k3';"},
+		{name: "project", source: "SELECT id, amount * 2 - user_id FROM events WHERE amount IS NOT NULL;"},
+		{name: "aggregate", source: "SELECT count(*), sum(amount), min(amount), max(amount) FROM events;"},
+		{name: "group", source: "SELECT kind, count(*), sum(amount), max(user_id) FROM events GROUP BY kind;"},
+	}
+	for _, q := range queries {
+		asts, err := parser.Parse(q.source)
+		assert.Nil(b, err, q.source)
+		slct := asts.Statements[0].SelectStatement
+
+		for _, mode := range []string{"rows", "vectorized", "columnar"} {
+			b.Run(q.name+"/"+mode, func(b *testing.B) {
+				db := mb
+				if mode == "columnar" {
+					db = columnar
+				}
+				mb.rowAtATime = mode == "rows"
+				for i := 0; i < b.N; i++ {
+					if _, err := selectAll(db, slct); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
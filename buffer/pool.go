@@ -0,0 +1,225 @@
+// Package buffer caches the pages of on-disk files in memory, within a
+// size limit, for storage engines that don't load whole tables.
+//
+// Pages are fetched pinned: a pinned page stays in the pool, and its data
+// in place, until it is unpinned. Unpinned pages are evicted with the
+// clock algorithm once the pool is full: the clock hand sweeps the pages
+// in turn, giving those used since it last passed a second chance, and
+// evicts the first one that wasn't. Pages unpinned dirty are written back
+// to their store before they are evicted.
+package buffer
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrUnpinned = errors.New("buffer: page is not pinned")
+
+// PageID names a page: its file, as numbered by the storage engine, and
+// its number in that file.
+type PageID struct {
+	File uint64
+	Page uint64
+}
+
+// Store reads pages from, and writes them back to, the files they belong
+// to.
+type Store interface {
+	ReadPage(id PageID) ([]byte, error)
+	WritePage(id PageID, data []byte) error
+}
+
+// Page is a page held in a Pool.
+type Page struct {
+	ID PageID
+	// Data may be modified while the page is pinned, as long as it is
+	// unpinned dirty. A page evicted leaves its data alone, pools never
+	// reuse it.
+	Data []byte
+
+	store Store
+	pins  int
+	dirty bool
+	// used is the reference bit of the clock, set whenever the page is
+	// fetched.
+	used bool
+}
+
+// Pool caches up to Size bytes of pages. When all of them are pinned it
+// holds more, until they are unpinned. It is safe for concurrent use.
+type Pool struct {
+	size int64
+
+	mu    sync.Mutex
+	pages map[PageID]*Page
+	// clock holds the pages in the order the hand visits them.
+	clock []*Page
+	hand  int
+	used  int64
+	stats Stats
+}
+
+// Stats describe the contents and the use of a Pool.
+type Stats struct {
+	// Size is the size limit and Used the size of the pages held, Pages
+	// of them.
+	Size  int64
+	Used  int64
+	Pages int
+	// Hits and Misses count the pages fetched that were in the pool and
+	// those that were read.
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Writes counts the dirty pages written back.
+	Writes uint64
+}
+
+// HitRatio is the fraction of the pages fetched that were in the pool, 0
+// before any.
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// New returns a pool of size bytes.
+func New(size int64) *Pool {
+	return &Pool{size: size, pages: map[PageID]*Page{}}
+}
+
+// Fetch returns page id pinned, reading it from s when it isn't in the
+// pool. It must be unpinned once done with.
+func (p *Pool) Fetch(id PageID, s Store) (*Page, error) {
+	p.mu.Lock()
+	if page, ok := p.pages[id]; ok {
+		p.stats.Hits++
+		page.pins++
+		page.used = true
+		p.mu.Unlock()
+		return page, nil
+	}
+	p.stats.Misses++
+	p.mu.Unlock()
+
+	data, err := s.ReadPage(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Another fetch may have read it meanwhile
+	if page, ok := p.pages[id]; ok {
+		page.pins++
+		page.used = true
+		return page, nil
+	}
+	if err := p.evict(int64(len(data))); err != nil {
+		return nil, err
+	}
+	page := &Page{ID: id, Data: data, store: s, pins: 1, used: true}
+	p.pages[id] = page
+	p.clock = append(p.clock, page)
+	p.used += int64(len(data))
+	return page, nil
+}
+
+// Unpin releases a page fetched, which is written back before it is
+// evicted if dirty is set.
+func (p *Pool) Unpin(page *Page, dirty bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if page.pins == 0 {
+		return ErrUnpinned
+	}
+	page.pins--
+	page.dirty = page.dirty || dirty
+	return nil
+}
+
+// evict makes room for n more bytes, as far as unpinned pages allow. It
+// must be called with mu held.
+func (p *Pool) evict(n int64) error {
+	// Two sweeps clear every reference bit, a third finds nothing new
+	for sweeps := 0; p.used+n > p.size && sweeps < 3*len(p.clock); sweeps++ {
+		if p.hand >= len(p.clock) {
+			p.hand = 0
+		}
+		page := p.clock[p.hand]
+		switch {
+		case page.pins > 0:
+			p.hand++
+		case page.used:
+			page.used = false
+			p.hand++
+		default:
+			if err := p.writeBack(page); err != nil {
+				return err
+			}
+			p.remove(p.hand)
+			p.stats.Evictions++
+		}
+	}
+	return nil
+}
+
+// remove drops the page at position i of the clock, the hand then
+// pointing at the page that takes its place.
+func (p *Pool) remove(i int) {
+	page := p.clock[i]
+	last := len(p.clock) - 1
+	p.clock[i] = p.clock[last]
+	p.clock[last] = nil
+	p.clock = p.clock[:last]
+	delete(p.pages, page.ID)
+	p.used -= int64(len(page.Data))
+}
+
+func (p *Pool) writeBack(page *Page) error {
+	if !page.dirty {
+		return nil
+	}
+	if err := page.store.WritePage(page.ID, page.Data); err != nil {
+		return err
+	}
+	page.dirty = false
+	p.stats.Writes++
+	return nil
+}
+
+// Flush writes back every dirty page.
+func (p *Pool) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, page := range p.clock {
+		if err := p.writeBack(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard drops the unpinned pages of file without writing them back, for
+// files that are removed.
+func (p *Pool) Discard(file uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < len(p.clock); {
+		if page := p.clock[i]; page.ID.File == file && page.pins == 0 {
+			p.remove(i)
+			continue
+		}
+		i++
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats
+	s.Size, s.Used, s.Pages = p.size, p.used, len(p.clock)
+	return s
+}
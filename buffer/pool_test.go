@@ -0,0 +1,96 @@
+package buffer
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// memStore holds pages of 10 bytes, counting the reads.
+type memStore struct {
+	pages map[PageID][]byte
+	reads int
+	fail  error
+}
+
+func (s *memStore) ReadPage(id PageID) ([]byte, error) {
+	s.reads++
+	data, ok := s.pages[id]
+	if !ok {
+		data = make([]byte, 10)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *memStore) WritePage(id PageID, data []byte) error {
+	if s.fail != nil {
+		return s.fail
+	}
+	s.pages[id] = append([]byte(nil), data...)
+	return nil
+}
+
+func fetch(t *testing.T, p *Pool, s Store, page uint64) *Page {
+	pg, err := p.Fetch(PageID{File: 1, Page: page}, s)
+	assert.Nil(t, err)
+	return pg
+}
+
+func TestPool(t *testing.T) {
+	s := &memStore{pages: map[PageID][]byte{}}
+	p := New(30)
+
+	// Pages stay in the pool, up to its size
+	for i := uint64(0); i < 3; i++ {
+		assert.Nil(t, p.Unpin(fetch(t, p, s, i), false))
+	}
+	assert.Nil(t, p.Unpin(fetch(t, p, s, 0), false))
+	assert.Equal(t, 3, s.reads)
+	stats := p.Stats()
+	assert.Equal(t, Stats{Size: 30, Used: 30, Pages: 3, Hits: 1, Misses: 3}, stats)
+	assert.Equal(t, 0.25, stats.HitRatio())
+
+	// Every page was used since the hand last passed: they all get a
+	// second chance, then the first one goes
+	assert.Nil(t, p.Unpin(fetch(t, p, s, 3), false))
+	assert.Equal(t, uint64(1), p.Stats().Evictions)
+	fetch(t, p, s, 0)
+	assert.Equal(t, 5, s.reads)
+
+	// Pinned pages are never evicted, the pool grows instead
+	pinned := fetch(t, p, s, 4)
+	pinned.Data[0] = 42
+	fetch(t, p, s, 5)
+	fetch(t, p, s, 6)
+	assert.Nil(t, p.Unpin(pinned, true))
+	assert.ErrorIs(t, p.Unpin(&Page{}, false), ErrUnpinned)
+	assert.Equal(t, 4, p.Stats().Pages)
+
+	// Dirty pages are written back when evicted
+	for i := uint64(7); i < 10; i++ {
+		assert.Nil(t, p.Unpin(fetch(t, p, s, i), false))
+	}
+	assert.Equal(t, byte(42), s.pages[PageID{File: 1, Page: 4}][0])
+	assert.Equal(t, uint64(1), p.Stats().Writes)
+	assert.Equal(t, byte(42), fetch(t, p, s, 4).Data[0])
+}
+
+func TestPoolFlush(t *testing.T) {
+	s := &memStore{pages: map[PageID][]byte{}}
+	p := New(100)
+	page := fetch(t, p, s, 1)
+	page.Data[0] = 1
+	assert.Nil(t, p.Unpin(page, true))
+
+	s.fail = errors.New("disk full")
+	assert.ErrorIs(t, p.Flush(), s.fail)
+	s.fail = nil
+	assert.Nil(t, p.Flush())
+	assert.Equal(t, byte(1), s.pages[PageID{File: 1, Page: 1}][0])
+	assert.Nil(t, p.Flush())
+	assert.Equal(t, uint64(1), p.Stats().Writes)
+
+	p.Discard(1)
+	assert.Equal(t, 0, p.Stats().Pages)
+	assert.Equal(t, int64(0), p.Stats().Used)
+}
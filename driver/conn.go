@@ -0,0 +1,159 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/session"
+)
+
+var (
+	ErrTxUnsupported  = errors.New("maydb: backend does not support transactions")
+	ErrIsolationLevel = errors.New("maydb: unsupported isolation level")
+)
+
+type conn struct {
+	connector *connector
+	session   *session.Session
+	inTx      bool
+	closed    bool
+	// ownsBackend is set for connections of Driver.Open, the only ones to
+	// use their backend, which they close
+	ownsBackend bool
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	if c.closed {
+		return nil, driver.ErrBadConn
+	}
+	// Parameter types are inferred from the catalog, which other
+	// connections may be changing
+	if !c.inTx {
+		c.connector.mu.Lock()
+		defer c.connector.mu.Unlock()
+	}
+	p, err := c.session.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, prepared: p}, nil
+}
+
+func (c *conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	if c.inTx {
+		_ = c.rollback()
+	}
+	c.closed = true
+	if c.ownsBackend {
+		return c.connector.Close()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if sql.IsolationLevel(opts.Isolation) != sql.LevelDefault &&
+		sql.IsolationLevel(opts.Isolation) != sql.LevelSerializable {
+		return nil, ErrIsolationLevel
+	}
+	tr, ok := c.connector.backend.(backend.Transactor)
+	if !ok {
+		return nil, ErrTxUnsupported
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c.connector.mu.Lock()
+	if err := tr.Begin(); err != nil {
+		c.connector.mu.Unlock()
+		return nil, err
+	}
+	c.inTx = true
+	return &tx{conn: c}, nil
+}
+
+func (c *conn) commit() error {
+	defer c.endTx()
+	return c.connector.backend.(backend.Transactor).Commit()
+}
+
+func (c *conn) rollback() error {
+	defer c.endTx()
+	return c.connector.backend.(backend.Transactor).Rollback()
+}
+
+func (c *conn) endTx() {
+	c.inTx = false
+	c.connector.mu.Unlock()
+}
+
+// exec runs p with args, returning the number of rows inserted and the
+// rows of the last statement that returned rows. In a transaction, which
+// keeps the backend locked, those are computed as they are read. Outside
+// one they are read before the backend is unlocked, so that statements run
+// while they are being read do not wait for them to be closed. The
+// statements, the reading of the rows included, stop once ctx is done.
+func (c *conn) exec(ctx context.Context, p *session.Prepared, args []interface{}) (int64, *rows, error) {
+	if c.closed {
+		return 0, nil, driver.ErrBadConn
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	if !c.inTx {
+		c.connector.mu.Lock()
+		defer c.connector.mu.Unlock()
+	}
+
+	rs, err := p.ExecContext(ctx, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var affected int64
+	var last *session.Result
+	for _, r := range rs {
+		affected += r.RowsAffected
+		if r.Rows != nil {
+			last = r
+		}
+	}
+	if last == nil {
+		return affected, nil, nil
+	}
+	if c.inTx {
+		return affected, &rows{rows: last.Rows}, nil
+	}
+	return affected, readRows(last.Rows), nil
+}
+
+type tx struct {
+	conn *conn
+}
+
+func (t *tx) Commit() error {
+	if !t.conn.inTx {
+		return backend.ErrNoTx
+	}
+	return t.conn.commit()
+}
+
+func (t *tx) Rollback() error {
+	if !t.conn.inTx {
+		return backend.ErrNoTx
+	}
+	return t.conn.rollback()
+}
@@ -0,0 +1,77 @@
+// Package driver registers maydb with database/sql under the name "maydb".
+//
+//	db, err := sql.Open("maydb", "memory:")
+//	db, err := sql.Open("maydb", "file:/data/app.db")
+//	db, err := sql.Open("maydb", "lsm:/data/app")
+//
+// All connections opened from one sql.DB share the same backend. Statements
+// are executed one at a time, and a transaction holds the backend exclusively
+// until it is committed or rolled back.
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/session"
+	"io"
+	"sync"
+)
+
+func init() {
+	sql.Register("maydb", &Driver{})
+}
+
+type Driver struct{}
+
+// Open returns a connection to a new backend for dsn, which closing the
+// connection closes. Use sql.Open, which goes through OpenConnector, to
+// share one backend between connections.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.openConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{connector: c, session: session.New(c.backend), ownsBackend: true}, nil
+}
+
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	return d.openConnector(dsn)
+}
+
+func (d *Driver) openConnector(dsn string) (*connector, error) {
+	b, err := backend.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{driver: d, backend: b}, nil
+}
+
+type connector struct {
+	driver  *Driver
+	backend backend.Backend
+
+	// mu serializes access to backend. It is held for the whole lifetime of
+	// a transaction.
+	mu sync.Mutex
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{
+		connector: c,
+		session:   session.New(c.backend),
+	}, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Close closes the backend, if it holds files open. sql.DB.Close calls it.
+func (c *connector) Close() error {
+	if closer, ok := c.backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDriver(t *testing.T) {
+	tests := []struct {
+		dsn string
+	}{
+		{dsn: "memory:"},
+		{dsn: "file:" + filepath.Join(t.TempDir(), "test.db")},
+		{dsn: "lsm:" + t.TempDir() + "?buffer_pool=1MB"},
+	}
+
+	for _, test := range tests {
+		db, err := sql.Open("maydb", test.dsn)
+		assert.Nil(t, err, test.dsn)
+
+		_, err = db.Exec("CREATE TABLE users (id INT, name TEXT);")
+		assert.Nil(t, err, test.dsn)
+
+		res, err := db.Exec("INSERT INTO users VALUES (1, 'Phil'); INSERT INTO users VALUES (2, 'Kate');")
+		assert.Nil(t, err, test.dsn)
+		affected, err := res.RowsAffected()
+		assert.Nil(t, err, test.dsn)
+		assert.Equal(t, int64(2), affected, test.dsn)
+
+		tx, err := db.Begin()
+		assert.Nil(t, err, test.dsn)
+		_, err = tx.Exec("INSERT INTO users VALUES (3, 'Dan');")
+		assert.Nil(t, err, test.dsn)
+		assert.Nil(t, tx.Rollback(), test.dsn)
+
+		rows, err := db.Query("SELECT id, name FROM users;")
+		assert.Nil(t, err, test.dsn)
+
+		var ids []int64
+		var names []string
+		for rows.Next() {
+			var id int64
+			var name string
+			assert.Nil(t, rows.Scan(&id, &name), test.dsn)
+			ids = append(ids, id)
+			names = append(names, name)
+		}
+		assert.Nil(t, rows.Err(), test.dsn)
+		assert.Equal(t, []int64{1, 2}, ids, test.dsn)
+		assert.Equal(t, []string{"Phil", "Kate"}, names, test.dsn)
+		assert.Nil(t, db.Close(), test.dsn)
+	}
+}
+
+func TestDriverArguments(t *testing.T) {
+	db, err := sql.Open("maydb", "memory:")
+	assert.Nil(t, err)
+	_, err = db.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	stmt, err := db.Prepare("INSERT INTO users VALUES ($1, $2);")
+	assert.Nil(t, err)
+	for i, name := range []string{"Phil", "Kate"} {
+		_, err = stmt.Exec(i+1, name)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, stmt.Close())
+
+	_, err = db.Exec("INSERT INTO users VALUES (:id, :name);", sql.Named("name", "Dan"), sql.Named("id", 3))
+	assert.Nil(t, err)
+
+	var count int
+	rows, err := db.Query("SELECT id FROM users;")
+	assert.Nil(t, err)
+	for rows.Next() {
+		count++
+	}
+	assert.Equal(t, 3, count)
+	assert.Nil(t, db.Close())
+}
+
+func TestDriverNoSemicolon(t *testing.T) {
+	db, err := sql.Open("maydb", "memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE users (id INT, name TEXT)")
+	assert.Nil(t, err)
+
+	stmt, err := db.Prepare("INSERT INTO users VALUES ($1, $2)")
+	assert.Nil(t, err)
+	_, err = stmt.Exec(1, "Phil")
+	assert.Nil(t, err)
+	assert.Nil(t, stmt.Close())
+
+	_, err = db.Exec("INSERT INTO users VALUES (2, 'Kate'); INSERT INTO users VALUES (3, 'Dan')")
+	assert.Nil(t, err)
+
+	var name string
+	assert.Nil(t, db.QueryRow("SELECT name FROM users WHERE id = $1", 2).Scan(&name))
+	assert.Equal(t, "Kate", name)
+}
+
+func TestDriverConcurrentPrepare(t *testing.T) {
+	db, err := sql.Open("maydb", "memory:")
+	assert.Nil(t, err)
+	_, err = db.Exec("CREATE TABLE users (id INT);")
+	assert.Nil(t, err)
+
+	// Preparing reads the catalog that the other connection changes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			_, err := db.Exec(fmt.Sprintf("CREATE TABLE t%d (id INT);", i))
+			assert.Nil(t, err)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		stmt, err := db.Prepare("SELECT id FROM users WHERE id = $1;")
+		assert.Nil(t, err)
+		assert.Nil(t, stmt.Close())
+	}
+	<-done
+	assert.Nil(t, db.Close())
+}
+
+func TestDriverStreamedRows(t *testing.T) {
+	db, err := sql.Open("maydb", "memory:")
+	assert.Nil(t, err)
+	_, err = db.Exec("CREATE TABLE users (id INT); INSERT INTO users VALUES (1), (2), (0);")
+	assert.Nil(t, err)
+
+	// Rows can be closed before they are all read
+	rows, err := db.Query("SELECT id FROM users;")
+	assert.Nil(t, err)
+	assert.True(t, rows.Next())
+	assert.Nil(t, rows.Close())
+	_, err = db.Exec("INSERT INTO users VALUES (3);")
+	assert.Nil(t, err)
+
+	// Statements run while rows are being read
+	rows, err = db.Query("SELECT id FROM users;")
+	assert.Nil(t, err)
+	var ids []int
+	for rows.Next() {
+		var id int
+		assert.Nil(t, rows.Scan(&id))
+		ids = append(ids, id)
+		_, err = db.Exec("INSERT INTO users VALUES ($1);", id+10)
+		assert.Nil(t, err)
+		var n int
+		assert.Nil(t, db.QueryRow("SELECT count(*) FROM users;").Scan(&n))
+	}
+	assert.Nil(t, rows.Err())
+	assert.Nil(t, rows.Close())
+	assert.Equal(t, []int{1, 2, 0, 3}, ids)
+
+	// Errors computing a row surface while reading the rows
+	rows, err = db.Query("SELECT 6 / id FROM users;")
+	assert.Nil(t, err)
+	for rows.Next() {
+	}
+	assert.ErrorIs(t, rows.Err(), backend.ErrDivisionByZero)
+	assert.Nil(t, rows.Close())
+
+	// Exec reads the rows, for nextval to run
+	_, err = db.Exec("CREATE SEQUENCE ids; SELECT nextval('ids');")
+	assert.Nil(t, err)
+	var id int
+	assert.Nil(t, db.QueryRow("SELECT nextval('ids');").Scan(&id))
+	assert.Equal(t, 2, id)
+	assert.Nil(t, db.Close())
+}
+
+func TestDriverContext(t *testing.T) {
+	db, err := sql.Open("maydb", "memory:")
+	assert.Nil(t, err)
+	_, err = db.Exec("CREATE TABLE t (i INT); INSERT INTO t VALUES (0);")
+	assert.Nil(t, err)
+	for n := 1; n < 2000; n *= 2 {
+		_, err = db.Exec("INSERT INTO t SELECT i + $1 FROM t;", n)
+		assert.Nil(t, err)
+	}
+	slow := "SELECT count(*) FROM t a, t b, t c WHERE a.i + b.i = c.i;"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var n int
+	err = db.QueryRowContext(ctx, slow).Scan(&n)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = db.ExecContext(ctx, slow)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// The backend is unlocked for the next statements
+	assert.Nil(t, db.QueryRow("SELECT count(*) FROM t;").Scan(&n))
+	assert.Equal(t, 2048, n)
+	assert.Nil(t, db.Close())
+}
+
+func TestDriverFilePersists(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db")
+
+	db, err := sql.Open("maydb", dsn)
+	assert.Nil(t, err)
+	_, err = db.Exec("CREATE TABLE users (id INT, name TEXT); INSERT INTO users VALUES (1, 'Phil');")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db, err = sql.Open("maydb", dsn)
+	assert.Nil(t, err)
+	var name string
+	assert.Nil(t, db.QueryRow("SELECT name FROM users;").Scan(&name))
+	assert.Equal(t, "Phil", name)
+	assert.Nil(t, db.Close())
+}
+
+func TestDriverOpen(t *testing.T) {
+	// Closing the connection closes its backend, unlocking the directory
+	dsn := "lsm:" + t.TempDir()
+	c, err := (&Driver{}).Open(dsn)
+	assert.Nil(t, err)
+	stmt, err := c.Prepare("CREATE TABLE users (id INT); INSERT INTO users VALUES (1);")
+	assert.Nil(t, err)
+	_, err = stmt.Exec(nil)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Close())
+
+	c, err = (&Driver{}).Open(dsn)
+	assert.Nil(t, err)
+	stmt, err = c.Prepare("SELECT id FROM users;")
+	assert.Nil(t, err)
+	rows, err := stmt.Query(nil)
+	assert.Nil(t, err)
+	dest := make([]driver.Value, 1)
+	assert.Nil(t, rows.Next(dest))
+	assert.Equal(t, int64(1), dest[0])
+	assert.Nil(t, rows.Close())
+	assert.Nil(t, c.Close())
+}
+
+func TestDriverInvalidDSN(t *testing.T) {
+	db, err := sql.Open("maydb", "postgres://localhost")
+	assert.Nil(t, db)
+	assert.Equal(t, backend.ErrInvalidDSN, err)
+
+	for _, dsn := range []string{"lsm:", "lsm:data?buffer_pool=lots", "lsm:data?buffer_pool=0", "lsm:data?cache=1MB"} {
+		_, err = sql.Open("maydb", dsn)
+		assert.ErrorIs(t, err, backend.ErrInvalidDSN, dsn)
+	}
+}
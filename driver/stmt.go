@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/session"
+	"io"
+	"reflect"
+)
+
+type stmt struct {
+	conn     *conn
+	prepared *session.Prepared
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return len(s.prepared.Params())
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamed(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamed(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	affected, r, err := s.conn.exec(ctx, s.prepared, namedToArgs(args))
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		// Read the rows, for what the query does as they are computed,
+		// such as nextval
+		_, err := backend.Collect(r.rows)
+		if err == nil {
+			err = r.err
+		}
+		if closeErr := r.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	_, r, err := s.conn.exec(ctx, s.prepared, namedToArgs(args))
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return &rows{rows: backend.ResultsRows(&backend.Results{})}, nil
+	}
+	return r, nil
+}
+
+func valuesToNamed(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// namedToArgs converts database/sql arguments to session arguments, keeping
+// the names given with sql.Named.
+func namedToArgs(named []driver.NamedValue) []interface{} {
+	args := make([]interface{}, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			args[i] = session.Named(nv.Name, nv.Value)
+			continue
+		}
+		args[i] = nv.Value
+	}
+	return args
+}
+
+type rows struct {
+	rows backend.Rows
+	// err is returned once the rows are read, for rows read before an
+	// error. See readRows.
+	err error
+}
+
+// readRows reads rs to the end. An error computing a row, such as a
+// division by zero, surfaces after the rows before it, as it does when the
+// rows are computed as they are read.
+func readRows(rs backend.Rows) *rows {
+	results := &backend.Results{Columns: rs.Columns()}
+	for rs.Next() {
+		results.Rows = append(results.Rows, append([]backend.Cell(nil), rs.Row()...))
+	}
+	err := rs.Err()
+	if closeErr := rs.Close(); err == nil {
+		err = closeErr
+	}
+	return &rows{rows: backend.ResultsRows(results), err: err}
+}
+
+func (r *rows) Columns() []string {
+	columns := r.rows.Columns()
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+	return names
+}
+
+func (r *rows) Close() error {
+	return r.rows.Close()
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		if r.err != nil {
+			return r.err
+		}
+		return io.EOF
+	}
+
+	for i, cell := range r.rows.Row() {
+		v, err := backend.CellValue(cell, r.rows.Columns()[i].Type)
+		if err != nil {
+			return err
+		}
+		dest[i] = v
+	}
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	switch r.rows.Columns()[index].Type {
+	case backend.IntType:
+		return "INT"
+	case backend.TextType:
+		return "TEXT"
+	case backend.BoolType:
+		return "BOOL"
+	}
+	return ""
+}
+
+func (r *rows) ColumnTypeScanType(index int) reflect.Type {
+	switch r.rows.Columns()[index].Type {
+	case backend.IntType:
+		return reflect.TypeOf(int64(0))
+	case backend.TextType:
+		return reflect.TypeOf("")
+	case backend.BoolType:
+		return reflect.TypeOf(false)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
@@ -0,0 +1,215 @@
+// Package dump writes a database out as SQL and reads it back in.
+//
+// A dump is a script of CREATE SEQUENCE and CREATE TABLE statements for
+// the whole catalog followed by one INSERT per row and a setval per used
+// sequence, so restoring it only relies on the parser and can move data
+// between maydb versions.
+package dump
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/lexer"
+	"github.com/nanjingblue/maydb/session"
+	"github.com/nanjingblue/maydb/token"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const header = "-- maydb dump\n"
+
+// Dump writes every sequence and table of b to w as SQL statements. It
+// stops once ctx is done.
+func Dump(ctx context.Context, b backend.Backend, w io.Writer) error {
+	names, err := b.ListTables()
+	if err != nil {
+		return err
+	}
+	seqs, err := b.ListSequences()
+	if err != nil {
+		return err
+	}
+
+	var defs []*backend.TableDefinition
+	for _, name := range names {
+		def, err := b.DescribeTable(name)
+		if err != nil {
+			return fmt.Errorf("describe %s: %w", name, err)
+		}
+		defs = append(defs, def)
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(header)
+
+	// Sequences come first, since SERIAL columns default to their nextval
+	for _, seq := range seqs {
+		maxValue := ""
+		if seq.MaxValue != 0 {
+			maxValue = fmt.Sprintf(" MAXVALUE %d", seq.MaxValue)
+		}
+		fmt.Fprintf(bw, "\nCREATE SEQUENCE %s START %d INCREMENT %d%s;\n", quoteIdentifier(seq.Name), seq.Start, seq.Increment, maxValue)
+	}
+
+	// Create every table before loading any, so that a dump can be
+	// replayed even once tables refer to each other.
+	for _, def := range defs {
+		fmt.Fprintf(bw, "\n%s\n", createTable(def))
+	}
+	for _, def := range defs {
+		if err := writeRows(ctx, bw, b, def); err != nil {
+			return fmt.Errorf("dump %s: %w", def.Name, err)
+		}
+	}
+
+	// Set the sequences last, the INSERTs don't call nextval
+	var used []string
+	for _, seq := range seqs {
+		if seq.Called {
+			used = append(used, fmt.Sprintf("SELECT setval('%s', %d);\n", strings.ReplaceAll(seq.Name, "'", "''"), seq.Last))
+		}
+	}
+	if len(used) > 0 {
+		bw.WriteString("\n" + strings.Join(used, ""))
+	}
+	return bw.Flush()
+}
+
+// Restore executes the statements of a dump read from r. Backends that
+// support transactions are left untouched if it fails, or if ctx is done
+// before it ends.
+func Restore(ctx context.Context, b backend.Backend, r io.Reader) error {
+	source, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	tx, ok := b.(backend.Transactor)
+	if ok {
+		if err := tx.Begin(); err != nil {
+			return err
+		}
+	}
+	if err := execAll(ctx, session.New(b), string(source)); err != nil {
+		if ok {
+			tx.Rollback()
+		}
+		return err
+	}
+	if ok {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// execAll executes source, reading the rows of its last statement, which
+// like those of setval are only computed as they are read.
+func execAll(ctx context.Context, s *session.Session, source string) error {
+	results, err := s.ExecContext(ctx, source)
+	if err != nil {
+		return err
+	}
+	if len(results) > 0 && results[len(results)-1].Rows != nil {
+		_, err = backend.Collect(results[len(results)-1].Rows)
+	}
+	return err
+}
+
+func createTable(def *backend.TableDefinition) string {
+	var cols []string
+	for _, col := range def.Columns {
+		c := quoteIdentifier(col.Name) + " " + strings.ToUpper(col.Type.String())
+		if col.NotNull {
+			c += " NOT NULL"
+		}
+		if col.Default != "" {
+			c += " DEFAULT " + col.Default
+		}
+		cols = append(cols, c)
+	}
+	for _, uc := range def.Constraints {
+		kind := "UNIQUE"
+		if uc.PrimaryKey {
+			kind = "PRIMARY KEY"
+		}
+		var names []string
+		for _, name := range uc.Columns {
+			names = append(names, quoteIdentifier(name))
+		}
+		cols = append(cols, fmt.Sprintf("CONSTRAINT %s %s (%s)", quoteIdentifier(uc.Name), kind, strings.Join(names, ", ")))
+	}
+	with := ""
+	if def.Storage != "" {
+		with = fmt.Sprintf(" WITH (storage = '%s')", def.Storage)
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)%s;", quoteIdentifier(def.Name), strings.Join(cols, ", "), with)
+}
+
+func writeRows(ctx context.Context, w io.Writer, b backend.Backend, def *backend.TableDefinition) error {
+	slct := &ast.SelectStatement{
+		From: []*ast.TableRef{{Name: token.Token{Value: def.Name, Kind: token.IdentifierKind}}},
+	}
+	for _, col := range def.Columns {
+		slct.Item = append(slct.Item, &ast.Expression{
+			Literal: &token.Token{Value: col.Name, Kind: token.IdentifierKind},
+			Kind:    ast.LiteralKind,
+		})
+	}
+	rows, err := b.Select(ctx, slct)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	prefix := "INSERT INTO " + quoteIdentifier(def.Name) + " VALUES ("
+	for first := true; rows.Next(); first = false {
+		if first {
+			fmt.Fprintln(w)
+		}
+		row := rows.Row()
+		values := make([]string, len(row))
+		for i, cell := range row {
+			values[i], err = literal(cell, rows.Columns()[i].Type)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(w, "%s%s);\n", prefix, strings.Join(values, ", "))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// literal renders a cell as an SQL literal of its column type.
+func literal(c backend.Cell, ct backend.ColumnType) (string, error) {
+	if c.IsNull() {
+		return "NULL", nil
+	}
+	switch ct {
+	case backend.IntType:
+		i, err := c.AsInt()
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(i)), nil
+	case backend.TextType:
+		return "'" + strings.ReplaceAll(c.AsText(), "'", "''") + "'", nil
+	}
+	return "", backend.ErrInvalidDataType
+}
+
+// quoteIdentifier double-quotes name unless it lexes back unchanged as a
+// plain identifier, so that keywords and mixed case survive a restore.
+func quoteIdentifier(name string) string {
+	tokens, err := lexer.Lex(name)
+	if err == nil && len(tokens) == 1 && tokens[0].Kind == token.IdentifierKind && tokens[0].Value == name {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,94 @@
+package dump
+
+import (
+	"bytes"
+	"context"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/session"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDumpRestore(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	s := session.New(b)
+	_, err := s.Exec(`CREATE TABLE users (id INT PRIMARY KEY, name TEXT DEFAULT 'it''s'); CREATE TABLE "Select" ("from" TEXT); CREATE TABLE empty (id INT, UNIQUE (id)); CREATE TABLE metrics (v INT) WITH (storage = 'columnar');`)
+	assert.Nil(t, err)
+	_, err = s.Exec("INSERT INTO users VALUES ($1, $2);", -2147483648, "it's")
+	assert.Nil(t, err)
+	_, err = s.Exec(`INSERT INTO users VALUES (7, 'a
+b'), (8, NULL); INSERT INTO "Select" VALUES ('');`)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	assert.Nil(t, Dump(context.Background(), b, &out))
+	assert.Equal(t, `-- maydb dump
+
+CREATE TABLE "Select" ("from" TEXT);
+
+CREATE TABLE empty (id INT, CONSTRAINT empty_id_key UNIQUE (id));
+
+CREATE TABLE metrics (v INT) WITH (storage = 'columnar');
+
+CREATE TABLE users (id INT NOT NULL, name TEXT DEFAULT 'it''s', CONSTRAINT users_pkey PRIMARY KEY (id));
+
+INSERT INTO "Select" VALUES ('');
+
+INSERT INTO users VALUES (-2147483648, 'it''s');
+INSERT INTO users VALUES (7, 'a
+b');
+INSERT INTO users VALUES (8, NULL);
+`, out.String())
+
+	restored := backend.NewMemoryBacked()
+	assert.Nil(t, Restore(context.Background(), restored, bytes.NewReader(out.Bytes())))
+	assert.Equal(t, b.Tables, restored.Tables)
+
+	var again bytes.Buffer
+	assert.Nil(t, Dump(context.Background(), restored, &again))
+	assert.Equal(t, out.String(), again.String())
+}
+
+func TestRestoreRollsBack(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	err := Restore(context.Background(), b, strings.NewReader("CREATE TABLE users (id INT); INSERT INTO users VALUES ('x');"))
+	assert.NotNil(t, err)
+
+	names, _ := b.ListTables()
+	assert.Empty(t, names)
+}
+
+func TestDumpSequences(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	s := session.New(b)
+	_, err := s.Exec(`CREATE TABLE items (id SERIAL, name TEXT); CREATE SEQUENCE unused START 5 INCREMENT -1;
+		INSERT INTO items (name) VALUES ('a'), ('b');`)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	assert.Nil(t, Dump(context.Background(), b, &out))
+	assert.Equal(t, `-- maydb dump
+
+CREATE SEQUENCE items_id_seq START 1 INCREMENT 1 MAXVALUE 2147483647;
+
+CREATE SEQUENCE unused START 5 INCREMENT -1;
+
+CREATE TABLE items (id INT NOT NULL DEFAULT nextval('items_id_seq'), name TEXT);
+
+INSERT INTO items VALUES (1, 'a');
+INSERT INTO items VALUES (2, 'b');
+
+SELECT setval('items_id_seq', 2);
+`, out.String())
+
+	restored := backend.NewMemoryBacked()
+	assert.Nil(t, Restore(context.Background(), restored, bytes.NewReader(out.Bytes())))
+	_, err = session.New(restored).Exec("INSERT INTO items (name) VALUES ('c');")
+	assert.Nil(t, err)
+	seqs, err := restored.ListSequences()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), seqs[0].Last)
+	assert.Equal(t, int64(math.MaxInt32), seqs[0].MaxValue)
+}
@@ -0,0 +1,124 @@
+package format
+
+import (
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Aligned draws rows as a box with one column per result column, or with
+// Expanded, one record per row. It reads every row before writing, to
+// size the columns.
+//
+//	+----+------+
+//	| id | name |
+//	+----+------+
+//	|  1 | Phil |
+//	+----+------+
+//	(1 row)
+type Aligned struct {
+	Expanded bool
+}
+
+func (a *Aligned) Format(w io.Writer, results backend.Rows) error {
+	var rows [][]string
+	for results.Next() {
+		row, err := strs(results)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+	if err := results.Err(); err != nil {
+		return err
+	}
+	columns := results.Columns()
+	if a.Expanded {
+		return a.formatExpanded(w, columns, rows)
+	}
+
+	widths := make([]int, len(columns))
+	for i, col := range columns {
+		widths[i] = utf8.RuneCountInString(col.Name)
+	}
+	for _, row := range rows {
+		for i, v := range row {
+			if n := utf8.RuneCountInString(v); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var b strings.Builder
+	border := func() {
+		b.WriteString("+")
+		for _, width := range widths {
+			b.WriteString(strings.Repeat("-", width+2))
+			b.WriteString("+")
+		}
+		b.WriteString("\n")
+	}
+
+	border()
+	b.WriteString("|")
+	for i, col := range columns {
+		fmt.Fprintf(&b, " %s |", pad(col.Name, widths[i], false))
+	}
+	b.WriteString("\n")
+	border()
+	for _, row := range rows {
+		b.WriteString("|")
+		for i, v := range row {
+			// Numbers line up on the right, like in psql
+			fmt.Fprintf(&b, " %s |", pad(v, widths[i], columns[i].Type == backend.IntType))
+		}
+		b.WriteString("\n")
+	}
+	if len(rows) > 0 {
+		border()
+	}
+	b.WriteString(rowCount(len(rows)))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (a *Aligned) formatExpanded(w io.Writer, columns []backend.Column, rows [][]string) error {
+	width := 0
+	for _, col := range columns {
+		if n := utf8.RuneCountInString(col.Name); n > width {
+			width = n
+		}
+	}
+
+	var b strings.Builder
+	for i, row := range rows {
+		fmt.Fprintf(&b, "-[ RECORD %d ]\n", i+1)
+		for j, v := range row {
+			fmt.Fprintf(&b, "%s | %s\n", pad(columns[j].Name, width, false), v)
+		}
+	}
+	if len(rows) == 0 {
+		b.WriteString(rowCount(0))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func pad(s string, width int, right bool) string {
+	padding := strings.Repeat(" ", width-utf8.RuneCountInString(s))
+	if right {
+		return padding + s
+	}
+	return s + padding
+}
+
+func rowCount(n int) string {
+	if n == 1 {
+		return "(1 row)\n"
+	}
+	return fmt.Sprintf("(%d rows)\n", n)
+}
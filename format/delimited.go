@@ -0,0 +1,73 @@
+package format
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"io"
+	"strings"
+)
+
+// CSV writes a header line followed by one line per row, quoted as in RFC
+// 4180.
+type CSV struct{}
+
+func (c *CSV) Format(w io.Writer, rows backend.Rows) error {
+	cw := csv.NewWriter(w)
+	cw.Write(names(rows))
+	for rows.Next() {
+		record, err := strs(rows)
+		if err != nil {
+			return err
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// TSV writes tab separated values. Tabs, newlines and backslashes in values
+// are escaped with a backslash rather than quoted, and NULL is \N.
+type TSV struct{}
+
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+func (t *TSV) Format(w io.Writer, rows backend.Rows) error {
+	writeLine := func(fields []interface{}) error {
+		var b strings.Builder
+		for i, f := range fields {
+			if i > 0 {
+				b.WriteString("\t")
+			}
+			if f == nil {
+				b.WriteString(`\N`)
+				continue
+			}
+			b.WriteString(tsvEscaper.Replace(fmt.Sprint(f)))
+		}
+		b.WriteString("\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	var header []interface{}
+	for _, name := range names(rows) {
+		header = append(header, name)
+	}
+	if err := writeLine(header); err != nil {
+		return err
+	}
+	for rows.Next() {
+		row, err := values(rows)
+		if err != nil {
+			return err
+		}
+		if err := writeLine(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
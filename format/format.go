@@ -0,0 +1,77 @@
+// Package format renders backend.Rows for people and other programs.
+package format
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"io"
+	"strings"
+)
+
+var ErrUnknownFormat = errors.New("unknown format")
+
+// Formatter writes rows, to the end, as they are read; formats that don't
+// need every row first don't wait for them. The caller closes the rows.
+type Formatter interface {
+	Format(w io.Writer, rows backend.Rows) error
+}
+
+// Names lists the formats accepted by New.
+var Names = []string{"aligned", "csv", "tsv", "json", "ndjson", "markdown"}
+
+func New(name string) (Formatter, error) {
+	switch strings.ToLower(name) {
+	case "aligned":
+		return &Aligned{}, nil
+	case "csv":
+		return &CSV{}, nil
+	case "tsv":
+		return &TSV{}, nil
+	case "json":
+		return &JSON{}, nil
+	case "ndjson":
+		return &NDJSON{}, nil
+	case "markdown":
+		return &Markdown{}, nil
+	}
+	return nil, fmt.Errorf("%w %q, expected one of %s", ErrUnknownFormat, name, strings.Join(Names, ", "))
+}
+
+// values converts every cell of the current row to its Go value.
+func values(rows backend.Rows) ([]interface{}, error) {
+	row := rows.Row()
+	vs := make([]interface{}, len(row))
+	for i, cell := range row {
+		v, err := backend.CellValue(cell, rows.Columns()[i].Type)
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = v
+	}
+	return vs, nil
+}
+
+// strs converts every cell of the current row to text, NULL being empty.
+func strs(rows backend.Rows) ([]string, error) {
+	vs, err := values(rows)
+	if err != nil {
+		return nil, err
+	}
+	ss := make([]string, len(vs))
+	for i, v := range vs {
+		if v != nil {
+			ss[i] = fmt.Sprint(v)
+		}
+	}
+	return ss, nil
+}
+
+// names returns the names of the columns of rows.
+func names(rows backend.Rows) []string {
+	var names []string
+	for _, col := range rows.Columns() {
+		names = append(names, col.Name)
+	}
+	return names
+}
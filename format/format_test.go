@@ -0,0 +1,121 @@
+package format
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func intCell(i int32) backend.MemoryCell {
+	cell := make(backend.MemoryCell, 4)
+	binary.BigEndian.PutUint32(cell, uint32(i))
+	return cell
+}
+
+func TestFormat(t *testing.T) {
+	results := &backend.Results{
+		Columns: []backend.Column{
+			{Type: backend.IntType, Name: "id"},
+			{Type: backend.TextType, Name: "name"},
+		},
+		Rows: [][]backend.Cell{
+			{intCell(1), backend.MemoryCell("Phil")},
+			{intCell(22), backend.MemoryCell("Kate\t|\"K\"")},
+		},
+	}
+
+	tests := []struct {
+		format string
+		output string
+	}{
+		{
+			format: "aligned",
+			output: "+----+-----------+\n" +
+				"| id | name      |\n" +
+				"+----+-----------+\n" +
+				"|  1 | Phil      |\n" +
+				"| 22 | Kate\t|\"K\" |\n" +
+				"+----+-----------+\n" +
+				"(2 rows)\n",
+		},
+		{
+			format: "csv",
+			output: "id,name\n1,Phil\n22,\"Kate\t|\"\"K\"\"\"\n",
+		},
+		{
+			format: "tsv",
+			output: "id\tname\n1\tPhil\n22\tKate\\t|\"K\"\n",
+		},
+		{
+			format: "json",
+			output: "[\n  {\"id\":1,\"name\":\"Phil\"},\n  {\"id\":22,\"name\":\"Kate\\t|\\\"K\\\"\"}\n]\n",
+		},
+		{
+			format: "ndjson",
+			output: "{\"id\":1,\"name\":\"Phil\"}\n{\"id\":22,\"name\":\"Kate\\t|\\\"K\\\"\"}\n",
+		},
+		{
+			format: "markdown",
+			output: "| id | name |\n| ---: | --- |\n| 1 | Phil |\n| 22 | Kate\t\\|\"K\" |\n",
+		},
+	}
+
+	for _, test := range tests {
+		f, err := New(test.format)
+		assert.Nil(t, err, test.format)
+
+		var out bytes.Buffer
+		assert.Nil(t, f.Format(&out, backend.ResultsRows(results)), test.format)
+		assert.Equal(t, test.output, out.String(), test.format)
+	}
+}
+
+func TestAlignedExpanded(t *testing.T) {
+	results := &backend.Results{
+		Columns: []backend.Column{
+			{Type: backend.IntType, Name: "id"},
+			{Type: backend.TextType, Name: "name"},
+		},
+		Rows: [][]backend.Cell{
+			{intCell(1), backend.MemoryCell("Phil")},
+		},
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, (&Aligned{Expanded: true}).Format(&out, backend.ResultsRows(results)))
+	assert.Equal(t, "-[ RECORD 1 ]\nid   | 1\nname | Phil\n", out.String())
+
+	out.Reset()
+	assert.Nil(t, (&Aligned{}).Format(&out, backend.ResultsRows(&backend.Results{Columns: results.Columns})))
+	assert.Equal(t, "+----+------+\n| id | name |\n+----+------+\n(0 rows)\n", out.String())
+}
+
+func TestFormatNull(t *testing.T) {
+	results := &backend.Results{
+		Columns: []backend.Column{
+			{Type: backend.IntType, Name: "id"},
+			{Type: backend.TextType, Name: "name"},
+		},
+		Rows: [][]backend.Cell{
+			{backend.MemoryCell(nil), backend.MemoryCell(`\N`)},
+		},
+	}
+
+	tests := []struct {
+		format string
+		output string
+	}{
+		{format: "csv", output: "id,name\n,\\N\n"},
+		{format: "tsv", output: "id\tname\n\\N\t\\\\N\n"},
+		{format: "ndjson", output: `{"id":null,"name":"\\N"}` + "\n"},
+	}
+	for _, test := range tests {
+		f, err := New(test.format)
+		assert.Nil(t, err)
+		var out bytes.Buffer
+		assert.Nil(t, f.Format(&out, backend.ResultsRows(results)), test.format)
+		assert.Equal(t, test.output, out.String(), test.format)
+	}
+}
@@ -0,0 +1,82 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/nanjingblue/maydb/backend"
+	"io"
+)
+
+// JSON writes an array with one object per row, keyed by column name in
+// column order.
+type JSON struct{}
+
+func (j *JSON) Format(w io.Writer, rows backend.Rows) error {
+	sep := "[\n  "
+	for rows.Next() {
+		obj, err := object(rows)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, sep+string(obj)); err != nil {
+			return err
+		}
+		sep = ",\n  "
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	end := "\n]\n"
+	if sep == "[\n  " {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(w, end)
+	return err
+}
+
+// NDJSON writes one JSON object per line and row.
+type NDJSON struct{}
+
+func (n *NDJSON) Format(w io.Writer, rows backend.Rows) error {
+	for rows.Next() {
+		obj, err := object(rows)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(obj, '\n')); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// object encodes the current row as a JSON object. encoding/json sorts map
+// keys, so the object is built by hand to keep the column order.
+func object(rows backend.Rows) ([]byte, error) {
+	row, err := values(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, v := range row {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, err := json.Marshal(rows.Columns()[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return b.Bytes(), nil
+}
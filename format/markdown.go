@@ -0,0 +1,53 @@
+package format
+
+import (
+	"github.com/nanjingblue/maydb/backend"
+	"io"
+	"strings"
+)
+
+// Markdown writes a GitHub-flavored Markdown table.
+type Markdown struct{}
+
+var markdownEscaper = strings.NewReplacer(`|`, `\|`, "\n", "<br>", "\r", "")
+
+func (m *Markdown) Format(w io.Writer, rows backend.Rows) error {
+	writeLine := func(fields []string, escape bool) error {
+		var b strings.Builder
+		b.WriteString("|")
+		for _, f := range fields {
+			if escape {
+				f = markdownEscaper.Replace(f)
+			}
+			b.WriteString(" " + f + " |")
+		}
+		b.WriteString("\n")
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	var align []string
+	for _, col := range rows.Columns() {
+		a := "---"
+		if col.Type == backend.IntType {
+			a = "---:"
+		}
+		align = append(align, a)
+	}
+	if err := writeLine(names(rows), true); err != nil {
+		return err
+	}
+	if err := writeLine(align, false); err != nil {
+		return err
+	}
+	for rows.Next() {
+		row, err := strs(rows)
+		if err != nil {
+			return err
+		}
+		if err := writeLine(row, true); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/nanjingblue/maydb/token"
 	"strings"
+	"unicode/utf8"
 )
 
 type Cursor struct {
@@ -19,7 +20,7 @@ func Lex(source string) ([]*token.Token, error) {
 
 lex:
 	for cur.pointer < uint(len(source)) {
-		lexers := []lexer{lexKeyword, lexSymbol, lexString, lexNumeric, lexIdentifier}
+		lexers := []lexer{lexKeyword, lexSymbol, lexString, lexNumeric, lexPlaceholder, lexIdentifier}
 		for _, l := range lexers {
 			if tok, newCursor, ok := l(source, cur); ok {
 				cur = newCursor
@@ -30,34 +31,48 @@ lex:
 				continue lex
 			}
 		}
-		hint := ""
-		if len(tokens) > 0 {
-			hint = " after " + tokens[len(tokens)-1].Value + ": '" + string(source[cur.pointer]) + "' "
+		r, _ := utf8.DecodeRuneInString(source[cur.pointer:])
+		return nil, &LexError{
+			Loc:   cur.loc,
+			Value: string(r),
 		}
-		for _, t := range tokens {
-			fmt.Println(t)
-		}
-		return nil, fmt.Errorf("unable to lex Token %s, at %d:%d", hint, cur.loc.Line, cur.loc.Col)
 	}
 	return tokens, nil
 }
 
+// LexError reports a character that does not start any token.
+type LexError struct {
+	Loc   token.Location
+	Value string
+}
+
+func (e *LexError) Error() string {
+	return fmt.Sprintf("unable to lex %q, at %d:%d", e.Value, e.Loc.Line, e.Loc.Col)
+}
+
 func lexNumeric(source string, ic Cursor) (*token.Token, Cursor, bool) {
 	cur := ic
 
+	// A leading - is lexed into the number, even after an operand where
+	// it means subtraction: the parser splits it back into a minus there
+	if source[cur.pointer] == '-' {
+		cur.pointer++
+		cur.loc.Col++
+	}
+	start := cur.pointer
+
 	periodFound := false
 	expMarkerFound := false
 
-	for ; cur.pointer < uint(len(source)); cur.pointer++ {
+	for ; cur.pointer < uint(len(source)); cur.pointer, cur.loc.Col = cur.pointer+1, cur.loc.Col+1 {
 		c := source[cur.pointer]
-		cur.loc.Col++
 
 		isDigit := c >= '0' && c <= '9'
 		isPeriod := c == '.'
 		isExpMarker := c == 'e'
 
 		// Must start with a digit or period
-		if cur.pointer == ic.pointer {
+		if cur.pointer == start {
 			if !isDigit && !isPeriod {
 				return nil, ic, false
 			}
@@ -104,7 +119,7 @@ func lexNumeric(source string, ic Cursor) (*token.Token, Cursor, bool) {
 	}
 
 	// No characters accumulated
-	if cur.pointer == ic.pointer {
+	if cur.pointer == start {
 		return nil, ic, false
 	}
 
@@ -146,7 +161,8 @@ func lexCharacterDelimited(source string, ic Cursor, delimiter byte) (*token.Tok
 			}
 			value = append(value, delimiter)
 			cur.pointer++
-			cur.loc.Col++
+			cur.loc.Col += 2
+			continue
 		}
 
 		value = append(value, c)
@@ -177,6 +193,15 @@ func lexSymbol(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		fallthrough
 	case ' ':
 		return nil, cur, true
+	case '-':
+		// Comments run to the end of the line
+		if cur.pointer < uint(len(source)) && source[cur.pointer] == '-' {
+			for cur.pointer < uint(len(source)) && source[cur.pointer] != '\n' {
+				cur.pointer++
+				cur.loc.Col++
+			}
+			return nil, cur, true
+		}
 	}
 
 	// Syntax that should be kept
@@ -186,6 +211,18 @@ func lexSymbol(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		token.RightParenSymbol,
 		token.SemicolonSymbol,
 		token.AsteriskSymbol,
+		token.DotSymbol,
+		token.EqualsSymbol,
+		token.NotEqualsSymbol,
+		token.BangEqualsSymbol,
+		token.LessSymbol,
+		token.LessEqualsSymbol,
+		token.GreaterSymbol,
+		token.GreaterEqualsSymbol,
+		token.PlusSymbol,
+		token.MinusSymbol,
+		token.SlashSymbol,
+		token.PercentSymbol,
 	}
 
 	var options []string
@@ -193,6 +230,12 @@ func lexSymbol(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		options = append(options, string(s))
 	}
 
+	// A period or a minus followed by a digit starts a number, like .5 or
+	// -1. The parser reads a - 1 without spaces back as a subtraction.
+	if (c == '.' || c == '-') && cur.pointer < uint(len(source)) && source[cur.pointer] >= '0' && source[cur.pointer] <= '9' {
+		return nil, ic, false
+	}
+
 	// Use `ic`, not `cur`
 	match := longestMatch(source, ic, options)
 	// Unknown character
@@ -223,6 +266,44 @@ func lexKeyword(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		token.IntoKeyword,
 		token.IntKeyword,
 		token.TextKeyword,
+		token.AsKeyword,
+		token.AllKeyword,
+		token.PrepareKeyword,
+		token.ExecuteKeyword,
+		token.DeallocateKeyword,
+		token.CopyKeyword,
+		token.ToKeyword,
+		token.WithKeyword,
+		token.NullKeyword,
+		token.NotKeyword,
+		token.DefaultKeyword,
+		token.ReturningKeyword,
+		token.PrimaryKeyword,
+		token.UniqueKeyword,
+		token.ConstraintKeyword,
+		token.OnKeyword,
+		token.UpdateKeyword,
+		token.SetKeyword,
+		token.SerialKeyword,
+		token.BigserialKeyword,
+		token.SequenceKeyword,
+		token.AndKeyword,
+		token.OrKeyword,
+		token.IsKeyword,
+		token.JoinKeyword,
+		token.InnerKeyword,
+		token.GroupKeyword,
+		token.HavingKeyword,
+		token.OrderKeyword,
+		token.ByKeyword,
+		token.AscKeyword,
+		token.DescKeyword,
+		token.LimitKeyword,
+		token.OffsetKeyword,
+		token.ExplainKeyword,
+		token.AnalyzeKeyword,
+		token.ShowKeyword,
+		token.ResetKeyword,
 	}
 
 	var options []string
@@ -235,6 +316,13 @@ func lexKeyword(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		return nil, ic, false
 	}
 
+	// A keyword followed by more identifier characters is an identifier
+	// that happens to start with a keyword, like "ascii" or "total".
+	end := ic.pointer + uint(len(match))
+	if end < uint(len(source)) && isIdentifierChar(source[end]) {
+		return nil, ic, false
+	}
+
 	cur.pointer = ic.pointer + uint(len(match))
 	cur.loc.Col = ic.loc.Col + uint(len(match))
 
@@ -295,8 +383,9 @@ func longestMatch(source string, ic Cursor, options []string) string {
 
 func lexIdentifier(source string, ic Cursor) (*token.Token, Cursor, bool) {
 	// Handle separately if is a double-quoted identifier
-	if token, newCursor, ok := lexCharacterDelimited(source, ic, '"'); ok {
-		return token, newCursor, true
+	if tok, newCursor, ok := lexCharacterDelimited(source, ic, '"'); ok {
+		tok.Kind = token.IdentifierKind
+		return tok, newCursor, true
 	}
 
 	cur := ic
@@ -314,10 +403,7 @@ func lexIdentifier(source string, ic Cursor) (*token.Token, Cursor, bool) {
 	for ; cur.pointer < uint(len(source)); cur.pointer++ {
 		c = source[cur.pointer]
 
-		// Other characters count too, big ignoring non-ascii for now
-		isAlphabetical := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
-		isNumeric := c >= '0' && c <= '9'
-		if isAlphabetical || isNumeric || c == '$' || c == '_' {
+		if isIdentifierChar(c) {
 			value = append(value, c)
 			cur.loc.Col++
 			continue
@@ -337,3 +423,49 @@ func lexIdentifier(source string, ic Cursor) (*token.Token, Cursor, bool) {
 		Kind:  token.IdentifierKind,
 	}, cur, true
 }
+
+func isIdentifierChar(c byte) bool {
+	// Other characters count too, big ignoring non-ascii for now
+	isAlphabetical := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+	isNumeric := c >= '0' && c <= '9'
+	return isAlphabetical || isNumeric || c == '$' || c == '_'
+}
+
+// lexPlaceholder lexes the bind parameter styles: $1 (numbered), ?
+// (positional) and :name (named).
+func lexPlaceholder(source string, ic Cursor) (*token.Token, Cursor, bool) {
+	cur := ic
+
+	c := source[cur.pointer]
+	if c != '$' && c != '?' && c != ':' {
+		return nil, ic, false
+	}
+	cur.pointer++
+	cur.loc.Col++
+
+	if c != '?' {
+		for ; cur.pointer < uint(len(source)); cur.pointer++ {
+			c := source[cur.pointer]
+			isNumeric := c >= '0' && c <= '9'
+			isAlphabetical := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+			if source[ic.pointer] == '$' && !isNumeric {
+				break
+			}
+			if source[ic.pointer] == ':' && !isAlphabetical && c != '_' &&
+				(!isNumeric || cur.pointer == ic.pointer+1) {
+				break
+			}
+			cur.loc.Col++
+		}
+
+		if cur.pointer == ic.pointer+1 {
+			return nil, ic, false
+		}
+	}
+
+	return &token.Token{
+		Value: source[ic.pointer:cur.pointer],
+		Loc:   ic.loc,
+		Kind:  token.PlaceholderKind,
+	}, cur, true
+}
@@ -106,28 +106,139 @@ func TestLex(t *testing.T) {
 					Kind:  token.NumericKind,
 				},
 				{
-					Loc:   token.Location{Col: 28, Line: 0},
+					Loc:   token.Location{Col: 27, Line: 0},
 					Value: string(token.CommaSymbol),
 					Kind:  token.SymbolKind,
 				},
 				{
-					Loc:   token.Location{Col: 30, Line: 0},
+					Loc:   token.Location{Col: 29, Line: 0},
 					Value: "Phil",
 					Kind:  token.StringKind,
 				},
+				{
+					Loc:   token.Location{Col: 35, Line: 0},
+					Value: string(token.RightParenSymbol),
+					Kind:  token.SymbolKind,
+				},
 				{
 					Loc:   token.Location{Col: 36, Line: 0},
+					Value: string(token.SemicolonSymbol),
+					Kind:  token.SymbolKind,
+				},
+			},
+			err: nil,
+		},
+		{
+			input: "INSERT INTO total VALUES ($1, ?, :name);",
+			tokens: []token.Token{
+				{
+					Loc:   token.Location{Col: 0, Line: 0},
+					Value: string(token.InsertKeyword),
+					Kind:  token.KeywordKind,
+				},
+				{
+					Loc:   token.Location{Col: 7, Line: 0},
+					Value: string(token.IntoKeyword),
+					Kind:  token.KeywordKind,
+				},
+				{
+					Loc:   token.Location{Col: 12, Line: 0},
+					Value: "total",
+					Kind:  token.IdentifierKind,
+				},
+				{
+					Loc:   token.Location{Col: 18, Line: 0},
+					Value: string(token.ValuesKeyword),
+					Kind:  token.KeywordKind,
+				},
+				{
+					Loc:   token.Location{Col: 25, Line: 0},
+					Value: string(token.LeftParenSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 26, Line: 0},
+					Value: "$1",
+					Kind:  token.PlaceholderKind,
+				},
+				{
+					Loc:   token.Location{Col: 28, Line: 0},
+					Value: string(token.CommaSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 30, Line: 0},
+					Value: "?",
+					Kind:  token.PlaceholderKind,
+				},
+				{
+					Loc:   token.Location{Col: 31, Line: 0},
+					Value: string(token.CommaSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 33, Line: 0},
+					Value: ":name",
+					Kind:  token.PlaceholderKind,
+				},
+				{
+					Loc:   token.Location{Col: 38, Line: 0},
 					Value: string(token.RightParenSymbol),
 					Kind:  token.SymbolKind,
 				},
 				{
-					Loc:   token.Location{Col: 37, Line: 0},
+					Loc:   token.Location{Col: 39, Line: 0},
 					Value: string(token.SemicolonSymbol),
 					Kind:  token.SymbolKind,
 				},
 			},
 			err: nil,
 		},
+		{input: "-- it's a comment\nVALUES ('it''s', -12, \"Id\")",
+			tokens: []token.Token{
+				{
+					Loc:   token.Location{Col: 0, Line: 1},
+					Value: string(token.ValuesKeyword),
+					Kind:  token.KeywordKind,
+				},
+				{
+					Loc:   token.Location{Col: 7, Line: 1},
+					Value: string(token.LeftParenSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 8, Line: 1},
+					Value: "it's",
+					Kind:  token.StringKind,
+				},
+				{
+					Loc:   token.Location{Col: 15, Line: 1},
+					Value: string(token.CommaSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 17, Line: 1},
+					Value: "-12",
+					Kind:  token.NumericKind,
+				},
+				{
+					Loc:   token.Location{Col: 20, Line: 1},
+					Value: string(token.CommaSymbol),
+					Kind:  token.SymbolKind,
+				},
+				{
+					Loc:   token.Location{Col: 22, Line: 1},
+					Value: "Id",
+					Kind:  token.IdentifierKind,
+				},
+				{
+					Loc:   token.Location{Col: 26, Line: 1},
+					Value: string(token.RightParenSymbol),
+					Kind:  token.SymbolKind,
+				},
+			},
+			err: nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -0,0 +1,79 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	kindPut byte = iota
+	kindDelete
+)
+
+// Batch is a list of writes that DB.Write applies atomically.
+type Batch struct {
+	data  []byte
+	count int
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.data = append(b.data, kindPut)
+	b.data = appendBytes(b.data, key)
+	b.data = appendBytes(b.data, value)
+	b.count++
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.data = append(b.data, kindDelete)
+	b.data = appendBytes(b.data, key)
+	b.count++
+}
+
+// Len is the number of writes in b.
+func (b *Batch) Len() int {
+	return b.count
+}
+
+func (b *Batch) Reset() {
+	b.data, b.count = b.data[:0], 0
+}
+
+func appendBytes(data, b []byte) []byte {
+	return append(binary.AppendUvarint(data, uint64(len(b))), b...)
+}
+
+var errCorruptBatch = errors.New("lsm: corrupt batch")
+
+// replay calls apply for every write of a batch encoded as data.
+func replay(data []byte, apply func(key, value []byte, deleted bool)) error {
+	read := func() ([]byte, error) {
+		n, w := binary.Uvarint(data)
+		if w <= 0 || n > uint64(len(data)-w) {
+			return nil, errCorruptBatch
+		}
+		b := data[w : w+int(n) : w+int(n)]
+		data = data[w+int(n):]
+		return b, nil
+	}
+	for len(data) > 0 {
+		kind := data[0]
+		data = data[1:]
+		key, err := read()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case kindPut:
+			value, err := read()
+			if err != nil {
+				return err
+			}
+			apply(key, value, false)
+		case kindDelete:
+			apply(key, nil, true)
+		default:
+			return errCorruptBatch
+		}
+	}
+	return nil
+}
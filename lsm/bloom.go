@@ -0,0 +1,58 @@
+package lsm
+
+import "hash/fnv"
+
+// bloom is a bloom filter over the keys of an SSTable: its last byte is
+// the number of hashes, the bits before it are set for every key.
+type bloom []byte
+
+func newBloom(keys [][]byte, bitsPerKey int) bloom {
+	// k = ln 2 * bits per key minimizes false positives
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	bits := len(keys) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	filter := make(bloom, (bits+7)/8+1)
+	filter[len(filter)-1] = byte(k)
+	n := uint32(len(filter)-1) * 8
+	for _, key := range keys {
+		h, delta := bloomHash(key)
+		for i := 0; i < k; i++ {
+			filter[h%n/8] |= 1 << (h % n % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// mayContain is false when key surely isn't in the table.
+func (f bloom) mayContain(key []byte) bool {
+	if len(f) < 2 {
+		return true
+	}
+	k := int(f[len(f)-1])
+	n := uint32(len(f)-1) * 8
+	h, delta := bloomHash(key)
+	for i := 0; i < k; i++ {
+		if f[h%n/8]&(1<<(h%n%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+// bloomHash gives the two hashes the k hashes of a key are derived from.
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
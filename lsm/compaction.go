@@ -0,0 +1,268 @@
+package lsm
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// background flushes the immutable memtable and compacts the levels, one
+// thing at a time, until db is closed. An error stops it, and fails the
+// writes that follow.
+func (db *DB) background() {
+	defer close(db.done)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for {
+		var c *compaction
+		for !db.closed && db.bgErr == nil && db.imm == nil {
+			if c = db.pickCompaction(); c != nil {
+				break
+			}
+			db.cond.Wait()
+		}
+		if db.closed || db.bgErr != nil {
+			return
+		}
+
+		var err error
+		if db.imm != nil {
+			err = db.flush()
+		} else {
+			err = db.compact(c)
+		}
+		if err != nil {
+			db.bgErr = err
+		}
+		db.cond.Broadcast()
+	}
+}
+
+// flush writes the immutable memtable to level 0. Its log is removed
+// once the manifest records the table.
+func (db *DB) flush() error {
+	imm, logNum := db.imm, db.logNum
+	db.mu.Unlock()
+	meta, err := db.writeLevel0(imm)
+	db.mu.Lock()
+	if err != nil {
+		return err
+	}
+
+	logs, err := db.files("log")
+	if err != nil {
+		return err
+	}
+	levels := db.current.levels
+	if meta != nil {
+		levels[0] = append(append([]*tableMeta(nil), levels[0]...), meta)
+	}
+	if err := db.install(levels); err != nil {
+		return err
+	}
+	db.imm = nil
+	for _, num := range logs {
+		if num < logNum {
+			os.Remove(db.path(num, "log"))
+		}
+	}
+	return nil
+}
+
+// writeLevel0 writes the entries of mem, tombstones included, to a new
+// table, nil when mem is empty. It locks db.mu to number the table, which
+// must not be held.
+func (db *DB) writeLevel0(mem *memtable) (*tableMeta, error) {
+	metas, err := db.writeTables(mem.iterator(), false, 0)
+	if err != nil || len(metas) == 0 {
+		return nil, err
+	}
+	return metas[0], nil
+}
+
+// writeTables writes the entries of it to new tables of up to limit bytes,
+// or a single table when limit is 0. Tombstones are dropped when drop is
+// set.
+func (db *DB) writeTables(it iterator, drop bool, limit int64) ([]*tableMeta, error) {
+	var metas []*tableMeta
+	var w *tableWriter
+	var num uint64
+	abort := func(err error) ([]*tableMeta, error) {
+		if w != nil {
+			w.abort()
+		}
+		for _, m := range metas {
+			atomic.StoreInt32(&m.table.obsolete, 1)
+			m.table.ref()
+			m.table.unref()
+		}
+		return nil, err
+	}
+	finish := func() error {
+		size, err := w.finish()
+		if err != nil {
+			return err
+		}
+		t, err := openTable(db.path(num, "sst"), num, db.pool)
+		if err != nil {
+			return err
+		}
+		metas = append(metas, &tableMeta{Num: num, Size: size, Smallest: w.smallest, Largest: w.largest, table: t})
+		w = nil
+		return nil
+	}
+
+	for it.seek(nil); it.valid(); it.next() {
+		if drop && it.deleted() {
+			continue
+		}
+		if w == nil {
+			db.mu.Lock()
+			num = db.newNum()
+			db.mu.Unlock()
+			var err error
+			if w, err = createTable(db.path(num, "sst"), &db.opts); err != nil {
+				return abort(err)
+			}
+		}
+		if err := w.add(it.key(), it.value(), it.deleted()); err != nil {
+			return abort(err)
+		}
+		if limit > 0 && w.size() >= limit {
+			if err := finish(); err != nil {
+				return abort(err)
+			}
+		}
+	}
+	if err := it.err(); err != nil {
+		return abort(err)
+	}
+	if w != nil {
+		if err := finish(); err != nil {
+			return abort(err)
+		}
+	}
+	return metas, it.close()
+}
+
+// compaction merges tables of level, inputs[0], with those of the level
+// below they overlap, inputs[1].
+type compaction struct {
+	level  int
+	inputs [2][]*tableMeta
+}
+
+func (db *DB) maxLevelSize(level int) int64 {
+	size := db.opts.LevelSize
+	for i := 1; i < level; i++ {
+		size *= 10
+	}
+	return size
+}
+
+// pickCompaction returns the compaction to run next, nil when the levels
+// are within their limits: all of level 0 once it has too many tables, or
+// else the table of the first level over its size that follows the one
+// compacted last.
+func (db *DB) pickCompaction() *compaction {
+	v := db.current
+	if len(v.levels[0]) >= db.opts.L0Tables {
+		c := &compaction{level: 0, inputs: [2][]*tableMeta{v.levels[0]}}
+		smallest, largest := keyRange(c.inputs[0])
+		c.inputs[1] = v.overlapping(1, smallest, largest)
+		return c
+	}
+	for level := 1; level < numLevels-1; level++ {
+		if v.levelSize(level) <= db.maxLevelSize(level) {
+			continue
+		}
+		metas := v.levels[level]
+		i := sort.Search(len(metas), func(i int) bool {
+			return bytes.Compare(metas[i].Smallest, db.pointers[level]) > 0
+		})
+		if i == len(metas) {
+			i = 0
+		}
+		c := &compaction{level: level, inputs: [2][]*tableMeta{{metas[i]}}}
+		c.inputs[1] = v.overlapping(level+1, metas[i].Smallest, metas[i].Largest)
+		return c
+	}
+	return nil
+}
+
+func keyRange(metas []*tableMeta) (smallest, largest []byte) {
+	for _, m := range metas {
+		if smallest == nil || bytes.Compare(m.Smallest, smallest) < 0 {
+			smallest = m.Smallest
+		}
+		if largest == nil || bytes.Compare(m.Largest, largest) > 0 {
+			largest = m.Largest
+		}
+	}
+	return smallest, largest
+}
+
+// compact runs c. A table that overlaps nothing below is moved down
+// rather than rewritten.
+func (db *DB) compact(c *compaction) error {
+	out := c.level + 1
+	smallest, largest := keyRange(append(append([]*tableMeta(nil), c.inputs[0]...), c.inputs[1]...))
+	db.pointers[c.level] = largest
+
+	var outputs []*tableMeta
+	if c.level > 0 && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 {
+		outputs = c.inputs[0]
+	} else {
+		// Tombstones only need to hide the values of deeper levels
+		drop := true
+		for level := out + 1; level < numLevels; level++ {
+			if len(db.current.overlapping(level, smallest, largest)) > 0 {
+				drop = false
+			}
+		}
+		var its []iterator
+		for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+			its = append(its, c.inputs[0][i].table.iterator())
+		}
+		its = append(its, &levelIterator{metas: c.inputs[1]})
+
+		db.mu.Unlock()
+		var err error
+		outputs, err = db.writeTables(&mergingIterator{its: its}, drop, db.opts.TableSize)
+		db.mu.Lock()
+		if err != nil {
+			return err
+		}
+	}
+
+	removed := map[*tableMeta]bool{}
+	for _, inputs := range c.inputs {
+		for _, m := range inputs {
+			removed[m] = true
+		}
+	}
+	var levels [numLevels][]*tableMeta
+	for level, metas := range db.current.levels {
+		for _, m := range metas {
+			if !removed[m] {
+				levels[level] = append(levels[level], m)
+			}
+		}
+	}
+	levels[out] = append(levels[out], outputs...)
+	sort.Slice(levels[out], func(i, j int) bool {
+		return bytes.Compare(levels[out][i].Smallest, levels[out][j].Smallest) < 0
+	})
+
+	kept := map[*tableMeta]bool{}
+	for _, m := range outputs {
+		kept[m] = true
+	}
+	for m := range removed {
+		if !kept[m] {
+			atomic.StoreInt32(&m.table.obsolete, 1)
+		}
+	}
+	return db.install(levels)
+}
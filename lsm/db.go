@@ -0,0 +1,486 @@
+// Package lsm is a key-value store built as a log-structured merge tree.
+//
+// Writes are appended to a write-ahead log and kept in a sorted memtable.
+// Once full, the memtable is written out as an SSTable, an immutable file
+// of sorted entries with a block index and a bloom filter, to level 0. A
+// background goroutine compacts the levels: level 0 tables are merged
+// into level 1 once there are Options.L0Tables of them, and a table of a
+// level over its size is merged into the level below. Each level is ten
+// times the size of the one above and, below level 0, holds tables that
+// don't overlap. Reads merge the memtables and the levels, the newest
+// value of a key winning.
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/buffer"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotFound = errors.New("lsm: key not found")
+	ErrClosed   = errors.New("lsm: database closed")
+	ErrLocked   = errors.New("lsm: database in use")
+)
+
+// Options tune a DB. Zero fields take their default.
+type Options struct {
+	// MemtableSize is the size in bytes the memtable grows to before it
+	// is written to level 0, 4MB by default.
+	MemtableSize int
+	// BlockSize is the size data blocks of SSTables are cut at, 4kB by
+	// default.
+	BlockSize int
+	// BloomBitsPerKey sizes the bloom filters, 10 by default for about 1%
+	// of false positives.
+	BloomBitsPerKey int
+	// L0Tables is the number of level 0 tables that triggers their
+	// compaction, 4 by default. Writes wait for compactions when there
+	// are three times as many.
+	L0Tables int
+	// LevelSize is the size of level 1, 10MB by default.
+	LevelSize int64
+	// TableSize is the size compactions cut SSTables at, 2MB by default.
+	TableSize int64
+	// NoSync skips syncing the log after every write, which loses the
+	// last writes on a crash.
+	NoSync bool
+	// BufferPoolSize is the size in bytes of the buffer pool caching the
+	// blocks of SSTables, 8MB by default.
+	BufferPoolSize int64
+}
+
+func (o *Options) withDefaults() {
+	if o.MemtableSize <= 0 {
+		o.MemtableSize = 4 << 20
+	}
+	if o.BlockSize <= 0 {
+		o.BlockSize = 4 << 10
+	}
+	if o.BloomBitsPerKey <= 0 {
+		o.BloomBitsPerKey = 10
+	}
+	if o.L0Tables <= 0 {
+		o.L0Tables = 4
+	}
+	if o.LevelSize <= 0 {
+		o.LevelSize = 10 << 20
+	}
+	if o.TableSize <= 0 {
+		o.TableSize = 2 << 20
+	}
+	if o.BufferPoolSize <= 0 {
+		o.BufferPoolSize = 8 << 20
+	}
+}
+
+// DB is an LSM tree stored in a directory. It is safe for concurrent use.
+type DB struct {
+	dir  string
+	opts Options
+	pool *buffer.Pool
+	// lock is the LOCK file of dir, locked while db is open
+	lock *os.File
+
+	// mu guards the fields below. cond is signaled whenever they change,
+	// to wake the background goroutine and the writes waiting for it.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	mem     *memtable
+	imm     *memtable
+	log     *logWriter
+	logNum  uint64
+	nextNum uint64
+	current *version
+	// pointers hold the largest key compacted last on each level, to
+	// compact the tables of a level in turn.
+	pointers [numLevels][]byte
+	bgErr    error
+	closed   bool
+	done     chan struct{}
+}
+
+// Open opens the database in dir, creating it if needed, and replays the
+// writes its log holds. The directory is locked until db is closed: Open
+// fails with ErrLocked while another DB has it open.
+func Open(dir string, opts Options) (_ *DB, err error) {
+	opts.withDefaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(filepath.Join(dir, "LOCK"))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+	db := &DB{dir: dir, opts: opts, pool: buffer.New(opts.BufferPoolSize), lock: lock, mem: newMemtable(), done: make(chan struct{})}
+	db.cond = sync.NewCond(&db.mu)
+
+	m, err := readManifest(db.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		m, err = &manifest{NextNum: 1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", db.manifestPath(), err)
+	}
+	db.nextNum = m.NextNum
+
+	var levels [numLevels][]*tableMeta
+	for level, metas := range m.Levels {
+		for _, meta := range metas {
+			if meta.table, err = openTable(db.path(meta.Num, "sst"), meta.Num, db.pool); err != nil {
+				db.closeTables(levels)
+				return nil, err
+			}
+			levels[level] = append(levels[level], meta)
+		}
+	}
+	db.current = newVersion(levels)
+
+	// Replay the logs into the memtable, then write it out, so that the
+	// new log starts empty. Files may be numbered past the NextNum of the
+	// manifest, when it wasn't written since they were created.
+	logs, err := db.files("log")
+	if err != nil {
+		db.current.release()
+		return nil, err
+	}
+	tables, err := db.files("sst")
+	if err != nil {
+		db.current.release()
+		return nil, err
+	}
+	for _, nums := range [][]uint64{logs, tables} {
+		if len(nums) > 0 && nums[len(nums)-1] >= db.nextNum {
+			db.nextNum = nums[len(nums)-1] + 1
+		}
+	}
+	for _, num := range logs {
+		if num < m.LogNum {
+			continue
+		}
+		err := readLog(db.path(num, "log"), func(data []byte) error {
+			return replay(data, db.mem.put)
+		})
+		if err != nil {
+			db.current.release()
+			return nil, err
+		}
+	}
+	// The background goroutine isn't started, recover needs no lock
+	if err := db.recover(); err != nil {
+		db.current.release()
+		return nil, err
+	}
+
+	// Remove the logs replayed and the tables of compactions cut short
+	for _, num := range logs {
+		os.Remove(db.path(num, "log"))
+	}
+	for _, num := range tables {
+		if !db.inVersion(num) {
+			os.Remove(db.path(num, "sst"))
+		}
+	}
+
+	go db.background()
+	return db, nil
+}
+
+// recover writes the replayed memtable to level 0 and starts a new log.
+func (db *DB) recover() error {
+	levels := db.current.levels
+	if !db.mem.empty() {
+		meta, err := db.writeLevel0(db.mem)
+		if err != nil {
+			return err
+		}
+		levels[0] = append(append([]*tableMeta(nil), levels[0]...), meta)
+		db.mem = newMemtable()
+	}
+	num := db.newNum()
+	log, err := createLog(db.path(num, "log"))
+	if err != nil {
+		return err
+	}
+	db.log, db.logNum = log, num
+	if err := db.install(levels); err != nil {
+		log.close()
+		return err
+	}
+	return nil
+}
+
+func (db *DB) inVersion(num uint64) bool {
+	for _, level := range db.current.levels {
+		for _, m := range level {
+			if m.Num == num {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (db *DB) closeTables(levels [numLevels][]*tableMeta) {
+	for _, level := range levels {
+		for _, m := range level {
+			m.table.f.Close()
+		}
+	}
+}
+
+func (db *DB) manifestPath() string {
+	return filepath.Join(db.dir, "MANIFEST")
+}
+
+func (db *DB) path(num uint64, ext string) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%06d.%s", num, ext))
+}
+
+// files returns the numbers of the files of dir with extension ext, in
+// order.
+func (db *DB) files(ext string) ([]uint64, error) {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	var nums []uint64
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), "."+ext)
+		if num, err := strconv.ParseUint(name, 10, 64); err == nil && name != e.Name() {
+			nums = append(nums, num)
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	return nums, nil
+}
+
+func (db *DB) newNum() uint64 {
+	db.nextNum++
+	return db.nextNum - 1
+}
+
+// install makes levels the current version, once the manifest records
+// it.
+func (db *DB) install(levels [numLevels][]*tableMeta) error {
+	m := &manifest{NextNum: db.nextNum, LogNum: db.logNum}
+	for _, level := range levels {
+		m.Levels = append(m.Levels, level)
+	}
+	if err := writeManifest(db.manifestPath(), m); err != nil {
+		return err
+	}
+	old := db.current
+	db.current = newVersion(levels)
+	db.unrefLocked(old)
+	return nil
+}
+
+func (db *DB) unrefVersion(v *version) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.unrefLocked(v)
+}
+
+func (db *DB) unrefLocked(v *version) {
+	if v.refs--; v.refs == 0 {
+		v.release()
+	}
+}
+
+func (db *DB) Put(key, value []byte) error {
+	var b Batch
+	b.Put(key, value)
+	return db.Write(&b)
+}
+
+func (db *DB) Delete(key []byte) error {
+	var b Batch
+	b.Delete(key)
+	return db.Write(&b)
+}
+
+// Write applies the writes of b atomically: after a crash either all of
+// them are found or none.
+func (db *DB) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.makeRoom(); err != nil {
+		return err
+	}
+	if err := db.log.append(b.data, !db.opts.NoSync); err != nil {
+		return err
+	}
+	return replay(append([]byte(nil), b.data...), db.mem.put)
+}
+
+// makeRoom switches to a new memtable when the current one is full,
+// waiting for the background goroutine to catch up when the previous one
+// isn't flushed yet or level 0 has too many tables.
+func (db *DB) makeRoom() error {
+	for {
+		switch {
+		case db.closed:
+			return ErrClosed
+		case db.bgErr != nil:
+			return db.bgErr
+		case len(db.current.levels[0]) >= 3*db.opts.L0Tables:
+			db.cond.Wait()
+		case db.mem.size < db.opts.MemtableSize:
+			return nil
+		case db.imm != nil:
+			db.cond.Wait()
+		default:
+			if err := db.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rotate makes the memtable immutable, for the background goroutine to
+// flush, and starts a new one with its own log.
+func (db *DB) rotate() error {
+	num := db.newNum()
+	log, err := createLog(db.path(num, "log"))
+	if err != nil {
+		return err
+	}
+	db.log.close()
+	db.imm, db.mem = db.mem, newMemtable()
+	db.log, db.logNum = log, num
+	db.cond.Broadcast()
+	return nil
+}
+
+// Flush writes the memtable to level 0 and waits until it is.
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.imm != nil && db.bgErr == nil && !db.closed {
+		db.cond.Wait()
+	}
+	if db.mem.empty() {
+		return db.bgErr
+	}
+	if err := db.rotate(); err != nil {
+		return err
+	}
+	for db.imm != nil && db.bgErr == nil && !db.closed {
+		db.cond.Wait()
+	}
+	return db.bgErr
+}
+
+// Get returns the value of key, or ErrNotFound. The value must not be
+// modified.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrClosed
+	}
+	mems := []*memtable{db.mem, db.imm}
+	v := db.current
+	v.refs++
+	db.mu.Unlock()
+	defer db.unrefVersion(v)
+
+	for _, mem := range mems {
+		if mem == nil {
+			continue
+		}
+		if value, deleted, ok := mem.get(key); ok {
+			if deleted {
+				return nil, ErrNotFound
+			}
+			return value, nil
+		}
+	}
+	value, deleted, ok, err := v.get(key)
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok || deleted:
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// NewIterator returns an iterator over the keys from lower, included, to
+// upper, excluded. A nil bound means no bound.
+func (db *DB) NewIterator(lower, upper []byte) *Iterator {
+	db.mu.Lock()
+	its := []iterator{db.mem.iterator()}
+	if db.imm != nil {
+		its = append(its, db.imm.iterator())
+	}
+	v := db.current
+	v.refs++
+	its = append(its, v.iterators()...)
+	db.mu.Unlock()
+
+	m := &mergingIterator{its: its}
+	m.seek(lower)
+	return &Iterator{db: db, v: v, it: m, upper: upper, first: true}
+}
+
+// Level describes a level of a DB.
+type Level struct {
+	Tables int
+	Size   int64
+}
+
+// Levels describes the levels of db, level 0 first.
+func (db *DB) Levels() []Level {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	levels := make([]Level, numLevels)
+	for i, metas := range db.current.levels {
+		levels[i] = Level{Tables: len(metas), Size: db.current.levelSize(i)}
+	}
+	return levels
+}
+
+// BufferStats describes the buffer pool of db.
+func (db *DB) BufferStats() buffer.Stats {
+	return db.pool.Stats()
+}
+
+// Close waits for the background work in progress and closes db. A
+// memtable not flushed yet is replayed from its log when db is opened
+// again.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.cond.Broadcast()
+	db.mu.Unlock()
+	<-db.done
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.unrefLocked(db.current)
+	err := db.log.close()
+	if closeErr := db.lock.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,220 @@
+package lsm
+
+import (
+	"fmt"
+	"github.com/nanjingblue/maydb/buffer"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// small keeps tables tiny, for tests to go through many flushes and
+// compactions.
+var small = Options{MemtableSize: 4 << 10, BlockSize: 256, L0Tables: 2, LevelSize: 16 << 10, TableSize: 8 << 10, NoSync: true, BufferPoolSize: 32 << 10}
+
+// waitIdle waits until db has nothing left to flush or compact.
+func waitIdle(t *testing.T, db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for db.bgErr == nil && (db.imm != nil || db.pickCompaction() != nil) {
+		db.cond.Wait()
+	}
+	assert.Nil(t, db.bgErr)
+}
+
+func scan(t *testing.T, db *DB, lower, upper []byte) []string {
+	it := db.NewIterator(lower, upper)
+	var kvs []string
+	for it.Next() {
+		kvs = append(kvs, string(it.Key())+"="+string(it.Value()))
+	}
+	assert.Nil(t, it.Err())
+	assert.Nil(t, it.Close())
+	return kvs
+}
+
+func TestDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{})
+	assert.Nil(t, err)
+	// The directory is locked until db is closed
+	_, err = Open(dir, Options{})
+	assert.ErrorIs(t, err, ErrLocked)
+
+	assert.Nil(t, db.Put([]byte("b"), []byte("1")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("2")))
+	assert.Nil(t, db.Put([]byte("c"), []byte("3")))
+	assert.Nil(t, db.Put([]byte("b"), []byte("4")))
+	assert.Nil(t, db.Delete([]byte("c")))
+	var b Batch
+	b.Put([]byte("d"), []byte(""))
+	b.Delete([]byte("a"))
+	assert.Nil(t, db.Write(&b))
+
+	value, err := db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "4", string(value))
+	_, err = db.Get([]byte("c"))
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, []string{"b=4", "d="}, scan(t, db, nil, nil))
+	assert.Nil(t, db.Close())
+	assert.ErrorIs(t, db.Put([]byte("e"), nil), ErrClosed)
+
+	// The log is replayed, and a write cut short is ignored
+	logs, err := db.files("log")
+	assert.Nil(t, err)
+	f, err := os.OpenFile(db.path(logs[len(logs)-1], "log"), os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3, 4, 200, 0, 0, 0, 1})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	db, err = Open(dir, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b=4", "d="}, scan(t, db, nil, nil))
+	assert.Equal(t, 1, db.Levels()[0].Tables)
+	assert.Nil(t, db.Close())
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, small)
+	assert.Nil(t, err)
+
+	model := map[string]string{}
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("key%05d", i*7919%5000)
+		switch {
+		case i%11 == 0:
+			assert.Nil(t, db.Delete([]byte(key)))
+			delete(model, key)
+		default:
+			value := fmt.Sprintf("value%d", i)
+			assert.Nil(t, db.Put([]byte(key), []byte(value)))
+			model[key] = value
+		}
+	}
+
+	check := func() {
+		var want []string
+		for k, v := range model {
+			want = append(want, k+"="+v)
+		}
+		sort.Strings(want)
+		assert.Equal(t, want, scan(t, db, nil, nil))
+		assert.Equal(t, want[100:200], scan(t, db, []byte(want[100][:8]), []byte(want[200][:8])))
+
+		for i := 0; i < 5000; i += 37 {
+			key := fmt.Sprintf("key%05d", i)
+			value, err := db.Get([]byte(key))
+			if v, ok := model[key]; ok {
+				assert.Nil(t, err, key)
+				assert.Equal(t, v, string(value), key)
+			} else {
+				assert.ErrorIs(t, err, ErrNotFound, key)
+			}
+		}
+	}
+	check()
+	waitIdle(t, db)
+	check()
+
+	levels := db.Levels()
+	assert.Less(t, levels[0].Tables, small.L0Tables)
+	assert.Greater(t, levels[1].Tables+levels[2].Tables, 1)
+	assert.LessOrEqual(t, levels[1].Size, small.LevelSize)
+
+	// Blocks are cached within the size of the buffer pool, once no
+	// iterator pins them
+	stats := db.BufferStats()
+	assert.Greater(t, stats.Hits, uint64(0))
+	assert.Greater(t, stats.Evictions, uint64(0))
+	assert.LessOrEqual(t, stats.Used, small.BufferPoolSize)
+
+	// Compacted tables are removed
+	tables, err := db.files("sst")
+	assert.Nil(t, err)
+	n := 0
+	for _, level := range levels {
+		n += level.Tables
+	}
+	assert.Len(t, tables, n)
+
+	// An iterator keeps reading the tables it started with
+	it := db.NewIterator(nil, nil)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(fmt.Sprintf("new%05d", i)), []byte("x")))
+	}
+	assert.Nil(t, db.Flush())
+	waitIdle(t, db)
+	count := 0
+	for it.Next() {
+		count++
+	}
+	assert.Nil(t, it.Err())
+	assert.Nil(t, it.Close())
+	assert.GreaterOrEqual(t, count, len(model))
+
+	assert.Nil(t, db.Close())
+	db, err = Open(dir, small)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		model[fmt.Sprintf("new%05d", i)] = "x"
+	}
+	check()
+	assert.Nil(t, db.Close())
+}
+
+func TestTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.sst")
+	opts := small
+	opts.withDefaults()
+	w, err := createTable(path, &opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, w.add([]byte(fmt.Sprintf("k%04d", i*2)), []byte(fmt.Sprint(i)), i%100 == 0))
+	}
+	_, err = w.finish()
+	assert.Nil(t, err)
+
+	tbl, err := openTable(path, 1, buffer.New(1<<20))
+	assert.Nil(t, err)
+	defer tbl.f.Close()
+	assert.Greater(t, len(tbl.index), 10)
+
+	value, deleted, ok, err := tbl.get([]byte("k0998"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, deleted)
+	assert.Equal(t, "499", string(value))
+	_, deleted, ok, err = tbl.get([]byte("k0200"))
+	assert.Nil(t, err)
+	assert.True(t, ok && deleted)
+
+	// The bloom filter rules out most keys the table doesn't hold
+	positives := 0
+	for i := 0; i < 1000; i++ {
+		if tbl.filter.mayContain([]byte(fmt.Sprintf("k%04d", i*2+1))) {
+			positives++
+		}
+	}
+	assert.Less(t, positives, 50)
+
+	it := tbl.iterator()
+	it.seek([]byte("k0101"))
+	assert.True(t, it.valid())
+	assert.Equal(t, "k0102", string(it.key()))
+
+	// Corrupt blocks are detected
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	data[10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0644))
+	corrupt, err := openTable(path, 1, buffer.New(1<<20))
+	assert.Nil(t, err)
+	defer corrupt.f.Close()
+	_, _, _, err = corrupt.get([]byte("k0000"))
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
@@ -0,0 +1,197 @@
+package lsm
+
+import (
+	"bytes"
+	"sort"
+)
+
+// iterator walks the entries of a memtable, an SSTable or a merge of them
+// in key order, tombstones included.
+type iterator interface {
+	// seek moves to the first entry whose key is at least key.
+	seek(key []byte)
+	next()
+	valid() bool
+	key() []byte
+	value() []byte
+	deleted() bool
+	err() error
+	close() error
+}
+
+// mergingIterator merges iterators, the first ones holding the newer
+// writes: of the entries with the same key, only the newest is returned.
+type mergingIterator struct {
+	its []iterator
+	cur iterator
+}
+
+func (m *mergingIterator) seek(key []byte) {
+	for _, it := range m.its {
+		it.seek(key)
+	}
+	m.pick()
+}
+
+// pick makes the iterator at the least key current, the newest one on
+// ties.
+func (m *mergingIterator) pick() {
+	m.cur = nil
+	for _, it := range m.its {
+		if it.valid() && (m.cur == nil || bytes.Compare(it.key(), m.cur.key()) < 0) {
+			m.cur = it
+		}
+	}
+}
+
+func (m *mergingIterator) next() {
+	key := append([]byte(nil), m.cur.key()...)
+	for _, it := range m.its {
+		for it.valid() && bytes.Equal(it.key(), key) {
+			it.next()
+		}
+	}
+	m.pick()
+}
+
+func (m *mergingIterator) valid() bool {
+	return m.cur != nil && m.err() == nil
+}
+
+func (m *mergingIterator) key() []byte   { return m.cur.key() }
+func (m *mergingIterator) value() []byte { return m.cur.value() }
+func (m *mergingIterator) deleted() bool { return m.cur.deleted() }
+
+func (m *mergingIterator) err() error {
+	for _, it := range m.its {
+		if err := it.err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergingIterator) close() error {
+	var err error
+	for _, it := range m.its {
+		if closeErr := it.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// levelIterator walks the tables of a level below 0, which are sorted
+// and don't overlap, one after the other.
+type levelIterator struct {
+	metas []*tableMeta
+	i     int
+	cur   iterator
+}
+
+func (l *levelIterator) seek(key []byte) {
+	l.i = sort.Search(len(l.metas), func(i int) bool {
+		return bytes.Compare(l.metas[i].Largest, key) >= 0
+	})
+	l.open()
+	if l.cur != nil {
+		l.cur.seek(key)
+		l.skipEmpty()
+	}
+}
+
+func (l *levelIterator) open() {
+	l.close()
+	l.cur = nil
+	if l.i < len(l.metas) {
+		l.cur = l.metas[l.i].table.iterator()
+	}
+}
+
+// skipEmpty moves on to the next tables once the current one is done.
+func (l *levelIterator) skipEmpty() {
+	for l.cur != nil && !l.cur.valid() && l.cur.err() == nil {
+		l.i++
+		l.open()
+		if l.cur != nil {
+			l.cur.seek(nil)
+		}
+	}
+}
+
+func (l *levelIterator) next() {
+	l.cur.next()
+	l.skipEmpty()
+}
+
+func (l *levelIterator) valid() bool   { return l.cur != nil && l.cur.valid() }
+func (l *levelIterator) key() []byte   { return l.cur.key() }
+func (l *levelIterator) value() []byte { return l.cur.value() }
+func (l *levelIterator) deleted() bool { return l.cur.deleted() }
+
+func (l *levelIterator) err() error {
+	if l.cur == nil {
+		return nil
+	}
+	return l.cur.err()
+}
+
+func (l *levelIterator) close() error {
+	if l.cur == nil {
+		return nil
+	}
+	return l.cur.close()
+}
+
+// Iterator walks the keys of a DB between two bounds in order, as of
+// when it was created for the SSTables and as of now for the memtables.
+// It must be closed.
+type Iterator struct {
+	db    *DB
+	v     *version
+	it    iterator
+	upper []byte
+	first bool
+	done  bool
+}
+
+// Next moves to the next key, the first one on the first call, and
+// reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if it.first {
+		it.first = false
+	} else {
+		it.it.next()
+	}
+	for it.it.valid() && it.it.deleted() {
+		it.it.next()
+	}
+	if !it.it.valid() || (it.upper != nil && bytes.Compare(it.it.key(), it.upper) >= 0) {
+		it.done = true
+		return false
+	}
+	return true
+}
+
+// Key returns the current key, which is only valid until Next is
+// called.
+func (it *Iterator) Key() []byte { return it.it.key() }
+
+// Value returns the current value, which is only valid until Next is
+// called.
+func (it *Iterator) Value() []byte { return it.it.value() }
+
+func (it *Iterator) Err() error { return it.it.err() }
+
+func (it *Iterator) Close() error {
+	if it.v == nil {
+		return nil
+	}
+	err := it.it.close()
+	it.db.unrefVersion(it.v)
+	it.v, it.done = nil, true
+	return err
+}
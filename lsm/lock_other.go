@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package lsm
+
+import "os"
+
+// lockFile creates or opens path. Locking is not supported on this
+// platform, so nothing keeps two DBs from opening the same directory.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+}
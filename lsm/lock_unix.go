@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile creates or opens path and takes an exclusive lock on it, which
+// holds until the file is closed. It fails with ErrLocked when the lock is
+// taken, by another process or by another DB of this one.
+func lockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,148 @@
+package lsm
+
+import (
+	"bytes"
+	"sync"
+)
+
+const maxHeight = 12
+
+// memtable holds the latest writes in a skiplist sorted by key. Deletes
+// are kept as tombstones, to hide the older values in SSTables.
+type memtable struct {
+	mu     sync.RWMutex
+	head   *node
+	height int
+	// size approximates the bytes held, to tell when to flush it
+	size int
+	seed uint32
+}
+
+type node struct {
+	key     []byte
+	value   []byte
+	deleted bool
+	next    []*node
+}
+
+func newMemtable() *memtable {
+	return &memtable{head: &node{next: make([]*node, maxHeight)}, height: 1, seed: 0x9e3779b9}
+}
+
+// randomHeight gives a node height, each level a quarter as likely as the
+// one below.
+func (m *memtable) randomHeight() int {
+	h := 1
+	for h < maxHeight {
+		m.seed ^= m.seed << 13
+		m.seed ^= m.seed >> 17
+		m.seed ^= m.seed << 5
+		if m.seed%4 != 0 {
+			break
+		}
+		h++
+	}
+	return h
+}
+
+// findGreaterOrEqual returns the first node whose key is at least key,
+// filling prev with the last node before it on every level when set.
+func (m *memtable) findGreaterOrEqual(key []byte, prev []*node) *node {
+	x := m.head
+	for level := m.height - 1; level >= 0; level-- {
+		for x.next[level] != nil && bytes.Compare(x.next[level].key, key) < 0 {
+			x = x.next[level]
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (m *memtable) put(key, value []byte, deleted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := make([]*node, maxHeight)
+	x := m.findGreaterOrEqual(key, prev)
+	if x != nil && bytes.Equal(x.key, key) {
+		m.size += len(value) - len(x.value)
+		x.value, x.deleted = value, deleted
+		return
+	}
+
+	h := m.randomHeight()
+	for level := m.height; level < h; level++ {
+		prev[level] = m.head
+	}
+	if h > m.height {
+		m.height = h
+	}
+	x = &node{key: key, value: value, deleted: deleted, next: make([]*node, h)}
+	for level := 0; level < h; level++ {
+		x.next[level] = prev[level].next[level]
+		prev[level].next[level] = x
+	}
+	m.size += len(key) + len(value) + 8*h
+}
+
+// get returns the entry for key, ok being false when there is none.
+func (m *memtable) get(key []byte) (value []byte, deleted, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	x := m.findGreaterOrEqual(key, nil)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return nil, false, false
+	}
+	return x.value, x.deleted, true
+}
+
+func (m *memtable) empty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.head.next[0] == nil
+}
+
+func (m *memtable) iterator() iterator {
+	return &memIterator{m: m}
+}
+
+// memIterator walks a memtable. Entries added after its position are
+// seen, those before aren't.
+type memIterator struct {
+	m *memtable
+	x *node
+}
+
+func (it *memIterator) seek(key []byte) {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.x = it.m.findGreaterOrEqual(key, nil)
+}
+
+func (it *memIterator) next() {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	it.x = it.x.next[0]
+}
+
+func (it *memIterator) valid() bool { return it.x != nil }
+
+func (it *memIterator) key() []byte { return it.x.key }
+
+func (it *memIterator) value() []byte {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	return it.x.value
+}
+
+func (it *memIterator) deleted() bool {
+	it.m.mu.RLock()
+	defer it.m.mu.RUnlock()
+	return it.x.deleted
+}
+
+func (it *memIterator) err() error { return nil }
+
+func (it *memIterator) close() error { return nil }
@@ -0,0 +1,381 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/buffer"
+	"hash/crc32"
+	"os"
+	"sort"
+	"sync/atomic"
+)
+
+// An SSTable is a file of sorted entries, written once. Entries are cut
+// into data blocks of about Options.BlockSize bytes, each followed by its
+// CRC-32, then come the bloom filter of the keys and the index, which
+// holds the last key and the place of every block. A footer of five
+// little-endian uint64 gives the offset and size of the index and of the
+// filter, then tableMagic.
+//
+// An entry is its key, its kind, then its value for puts, keys and values
+// being preceded by their length as a uvarint.
+
+const (
+	tableMagic  = 0x6d617964622d7373
+	footerSize  = 5 * 8
+	checksumLen = 4
+)
+
+var (
+	ErrCorrupt  = errors.New("lsm: corrupt table")
+	errReadOnly = errors.New("lsm: tables are written once")
+)
+
+type tableWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	opts   *Options
+	offset uint64
+
+	block   []byte
+	lastKey []byte
+	index   []byte
+	keys    [][]byte
+
+	smallest, largest []byte
+}
+
+func createTable(path string, opts *Options) (*tableWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &tableWriter{f: f, w: bufio.NewWriter(f), opts: opts}, nil
+}
+
+// add appends an entry, whose key must be greater than those before.
+func (w *tableWriter) add(key, value []byte, deleted bool) error {
+	key = append([]byte(nil), key...)
+	if w.smallest == nil {
+		w.smallest = key
+	}
+	w.largest, w.lastKey = key, key
+	w.keys = append(w.keys, key)
+
+	w.block = appendBytes(w.block, key)
+	if deleted {
+		w.block = append(w.block, kindDelete)
+	} else {
+		w.block = appendBytes(append(w.block, kindPut), value)
+	}
+	if len(w.block) >= w.opts.BlockSize {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+func (w *tableWriter) flushBlock() error {
+	if len(w.block) == 0 {
+		return nil
+	}
+	w.index = appendBytes(w.index, w.lastKey)
+	w.index = binary.AppendUvarint(w.index, w.offset)
+	w.index = binary.AppendUvarint(w.index, uint64(len(w.block)))
+	if err := w.write(w.block); err != nil {
+		return err
+	}
+	w.block = w.block[:0]
+	return nil
+}
+
+// write writes data followed by its checksum.
+func (w *tableWriter) write(data []byte) error {
+	var sum [checksumLen]byte
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(data))
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(sum[:]); err != nil {
+		return err
+	}
+	w.offset += uint64(len(data) + checksumLen)
+	return nil
+}
+
+// size is the number of bytes written so far.
+func (w *tableWriter) size() int64 {
+	return int64(w.offset) + int64(len(w.block))
+}
+
+func (w *tableWriter) empty() bool {
+	return w.smallest == nil
+}
+
+// finish writes the filter, index and footer and syncs the file.
+func (w *tableWriter) finish() (int64, error) {
+	if err := w.flushBlock(); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+	filterOffset := w.offset
+	filter := newBloom(w.keys, w.opts.BloomBitsPerKey)
+	if err := w.write(filter); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+	indexOffset := w.offset
+	if err := w.write(w.index); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+
+	var footer [footerSize]byte
+	for i, v := range []uint64{indexOffset, uint64(len(w.index)), filterOffset, uint64(len(filter)), tableMagic} {
+		binary.LittleEndian.PutUint64(footer[i*8:], v)
+	}
+	if _, err := w.w.Write(footer[:]); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return 0, err
+	}
+	return int64(w.offset) + footerSize, w.f.Close()
+}
+
+// abort gives up writing the table and removes it.
+func (w *tableWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+type blockHandle struct {
+	lastKey      []byte
+	offset, size uint64
+}
+
+// table reads an SSTable. Its index and filter are kept in memory, its
+// blocks are read through the buffer pool, as its pages numbered in
+// order. Versions that hold the table count as references; the last one
+// to go closes it, and removes the file once compactions made it
+// obsolete.
+type table struct {
+	num    uint64
+	f      *os.File
+	pool   *buffer.Pool
+	index  []blockHandle
+	filter bloom
+
+	refs     int32
+	obsolete int32
+}
+
+func openTable(path string, num uint64, pool *buffer.Pool) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &table{num: num, f: f, pool: pool}
+	if err := t.readMeta(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *table) readMeta() error {
+	fi, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < footerSize {
+		return ErrCorrupt
+	}
+	var footer [footerSize]byte
+	if _, err := t.f.ReadAt(footer[:], fi.Size()-footerSize); err != nil {
+		return err
+	}
+	var v [5]uint64
+	for i := range v {
+		v[i] = binary.LittleEndian.Uint64(footer[i*8:])
+	}
+	if v[4] != tableMagic {
+		return ErrCorrupt
+	}
+	index, err := t.readBlock(blockHandle{offset: v[0], size: v[1]})
+	if err != nil {
+		return err
+	}
+	if t.filter, err = t.readBlock(blockHandle{offset: v[2], size: v[3]}); err != nil {
+		return err
+	}
+
+	for len(index) > 0 {
+		var h blockHandle
+		var n int
+		if h.lastKey, index, err = readBytes(index); err != nil {
+			return err
+		}
+		if h.offset, n = binary.Uvarint(index); n <= 0 {
+			return ErrCorrupt
+		}
+		index = index[n:]
+		if h.size, n = binary.Uvarint(index); n <= 0 {
+			return ErrCorrupt
+		}
+		index = index[n:]
+		t.index = append(t.index, h)
+	}
+	return nil
+}
+
+func (t *table) readBlock(h blockHandle) ([]byte, error) {
+	data := make([]byte, h.size+checksumLen)
+	if _, err := t.f.ReadAt(data, int64(h.offset)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	block := data[:h.size]
+	if crc32.ChecksumIEEE(block) != binary.LittleEndian.Uint32(data[h.size:]) {
+		return nil, ErrCorrupt
+	}
+	return block, nil
+}
+
+// ReadPage reads block id.Page, for the buffer pool.
+func (t *table) ReadPage(id buffer.PageID) ([]byte, error) {
+	if id.Page >= uint64(len(t.index)) {
+		return nil, ErrCorrupt
+	}
+	return t.readBlock(t.index[id.Page])
+}
+
+func (t *table) WritePage(buffer.PageID, []byte) error {
+	return errReadOnly
+}
+
+func (t *table) ref() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+func (t *table) unref() {
+	if atomic.AddInt32(&t.refs, -1) > 0 {
+		return
+	}
+	t.f.Close()
+	t.pool.Discard(t.num)
+	if atomic.LoadInt32(&t.obsolete) == 1 {
+		os.Remove(t.f.Name())
+	}
+}
+
+// get looks key up, ok being false when the table doesn't hold it.
+func (t *table) get(key []byte) (value []byte, deleted, ok bool, err error) {
+	if !t.filter.mayContain(key) {
+		return nil, false, false, nil
+	}
+	it := t.iterator()
+	defer it.close()
+	it.seek(key)
+	if !it.valid() || !bytes.Equal(it.key(), key) {
+		return nil, false, false, it.err()
+	}
+	return it.value(), it.deleted(), true, nil
+}
+
+func (t *table) iterator() iterator {
+	return &tableIterator{t: t}
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	n, w := binary.Uvarint(data)
+	if w <= 0 || n > uint64(len(data)-w) {
+		return nil, nil, ErrCorrupt
+	}
+	end := w + int(n)
+	return data[w:end:end], data[end:], nil
+}
+
+// tableIterator keeps the block it is in pinned, until it moves on or is
+// closed. Keys and values stay valid after that, blocks being immutable.
+type tableIterator struct {
+	t     *table
+	bi    int
+	page  *buffer.Page
+	block []byte
+
+	k, v []byte
+	del  bool
+	ok   bool
+	e    error
+}
+
+func (it *tableIterator) seek(key []byte) {
+	it.bi = sort.Search(len(it.t.index), func(i int) bool {
+		return bytes.Compare(it.t.index[i].lastKey, key) >= 0
+	})
+	it.block, it.ok = nil, false
+	it.unpin()
+	for it.next(); it.ok && bytes.Compare(it.k, key) < 0; it.next() {
+	}
+}
+
+// next reads the next entry, loading the next block when needed.
+func (it *tableIterator) next() {
+	it.ok = false
+	for len(it.block) == 0 {
+		if it.e != nil || it.bi >= len(it.t.index) {
+			return
+		}
+		it.unpin()
+		if it.page, it.e = it.t.pool.Fetch(buffer.PageID{File: it.t.num, Page: uint64(it.bi)}, it.t); it.e != nil {
+			return
+		}
+		it.block = it.page.Data
+		it.bi++
+	}
+
+	var err error
+	if it.k, it.block, err = readBytes(it.block); err != nil || len(it.block) == 0 {
+		it.e = ErrCorrupt
+		return
+	}
+	kind := it.block[0]
+	it.block = it.block[1:]
+	it.del, it.v = kind == kindDelete, nil
+	if kind == kindPut {
+		if it.v, it.block, err = readBytes(it.block); err != nil {
+			it.e = err
+			return
+		}
+	} else if kind != kindDelete {
+		it.e = ErrCorrupt
+		return
+	}
+	it.ok = true
+}
+
+func (it *tableIterator) valid() bool   { return it.ok }
+func (it *tableIterator) key() []byte   { return it.k }
+func (it *tableIterator) value() []byte { return it.v }
+func (it *tableIterator) deleted() bool { return it.del }
+func (it *tableIterator) err() error    { return it.e }
+
+func (it *tableIterator) close() error {
+	it.unpin()
+	return nil
+}
+
+func (it *tableIterator) unpin() {
+	if it.page != nil {
+		it.t.pool.Unpin(it.page, false)
+		it.page = nil
+	}
+}
@@ -0,0 +1,153 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const numLevels = 7
+
+// tableMeta describes an SSTable of a level.
+type tableMeta struct {
+	Num      uint64
+	Size     int64
+	Smallest []byte
+	Largest  []byte
+
+	table *table
+}
+
+func (m *tableMeta) overlaps(smallest, largest []byte) bool {
+	return bytes.Compare(m.Largest, smallest) >= 0 && bytes.Compare(m.Smallest, largest) <= 0
+}
+
+// version is the set of SSTables of every level at some point. Level 0
+// holds the flushed memtables, oldest first, whose keys overlap; the
+// tables of the levels below are sorted and don't overlap. Versions never
+// change, compactions install new ones; refs counts the iterators and
+// reads using a version, plus one for the current version.
+type version struct {
+	levels [numLevels][]*tableMeta
+	refs   int
+}
+
+func newVersion(levels [numLevels][]*tableMeta) *version {
+	v := &version{levels: levels, refs: 1}
+	for _, level := range levels {
+		for _, m := range level {
+			m.table.ref()
+		}
+	}
+	return v
+}
+
+func (v *version) release() {
+	for _, level := range v.levels {
+		for _, m := range level {
+			m.table.unref()
+		}
+	}
+}
+
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, m := range v.levels[level] {
+		size += m.Size
+	}
+	return size
+}
+
+// overlapping returns the tables of level whose keys overlap [smallest,
+// largest].
+func (v *version) overlapping(level int, smallest, largest []byte) []*tableMeta {
+	var metas []*tableMeta
+	for _, m := range v.levels[level] {
+		if m.overlaps(smallest, largest) {
+			metas = append(metas, m)
+		}
+	}
+	return metas
+}
+
+// get looks key up in the SSTables, newest first.
+func (v *version) get(key []byte) (value []byte, deleted, ok bool, err error) {
+	l0 := v.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		if l0[i].overlaps(key, key) {
+			if value, deleted, ok, err = l0[i].table.get(key); ok || err != nil {
+				return
+			}
+		}
+	}
+	for _, level := range v.levels[1:] {
+		i := sort.Search(len(level), func(i int) bool {
+			return bytes.Compare(level[i].Largest, key) >= 0
+		})
+		if i < len(level) && bytes.Compare(level[i].Smallest, key) <= 0 {
+			if value, deleted, ok, err = level[i].table.get(key); ok || err != nil {
+				return
+			}
+		}
+	}
+	return nil, false, false, nil
+}
+
+// iterators returns iterators over the tables of v, newest first.
+func (v *version) iterators() []iterator {
+	var its []iterator
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		its = append(its, v.levels[0][i].table.iterator())
+	}
+	for _, level := range v.levels[1:] {
+		if len(level) > 0 {
+			its = append(its, &levelIterator{metas: level})
+		}
+	}
+	return its
+}
+
+// manifest is what the MANIFEST file of a DB holds. Logs numbered below
+// LogNum were flushed to SSTables already.
+type manifest struct {
+	NextNum uint64
+	LogNum  uint64
+	Levels  [][]*tableMeta
+}
+
+func readManifest(path string) (*manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m manifest
+	if err := gob.NewDecoder(f).Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest writes m to a temporary file renamed into place, so that
+// a crash leaves either the old manifest or the new one.
+func writeManifest(path string, m *manifest) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := gob.NewEncoder(tmp).Encode(m); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
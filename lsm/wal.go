@@ -0,0 +1,73 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// logWriter appends batches to a write-ahead log, each record being the
+// CRC-32 and length of a batch followed by it.
+type logWriter struct {
+	f      *os.File
+	header [8]byte
+}
+
+func createLog(path string) (*logWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &logWriter{f: f}, nil
+}
+
+func (w *logWriter) append(data []byte, sync bool) error {
+	binary.LittleEndian.PutUint32(w.header[:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(w.header[4:], uint32(len(data)))
+	if _, err := w.f.Write(append(w.header[:], data...)); err != nil {
+		return err
+	}
+	if sync {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+func (w *logWriter) close() error {
+	return w.f.Close()
+}
+
+// readLog calls apply for every batch of the log at path. A record cut
+// short or that fails its checksum ends the log: it is a write that
+// didn't complete before a crash.
+func readLog(path string, apply func(data []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(r, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[:4]) {
+			return nil
+		}
+		if err := apply(data); err != nil {
+			return err
+		}
+	}
+}
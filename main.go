@@ -1,20 +1,285 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/dump"
+	"github.com/nanjingblue/maydb/format"
 	"github.com/nanjingblue/maydb/repl"
+	"github.com/nanjingblue/maydb/server"
+	"github.com/nanjingblue/maydb/sqlstate"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"strings"
+	"syscall"
 )
 
+// Exit codes, so scripts can tell failing SQL from a bad invocation.
+const (
+	exitOK       = 0
+	exitSQLError = 1
+	exitUsage    = 2
+)
+
+// inputs collects -c and -f in the order they were given.
+type inputs struct {
+	readers []io.Reader
+	files   []*os.File
+}
+
+func (in *inputs) close() {
+	for _, f := range in.files {
+		f.Close()
+	}
+}
+
+type commandFlag struct{ *inputs }
+
+func (c commandFlag) String() string { return "" }
+
+func (c commandFlag) Set(sql string) error {
+	// Allow -c "SELECT 1" without the trailing semicolon; meta-commands
+	// take none
+	trimmed := strings.TrimSpace(sql)
+	if !strings.HasPrefix(trimmed, `\`) && !strings.HasSuffix(trimmed, ";") {
+		sql += ";"
+	}
+	c.readers = append(c.readers, strings.NewReader(sql+"\n"))
+	return nil
+}
+
+type fileFlag struct{ *inputs }
+
+func (f fileFlag) String() string { return "" }
+
+func (f fileFlag) Set(path string) error {
+	if path == "-" {
+		f.readers = append(f.readers, os.Stdin)
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	f.files = append(f.files, file)
+	f.readers = append(f.readers, file)
+	return nil
+}
+
+// dataSource turns --db into a DSN; a plain path means a file database.
+func dataSource(db string) string {
+	if db == "memory:" || strings.HasPrefix(db, "file:") || strings.HasPrefix(db, "lsm:") {
+		return db
+	}
+	return "file:" + db
+}
+
+// closeBackend closes the backends that hold files open, like lsm ones.
+func closeBackend(b backend.Backend) {
+	if c, ok := b.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// stdinIsTerminal reports whether stdin is interactive rather than a pipe
+// or file.
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
-	currentUser, err := user.Current()
+	os.Exit(run())
+}
+
+func run() int {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "dump":
+			return runDump(os.Args[2:])
+		case "restore":
+			return runRestore(os.Args[2:])
+		}
+	}
+
+	var in inputs
+	defer in.close()
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %[1]s dump [flags]\n       %[1]s restore [flags] [file]\n\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "Runs the -c commands and -f files in order, or SQL piped on stdin, or else starts the REPL.\n\nFlags:")
+		flag.PrintDefaults()
+	}
+	db := flag.String("db", "memory:", `database to open, "memory:", "lsm:<dir>" or a file path`)
+	bufferPool := flag.String("buffer-pool", "", `size of the buffer pool of an "lsm:" database, like 64MB (default 8MB)`)
+	httpAddr := flag.String("http", "", "serve the HTTP query API on this address instead of starting the REPL")
+	formatName := flag.String("format", "aligned", "result format: "+strings.Join(format.Names, ", "))
+	flag.Var(commandFlag{&in}, "c", "run this SQL and exit (repeatable)")
+	flag.Var(fileFlag{&in}, "f", `run the SQL in this file and exit, "-" for stdin (repeatable)`)
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+		flag.Usage()
+		return exitUsage
+	}
+	if _, err := format.New(*formatName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+
+	dsn := dataSource(*db)
+	if *bufferPool != "" {
+		if !strings.HasPrefix(dsn, "lsm:") {
+			fmt.Fprintln(os.Stderr, `--buffer-pool needs an "lsm:" database`)
+			return exitUsage
+		}
+		dsn += "?buffer_pool=" + url.QueryEscape(*bufferPool)
+	}
+	b, err := backend.Open(dsn)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer closeBackend(b)
+
+	if *httpAddr != "" {
+		return serve(*httpAddr, b)
+	}
+
+	if len(in.readers) == 0 && !stdinIsTerminal() {
+		in.readers = append(in.readers, os.Stdin)
+	}
+	if len(in.readers) > 0 {
+		if err := repl.Run(b, in.readers, os.Stdout, os.Stderr, *formatName); err != nil {
+			return exitSQLError
+		}
+		return exitOK
+	}
+
+	if currentUser, err := user.Current(); err == nil {
+		username := currentUser.Username[strings.Index(currentUser.Username, `\`)+1:]
+		fmt.Printf("Hello %s!\n", username)
 	}
-	username := currentUser.Username[strings.Index(currentUser.Username, `\`)+1:]
-	fmt.Printf("Hello %s!\n", username)
 	fmt.Printf("Feel free to type in commands\n")
-	repl.Start(os.Stdin, os.Stdout)
+	repl.Start(b, os.Stdin, os.Stdout, *formatName)
+	return exitOK
+}
+
+// serve answers HTTP queries on addr until it is interrupted, then returns
+// for the backend to be closed.
+func serve(addr string, b backend.Backend) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	srv := &http.Server{Addr: addr, Handler: server.New(b), ConnContext: server.ConnContext}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	log.Printf("Listening on %s", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Print(err)
+		return exitUsage
+	}
+	return exitOK
+}
+
+// runDump implements "maydb dump", writing the database as SQL.
+func runDump(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	db := fs.String("db", "", `database to dump, "lsm:<dir>" or a file path (required)`)
+	output := fs.String("o", "-", `file to write the dump to, "-" for stdout`)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if !requireDB(fs, *db) {
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	b, err := backend.Open(dataSource(*db))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer closeBackend(b)
+
+	w := io.Writer(os.Stdout)
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := dump.Dump(context.Background(), b, w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitSQLError
+	}
+	return exitOK
+}
+
+// requireDB reports whether db was given, as dumping or restoring an
+// in-memory database would do nothing, and prints the usage otherwise.
+func requireDB(fs *flag.FlagSet, db string) bool {
+	if db != "" {
+		return true
+	}
+	fmt.Fprintln(fs.Output(), "flag is required: -db")
+	fs.Usage()
+	return false
+}
+
+// runRestore implements "maydb restore", loading a dump into the database.
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	db := fs.String("db", "", `database to restore into, "lsm:<dir>" or a file path (required)`)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if !requireDB(fs, *db) {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", fs.Arg(1))
+		return exitUsage
+	}
+
+	in := io.Reader(os.Stdin)
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		defer f.Close()
+		in = f
+	}
+
+	b, err := backend.Open(dataSource(*db))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	defer closeBackend(b)
+	if err := dump.Restore(context.Background(), b, in); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR %s: %s\n", sqlstate.Code(err), err)
+		return exitSQLError
+	}
+	return exitOK
 }
@@ -0,0 +1,284 @@
+package parser
+
+import (
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/token"
+	"strings"
+)
+
+// Operators by increasing precedence, as in PostgreSQL: OR, AND, NOT,
+// IS [NOT] NULL, comparisons, + and -, then *, / and %.
+var (
+	comparisonOperators = []token.Symbol{
+		token.EqualsSymbol,
+		token.NotEqualsSymbol,
+		token.BangEqualsSymbol,
+		token.LessSymbol,
+		token.LessEqualsSymbol,
+		token.GreaterSymbol,
+		token.GreaterEqualsSymbol,
+	}
+	additiveOperators       = []token.Symbol{token.PlusSymbol, token.MinusSymbol}
+	multiplicativeOperators = []token.Symbol{token.AsteriskSymbol, token.SlashSymbol, token.PercentSymbol}
+)
+
+// parseExpression parses a whole expression, operators included.
+func (p *parser) parseExpression(initialCursor uint, _ token.Token) (*ast.Expression, uint, bool) {
+	return p.parseOr(initialCursor)
+}
+
+func binary(op *token.Token, left, right *ast.Expression) *ast.Expression {
+	return &ast.Expression{
+		Literal: op,
+		Args:    []*ast.Expression{left, right},
+		Kind:    ast.BinaryKind,
+	}
+}
+
+// parseKeywordOperator parses operand {keyword operand}.
+func (p *parser) parseKeywordOperator(initialCursor uint, k token.Keyword, operand func(uint) (*ast.Expression, uint, bool)) (*ast.Expression, uint, bool) {
+	left, cursor, ok := operand(initialCursor)
+	if !ok {
+		return nil, initialCursor, false
+	}
+	for p.expectToken(cursor, tokenFromKeyword(k)) {
+		op := p.tokens[cursor]
+		right, newCursor, ok := operand(cursor + 1)
+		if !ok {
+			p.expected(cursor+1, "expression")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		left = binary(op, left, right)
+	}
+	return left, cursor, true
+}
+
+func (p *parser) parseOr(initialCursor uint) (*ast.Expression, uint, bool) {
+	return p.parseKeywordOperator(initialCursor, token.OrKeyword, p.parseAnd)
+}
+
+func (p *parser) parseAnd(initialCursor uint) (*ast.Expression, uint, bool) {
+	return p.parseKeywordOperator(initialCursor, token.AndKeyword, p.parseNot)
+}
+
+func (p *parser) parseNot(initialCursor uint) (*ast.Expression, uint, bool) {
+	if !p.expectToken(initialCursor, tokenFromKeyword(token.NotKeyword)) {
+		return p.parseIs(initialCursor)
+	}
+	operand, cursor, ok := p.parseNot(initialCursor + 1)
+	if !ok {
+		p.expected(initialCursor+1, "expression")
+		return nil, initialCursor, false
+	}
+	return &ast.Expression{
+		Literal: p.tokens[initialCursor],
+		Args:    []*ast.Expression{operand},
+		Kind:    ast.UnaryKind,
+	}, cursor, true
+}
+
+// parseIs parses operand [IS [NOT] NULL].
+func (p *parser) parseIs(initialCursor uint) (*ast.Expression, uint, bool) {
+	exp, cursor, ok := p.parseComparison(initialCursor)
+	if !ok {
+		return nil, initialCursor, false
+	}
+	for p.expectToken(cursor, tokenFromKeyword(token.IsKeyword)) {
+		is := &ast.Expression{
+			Literal: p.tokens[cursor],
+			Args:    []*ast.Expression{exp},
+			Kind:    ast.UnaryKind,
+		}
+		cursor++
+		if p.expectToken(cursor, tokenFromKeyword(token.NotKeyword)) {
+			is.Not = true
+			cursor++
+		}
+		if !p.expectToken(cursor, tokenFromKeyword(token.NullKeyword)) {
+			p.expected(cursor, "NULL")
+			return nil, initialCursor, false
+		}
+		cursor++
+		exp = is
+	}
+	return exp, cursor, true
+}
+
+// parseSymbolOperator parses operand {op operand} for the operators ops.
+// first, when not nil, is an operand that was already parsed.
+func (p *parser) parseSymbolOperator(initialCursor uint, first *ast.Expression, ops []token.Symbol, operand func(uint, *ast.Expression) (*ast.Expression, uint, bool)) (*ast.Expression, uint, bool) {
+	left, cursor, ok := operand(initialCursor, first)
+	if !ok {
+		return nil, initialCursor, false
+	}
+
+outer:
+	for cursor < uint(len(p.tokens)) {
+		current := p.tokens[cursor]
+
+		// a -1 lexes as a followed by the number -1, which is a
+		// subtraction here
+		if current.Kind == token.NumericKind && strings.HasPrefix(current.Value, "-") && hasSymbol(ops, token.MinusSymbol) {
+			op := &token.Token{Value: string(token.MinusSymbol), Kind: token.SymbolKind, Loc: current.Loc}
+			number := &token.Token{Value: current.Value[1:], Kind: token.NumericKind, Loc: current.Loc}
+			number.Loc.Col++
+			right, newCursor, ok := operand(cursor+1, &ast.Expression{Literal: number, Kind: ast.LiteralKind})
+			if !ok {
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+			left = binary(op, left, right)
+			continue
+		}
+
+		for _, s := range ops {
+			if !p.expectToken(cursor, tokenFromSymbol(s)) {
+				continue
+			}
+			right, newCursor, ok := operand(cursor+1, nil)
+			if !ok {
+				p.expected(cursor+1, "expression")
+				return nil, initialCursor, false
+			}
+			left = binary(current, left, right)
+			cursor = newCursor
+			continue outer
+		}
+		break
+	}
+	return left, cursor, true
+}
+
+func hasSymbol(symbols []token.Symbol, s token.Symbol) bool {
+	for _, symbol := range symbols {
+		if symbol == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseComparison(initialCursor uint) (*ast.Expression, uint, bool) {
+	return p.parseSymbolOperator(initialCursor, nil, comparisonOperators, p.parseAdditive)
+}
+
+func (p *parser) parseAdditive(initialCursor uint, first *ast.Expression) (*ast.Expression, uint, bool) {
+	return p.parseSymbolOperator(initialCursor, first, additiveOperators, p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative(initialCursor uint, first *ast.Expression) (*ast.Expression, uint, bool) {
+	return p.parseSymbolOperator(initialCursor, first, multiplicativeOperators, p.parseUnary)
+}
+
+// parseUnary parses an operand with an optional minus sign, or returns
+// first as is when it was already parsed.
+func (p *parser) parseUnary(initialCursor uint, first *ast.Expression) (*ast.Expression, uint, bool) {
+	if first != nil {
+		return first, initialCursor, true
+	}
+	if !p.expectToken(initialCursor, tokenFromSymbol(token.MinusSymbol)) {
+		return p.parsePrimary(initialCursor)
+	}
+	operand, cursor, ok := p.parseUnary(initialCursor+1, nil)
+	if !ok {
+		p.expected(initialCursor+1, "expression")
+		return nil, initialCursor, false
+	}
+	return &ast.Expression{
+		Literal: p.tokens[initialCursor],
+		Args:    []*ast.Expression{operand},
+		Kind:    ast.UnaryKind,
+	}, cursor, true
+}
+
+// parsePrimary parses an expression without operators, or one between
+// parentheses.
+func (p *parser) parsePrimary(initialCursor uint) (*ast.Expression, uint, bool) {
+	cursor := initialCursor
+
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		exp, newCursor, ok := p.parseExpression(cursor+1, tokenFromSymbol(token.RightParenSymbol))
+		if !ok {
+			p.expected(cursor+1, "expression")
+			return nil, initialCursor, false
+		}
+		if !p.expectToken(newCursor, tokenFromSymbol(token.RightParenSymbol)) {
+			p.expected(newCursor, "')'")
+			return nil, initialCursor, false
+		}
+		return exp, newCursor + 1, true
+	}
+
+	if p.expectToken(cursor, tokenFromSymbol(token.AsteriskSymbol)) {
+		return &ast.Expression{
+			Literal: p.tokens[cursor],
+			Kind:    ast.StarKind,
+		}, cursor + 1, true
+	}
+
+	// Look for a qualified column reference, like users.id, or users.*
+	if table, newCursor, ok := p.parseToken(cursor, token.IdentifierKind); ok && p.expectToken(newCursor, tokenFromSymbol(token.DotSymbol)) {
+		if p.expectToken(newCursor+1, tokenFromSymbol(token.AsteriskSymbol)) {
+			return &ast.Expression{
+				Literal: p.tokens[newCursor+1],
+				Table:   table,
+				Kind:    ast.StarKind,
+			}, newCursor + 2, true
+		}
+		col, newCursor, ok := p.parseToken(newCursor+1, token.IdentifierKind)
+		if !ok {
+			p.expected(newCursor+1, "column name")
+			return nil, initialCursor, false
+		}
+		return &ast.Expression{
+			Literal: col,
+			Table:   table,
+			Kind:    ast.LiteralKind,
+		}, newCursor, true
+	}
+
+	// Look for a function call, like nextval('users_id_seq')
+	if name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind); ok && p.expectToken(newCursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		args, newCursor, ok := p.parseExpressions(newCursor+1, []token.Token{tokenFromSymbol(token.RightParenSymbol)})
+		if !ok {
+			return nil, initialCursor, false
+		}
+		return &ast.Expression{
+			Literal: name,
+			Args:    *args,
+			Kind:    ast.FunctionKind,
+		}, newCursor + 1, true
+	}
+
+	kinds := []token.TokenKind{token.IdentifierKind, token.NumericKind, token.StringKind}
+	for _, kind := range kinds {
+		t, newCursor, ok := p.parseToken(cursor, kind)
+		if ok {
+			return &ast.Expression{
+				Literal: t,
+				Kind:    ast.LiteralKind,
+			}, newCursor, true
+		}
+	}
+
+	// NULL, and DEFAULT in VALUES, are keywords standing for values
+	for _, k := range []token.Keyword{token.NullKeyword, token.DefaultKeyword} {
+		if p.expectToken(cursor, tokenFromKeyword(k)) {
+			return &ast.Expression{
+				Literal: p.tokens[cursor],
+				Kind:    ast.LiteralKind,
+			}, cursor + 1, true
+		}
+	}
+
+	t, newCursor, ok := p.parseToken(cursor, token.PlaceholderKind)
+	if ok {
+		return &ast.Expression{
+			Literal: t,
+			Kind:    ast.PlaceholderKind,
+		}, newCursor, true
+	}
+
+	return nil, initialCursor, false
+}
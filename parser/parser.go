@@ -6,6 +6,7 @@ import (
 	"github.com/nanjingblue/maydb/ast"
 	"github.com/nanjingblue/maydb/lexer"
 	"github.com/nanjingblue/maydb/token"
+	"strings"
 )
 
 func tokenFromKeyword(k token.Keyword) token.Token {
@@ -22,63 +23,250 @@ func tokenFromSymbol(s token.Symbol) token.Token {
 	}
 }
 
-func expectToken(tokens []*token.Token, cursor uint, t token.Token) bool {
-	if cursor >= uint(len(tokens)) {
-		return false
+// describe renders a token the way it is shown in "expected" lists.
+func describe(t token.Token) string {
+	switch t.Kind {
+	case token.KeywordKind:
+		return strings.ToUpper(t.Value)
+	case token.SymbolKind:
+		return "'" + t.Value + "'"
+	case token.StringKind:
+		return "'" + strings.ReplaceAll(t.Value, "'", "''") + "'"
 	}
-	return t.Equals(tokens[cursor])
+	return `"` + t.Value + `"`
 }
 
-func helpMessage(tokens []*token.Token, cursor uint, msg string) {
-	var c *token.Token
-	if cursor < uint(len(tokens)) {
-		c = tokens[cursor]
+// ParseError is returned by Parse for source that is not valid SQL.
+type ParseError struct {
+	Loc token.Location
+	// Expected lists what would have been valid at Loc, empty when the
+	// source could not even be split into tokens.
+	Expected []string
+	// Actual is the offending token, nil at the end of the input.
+	Actual *token.Token
+	Source string
+}
+
+func (e *ParseError) Error() string {
+	got := "end of input"
+	if e.Actual != nil {
+		got = describe(*e.Actual)
+	}
+
+	msg := "unexpected " + got
+	if len(e.Expected) > 0 {
+		msg = "expected " + strings.Join(e.Expected, " or ") + ", got " + got
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Loc.Line+1, e.Loc.Col+1, msg)
+}
+
+// Snippet renders the offending line of the source with a caret under the
+// error location.
+func (e *ParseError) Snippet() string {
+	lines := strings.Split(e.Source, "\n")
+	if int(e.Loc.Line) >= len(lines) {
+		return ""
+	}
+	line := strings.TrimRight(lines[e.Loc.Line], "\r")
+
+	// Keep tabs so that the caret lines up with the source
+	var pad []byte
+	for i := 0; i < int(e.Loc.Col); i++ {
+		if i < len(line) && line[i] == '\t' {
+			pad = append(pad, '\t')
+			continue
+		}
+		pad = append(pad, ' ')
+	}
+	return line + "\n" + string(pad) + "^"
+}
+
+type parser struct {
+	source string
+	tokens []*token.Token
+
+	// err is the failure furthest into the source, which is the most
+	// useful one to report after backtracking.
+	err       *ParseError
+	errCursor uint
+}
+
+// expected records that one of what was expected at cursor, unless an error
+// was already recorded further into the source.
+func (p *parser) expected(cursor uint, what ...string) {
+	if p.err != nil && cursor < p.errCursor {
+		return
+	}
+	if p.err != nil && cursor == p.errCursor {
+	merge:
+		for _, w := range what {
+			for _, e := range p.err.Expected {
+				if e == w {
+					continue merge
+				}
+			}
+			p.err.Expected = append(p.err.Expected, w)
+		}
+		return
+	}
+
+	p.err = &ParseError{
+		Expected: what,
+		Source:   p.source,
+	}
+	p.errCursor = cursor
+	if cursor < uint(len(p.tokens)) {
+		p.err.Actual = p.tokens[cursor]
+		p.err.Loc = p.tokens[cursor].Loc
 	} else {
-		c = tokens[cursor-1]
+		p.err.Loc = endOfInput(p.source)
+	}
+}
+
+// endOfInput returns the location just past the last token of source.
+func endOfInput(source string) token.Location {
+	var loc, end token.Location
+	for _, c := range []byte(source) {
+		switch c {
+		case '\n':
+			loc.Line++
+			loc.Col = 0
+		case ' ', '\t', '\r':
+			loc.Col++
+		default:
+			loc.Col++
+			end = loc
+		}
+	}
+	return end
+}
+
+func (p *parser) expectToken(cursor uint, t token.Token) bool {
+	if cursor >= uint(len(p.tokens)) {
+		return false
 	}
+	return t.Equals(p.tokens[cursor])
+}
+
+// expectWord reports whether the token at cursor is the identifier word.
+// It matches the words that only mean something in one place, like KEY,
+// which are not keywords so that they can still be used as names.
+func (p *parser) expectWord(cursor uint, word string) bool {
+	if cursor >= uint(len(p.tokens)) {
+		return false
+	}
+	t := p.tokens[cursor]
+	return t.Kind == token.IdentifierKind && t.Value == word
+}
+
+// parseColumnList parses a parenthesized list of column names.
+func (p *parser) parseColumnList(initialCursor uint) ([]token.Token, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		p.expected(cursor, "'('")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	var columns []token.Token
+	for !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+		if len(columns) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", "')'")
+				return nil, initialCursor, false
+			}
+			cursor++
+		}
 
-	fmt.Printf("[%d,%d]: %s, got: %s\n", c.Loc.Line, c.Loc.Col, msg, c.Value)
+		col, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+		if !ok {
+			p.expected(cursor, "column name")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		columns = append(columns, *col)
+	}
+	cursor++
+
+	return columns, cursor, true
+}
+
+// ParseExpression parses source holding a single expression, like the
+// DEFAULT of a column.
+func ParseExpression(source string) (*ast.Expression, error) {
+	tokens, err := lexer.Lex(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{source: source, tokens: tokens}
+	exp, cursor, ok := p.parseExpression(0, tokenFromSymbol(token.SemicolonSymbol))
+	if !ok {
+		p.expected(0, "expression")
+		return nil, p.err
+	}
+	if cursor < uint(len(tokens)) {
+		p.expected(cursor, "end of input")
+		return nil, p.err
+	}
+	return exp, nil
 }
 
 func Parse(source string) (*ast.Ast, error) {
 	tokens, err := lexer.Lex(source)
 	if err != nil {
+		var lexErr *lexer.LexError
+		if errors.As(err, &lexErr) {
+			return nil, &ParseError{
+				Loc: lexErr.Loc,
+				Actual: &token.Token{
+					Value: lexErr.Value,
+					Kind:  token.SymbolKind,
+					Loc:   lexErr.Loc,
+				},
+				Source: source,
+			}
+		}
 		return nil, err
 	}
 
+	p := parser{source: source, tokens: tokens}
 	a := ast.Ast{}
 	cursor := uint(0)
 	for cursor < uint(len(tokens)) {
-		stmt, newCursor, ok := parseStatement(tokens, cursor, tokenFromSymbol(token.SemicolonSymbol))
+		stmt, newCursor, ok := p.parseStatement(cursor, tokenFromSymbol(token.SemicolonSymbol))
 		if !ok {
-			helpMessage(tokens, cursor, "Expected statement")
-			return nil, errors.New("failed to parse, expected statement")
+			p.expected(cursor, "statement")
+			return nil, p.err
 		}
 		cursor = newCursor
 
 		a.Statements = append(a.Statements, stmt)
 
 		atLeastOneSemicolon := false
-		for expectToken(tokens, cursor, tokenFromSymbol(token.SemicolonSymbol)) {
+		for p.expectToken(cursor, tokenFromSymbol(token.SemicolonSymbol)) {
 			cursor++
 			atLeastOneSemicolon = true
 		}
 
-		if !atLeastOneSemicolon {
-			helpMessage(tokens, cursor, "Expected semi-colon delimiter between statements")
-			return nil, errors.New("missing semi-colon between statements")
+		// The last statement may go without its semicolon
+		if !atLeastOneSemicolon && cursor < uint(len(tokens)) {
+			p.expected(cursor, "';'")
+			return nil, p.err
 		}
 	}
 
 	return &a, nil
 }
 
-func parseStatement(tokens []*token.Token, initialCursor uint, delimiter token.Token) (*ast.Statement, uint, bool) {
+func (p *parser) parseStatement(initialCursor uint, delimiter token.Token) (*ast.Statement, uint, bool) {
 	cursor := initialCursor
 
 	// Look for a SELECT statement
 	semicolonToken := tokenFromSymbol(token.SemicolonSymbol)
-	slct, newCursor, ok := parseSelectStatement(tokens, cursor, semicolonToken)
+	slct, newCursor, ok := p.parseSelectStatement(cursor, semicolonToken)
 	if ok {
 		return &ast.Statement{
 			Kind:            ast.SelectKind,
@@ -87,7 +275,7 @@ func parseStatement(tokens []*token.Token, initialCursor uint, delimiter token.T
 	}
 
 	// Look for a INSERT statement
-	inst, newCursor, ok := parseInsertStatement(tokens, cursor, semicolonToken)
+	inst, newCursor, ok := p.parseInsertStatement(cursor, semicolonToken)
 	if ok {
 		return &ast.Statement{
 			Kind:            ast.InsertKind,
@@ -96,7 +284,7 @@ func parseStatement(tokens []*token.Token, initialCursor uint, delimiter token.T
 	}
 
 	// Look for a CREATE statement
-	crtTbl, newCursor, ok := parseCreateTableStatement(tokens, cursor, semicolonToken)
+	crtTbl, newCursor, ok := p.parseCreateTableStatement(cursor, semicolonToken)
 	if ok {
 		return &ast.Statement{
 			Kind:                 ast.CreateTableKind,
@@ -104,254 +292,1275 @@ func parseStatement(tokens []*token.Token, initialCursor uint, delimiter token.T
 		}, newCursor, true
 	}
 
+	// Look for a PREPARE statement
+	prep, newCursor, ok := p.parsePrepareStatement(cursor, semicolonToken)
+	if ok {
+		return &ast.Statement{
+			Kind:             ast.PrepareKind,
+			PrepareStatement: prep,
+		}, newCursor, true
+	}
+
+	// Look for an EXECUTE statement
+	exec, newCursor, ok := p.parseExecuteStatement(cursor, semicolonToken)
+	if ok {
+		return &ast.Statement{
+			Kind:             ast.ExecuteKind,
+			ExecuteStatement: exec,
+		}, newCursor, true
+	}
+
+	// Look for a DEALLOCATE statement
+	dealloc, newCursor, ok := p.parseDeallocateStatement(cursor, semicolonToken)
+	if ok {
+		return &ast.Statement{
+			Kind:                ast.DeallocateKind,
+			DeallocateStatement: dealloc,
+		}, newCursor, true
+	}
+
+	// Look for a COPY statement
+	cp, newCursor, ok := p.parseCopyStatement(cursor, semicolonToken)
+	if ok {
+		return &ast.Statement{
+			Kind:          ast.CopyKind,
+			CopyStatement: cp,
+		}, newCursor, true
+	}
+
+	// Look for an EXPLAIN statement
+	explain, newCursor, ok := p.parseExplainStatement(cursor, semicolonToken)
+	if ok {
+		return &ast.Statement{
+			Kind:             ast.ExplainKind,
+			ExplainStatement: explain,
+		}, newCursor, true
+	}
+
+	// Look for an ANALYZE statement
+	analyze, newCursor, ok := p.parseAnalyzeStatement(cursor)
+	if ok {
+		return &ast.Statement{
+			Kind:             ast.AnalyzeKind,
+			AnalyzeStatement: analyze,
+		}, newCursor, true
+	}
+
+	// Look for a CREATE SEQUENCE statement
+	seq, newCursor, ok := p.parseCreateSequenceStatement(cursor)
+	if ok {
+		return &ast.Statement{
+			Kind:                    ast.CreateSequenceKind,
+			CreateSequenceStatement: seq,
+		}, newCursor, true
+	}
+
+	// Look for a SET or RESET statement
+	set, newCursor, ok := p.parseSetStatement(cursor)
+	if ok {
+		return &ast.Statement{
+			Kind:         ast.SetKind,
+			SetStatement: set,
+		}, newCursor, true
+	}
+
+	// Look for a SHOW statement
+	show, newCursor, ok := p.parseShowStatement(cursor)
+	if ok {
+		return &ast.Statement{
+			Kind:          ast.ShowKind,
+			ShowStatement: show,
+		}, newCursor, true
+	}
+
 	return nil, initialCursor, false
 }
 
-func parseSelectStatement(tokens []*token.Token, initialCursor uint, delimiter token.Token) (*ast.SelectStatement, uint, bool) {
+func (p *parser) parseSelectStatement(initialCursor uint, delimiter token.Token) (*ast.SelectStatement, uint, bool) {
 	cursor := initialCursor
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.SelectKeyword)) {
+	if !p.expectToken(cursor, tokenFromKeyword(token.SelectKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
 	slct := ast.SelectStatement{}
 
-	exps, newCursor, ok := parseExpressions(tokens, cursor, []token.Token{tokenFromKeyword(token.FromKeyword), delimiter})
-	if !ok {
-		return nil, initialCursor, false
-	}
+	// Look for the items, each with an optional AS name
+	for {
+		if len(slct.Item) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", "FROM")
+				break
+			}
+			cursor++
+		}
 
-	slct.Item = *exps
-	cursor = newCursor
+		exp, newCursor, ok := p.parseExpression(cursor, delimiter)
+		if !ok {
+			p.expected(cursor, "expression")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
 
-	if expectToken(tokens, cursor, tokenFromKeyword(token.FromKeyword)) {
-		cursor++
+		if p.expectToken(cursor, tokenFromKeyword(token.AsKeyword)) {
+			alias, newCursor, ok := p.parseToken(cursor+1, token.IdentifierKind)
+			if !ok {
+				p.expected(cursor+1, "column alias")
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+			exp.Alias = alias
+		}
+		slct.Item = append(slct.Item, exp)
+	}
 
-		from, newCursor, ok := parseToken(tokens, cursor, token.IdentifierKind)
+	if p.expectToken(cursor, tokenFromKeyword(token.FromKeyword)) {
+		from, newCursor, ok := p.parseFrom(cursor + 1)
 		if !ok {
-			helpMessage(tokens, cursor, "Expected FROM token")
 			return nil, initialCursor, false
 		}
+		slct.From = from
+		cursor = newCursor
+	}
 
-		slct.From = *from
+	if p.expectToken(cursor, tokenFromKeyword(token.WhereKeyword)) {
+		where, newCursor, ok := p.parseExpression(cursor+1, delimiter)
+		if !ok {
+			p.expected(cursor+1, "expression")
+			return nil, initialCursor, false
+		}
+		slct.Where = where
 		cursor = newCursor
 	}
 
-	return &slct, cursor, true
-}
+	if p.expectToken(cursor, tokenFromKeyword(token.GroupKeyword)) {
+		cursor++
+		if !p.expectToken(cursor, tokenFromKeyword(token.ByKeyword)) {
+			p.expected(cursor, "BY")
+			return nil, initialCursor, false
+		}
+		cursor++
 
-func parseToken(tokens []*token.Token, initialCursor uint, kind token.TokenKind) (*token.Token, uint, bool) {
-	cursor := initialCursor
+		for {
+			exp, newCursor, ok := p.parseExpression(cursor, delimiter)
+			if !ok {
+				p.expected(cursor, "expression")
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+			slct.GroupBy = append(slct.GroupBy, exp)
 
-	if cursor >= uint(len(tokens)) {
-		return nil, initialCursor, false
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				break
+			}
+			cursor++
+		}
 	}
 
-	current := tokens[cursor]
-	if current.Kind == kind {
-		return current, cursor + 1, true
+	if p.expectToken(cursor, tokenFromKeyword(token.HavingKeyword)) {
+		having, newCursor, ok := p.parseExpression(cursor+1, delimiter)
+		if !ok {
+			p.expected(cursor+1, "expression")
+			return nil, initialCursor, false
+		}
+		slct.Having = having
+		cursor = newCursor
 	}
 
-	return nil, initialCursor, false
-}
-
-func parseExpressions(tokens []*token.Token, initialCursor uint, delimiters []token.Token) (*[]*ast.Expression, uint, bool) {
-	cursor := initialCursor
-
-	var exps []*ast.Expression
-outer:
-	for {
-		if cursor >= uint(len(tokens)) {
+	if p.expectToken(cursor, tokenFromKeyword(token.OrderKeyword)) {
+		cursor++
+		if !p.expectToken(cursor, tokenFromKeyword(token.ByKeyword)) {
+			p.expected(cursor, "BY")
 			return nil, initialCursor, false
 		}
+		cursor++
 
-		// Look for delimiter
-		current := tokens[cursor]
-		for _, delimiter := range delimiters {
-			if delimiter.Equals(current) {
-				break outer
+		for {
+			exp, newCursor, ok := p.parseExpression(cursor, delimiter)
+			if !ok {
+				p.expected(cursor, "expression")
+				return nil, initialCursor, false
 			}
-		}
+			cursor = newCursor
 
-		// Look for comma
-		if len(exps) > 0 {
-			if !expectToken(tokens, cursor, tokenFromSymbol(token.CommaSymbol)) {
-				helpMessage(tokens, cursor, "Expected comma")
-				return nil, initialCursor, false
+			term := &ast.OrderTerm{Expression: exp}
+			if p.expectToken(cursor, tokenFromKeyword(token.DescKeyword)) {
+				term.Desc = true
+				cursor++
+			} else if p.expectToken(cursor, tokenFromKeyword(token.AscKeyword)) {
+				cursor++
 			}
+			slct.OrderBy = append(slct.OrderBy, term)
 
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				break
+			}
 			cursor++
 		}
+	}
 
-		// Look for expression
-		exp, newCursor, ok := parseExpression(tokens, cursor, tokenFromSymbol(token.CommaSymbol))
+	// LIMIT and OFFSET, in any order
+	for _, clause := range []struct {
+		keyword token.Keyword
+		exp     **ast.Expression
+	}{
+		{token.LimitKeyword, &slct.Limit},
+		{token.OffsetKeyword, &slct.Offset},
+		{token.LimitKeyword, &slct.Limit},
+	} {
+		if *clause.exp != nil || !p.expectToken(cursor, tokenFromKeyword(clause.keyword)) {
+			continue
+		}
+		exp, newCursor, ok := p.parseExpression(cursor+1, delimiter)
 		if !ok {
-			helpMessage(tokens, cursor, "Expected expression")
+			p.expected(cursor+1, "expression")
 			return nil, initialCursor, false
 		}
+		*clause.exp = exp
 		cursor = newCursor
-
-		exps = append(exps, exp)
 	}
 
-	return &exps, cursor, true
+	return &slct, cursor, true
+}
+
+// reservedAliases are the words that cannot alias a table without AS.
+// The lexer has no keywords for the joins that are not supported, so
+// without them FROM a LEFT JOIN b would be an inner join of a, aliased
+// left, with b.
+var reservedAliases = map[string]bool{
+	"cross":   true,
+	"full":    true,
+	"left":    true,
+	"natural": true,
+	"outer":   true,
+	"right":   true,
+	"using":   true,
 }
 
-func parseExpression(tokens []*token.Token, initialCursor uint, _ token.Token) (*ast.Expression, uint, bool) {
+// parseFrom parses the tables of FROM, each with an optional alias,
+// separated by commas or joined with [INNER] JOIN ... ON.
+func (p *parser) parseFrom(initialCursor uint) ([]*ast.TableRef, uint, bool) {
 	cursor := initialCursor
 
-	kinds := []token.TokenKind{token.IdentifierKind, token.NumericKind, token.StringKind}
-	for _, kind := range kinds {
-		t, newCursor, ok := parseToken(tokens, cursor, kind)
-		if ok {
-			return &ast.Expression{
-				Literal: t,
-				Kind:    ast.LiteralKind,
-			}, newCursor, true
+	var from []*ast.TableRef
+	for {
+		ref := &ast.TableRef{}
+		join := false
+		switch {
+		case len(from) == 0:
+		case p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)):
+			cursor++
+		case p.expectToken(cursor, tokenFromKeyword(token.InnerKeyword)):
+			cursor++
+			if !p.expectToken(cursor, tokenFromKeyword(token.JoinKeyword)) {
+				p.expected(cursor, "JOIN")
+				return nil, initialCursor, false
+			}
+			fallthrough
+		case p.expectToken(cursor, tokenFromKeyword(token.JoinKeyword)):
+			cursor++
+			join = true
+		default:
+			return from, cursor, true
 		}
-	}
 
-	return nil, initialCursor, false
+		name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+		if !ok {
+			p.expected(cursor, "table name")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		ref.Name = *name
+
+		if p.expectToken(cursor, tokenFromKeyword(token.AsKeyword)) {
+			cursor++
+			alias, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+			if !ok {
+				p.expected(cursor, "table alias")
+				return nil, initialCursor, false
+			}
+			ref.Alias = alias
+			cursor = newCursor
+		} else if alias, newCursor, ok := p.parseToken(cursor, token.IdentifierKind); ok && !reservedAliases[alias.Value] {
+			ref.Alias = alias
+			cursor = newCursor
+		}
+
+		if join {
+			if !p.expectToken(cursor, tokenFromKeyword(token.OnKeyword)) {
+				p.expected(cursor, "ON")
+				return nil, initialCursor, false
+			}
+			on, newCursor, ok := p.parseExpression(cursor+1, tokenFromSymbol(token.SemicolonSymbol))
+			if !ok {
+				p.expected(cursor+1, "expression")
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+			ref.On = on
+		}
+		from = append(from, ref)
+	}
 }
 
-func parseInsertStatement(tokens []*token.Token, initialCursor uint, delimiter token.Token) (*ast.InsertStatement, uint, bool) {
+// parseExplainStatement parses EXPLAIN followed by a SELECT.
+func (p *parser) parseExplainStatement(initialCursor uint, delimiter token.Token) (*ast.ExplainStatement, uint, bool) {
 	cursor := initialCursor
-
-	// Look for INSERT
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.InsertKeyword)) {
+	if !p.expectToken(cursor, tokenFromKeyword(token.ExplainKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	// Look for INTO
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.IntoKeyword)) {
-		helpMessage(tokens, cursor, "Expected into")
-		return nil, initialCursor, false
+	explain := &ast.ExplainStatement{}
+	if p.expectToken(cursor, tokenFromKeyword(token.AnalyzeKeyword)) {
+		explain.Analyze = true
+		cursor++
+	} else if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		newCursor, ok := p.parseExplainOptions(cursor, explain)
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
 	}
-	cursor++
 
-	// Look for table name
-	table, newCursor, ok := parseToken(tokens, cursor, token.IdentifierKind)
+	slct, newCursor, ok := p.parseSelectStatement(cursor, delimiter)
 	if !ok {
-		helpMessage(tokens, cursor, "Expected table name")
+		p.expected(cursor, "SELECT")
 		return nil, initialCursor, false
 	}
-	cursor = newCursor
+	explain.Statement = &ast.Statement{
+		Kind:            ast.SelectKind,
+		SelectStatement: slct,
+	}
+	return explain, newCursor, true
+}
+
+// parseExplainOptions parses the options of EXPLAIN, like PostgreSQL's:
+// (ANALYZE [boolean], FORMAT {TEXT | JSON}).
+func (p *parser) parseExplainOptions(initialCursor uint, explain *ast.ExplainStatement) (uint, bool) {
+	cursor := initialCursor + 1
+	for first := true; !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)); first = false {
+		if !first {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", "')'")
+				return initialCursor, false
+			}
+			cursor++
+		}
+
+		// Like those of COPY, option names and values are plain words
+		if cursor >= uint(len(p.tokens)) || p.tokens[cursor].Kind == token.SymbolKind {
+			p.expected(cursor, "EXPLAIN option")
+			return initialCursor, false
+		}
+		nameCursor := cursor
+		name := strings.ToLower(p.tokens[cursor].Value)
+		cursor++
+		valueCursor := cursor
+		var value string
+		if cursor < uint(len(p.tokens)) && p.tokens[cursor].Kind != token.SymbolKind {
+			value = strings.ToLower(p.tokens[cursor].Value)
+			cursor++
+		}
+
+		switch {
+		case name == "analyze" && (value == "" || value == "true" || value == "on"):
+			explain.Analyze = true
+		case name == "analyze" && (value == "false" || value == "off"):
+			explain.Analyze = false
+		case name == "analyze":
+			p.expected(valueCursor, "boolean")
+			return initialCursor, false
+		case name == "format" && value == "text":
+			explain.JSON = false
+		case name == "format" && value == "json":
+			explain.JSON = true
+		case name == "format":
+			p.expected(valueCursor, "TEXT", "JSON")
+			return initialCursor, false
+		default:
+			p.expected(nameCursor, "EXPLAIN option")
+			return initialCursor, false
+		}
+	}
+	return cursor + 1, true
+}
 
-	// Look for VALUES
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.ValuesKeyword)) {
-		helpMessage(tokens, cursor, "Expected VALUES")
+// parseAnalyzeStatement parses ANALYZE [table].
+func (p *parser) parseAnalyzeStatement(initialCursor uint) (*ast.AnalyzeStatement, uint, bool) {
+	cursor := initialCursor
+	if !p.expectToken(cursor, tokenFromKeyword(token.AnalyzeKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	// Look for left paren
-	if !expectToken(tokens, cursor, tokenFromSymbol(token.LeftParenSymbol)) {
-		helpMessage(tokens, cursor, "Expected left paren")
+	analyze := &ast.AnalyzeStatement{}
+	if table, newCursor, ok := p.parseToken(cursor, token.IdentifierKind); ok {
+		analyze.Table = table
+		cursor = newCursor
+	} else {
+		p.expected(cursor, "table name")
+	}
+	return analyze, cursor, true
+}
+
+// parseSetStatement parses SET name { = | TO } { value | DEFAULT }, RESET
+// name and RESET ALL. Values are literals or plain words, like on.
+func (p *parser) parseSetStatement(initialCursor uint) (*ast.SetStatement, uint, bool) {
+	cursor := initialCursor
+	if p.expectToken(cursor, tokenFromKeyword(token.ResetKeyword)) {
+		cursor++
+		if p.expectToken(cursor, tokenFromKeyword(token.AllKeyword)) {
+			return &ast.SetStatement{}, cursor + 1, true
+		}
+		name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+		if !ok {
+			p.expected(cursor, "setting name", "ALL")
+			return nil, initialCursor, false
+		}
+		return &ast.SetStatement{Name: name}, newCursor, true
+	}
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.SetKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	// Look for expression list
-	values, newCursor, ok := parseExpressions(tokens, cursor, []token.Token{tokenFromSymbol(token.RightParenSymbol)})
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
 	if !ok {
+		p.expected(cursor, "setting name")
 		return nil, initialCursor, false
 	}
 	cursor = newCursor
 
-	// Look for right paren
-	if !expectToken(tokens, cursor, tokenFromSymbol(token.RightParenSymbol)) {
-		helpMessage(tokens, cursor, "Expected right paren")
+	if !p.expectToken(cursor, tokenFromSymbol(token.EqualsSymbol)) && !p.expectToken(cursor, tokenFromKeyword(token.ToKeyword)) {
+		p.expected(cursor, "'='", "TO")
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	return &ast.InsertStatement{
-		Table:  *table,
-		Values: values,
-	}, cursor, true
+	set := &ast.SetStatement{Name: name}
+	switch {
+	case p.expectToken(cursor, tokenFromKeyword(token.DefaultKeyword)):
+	case cursor >= uint(len(p.tokens)) || p.tokens[cursor].Kind == token.SymbolKind:
+		p.expected(cursor, "setting value", "DEFAULT")
+		return nil, initialCursor, false
+	default:
+		set.Value = p.tokens[cursor]
+	}
+	return set, cursor + 1, true
 }
 
-func parseCreateTableStatement(tokens []*token.Token, initialCursor uint, delimiter token.Token) (*ast.CreateTableStatement, uint, bool) {
+// parseShowStatement parses SHOW name and SHOW ALL.
+func (p *parser) parseShowStatement(initialCursor uint) (*ast.ShowStatement, uint, bool) {
 	cursor := initialCursor
-
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.CreateKeyword)) {
+	if !p.expectToken(cursor, tokenFromKeyword(token.ShowKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	if !expectToken(tokens, cursor, tokenFromKeyword(token.TableKeyword)) {
-		return nil, initialCursor, false
+	if p.expectToken(cursor, tokenFromKeyword(token.AllKeyword)) {
+		return &ast.ShowStatement{}, cursor + 1, true
 	}
-	cursor++
-
-	name, newCursor, ok := parseToken(tokens, cursor, token.IdentifierKind)
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
 	if !ok {
-		helpMessage(tokens, cursor, "Expected table name")
+		p.expected(cursor, "setting name", "ALL")
+		return nil, initialCursor, false
+	}
+	return &ast.ShowStatement{Name: name}, newCursor, true
+}
+
+func (p *parser) parseToken(initialCursor uint, kind token.TokenKind) (*token.Token, uint, bool) {
+	cursor := initialCursor
+
+	if cursor >= uint(len(p.tokens)) {
+		return nil, initialCursor, false
+	}
+
+	current := p.tokens[cursor]
+	if current.Kind == kind {
+		return current, cursor + 1, true
+	}
+
+	return nil, initialCursor, false
+}
+
+func (p *parser) parseExpressions(initialCursor uint, delimiters []token.Token) (*[]*ast.Expression, uint, bool) {
+	cursor := initialCursor
+
+	expectedAfterExpression := []string{describe(tokenFromSymbol(token.CommaSymbol))}
+	for _, delimiter := range delimiters {
+		expectedAfterExpression = append(expectedAfterExpression, describe(delimiter))
+	}
+
+	// A list ending its statement may also end the input, the last
+	// statement needing no semicolon
+	endsStatement := false
+	semicolon := tokenFromSymbol(token.SemicolonSymbol)
+	for _, delimiter := range delimiters {
+		if delimiter.Equals(&semicolon) {
+			endsStatement = true
+		}
+	}
+
+	var exps []*ast.Expression
+outer:
+	for {
+		if cursor >= uint(len(p.tokens)) {
+			if len(exps) > 0 && endsStatement {
+				break
+			}
+			if len(exps) > 0 {
+				p.expected(cursor, expectedAfterExpression...)
+			} else {
+				p.expected(cursor, "expression")
+			}
+			return nil, initialCursor, false
+		}
+
+		// Look for delimiter
+		current := p.tokens[cursor]
+		for _, delimiter := range delimiters {
+			if delimiter.Equals(current) {
+				break outer
+			}
+		}
+
+		// Look for comma
+		if len(exps) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, expectedAfterExpression...)
+				return nil, initialCursor, false
+			}
+
+			cursor++
+		}
+
+		// Look for expression
+		exp, newCursor, ok := p.parseExpression(cursor, tokenFromSymbol(token.CommaSymbol))
+		if !ok {
+			p.expected(cursor, "expression")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		exps = append(exps, exp)
+	}
+
+	return &exps, cursor, true
+}
+
+func (p *parser) parseInsertStatement(initialCursor uint, delimiter token.Token) (*ast.InsertStatement, uint, bool) {
+	cursor := initialCursor
+
+	// Look for INSERT
+	if !p.expectToken(cursor, tokenFromKeyword(token.InsertKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	// Look for INTO
+	if !p.expectToken(cursor, tokenFromKeyword(token.IntoKeyword)) {
+		p.expected(cursor, "INTO")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	// Look for table name
+	table, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "table name")
 		return nil, initialCursor, false
 	}
 	cursor = newCursor
-	if !expectToken(tokens, cursor, tokenFromSymbol(token.LeftParenSymbol)) {
-		helpMessage(tokens, cursor, "Expected left parenthesis")
+
+	inst := ast.InsertStatement{Table: *table}
+
+	// Look for an optional column list
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		columns, newCursor, ok := p.parseColumnList(cursor)
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		inst.Columns = columns
+	}
+
+	// Look for the rows, either VALUES or a SELECT
+	if slct, newCursor, ok := p.parseSelectStatement(cursor, delimiter); ok {
+		inst.Select = slct
+		cursor = newCursor
+	} else {
+		if !p.expectToken(cursor, tokenFromKeyword(token.ValuesKeyword)) {
+			p.expected(cursor, "VALUES", "SELECT")
+			return nil, initialCursor, false
+		}
+		cursor++
+
+		for {
+			// Look for left paren
+			if !p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+				p.expected(cursor, "'('")
+				return nil, initialCursor, false
+			}
+			cursor++
+
+			// Look for expression list
+			values, newCursor, ok := p.parseExpressions(cursor, []token.Token{tokenFromSymbol(token.RightParenSymbol)})
+			if !ok {
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+
+			// Look for right paren
+			if !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+				p.expected(cursor, "')'")
+				return nil, initialCursor, false
+			}
+			cursor++
+
+			inst.Values = append(inst.Values, *values)
+
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				break
+			}
+			cursor++
+		}
+	}
+
+	// Look for an optional ON CONFLICT
+	if p.expectToken(cursor, tokenFromKeyword(token.OnKeyword)) {
+		oc, newCursor, ok := p.parseOnConflict(cursor)
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		inst.OnConflict = oc
+	}
+
+	// Look for an optional RETURNING
+	if p.expectToken(cursor, tokenFromKeyword(token.ReturningKeyword)) {
+		cursor++
+
+		items, newCursor, ok := p.parseExpressions(cursor, []token.Token{delimiter})
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		inst.Returning = *items
+	}
+
+	return &inst, cursor, true
+}
+
+func (p *parser) parseOnConflict(initialCursor uint) (*ast.OnConflict, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.OnKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	if !p.expectWord(cursor, "conflict") {
+		p.expected(cursor, "CONFLICT")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	oc := ast.OnConflict{}
+
+	// Look for an optional conflict target
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		target, newCursor, ok := p.parseColumnList(cursor)
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		oc.Target = target
+	}
+
+	if !p.expectWord(cursor, "do") {
+		p.expected(cursor, "DO")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	if p.expectWord(cursor, "nothing") {
+		cursor++
+		return &oc, cursor, true
+	}
+
+	// DO UPDATE needs a target to know which row to update
+	if oc.Target == nil {
+		p.expected(cursor, "NOTHING")
+		return nil, initialCursor, false
+	}
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.UpdateKeyword)) {
+		p.expected(cursor, "NOTHING", "UPDATE")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.SetKeyword)) {
+		p.expected(cursor, "SET")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	for {
+		col, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+		if !ok {
+			p.expected(cursor, "column name")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		if !p.expectToken(cursor, tokenFromSymbol(token.EqualsSymbol)) {
+			p.expected(cursor, "'='")
+			return nil, initialCursor, false
+		}
+		cursor++
+
+		exp, newCursor, ok := p.parseExpression(cursor, tokenFromSymbol(token.CommaSymbol))
+		if !ok {
+			p.expected(cursor, "expression")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		oc.Set = append(oc.Set, &ast.SetClause{Column: *col, Value: exp})
+
+		if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+			break
+		}
+		cursor++
+	}
+
+	return &oc, cursor, true
+}
+
+func (p *parser) parseCreateTableStatement(initialCursor uint, delimiter token.Token) (*ast.CreateTableStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.CreateKeyword)) {
 		return nil, initialCursor, false
 	}
 	cursor++
 
-	cols, newCursor, ok := parseColumnDefinitions(tokens, cursor, tokenFromSymbol(token.RightParenSymbol))
+	if !p.expectToken(cursor, tokenFromKeyword(token.TableKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
 	if !ok {
+		p.expected(cursor, "table name")
 		return nil, initialCursor, false
 	}
 	cursor = newCursor
+	if !p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		p.expected(cursor, "'('")
+		return nil, initialCursor, false
+	}
+	cursor++
 
-	if !expectToken(tokens, cursor, tokenFromSymbol(token.RightParenSymbol)) {
-		helpMessage(tokens, cursor, "Expected right parenthesis")
+	cols, constraints, newCursor, ok := p.parseColumnDefinitions(cursor, tokenFromSymbol(token.RightParenSymbol))
+	if !ok {
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	if !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+		p.expected(cursor, "')'")
 		return nil, initialCursor, false
 	}
 	cursor++
-	return &ast.CreateTableStatement{
-		Name: *name,
-		Cols: cols,
-	}, cursor, true
+
+	crt := &ast.CreateTableStatement{
+		Name:        *name,
+		Cols:        cols,
+		Constraints: constraints,
+	}
+	if !p.expectToken(cursor, tokenFromKeyword(token.WithKeyword)) {
+		return crt, cursor, true
+	}
+	cursor++
+
+	options, newCursor, ok := p.parseTableOptions(cursor)
+	if !ok {
+		return nil, initialCursor, false
+	}
+	crt.Options = options
+	return crt, newCursor, true
+}
+
+// parseTableOptions parses the parenthesized storage parameters of CREATE
+// TABLE WITH, like (storage = 'columnar').
+func (p *parser) parseTableOptions(initialCursor uint) ([]*ast.TableOption, uint, bool) {
+	cursor := initialCursor
+	if !p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		p.expected(cursor, "'('")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	var options []*ast.TableOption
+	for !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+		if len(options) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", "')'")
+				return nil, initialCursor, false
+			}
+			cursor++
+		}
+
+		// Names are plain words, which may happen to be keywords
+		if cursor >= uint(len(p.tokens)) || p.tokens[cursor].Kind == token.SymbolKind || p.tokens[cursor].Kind == token.StringKind {
+			p.expected(cursor, "table option")
+			return nil, initialCursor, false
+		}
+		option := ast.TableOption{Name: *p.tokens[cursor]}
+		cursor++
+
+		if !p.expectToken(cursor, tokenFromSymbol(token.EqualsSymbol)) {
+			p.expected(cursor, "'='")
+			return nil, initialCursor, false
+		}
+		cursor++
+
+		if cursor >= uint(len(p.tokens)) || p.tokens[cursor].Kind == token.SymbolKind {
+			p.expected(cursor, "option value")
+			return nil, initialCursor, false
+		}
+		option.Value = *p.tokens[cursor]
+		cursor++
+		options = append(options, &option)
+	}
+	return options, cursor + 1, true
 }
 
-func parseColumnDefinitions(tokens []*token.Token, initialCursor uint, delimiter token.Token) (*[]*ast.ColumnDefinition, uint, bool) {
+func (p *parser) parseColumnDefinitions(initialCursor uint, delimiter token.Token) (*[]*ast.ColumnDefinition, []*ast.TableConstraint, uint, bool) {
 	cursor := initialCursor
 
 	var cds []*ast.ColumnDefinition
+	var constraints []*ast.TableConstraint
 	for {
-		if cursor >= uint(len(tokens)) {
-			return nil, initialCursor, false
+		if cursor >= uint(len(p.tokens)) {
+			p.expected(cursor, "','", describe(delimiter))
+			return nil, nil, initialCursor, false
 		}
 
-		current := tokens[cursor]
+		current := p.tokens[cursor]
 		if delimiter.Equals(current) {
 			break
 		}
-		if len(cds) > 0 {
-			if !expectToken(tokens, cursor, tokenFromSymbol(token.CommaSymbol)) {
-				helpMessage(tokens, cursor, "Expected comma")
-				return nil, initialCursor, false
+		if len(cds) > 0 || len(constraints) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", describe(delimiter))
+				return nil, nil, initialCursor, false
 			}
 			cursor++
 		}
-		id, newCursor, ok := parseToken(tokens, cursor, token.IdentifierKind)
+
+		// Look for a table constraint
+		if tc, newCursor, ok := p.parseTableConstraint(cursor); ok {
+			cursor = newCursor
+			constraints = append(constraints, tc)
+			continue
+		}
+
+		id, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
 		if !ok {
-			helpMessage(tokens, cursor, "Expected column name")
-			return nil, initialCursor, false
+			p.expected(cursor, "column name")
+			return nil, nil, initialCursor, false
 		}
 		cursor = newCursor
 
-		ty, newCursor, ok := parseToken(tokens, cursor, token.KeywordKind)
+		ty, newCursor, ok := p.parseToken(cursor, token.KeywordKind)
 		if !ok {
-			helpMessage(tokens, cursor, "Expected column type")
-			return nil, initialCursor, false
+			p.expected(cursor, "column type")
+			return nil, nil, initialCursor, false
 		}
 		cursor = newCursor
 
-		cds = append(cds, &ast.ColumnDefinition{
+		cd := ast.ColumnDefinition{
 			Name:     *id,
 			Datatype: *ty,
-		})
+		}
+
+		// Look for column constraints, in any order
+	constraints:
+		for {
+			switch {
+			case p.expectToken(cursor, tokenFromKeyword(token.NotKeyword)):
+				cursor++
+				if !p.expectToken(cursor, tokenFromKeyword(token.NullKeyword)) {
+					p.expected(cursor, "NULL")
+					return nil, nil, initialCursor, false
+				}
+				cursor++
+				cd.NotNull = true
+			case p.expectToken(cursor, tokenFromKeyword(token.NullKeyword)):
+				cursor++
+				cd.NotNull = false
+			case p.expectToken(cursor, tokenFromKeyword(token.DefaultKeyword)):
+				cursor++
+				exp, newCursor, ok := p.parseExpression(cursor, delimiter)
+				if !ok || !isDefaultValue(exp) {
+					p.expected(cursor, "default value")
+					return nil, nil, initialCursor, false
+				}
+				cursor = newCursor
+				cd.Default = exp
+			case p.expectToken(cursor, tokenFromKeyword(token.PrimaryKeyword)):
+				cursor++
+				if !p.expectWord(cursor, "key") {
+					p.expected(cursor, "KEY")
+					return nil, nil, initialCursor, false
+				}
+				cursor++
+				cd.PrimaryKey = true
+			case p.expectToken(cursor, tokenFromKeyword(token.UniqueKeyword)):
+				cursor++
+				cd.Unique = true
+			default:
+				break constraints
+			}
+		}
+
+		cds = append(cds, &cd)
+	}
+	return &cds, constraints, cursor, true
+}
+
+// isDefaultValue reports whether exp can be the DEFAULT of a column: a
+// literal or a function call, but not a column or a placeholder.
+func isDefaultValue(exp *ast.Expression) bool {
+	switch exp.Kind {
+	case ast.FunctionKind:
+		return true
+	case ast.LiteralKind:
+		return exp.Literal.Kind != token.IdentifierKind && exp.Literal.Value != string(token.DefaultKeyword)
 	}
-	return &cds, cursor, true
+	return false
+}
+
+// parseCreateSequenceStatement parses CREATE SEQUENCE name [START [WITH] n]
+// [INCREMENT [BY] n].
+func (p *parser) parseCreateSequenceStatement(initialCursor uint) (*ast.CreateSequenceStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.CreateKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.SequenceKeyword)) {
+		p.expected(cursor, "TABLE", "SEQUENCE")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "sequence name")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	seq := ast.CreateSequenceStatement{Name: *name}
+	for {
+		var value **token.Token
+		var noise token.Token
+		switch {
+		case p.expectWord(cursor, "start") && seq.Start == nil:
+			value = &seq.Start
+			noise = tokenFromKeyword(token.WithKeyword)
+		case p.expectWord(cursor, "increment") && seq.Increment == nil:
+			value = &seq.Increment
+			noise = tokenFromKeyword(token.ByKeyword)
+		case p.expectWord(cursor, "maxvalue") && seq.MaxValue == nil:
+			value = &seq.MaxValue
+		default:
+			return &seq, cursor, true
+		}
+		cursor++
+
+		if noise.Value != "" && p.expectToken(cursor, noise) {
+			cursor++
+		}
+		n, newCursor, ok := p.parseToken(cursor, token.NumericKind)
+		if !ok {
+			p.expected(cursor, "number")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		*value = n
+	}
+}
+
+// parseTableConstraint parses [CONSTRAINT name] PRIMARY KEY (cols) or
+// [CONSTRAINT name] UNIQUE (cols).
+func (p *parser) parseTableConstraint(initialCursor uint) (*ast.TableConstraint, uint, bool) {
+	cursor := initialCursor
+
+	tc := ast.TableConstraint{}
+	if p.expectToken(cursor, tokenFromKeyword(token.ConstraintKeyword)) {
+		cursor++
+		name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+		if !ok {
+			p.expected(cursor, "constraint name")
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		tc.Name = name
+	}
+
+	switch {
+	case p.expectToken(cursor, tokenFromKeyword(token.PrimaryKeyword)):
+		cursor++
+		if !p.expectWord(cursor, "key") {
+			p.expected(cursor, "KEY")
+			return nil, initialCursor, false
+		}
+		cursor++
+		tc.PrimaryKey = true
+	case p.expectToken(cursor, tokenFromKeyword(token.UniqueKeyword)):
+		cursor++
+	default:
+		if tc.Name != nil {
+			p.expected(cursor, "PRIMARY", "UNIQUE")
+		}
+		return nil, initialCursor, false
+	}
+
+	columns, newCursor, ok := p.parseColumnList(cursor)
+	if !ok {
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+	tc.Columns = columns
+
+	return &tc, cursor, true
+}
+
+func (p *parser) parsePrepareStatement(initialCursor uint, delimiter token.Token) (*ast.PrepareStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.PrepareKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "prepared statement name")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	// Look for optional parameter types
+	var types []token.Token
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		cursor++
+
+		for !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+			if len(types) > 0 {
+				if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+					p.expected(cursor, "','")
+					return nil, initialCursor, false
+				}
+				cursor++
+			}
+
+			ty, newCursor, ok := p.parseToken(cursor, token.KeywordKind)
+			if !ok {
+				p.expected(cursor, "parameter type")
+				return nil, initialCursor, false
+			}
+			cursor = newCursor
+
+			types = append(types, *ty)
+		}
+		cursor++
+	}
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.AsKeyword)) {
+		p.expected(cursor, "AS")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	stmt, newCursor, ok := p.parseStatement(cursor, delimiter)
+	if !ok {
+		p.expected(cursor, "statement")
+		return nil, initialCursor, false
+	}
+	switch stmt.Kind {
+	case ast.PrepareKind, ast.ExecuteKind, ast.DeallocateKind, ast.SetKind, ast.ShowKind:
+		p.expected(cursor, "SELECT", "INSERT", "CREATE")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	return &ast.PrepareStatement{
+		Name:      *name,
+		Types:     types,
+		Statement: stmt,
+	}, cursor, true
+}
+
+func (p *parser) parseExecuteStatement(initialCursor uint, delimiter token.Token) (*ast.ExecuteStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.ExecuteKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "prepared statement name")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	exec := ast.ExecuteStatement{Name: *name}
+
+	// Look for optional argument list
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		cursor++
+
+		args, newCursor, ok := p.parseExpressions(cursor, []token.Token{tokenFromSymbol(token.RightParenSymbol)})
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+
+		if !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+			p.expected(cursor, "')'")
+			return nil, initialCursor, false
+		}
+		cursor++
+
+		exec.Args = args
+	}
+
+	return &exec, cursor, true
+}
+
+func (p *parser) parseDeallocateStatement(initialCursor uint, delimiter token.Token) (*ast.DeallocateStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.DeallocateKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	// PREPARE is optional noise, as in DEALLOCATE PREPARE name
+	if p.expectToken(cursor, tokenFromKeyword(token.PrepareKeyword)) {
+		cursor++
+	}
+
+	if p.expectToken(cursor, tokenFromKeyword(token.AllKeyword)) {
+		cursor++
+		return &ast.DeallocateStatement{}, cursor, true
+	}
+
+	name, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "prepared statement name", "ALL")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	return &ast.DeallocateStatement{Name: name}, cursor, true
+}
+
+func (p *parser) parseCopyStatement(initialCursor uint, delimiter token.Token) (*ast.CopyStatement, uint, bool) {
+	cursor := initialCursor
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.CopyKeyword)) {
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	table, newCursor, ok := p.parseToken(cursor, token.IdentifierKind)
+	if !ok {
+		p.expected(cursor, "table name")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+
+	cp := ast.CopyStatement{Table: *table}
+
+	// Look for an optional column list
+	if p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		columns, newCursor, ok := p.parseColumnList(cursor)
+		if !ok {
+			return nil, initialCursor, false
+		}
+		cursor = newCursor
+		cp.Columns = columns
+	}
+
+	switch {
+	case p.expectToken(cursor, tokenFromKeyword(token.FromKeyword)):
+		cp.From = true
+	case p.expectToken(cursor, tokenFromKeyword(token.ToKeyword)):
+	default:
+		p.expected(cursor, "FROM", "TO")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	file, newCursor, ok := p.parseToken(cursor, token.StringKind)
+	if !ok {
+		p.expected(cursor, "file name")
+		return nil, initialCursor, false
+	}
+	cursor = newCursor
+	cp.File = *file
+
+	if !p.expectToken(cursor, tokenFromKeyword(token.WithKeyword)) {
+		return &cp, cursor, true
+	}
+	cursor++
+
+	if !p.expectToken(cursor, tokenFromSymbol(token.LeftParenSymbol)) {
+		p.expected(cursor, "'('")
+		return nil, initialCursor, false
+	}
+	cursor++
+
+	for !p.expectToken(cursor, tokenFromSymbol(token.RightParenSymbol)) {
+		if len(cp.Options) > 0 {
+			if !p.expectToken(cursor, tokenFromSymbol(token.CommaSymbol)) {
+				p.expected(cursor, "','", "')'")
+				return nil, initialCursor, false
+			}
+			cursor++
+		}
+
+		// Option names and values are plain words, which may happen to
+		// be keywords
+		if cursor >= uint(len(p.tokens)) || p.tokens[cursor].Kind == token.SymbolKind {
+			p.expected(cursor, "COPY option")
+			return nil, initialCursor, false
+		}
+		option := ast.CopyOption{Name: *p.tokens[cursor]}
+		cursor++
+
+		if cursor < uint(len(p.tokens)) && p.tokens[cursor].Kind != token.SymbolKind {
+			option.Value = p.tokens[cursor]
+			cursor++
+		}
+
+		cp.Options = append(cp.Options, &option)
+	}
+	cursor++
+
+	return &cp, cursor, true
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/nanjingblue/maydb/ast"
 	"github.com/nanjingblue/maydb/token"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -13,6 +14,51 @@ func TestParse(t *testing.T) {
 		source string
 		ast    *ast.Ast
 	}{
+		{
+			source: "CREATE TABLE t (id INT) WITH (storage = 'columnar');",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.CreateTableKind,
+						CreateTableStatement: &ast.CreateTableStatement{
+							Name: token.Token{
+								Loc:   token.Location{Col: 13, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "t",
+							},
+							Cols: &[]*ast.ColumnDefinition{
+								{
+									Name: token.Token{
+										Loc:   token.Location{Col: 16, Line: 0},
+										Kind:  token.IdentifierKind,
+										Value: "id",
+									},
+									Datatype: token.Token{
+										Loc:   token.Location{Col: 19, Line: 0},
+										Kind:  token.KeywordKind,
+										Value: "int",
+									},
+								},
+							},
+							Options: []*ast.TableOption{
+								{
+									Name: token.Token{
+										Loc:   token.Location{Col: 30, Line: 0},
+										Kind:  token.IdentifierKind,
+										Value: "storage",
+									},
+									Value: token.Token{
+										Loc:   token.Location{Col: 40, Line: 0},
+										Kind:  token.StringKind,
+										Value: "columnar",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			source: "CREATE TABLE users (id INT, name TEXT);",
 			ast: &ast.Ast{
@@ -56,6 +102,235 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			source: "EXECUTE add ('a', $1); DEALLOCATE ALL;",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.ExecuteKind,
+						ExecuteStatement: &ast.ExecuteStatement{
+							Name: token.Token{
+								Loc:   token.Location{Col: 8, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "add",
+							},
+							Args: &[]*ast.Expression{
+								{
+									Literal: &token.Token{
+										Loc:   token.Location{Col: 13, Line: 0},
+										Kind:  token.StringKind,
+										Value: "a",
+									},
+									Kind: ast.LiteralKind,
+								},
+								{
+									Literal: &token.Token{
+										Loc:   token.Location{Col: 18, Line: 0},
+										Kind:  token.PlaceholderKind,
+										Value: "$1",
+									},
+									Kind: ast.PlaceholderKind,
+								},
+							},
+						},
+					},
+					{
+						Kind:                ast.DeallocateKind,
+						DeallocateStatement: &ast.DeallocateStatement{},
+					},
+				},
+			},
+		},
+		{
+			source: "COPY users (id) TO 'users.csv' WITH (HEADER, DELIMITER ';');",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.CopyKind,
+						CopyStatement: &ast.CopyStatement{
+							Table: token.Token{
+								Loc:   token.Location{Col: 5, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "users",
+							},
+							Columns: []token.Token{
+								{
+									Loc:   token.Location{Col: 12, Line: 0},
+									Kind:  token.IdentifierKind,
+									Value: "id",
+								},
+							},
+							File: token.Token{
+								Loc:   token.Location{Col: 19, Line: 0},
+								Kind:  token.StringKind,
+								Value: "users.csv",
+							},
+							Options: []*ast.CopyOption{
+								{
+									Name: token.Token{
+										Loc:   token.Location{Col: 37, Line: 0},
+										Kind:  token.IdentifierKind,
+										Value: "header",
+									},
+								},
+								{
+									Name: token.Token{
+										Loc:   token.Location{Col: 45, Line: 0},
+										Kind:  token.IdentifierKind,
+										Value: "delimiter",
+									},
+									Value: &token.Token{
+										Loc:   token.Location{Col: 55, Line: 0},
+										Kind:  token.StringKind,
+										Value: ";",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			source: "INSERT INTO users (id) VALUES (NULL), (DEFAULT) RETURNING id;",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.InsertKind,
+						InsertStatement: &ast.InsertStatement{
+							Table: token.Token{
+								Loc:   token.Location{Col: 12, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "users",
+							},
+							Columns: []token.Token{
+								{
+									Loc:   token.Location{Col: 19, Line: 0},
+									Kind:  token.IdentifierKind,
+									Value: "id",
+								},
+							},
+							Values: [][]*ast.Expression{
+								{
+									{
+										Literal: &token.Token{
+											Loc:   token.Location{Col: 31, Line: 0},
+											Kind:  token.KeywordKind,
+											Value: "null",
+										},
+										Kind: ast.LiteralKind,
+									},
+								},
+								{
+									{
+										Literal: &token.Token{
+											Loc:   token.Location{Col: 39, Line: 0},
+											Kind:  token.KeywordKind,
+											Value: "default",
+										},
+										Kind: ast.LiteralKind,
+									},
+								},
+							},
+							Returning: []*ast.Expression{
+								{
+									Literal: &token.Token{
+										Loc:   token.Location{Col: 58, Line: 0},
+										Kind:  token.IdentifierKind,
+										Value: "id",
+									},
+									Kind: ast.LiteralKind,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			source: "ANALYZE users; ANALYZE;",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.AnalyzeKind,
+						AnalyzeStatement: &ast.AnalyzeStatement{
+							Table: &token.Token{
+								Loc:   token.Location{Col: 8, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "users",
+							},
+						},
+					},
+					{
+						Kind:             ast.AnalyzeKind,
+						AnalyzeStatement: &ast.AnalyzeStatement{},
+					},
+				},
+			},
+		},
+		{
+			source: "SET max_parallel_workers TO 4; RESET ALL; SHOW max_parallel_workers;",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.SetKind,
+						SetStatement: &ast.SetStatement{
+							Name: &token.Token{
+								Loc:   token.Location{Col: 4, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "max_parallel_workers",
+							},
+							Value: &token.Token{
+								Loc:   token.Location{Col: 28, Line: 0},
+								Kind:  token.NumericKind,
+								Value: "4",
+							},
+						},
+					},
+					{
+						Kind:         ast.SetKind,
+						SetStatement: &ast.SetStatement{},
+					},
+					{
+						Kind: ast.ShowKind,
+						ShowStatement: &ast.ShowStatement{
+							Name: &token.Token{
+								Loc:   token.Location{Col: 47, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "max_parallel_workers",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			source: "CREATE SEQUENCE ids START WITH 5 INCREMENT -1;",
+			ast: &ast.Ast{
+				Statements: []*ast.Statement{
+					{
+						Kind: ast.CreateSequenceKind,
+						CreateSequenceStatement: &ast.CreateSequenceStatement{
+							Name: token.Token{
+								Loc:   token.Location{Col: 16, Line: 0},
+								Kind:  token.IdentifierKind,
+								Value: "ids",
+							},
+							Start: &token.Token{
+								Loc:   token.Location{Col: 31, Line: 0},
+								Kind:  token.NumericKind,
+								Value: "5",
+							},
+							Increment: &token.Token{
+								Loc:   token.Location{Col: 43, Line: 0},
+								Kind:  token.NumericKind,
+								Value: "-1",
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -65,3 +340,171 @@ func TestParse(t *testing.T) {
 		assert.Equal(t, test.ast, asts, test.source)
 	}
 }
+
+func TestParseExpression(t *testing.T) {
+	exp, err := ParseExpression("setval('ids', 10)")
+	assert.Nil(t, err)
+	assert.Equal(t, &ast.Expression{
+		Literal: &token.Token{Loc: token.Location{Col: 0, Line: 0}, Kind: token.IdentifierKind, Value: "setval"},
+		Args: []*ast.Expression{
+			{
+				Literal: &token.Token{Loc: token.Location{Col: 7, Line: 0}, Kind: token.StringKind, Value: "ids"},
+				Kind:    ast.LiteralKind,
+			},
+			{
+				Literal: &token.Token{Loc: token.Location{Col: 14, Line: 0}, Kind: token.NumericKind, Value: "10"},
+				Kind:    ast.LiteralKind,
+			},
+		},
+		Kind: ast.FunctionKind,
+	}, exp)
+
+	_, err = ParseExpression("nextval('ids') 1")
+	assert.EqualError(t, err, "1:16: expected end of input, got \"1\"")
+}
+
+// sexp renders an expression with explicit parentheses, to check
+// precedence.
+func sexp(exp *ast.Expression) string {
+	if exp == nil {
+		return ""
+	}
+	s := exp.Literal.Value
+	if exp.Table != nil {
+		s = exp.Table.Value + "." + s
+	}
+	if exp.Kind == ast.UnaryKind && exp.Not {
+		s += " not"
+	}
+	if len(exp.Args) == 0 {
+		return s
+	}
+	var args []string
+	for _, arg := range exp.Args {
+		args = append(args, sexp(arg))
+	}
+	return "(" + s + " " + strings.Join(args, " ") + ")"
+}
+
+func TestParseSelect(t *testing.T) {
+	asts, err := Parse(`SELECT u.name AS n, count(*) FROM users u JOIN orders AS o ON u.id = o.user_id, items
+		WHERE a + 1 * 2 > 3 OR NOT b IS NOT NULL AND c <> -1 - 2
+		GROUP BY u.name HAVING count(*) >= 2 ORDER BY n DESC, 2 OFFSET 5 LIMIT 10;`)
+	assert.Nil(t, err)
+	slct := asts.Statements[0].SelectStatement
+
+	assert.Equal(t, "u.name", sexp(slct.Item[0]))
+	assert.Equal(t, "n", slct.Item[0].Alias.Value)
+	assert.Equal(t, "(count *)", sexp(slct.Item[1]))
+
+	assert.Equal(t, 3, len(slct.From))
+	assert.Equal(t, "users", slct.From[0].Name.Value)
+	assert.Equal(t, "u", slct.From[0].Alias.Value)
+	assert.Equal(t, "o", slct.From[1].Alias.Value)
+	assert.Equal(t, "(= u.id o.user_id)", sexp(slct.From[1].On))
+	assert.Nil(t, slct.From[2].On)
+
+	assert.Equal(t, "(or (> (+ a (* 1 2)) 3) (and (not (is not b)) (<> c (- -1 2))))", sexp(slct.Where))
+	assert.Equal(t, "u.name", sexp(slct.GroupBy[0]))
+	assert.Equal(t, "(>= (count *) 2)", sexp(slct.Having))
+	assert.Equal(t, "n", sexp(slct.OrderBy[0].Expression))
+	assert.True(t, slct.OrderBy[0].Desc)
+	assert.False(t, slct.OrderBy[1].Desc)
+	assert.Equal(t, "10", sexp(slct.Limit))
+	assert.Equal(t, "5", sexp(slct.Offset))
+
+	// Join words only alias a table after AS
+	asts, err = Parse("SELECT * FROM a AS left JOIN b ON left.id = b.id;")
+	assert.Nil(t, err)
+	assert.Equal(t, "left", asts.Statements[0].SelectStatement.From[0].Alias.Value)
+
+	// The last statement needs no semicolon
+	asts, err = Parse("SELECT 1; SELECT 2")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(asts.Statements))
+	asts, err = Parse("INSERT INTO t VALUES (1) RETURNING id, *")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(asts.Statements[0].InsertStatement.Returning))
+
+	asts, err = Parse("EXPLAIN SELECT a-1 FROM t;")
+	assert.Nil(t, err)
+	assert.Equal(t, ast.ExplainKind, asts.Statements[0].Kind)
+	assert.Equal(t, "(- a 1)", sexp(asts.Statements[0].ExplainStatement.Statement.SelectStatement.Item[0]))
+	assert.False(t, asts.Statements[0].ExplainStatement.Analyze)
+
+	asts, err = Parse("EXPLAIN ANALYZE SELECT 1; EXPLAIN (ANALYZE, FORMAT JSON) SELECT 1; EXPLAIN (analyze off, format text) SELECT 1;")
+	assert.Nil(t, err)
+	for i, want := range []ast.ExplainStatement{{Analyze: true}, {Analyze: true, JSON: true}, {}} {
+		ex := asts.Statements[i].ExplainStatement
+		assert.Equal(t, want.Analyze, ex.Analyze, i)
+		assert.Equal(t, want.JSON, ex.JSON, i)
+		assert.Equal(t, ast.SelectKind, ex.Statement.Kind, i)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		source  string
+		err     string
+		snippet string
+	}{
+		{
+			source:  "SELECT id FROM users\nSELECT name FROM users",
+			err:     "2:1: expected ';', got SELECT",
+			snippet: "SELECT name FROM users\n^",
+		},
+		{
+			source:  "SELECT id name FROM users;",
+			err:     `1:11: expected ',' or FROM or ';', got "name"`,
+			snippet: "SELECT id name FROM users;\n          ^",
+		},
+		{
+			source:  "CREATE TABLE users (id INT,\n\tname);",
+			err:     "2:6: expected column type, got ')'",
+			snippet: "\tname);\n\t    ^",
+		},
+		{
+			source:  "CREATE TABLE t (id INT) WITH (storage 'columnar');",
+			err:     `1:39: expected '=', got 'columnar'`,
+			snippet: "CREATE TABLE t (id INT) WITH (storage 'columnar');\n                                      ^",
+		},
+		{
+			source:  "EXPLAIN (FORMAT xml) SELECT 1;",
+			err:     `1:17: expected TEXT or JSON, got "xml"`,
+			snippet: "EXPLAIN (FORMAT xml) SELECT 1;\n                ^",
+		},
+		{
+			source:  "EXPLAIN (ANALYZE, COSTS) SELECT 1;",
+			err:     `1:19: expected EXPLAIN option, got "costs"`,
+			snippet: "EXPLAIN (ANALYZE, COSTS) SELECT 1;\n                  ^",
+		},
+		{
+			source:  "SELECT * FROM a LEFT JOIN b ON a.id = b.id;",
+			err:     `1:17: expected ';', got "left"`,
+			snippet: "SELECT * FROM a LEFT JOIN b ON a.id = b.id;\n                ^",
+		},
+		{
+			source:  "INSERT INTO users VALUES (1, #);",
+			err:     "1:30: unexpected '#'",
+			snippet: "INSERT INTO users VALUES (1, #);\n                             ^",
+		},
+		{
+			source:  "DROP TABLE users;",
+			err:     `1:1: expected statement, got "drop"`,
+			snippet: "DROP TABLE users;\n^",
+		},
+		{
+			source:  "INSERT INTO t VALUES (1) ON CONFLICT DO UPDATE SET a = 1;",
+			err:     "1:41: expected NOTHING, got UPDATE",
+			snippet: "INSERT INTO t VALUES (1) ON CONFLICT DO UPDATE SET a = 1;\n                                        ^",
+		},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.source)
+		var parseErr *ParseError
+		assert.ErrorAs(t, err, &parseErr, test.source)
+		assert.Equal(t, test.err, parseErr.Error(), test.source)
+		assert.Equal(t, test.snippet, parseErr.Snippet(), test.source)
+	}
+}
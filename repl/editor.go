@@ -0,0 +1,226 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by ReadLine when the user presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+type lineReader interface {
+	ReadLine(prompt string) (string, error)
+	AddHistory(entry string)
+}
+
+// newLineReader returns a line editor when in is a terminal, and a plain
+// reader otherwise.
+func newLineReader(in io.Reader, out io.Writer) lineReader {
+	if f, ok := in.(*os.File); ok && isTerminal(f.Fd()) {
+		return &lineEditor{
+			fd:      f.Fd(),
+			in:      bufio.NewReader(in),
+			out:     out,
+			history: loadHistory(historyPath()),
+		}
+	}
+	return &plainReader{in: bufio.NewReader(in), out: out}
+}
+
+type plainReader struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (r *plainReader) ReadLine(prompt string) (string, error) {
+	io.WriteString(r.out, prompt)
+	text, err := r.in.ReadString('\n')
+	return strings.TrimRight(text, "\r\n"), err
+}
+
+func (r *plainReader) AddHistory(string) {}
+
+// lineEditor reads lines from a terminal in raw mode, supporting cursor
+// movement, history and the usual Emacs-style control keys.
+type lineEditor struct {
+	fd      uintptr
+	in      *bufio.Reader
+	out     io.Writer
+	history *history
+}
+
+func (e *lineEditor) AddHistory(entry string) {
+	e.history.add(entry)
+}
+
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	return e.edit(prompt)
+}
+
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+
+	// histPos is the history entry being shown, len(entries) is the line
+	// that was being typed before browsing, kept in draft.
+	histPos := len(e.history.entries)
+	var draft []rune
+	showHistory := func(i int) {
+		if i < 0 || i > len(e.history.entries) || i == histPos {
+			return
+		}
+		if histPos == len(e.history.entries) {
+			draft = line
+		}
+		histPos = i
+		if i == len(e.history.entries) {
+			line = draft
+		} else {
+			line = []rune(e.history.entries[i])
+		}
+		pos = len(line)
+	}
+
+	io.WriteString(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			io.WriteString(e.out, "\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			io.WriteString(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos:pos], line[pos+1:]...)
+			}
+		case 127, 8: // Backspace, Ctrl-H
+			if pos > 0 {
+				line = append(line[:pos-1:pos-1], line[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(line)
+		case 2: // Ctrl-B
+			if pos > 0 {
+				pos--
+			}
+		case 6: // Ctrl-F
+			if pos < len(line) {
+				pos++
+			}
+		case 11: // Ctrl-K
+			line = line[:pos]
+		case 21: // Ctrl-U
+			line = line[pos:]
+			pos = 0
+		case 16: // Ctrl-P
+			showHistory(histPos - 1)
+		case 14: // Ctrl-N
+			showHistory(histPos + 1)
+		case 27: // Escape sequence
+			key, err := e.readEscape()
+			if err != nil {
+				return "", err
+			}
+			switch key {
+			case 'A':
+				showHistory(histPos - 1)
+			case 'B':
+				showHistory(histPos + 1)
+			case 'C':
+				if pos < len(line) {
+					pos++
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+				}
+			case 'H':
+				pos = 0
+			case 'F':
+				pos = len(line)
+			case '~':
+				if pos < len(line) {
+					line = append(line[:pos:pos], line[pos+1:]...)
+				}
+			}
+		default:
+			if !unicode.IsPrint(r) && r != '\t' {
+				continue
+			}
+			line = append(line[:pos:pos], append([]rune{r}, line[pos:]...)...)
+			pos++
+		}
+
+		e.redraw(prompt, line, pos)
+	}
+}
+
+// readEscape reads the rest of an ANSI escape sequence after ESC and
+// returns its final byte, normalized so that Home and End are 'H' and 'F'
+// and Delete is '~'. Unknown sequences return 0.
+func (e *lineEditor) readEscape() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if r != '[' && r != 'O' {
+		return 0, nil
+	}
+
+	var params []rune
+	for {
+		r, _, err = e.in.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if (r < '0' || r > '9') && r != ';' {
+			break
+		}
+		params = append(params, r)
+	}
+
+	if r != '~' {
+		return r, nil
+	}
+	switch string(params) {
+	case "1", "7":
+		return 'H', nil
+	case "4", "8":
+		return 'F', nil
+	case "3":
+		return '~', nil
+	}
+	return 0, nil
+}
+
+// redraw rewrites the whole line and puts the cursor back at pos. Line
+// breaks, which recalled statements have in quotes, take one column as ↵.
+func (e *lineEditor) redraw(prompt string, line []rune, pos int) {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, strings.ReplaceAll(string(line), "\n", "↵"))
+	if back := len(line) - pos; back > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", back)
+	}
+}
@@ -0,0 +1,143 @@
+package repl
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxHistory is the number of entries kept in memory and loaded from the
+// history file.
+const maxHistory = 1000
+
+type history struct {
+	path    string
+	entries []string
+}
+
+// historyPath returns $MAYDB_HISTORY, or ~/.maydb_history.
+func historyPath() string {
+	if path := os.Getenv("MAYDB_HISTORY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".maydb_history")
+}
+
+// loadHistory reads the history file at path. A missing or unreadable file
+// gives an empty history; an empty path one that is never saved.
+func loadHistory(path string) *history {
+	h := &history{path: path}
+	if path == "" {
+		return h
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		h.entries = append(h.entries, unescapeEntry(scanner.Text()))
+	}
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+	return h
+}
+
+// add appends entry to the history and the history file. Multi-line
+// statements are stored on one line, as the editor only edits one line:
+// their comments are removed, as they would run to the end of the line,
+// and their lines are joined by spaces, the rest of the text kept as typed.
+// Line breaks in quotes are part of the values and are kept: the editor
+// shows them as ↵, and the history file escapes them.
+func (h *history) add(entry string) {
+	entry = strings.TrimSpace(joinLines(stripComments(entry)))
+	if entry == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[1:]
+	}
+
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(escapeEntry(entry) + "\n")
+}
+
+// joinLines replaces the line breaks of text by spaces, leaving those in
+// quotes.
+func joinLines(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\n':
+			c = ' '
+		case c == '\'' || c == '"':
+			quote = c
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+var (
+	entryEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	entryUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// escapeEntry puts an entry on a line of the history file.
+func escapeEntry(entry string) string {
+	return entryEscaper.Replace(entry)
+}
+
+func unescapeEntry(line string) string {
+	return entryUnescaper.Replace(line)
+}
+
+// stripComments removes the -- comments of text, up to the end of their
+// line, leaving those in quotes.
+func stripComments(text string) string {
+	var b strings.Builder
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			for i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
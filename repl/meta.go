@@ -0,0 +1,258 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/format"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrUnknownCommand = errors.New("invalid command")
+
+const metaHelp = `\d [table]       describe table, or list tables
+\dt              list tables
+\buffers         show the buffer pool usage and hit ratio
+\i file          execute statements from file
+\o [file]        send results to file, or back to the terminal
+\format [name]   set the result format: %s
+\timing [on|off] toggle showing how long each statement took
+\x [on|off]      toggle expanded display
+\q               quit
+\?               show this help
+`
+
+// metaError is an error of a meta-command itself, as opposed to one of the
+// statements it runs.
+type metaError struct {
+	err error
+}
+
+func (e *metaError) Error() string {
+	return e.err.Error()
+}
+
+func (e *metaError) Unwrap() error {
+	return e.err
+}
+
+// metaCommand runs a backslash command and reports whether the REPL should
+// quit.
+func (r *repl) metaCommand(line string) (bool, error) {
+	fields := strings.Fields(line)
+	cmd, args := fields[0], fields[1:]
+
+	switch cmd {
+	case `\q`:
+		return true, nil
+	case `\i`:
+		return r.include(args)
+	}
+
+	if err := r.setting(cmd, args); err != nil {
+		return false, &metaError{err}
+	}
+	return false, nil
+}
+
+// include runs the statements of a file for \i.
+func (r *repl) include(args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, &metaError{errors.New(`\i: missing file name`)}
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return false, &metaError{err}
+	}
+	defer f.Close()
+
+	// Prompts would only clutter the output of a script
+	return r.run(&plainReader{in: bufio.NewReader(f), out: io.Discard})
+}
+
+// setting runs the meta-commands that neither quit nor run statements.
+func (r *repl) setting(cmd string, args []string) error {
+	switch cmd {
+	case `\?`:
+		fmt.Fprintf(r.term, metaHelp, strings.Join(format.Names, ", "))
+	case `\dt`:
+		return r.listTables()
+	case `\buffers`:
+		return r.bufferStats()
+	case `\d`:
+		if len(args) == 0 {
+			return r.listTables()
+		}
+		return r.describeTable(args[0])
+	case `\o`:
+		if len(args) == 0 {
+			return r.setOutput("")
+		}
+		return r.setOutput(args[0])
+	case `\format`:
+		if len(args) > 0 {
+			if _, err := format.New(args[0]); err != nil {
+				return err
+			}
+			r.format = strings.ToLower(args[0])
+		}
+		fmt.Fprintf(r.term, "Output format is %s.\n", r.format)
+	case `\timing`:
+		on, err := toggle(r.timing, args)
+		if err != nil {
+			return err
+		}
+		r.timing = on
+		fmt.Fprintf(r.term, "Timing is %s.\n", onOff(on))
+	case `\x`:
+		on, err := toggle(r.expanded, args)
+		if err != nil {
+			return err
+		}
+		r.expanded = on
+		fmt.Fprintf(r.term, "Expanded display is %s.\n", onOff(on))
+	default:
+		return fmt.Errorf("%w %s, try \\? for help", ErrUnknownCommand, cmd)
+	}
+	return nil
+}
+
+func (r *repl) listTables() error {
+	names, err := r.sess.Backend().ListTables()
+	if err != nil {
+		return err
+	}
+
+	results := &backend.Results{
+		Columns: []backend.Column{{Type: backend.TextType, Name: "name"}},
+	}
+	for _, name := range names {
+		results.Rows = append(results.Rows, []backend.Cell{backend.MemoryCell(name)})
+	}
+	return r.printResults(backend.ResultsRows(results))
+}
+
+func (r *repl) describeTable(name string) error {
+	def, err := r.sess.Backend().DescribeTable(name)
+	if err != nil {
+		return err
+	}
+
+	results := &backend.Results{
+		Columns: []backend.Column{
+			{Type: backend.TextType, Name: "column"},
+			{Type: backend.TextType, Name: "type"},
+			{Type: backend.TextType, Name: "nullable"},
+			{Type: backend.TextType, Name: "default"},
+		},
+	}
+	for _, col := range def.Columns {
+		var nullable, dflt backend.MemoryCell
+		if col.NotNull {
+			nullable = backend.MemoryCell("not null")
+		}
+		if col.Default != "" {
+			dflt = backend.MemoryCell(col.Default)
+		}
+		results.Rows = append(results.Rows, []backend.Cell{
+			backend.MemoryCell(col.Name),
+			backend.MemoryCell(col.Type.String()),
+			nullable,
+			dflt,
+		})
+	}
+	// Only the columns are data, the rest goes with the statuses
+	status := r.status()
+	fmt.Fprintf(status, "Table %q\n", def.Name)
+	if err := r.printResults(backend.ResultsRows(results)); err != nil {
+		return err
+	}
+
+	if len(def.Constraints) > 0 {
+		fmt.Fprintln(status, "Indexes:")
+	}
+	for _, c := range def.Constraints {
+		kind := "UNIQUE"
+		if c.PrimaryKey {
+			kind = "PRIMARY KEY"
+		}
+		fmt.Fprintf(status, "    %q %s (%s)\n", c.Name, kind, strings.Join(c.Columns, ", "))
+	}
+	if def.Storage != "" {
+		fmt.Fprintf(status, "Storage: %s\n", def.Storage)
+	}
+	return nil
+}
+
+// bufferStats shows the buffer pool of the backend, for \buffers.
+func (r *repl) bufferStats() error {
+	b, ok := r.sess.Backend().(backend.Buffered)
+	if !ok {
+		return errors.New("the database has no buffer pool")
+	}
+	s := b.BufferStats()
+	results := &backend.Results{
+		Columns: []backend.Column{
+			{Type: backend.TextType, Name: "metric"},
+			{Type: backend.TextType, Name: "value"},
+		},
+	}
+	for _, m := range [][2]string{
+		{"size", fmt.Sprint(s.Size)},
+		{"used", fmt.Sprint(s.Used)},
+		{"pages", fmt.Sprint(s.Pages)},
+		{"hits", fmt.Sprint(s.Hits)},
+		{"misses", fmt.Sprint(s.Misses)},
+		{"hit ratio", fmt.Sprintf("%.1f%%", 100*s.HitRatio())},
+		{"evictions", fmt.Sprint(s.Evictions)},
+		{"writes", fmt.Sprint(s.Writes)},
+	} {
+		results.Rows = append(results.Rows, []backend.Cell{backend.MemoryCell(m[0]), backend.MemoryCell(m[1])})
+	}
+	return r.printResults(backend.ResultsRows(results))
+}
+
+// setOutput sends results to the file at path, or back to the terminal
+// when path is empty.
+func (r *repl) setOutput(path string) error {
+	if r.outFile != nil {
+		r.outFile.Close()
+		r.outFile = nil
+	}
+	r.out = r.stdout
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	r.out = f
+	r.outFile = f
+	return nil
+}
+
+// toggle returns the new value of a setting after \cmd [on|off].
+func toggle(current bool, args []string) (bool, error) {
+	if len(args) == 0 {
+		return !current, nil
+	}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return current, fmt.Errorf("unrecognized value %q, expected on or off", args[0])
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
@@ -2,76 +2,278 @@ package repl
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/nanjingblue/maydb/ast"
 	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/format"
 	"github.com/nanjingblue/maydb/parser"
+	"github.com/nanjingblue/maydb/session"
+	"github.com/nanjingblue/maydb/sqlstate"
 	"io"
+	"os"
+	"os/signal"
 	"strings"
+	"time"
 )
 
-func Start(in io.Reader, out io.Writer) {
-	mb := backend.NewMemoryBacked()
+const (
+	prompt             = "# "
+	continuationPrompt = "- "
+)
 
-	reader := bufio.NewReader(in)
-	fmt.Println("Welcome to gosql.")
-	for {
-		fmt.Print("# ")
-		text, _ := reader.ReadString('\n')
-		text = strings.Replace(text, "\n", "", -1)
-		text = text[:len(text)-1]
+type repl struct {
+	sess *session.Session
+
+	// term receives prompts and errors, out the results of statements.
+	// out is stdout unless changed with \o.
+	term    io.Writer
+	stdout  io.Writer
+	out     io.Writer
+	outFile io.Closer
+
+	format   string
+	timing   bool
+	expanded bool
+
+	// stopOnError makes run return the first error instead of printing it
+	// and carrying on.
+	stopOnError bool
+}
+
+// Start reads statements from in until EOF or \q and writes their results
+// to out in the given format, one of format.Names. A statement may span
+// several lines, it is executed once a line ends with a semicolon outside
+// of any quotes. Lines starting with a backslash are meta-commands, see \?.
+// Ctrl-C cancels the running statement, or clears the line being typed.
+func Start(b backend.Backend, in io.Reader, out io.Writer, formatName string) {
+	r := &repl{
+		sess:   session.New(b),
+		term:   out,
+		stdout: out,
+		out:    out,
+		format: formatName,
+	}
+	defer r.setOutput("")
+
+	fmt.Fprintln(r.term, "Welcome to gosql.")
+	if quit, _ := r.run(newLineReader(in, out)); !quit {
+		fmt.Fprintln(r.term)
+	}
+}
 
-		asts, err := parser.Parse(text)
+// Run executes the statements and meta-commands read from each of inputs in
+// turn, in one session and without prompting. Results are written to out in
+// the given format, errors to errOut. It stops at the first error and
+// returns it.
+func Run(b backend.Backend, inputs []io.Reader, out, errOut io.Writer, formatName string) error {
+	r := &repl{
+		sess:        session.New(b),
+		term:        errOut,
+		stdout:      out,
+		out:         out,
+		format:      formatName,
+		stopOnError: true,
+	}
+	defer r.setOutput("")
+
+	for _, in := range inputs {
+		quit, err := r.run(&plainReader{in: bufio.NewReader(in), out: io.Discard})
 		if err != nil {
-			panic(err)
+			r.printError(err)
+			return err
+		}
+		if quit {
+			break
+		}
+	}
+	return nil
+}
+
+// run executes what lr reads until EOF or \q, and reports whether \q was
+// used.
+func (r *repl) run(lr lineReader) (bool, error) {
+	report := func(err error) error {
+		if r.stopOnError {
+			return err
+		}
+		r.printError(err)
+		return nil
+	}
+
+	var buf []string
+	for {
+		p := prompt
+		if len(buf) > 0 {
+			p = continuationPrompt
+		}
+
+		line, readErr := lr.ReadLine(p)
+		if readErr == errInterrupted {
+			buf = nil
+			continue
+		}
+		if readErr != nil && readErr != io.EOF {
+			return false, report(readErr)
 		}
-		for _, stmt := range asts.Statements {
-			switch stmt.Kind {
-			case ast.CreateTableKind:
-				err = mb.CreateTable(asts.Statements[0].CreateTableStatement)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Println("ok")
-			case ast.InsertKind:
-				err = mb.Insert(stmt.InsertStatement)
-				if err != nil {
-					panic(err)
-				}
-				fmt.Println("ok")
-			case ast.SelectKind:
-				results, err := mb.Select(stmt.SelectStatement)
-				if err != nil {
-					panic(err)
-				}
-				for _, col := range results.Columns {
-					io.WriteString(out, fmt.Sprintf("| %s", col.Name))
-				}
-				io.WriteString(out, "|")
 
-				for i := 0; i < 20; i++ {
-					io.WriteString(out, "=")
+		if len(buf) == 0 && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			lr.AddHistory(line)
+			quit, err := r.metaCommand(strings.TrimSpace(line))
+			if err != nil {
+				if err := report(err); err != nil {
+					return false, err
 				}
-				io.WriteString(out, "\n")
-
-				for _, result := range results.Rows {
-					io.WriteString(out, "|")
-
-					for i, cell := range result {
-						typ := results.Columns[i].Type
-						s := ""
-						switch typ {
-						case backend.IntType:
-							s = fmt.Sprintf("%d", cell.AsInt())
-						case backend.TextType:
-							s = cell.AsText()
-						}
-						io.WriteString(out, fmt.Sprintf("%s |", s))
-					}
-					fmt.Println()
+			}
+			if quit {
+				return true, nil
+			}
+		} else if len(buf) > 0 || strings.TrimSpace(line) != "" {
+			buf = append(buf, line)
+		}
+
+		text := strings.Join(buf, "\n")
+		if statementComplete(text) || (readErr == io.EOF && strings.TrimSpace(text) != "") {
+			lr.AddHistory(text)
+			if err := r.execute(text); err != nil {
+				if err := report(err); err != nil {
+					return false, err
 				}
-				fmt.Println("ok")
 			}
+			buf = nil
+		}
+
+		if readErr == io.EOF {
+			return false, nil
 		}
 	}
 }
+
+// statementComplete reports whether text ends with a semicolon that is not
+// inside a string or a quoted identifier.
+func statementComplete(text string) bool {
+	var quote byte
+	complete := false
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			// A doubled quote escapes it, and is handled as closing and
+			// reopening the quotes.
+			if c == quote {
+				quote = 0
+			}
+		case c == '-' && i+1 < len(text) && text[i+1] == '-':
+			// Skip the comment, up to the end of the line
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			complete = false
+		case c == ';':
+			complete = true
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			complete = false
+		}
+	}
+	return quote == 0 && complete
+}
+
+// notifyInterrupt relays Ctrl-C to c, as signal.Notify does. Tests replace
+// it to interrupt statements without signals.
+var notifyInterrupt = func(c chan<- os.Signal) { signal.Notify(c, os.Interrupt) }
+
+// onInterrupt calls cancel when Ctrl-C is pressed, rather than letting it
+// end the process, until the returned function is called.
+func onInterrupt(cancel func()) func() {
+	sig := make(chan os.Signal, 1)
+	notifyInterrupt(sig)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+	}
+}
+
+func (r *repl) execute(text string) error {
+	// The statements are canceled by Ctrl-C until their rows are printed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer onInterrupt(cancel)()
+
+	start := time.Now()
+	rs, err := r.sess.ExecContext(ctx, text)
+	if err != nil {
+		return err
+	}
+
+	for i, res := range rs {
+		if res.Rows == nil {
+			fmt.Fprintln(r.status(), "ok")
+			continue
+		}
+		if err := r.printResults(res.Rows); err != nil {
+			// The rows of the last statement still have to be closed
+			if last := rs[len(rs)-1]; i < len(rs)-1 && last.Rows != nil {
+				last.Rows.Close()
+			}
+			return err
+		}
+	}
+
+	// The rows are computed as they are printed, so that is timed too
+	if r.timing {
+		fmt.Fprintf(r.status(), "Time: %.3f ms\n", float64(time.Since(start).Microseconds())/1000)
+	}
+	return nil
+}
+
+// status returns where statuses and timings go. Only the aligned format is
+// for people, the others are data that they would corrupt.
+func (r *repl) status() io.Writer {
+	if r.format != "aligned" {
+		return r.term
+	}
+	return r.out
+}
+
+func (r *repl) printResults(rows backend.Rows) error {
+	defer rows.Close()
+	f, err := format.New(r.format)
+	if err != nil {
+		return err
+	}
+	if aligned, ok := f.(*format.Aligned); ok {
+		aligned.Expanded = r.expanded
+	}
+	if err := f.Format(r.out, rows); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// printError writes err with its SQLSTATE, and the offending source line
+// for parse errors.
+func (r *repl) printError(err error) {
+	var metaErr *metaError
+	if errors.As(err, &metaErr) {
+		// Not an SQL error, so there is no SQLSTATE to show
+		fmt.Fprintln(r.term, err)
+		return
+	}
+
+	fmt.Fprintf(r.term, "ERROR %s: %s\n", sqlstate.Code(err), err)
+
+	var parseErr *parser.ParseError
+	if errors.As(err, &parseErr) {
+		fmt.Fprintln(r.term, parseErr.Snippet())
+	}
+}
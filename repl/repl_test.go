@@ -0,0 +1,230 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatementComplete(t *testing.T) {
+	tests := []struct {
+		text     string
+		complete bool
+	}{
+		{text: "SELECT id FROM users;", complete: true},
+		{text: "SELECT id FROM users;  ", complete: true},
+		{text: "SELECT id\nFROM users", complete: false},
+		{text: "INSERT INTO users VALUES (1, 'a;", complete: false},
+		{text: "INSERT INTO users VALUES (1, 'a;');", complete: true},
+		{text: "INSERT INTO users VALUES (1, 'it''s;", complete: false},
+		{text: "SELECT id FROM users; SELECT", complete: false},
+		{text: "SELECT id FROM users; -- it's done", complete: true},
+		{text: "-- the users;\nSELECT id", complete: false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.complete, statementComplete(test.text), test.text)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		input   string
+		history []string
+		line    string
+		err     error
+	}{
+		{input: "select\r", line: "select"},
+		// Left twice, insert, End, Backspace
+		{input: "abcd\x1b[D\x1b[DX\x1b[F\x7f\r", line: "abXc"},
+		// Home, Delete
+		{input: "abc\x1b[H\x1b[3~\r", line: "bc"},
+		// Ctrl-A, Ctrl-K, then type
+		{input: "abc\x01\x0bxy\r", line: "xy"},
+		// Up twice, Down once
+		{input: "\x1b[A\x1b[A\x1b[B\r", history: []string{"one", "two"}, line: "two"},
+		// Up then back down to the draft
+		{input: "dr\x1b[A\x1b[B\r", history: []string{"one"}, line: "dr"},
+		{input: "abc\x03", err: errInterrupted},
+		{input: "\x04", err: io.EOF},
+	}
+
+	for _, test := range tests {
+		e := &lineEditor{
+			in:      bufio.NewReader(strings.NewReader(test.input)),
+			out:     io.Discard,
+			history: &history{entries: test.history},
+		}
+		line, err := e.edit(prompt)
+		assert.Equal(t, test.err, err, test.input)
+		assert.Equal(t, test.line, line, test.input)
+	}
+}
+
+func TestHistoryAdd(t *testing.T) {
+	h := &history{}
+	h.add("SELECT name\r\nFROM users\nWHERE name = 'a    b';\n")
+	h.add("INSERT INTO t VALUES ('a    b');")
+	h.add("INSERT INTO t VALUES ('a    b');")
+	h.add("  \n")
+	h.add("SELECT name -- the name\nFROM users\r\n-- of everyone\nWHERE name <> '--';")
+	assert.Equal(t, []string{
+		"SELECT name FROM users WHERE name = 'a    b';",
+		"INSERT INTO t VALUES ('a    b');",
+		"SELECT name  FROM users  WHERE name <> '--';",
+	}, h.entries)
+
+	// Recalled statements with comments can be run
+	e := &lineEditor{in: bufio.NewReader(strings.NewReader("\x1b[A\r")), out: io.Discard, history: h}
+	line, err := e.edit(prompt)
+	assert.Nil(t, err)
+	assert.True(t, statementComplete(line))
+}
+
+func TestHistoryQuotedNewlines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h := loadHistory(path)
+	h.add("INSERT INTO t\nVALUES ('a;\r\nb', 'c\\nd');")
+	want := "INSERT INTO t VALUES ('a;\nb', 'c\\nd');"
+	assert.Equal(t, []string{want}, h.entries)
+
+	// The history file keeps an entry a line
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+	assert.Equal(t, []string{want}, loadHistory(path).entries)
+
+	// The recalled statement keeps the values as typed
+	e := &lineEditor{in: bufio.NewReader(strings.NewReader("\x1b[A\r")), out: io.Discard, history: h}
+	line, err := e.edit(prompt)
+	assert.Nil(t, err)
+	assert.Equal(t, want, line)
+}
+
+func TestStartMultiLine(t *testing.T) {
+	in := strings.NewReader("CREATE TABLE users\n(id INT, name TEXT);\nINSERT INTO users VALUES (1, 'a;\nb');\nSELECT name\nFROM users;\n")
+	var out bytes.Buffer
+	Start(backend.NewMemoryBacked(), in, &out, "aligned")
+
+	assert.NotContains(t, out.String(), "ERROR")
+	assert.Contains(t, out.String(), "| a;\nb |")
+	assert.Contains(t, out.String(), continuationPrompt)
+}
+
+func TestMetaCommands(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.sql")
+	output := filepath.Join(dir, "out.txt")
+	assert.Nil(t, os.WriteFile(script, []byte("CREATE TABLE users (id INT, name TEXT);\nINSERT INTO users VALUES (1, 'Phil');\n"), 0600))
+
+	in := strings.NewReader(strings.Join([]string{
+		`\i ` + script,
+		`\dt`,
+		`\d users`,
+		`\x on`,
+		`\o ` + output,
+		`SELECT name FROM users;`,
+		`\o`,
+		`\q`,
+		`SELECT nope FROM users;`,
+	}, "\n"))
+	var out bytes.Buffer
+	Start(backend.NewMemoryBacked(), in, &out, "aligned")
+
+	assert.NotContains(t, out.String(), "ERROR")
+	assert.Contains(t, out.String(), "| users |")
+	assert.Contains(t, out.String(), "| name   | text |")
+	assert.Contains(t, out.String(), "Expanded display is on.")
+
+	written, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, "-[ RECORD 1 ]\nname | Phil\n", string(written))
+}
+
+func TestBufferStats(t *testing.T) {
+	b, err := backend.Open("lsm:" + t.TempDir() + "?buffer_pool=64kB")
+	assert.Nil(t, err)
+	defer b.(io.Closer).Close()
+
+	in := strings.NewReader("CREATE TABLE users (id INT, name TEXT);\nINSERT INTO users VALUES (1, 'Phil');\n\\buffers\n")
+	var out bytes.Buffer
+	Start(b, in, &out, "aligned")
+	assert.NotContains(t, out.String(), "ERROR")
+	assert.Contains(t, out.String(), "| size      | 65536 |")
+	assert.Contains(t, out.String(), "| hit ratio |")
+
+	out.Reset()
+	Start(backend.NewMemoryBacked(), strings.NewReader("\\buffers\n"), &out, "aligned")
+	assert.Contains(t, out.String(), "has no buffer pool")
+}
+
+func TestRun(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	inputs := []io.Reader{
+		strings.NewReader("\\timing\nCREATE TABLE users (name TEXT);\nINSERT INTO users VALUES ('Phil');\n"),
+		strings.NewReader("SELECT name FROM users;\nSELECT age FROM users;\nSELECT name FROM users;\n"),
+	}
+	var out, errOut bytes.Buffer
+	err := Run(b, inputs, &out, &errOut, "csv")
+
+	assert.True(t, errors.Is(err, backend.ErrColumnDoesNotExist))
+	// Statuses and timings are not mixed into CSV
+	assert.Equal(t, "name\nPhil\n", out.String())
+	assert.Regexp(t, `^Timing is on.\nok\nTime: .* ms\nok\nTime: .* ms\n`, errOut.String())
+	assert.Contains(t, errOut.String(), "ERROR 42703")
+
+	out.Reset()
+	err = Run(b, []io.Reader{strings.NewReader("\\q\nSELECT age FROM users;\n")}, &out, &errOut, "csv")
+	assert.Nil(t, err)
+	assert.Equal(t, "", out.String())
+}
+
+func TestDescribeTableData(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	in := strings.NewReader("CREATE TABLE users (id INT PRIMARY KEY, name TEXT) WITH (storage = 'columnar');\n\\d users\n")
+	var out, errOut bytes.Buffer
+	assert.Nil(t, Run(b, []io.Reader{in}, &out, &errOut, "csv"))
+
+	// Only the columns are data
+	assert.Equal(t, "column,type,nullable,default\nid,int,not null,\nname,text,,\n", out.String())
+	assert.Contains(t, errOut.String(), "Table \"users\"\n")
+	assert.Contains(t, errOut.String(), "Indexes:\n    \"users_pkey\" PRIMARY KEY (id)\n")
+	assert.Contains(t, errOut.String(), "Storage: columnar\n")
+}
+
+func TestInterrupt(t *testing.T) {
+	lines := []string{"CREATE TABLE t (i INT);", "INSERT INTO t VALUES (0);"}
+	for n := 1; n < 2000; n *= 2 {
+		lines = append(lines, fmt.Sprintf("INSERT INTO t SELECT i + %d FROM t;", n))
+	}
+	lines = append(lines,
+		"SELECT count(*) FROM t a, t b, t c WHERE a.i + b.i = c.i;",
+		"SELECT count(*) FROM t;")
+	slow := len(lines) - 2
+
+	// Ctrl-C is pressed as the slow statement starts, and only then
+	defer func(notify func(chan<- os.Signal)) { notifyInterrupt = notify }(notifyInterrupt)
+	calls := 0
+	notifyInterrupt = func(c chan<- os.Signal) {
+		if calls == slow {
+			c <- os.Interrupt
+		}
+		calls++
+	}
+
+	var out bytes.Buffer
+	Start(backend.NewMemoryBacked(), strings.NewReader(strings.Join(lines, "\n")), &out, "csv")
+
+	assert.Equal(t, len(lines), calls)
+	assert.Equal(t, 1, strings.Count(out.String(), "ERROR"))
+	assert.Contains(t, out.String(), "ERROR 57014: canceling statement due to user request\n")
+	assert.Contains(t, out.String(), "count\n2048\n")
+}
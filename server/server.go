@@ -0,0 +1,499 @@
+// Package server exposes a backend over HTTP.
+//
+// POST /query takes a JSON body {"sql": "...", "params": [...]} where params
+// is either a list of positional arguments or an object of named arguments,
+// and answers with the results of every statement:
+//
+//	{"results": [{"columns": [{"name": "id", "type": "int"}], "rows": [[1]], "rows_affected": 0}]}
+//
+// Clients sending "Accept: application/x-ndjson" instead get one JSON value
+// per line: a {"columns": ...} header followed by one array per row for
+// statements returning rows, and {"rows_affected": n} for the others.
+//
+// A query stops with error 57014 once its client goes away. A query whose
+// body also has an "id" can be canceled while it runs, or waits for the
+// ones before it, by POST /cancel with the body {"id": "..."}, which
+// answers {"canceled": true}, or false when no such query is running.
+//
+// GET /dump answers with the whole database as SQL, see package dump.
+//
+// Queries hold the backend while their rows are written, so a client that
+// stops reading would hold it for everyone. Servers whose ConnContext is
+// ConnContext give up on writes that make no progress for a minute.
+//
+// Request bodies are limited to 16MB, larger ones are answered with status
+// 413.
+//
+// Errors are answered with {"error": {"code": "42601", "message": "...",
+// "location": {...}}}, where code is the SQLSTATE of the error.
+// Parse errors also carry the expected and actual tokens, and their
+// location is 0-based, like token.Location.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/dump"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/nanjingblue/maydb/session"
+	"github.com/nanjingblue/maydb/sqlstate"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+// flushEvery is the number of NDJSON rows written between flushes.
+const flushEvery = 1000
+
+// maxBodySize is the largest request body read, in bytes.
+const maxBodySize = 16 << 20
+
+// writeTimeout is how long a write to a client may take.
+const writeTimeout = time.Minute
+
+var errQueryIDInUse = errors.New("a running query already has this id")
+
+type Server struct {
+	backend backend.Backend
+	mux     *http.ServeMux
+
+	// mu serializes access to backend.
+	mu sync.Mutex
+
+	// running cancels the queries that have an id, by id. It is guarded by
+	// runningMu rather than mu, which the query to cancel holds.
+	runningMu sync.Mutex
+	running   map[string]context.CancelFunc
+
+	// writeTimeout replaces the constant of the same name, for tests.
+	writeTimeout time.Duration
+}
+
+func New(b backend.Backend) *Server {
+	s := &Server{
+		backend:      b,
+		mux:          http.NewServeMux(),
+		running:      map[string]context.CancelFunc{},
+		writeTimeout: writeTimeout,
+	}
+	s.mux.HandleFunc("/query", s.handleQuery)
+	s.mux.HandleFunc("/cancel", s.handleCancel)
+	s.mux.HandleFunc("/dump", s.handleDump)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+	dw := &deadlineWriter{ResponseWriter: w, conn: conn, timeout: s.writeTimeout}
+	dw.extend()
+	s.mux.ServeHTTP(dw, r)
+	// For what is left to write once the handler returns
+	dw.extend()
+}
+
+type connKey struct{}
+
+// ConnContext is meant for the ConnContext of an http.Server, to let the
+// server time out the writes of its responses.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// deadlineWriter moves the write deadline of conn forward as a response is
+// written, so that each write has at least half of timeout to complete. A
+// client that stops reading makes writes fail instead of block.
+type deadlineWriter struct {
+	http.ResponseWriter
+	conn     net.Conn
+	timeout  time.Duration
+	extended time.Time
+}
+
+func (w *deadlineWriter) extend() {
+	if w.conn == nil {
+		return
+	}
+	now := time.Now()
+	if now.Sub(w.extended) > w.timeout/2 {
+		w.conn.SetWriteDeadline(now.Add(w.timeout))
+		w.extended = now
+	}
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.extend()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deadlineWriter) Flush() {
+	w.extend()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+type queryRequest struct {
+	SQL    string          `json:"sql"`
+	Params json.RawMessage `json:"params"`
+	ID     string          `json:"id"`
+}
+
+type cancelRequest struct {
+	ID string `json:"id"`
+}
+
+type column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type result struct {
+	Columns      []column        `json:"columns"`
+	Rows         [][]interface{} `json:"rows"`
+	RowsAffected int64           `json:"rows_affected"`
+}
+
+type location struct {
+	Line uint `json:"line"`
+	Col  uint `json:"col"`
+}
+
+type errorDetail struct {
+	Code     string    `json:"code"`
+	Message  string    `json:"message"`
+	Location *location `json:"location,omitempty"`
+	Expected []string  `json:"expected,omitempty"`
+	Actual   string    `json:"actual,omitempty"`
+}
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req queryRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+	args, err := decodeParams(req.Params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+	if req.ID != "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		if !s.register(req.ID, cancel) {
+			writeError(w, http.StatusConflict, errQueryIDInUse)
+			return
+		}
+		defer s.unregister(req.ID)
+	}
+
+	// The rows of the last statement are read from the backend as they are
+	// written, so it stays locked until the response is done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// COPY paths would be files of the server, not of the client
+	sess := session.New(s.backend)
+	sess.DisableCopyFiles()
+	rs, err := sess.ExecContext(ctx, req.SQL, args...)
+	if err != nil {
+		var parseErr *parser.ParseError
+		if errors.As(err, &parseErr) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	// SQL without statements, such as only a comment, has no results
+	if len(rs) > 0 && rs[len(rs)-1].Rows != nil {
+		defer rs[len(rs)-1].Rows.Close()
+	}
+
+	if wantsNDJSON(r) {
+		writeNDJSON(w, rs)
+		return
+	}
+
+	body := struct {
+		Results []result `json:"results"`
+	}{Results: []result{}}
+	for _, r := range rs {
+		res, err := toResult(r)
+		if err != nil {
+			// Rows are computed as they are read, so this is most likely
+			// an error of the query, such as a division by zero
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		body.Results = append(body.Results, res)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var req cancelRequest
+	if !decodeBody(w, r, &req) {
+		return
+	}
+
+	s.runningMu.Lock()
+	cancel, ok := s.running[req.ID]
+	s.runningMu.Unlock()
+	if ok {
+		cancel()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Canceled bool `json:"canceled"`
+	}{ok})
+}
+
+// register makes cancel the way to cancel the query id, unless another
+// query has that id.
+func (s *Server) register(id string, cancel context.CancelFunc) bool {
+	s.runningMu.Lock()
+	defer s.runningMu.Unlock()
+	if _, ok := s.running[id]; ok {
+		return false
+	}
+	s.running[id] = cancel
+	return true
+}
+
+func (s *Server) unregister(id string) {
+	s.runningMu.Lock()
+	delete(s.running, id)
+	s.runningMu.Unlock()
+}
+
+func (s *Server) handleDump(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	// Dump into a buffer so that a failure can still be answered with an
+	// error status.
+	var buf bytes.Buffer
+	s.mu.Lock()
+	err := dump.Dump(r.Context(), s.backend, &buf)
+	s.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sql")
+	buf.WriteTo(w)
+}
+
+// decodeBody decodes the JSON body of r into v, or else answers with an
+// error and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body larger than %d bytes", maxBodySize))
+		return false
+	case err != nil:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// decodeParams turns the params of a request into session arguments. JSON
+// numbers must be integers, there is no other numeric type.
+func decodeParams(raw json.RawMessage) ([]interface{}, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var params interface{}
+	if err := dec.Decode(&params); err != nil {
+		return nil, fmt.Errorf("invalid params: %w", err)
+	}
+
+	switch params := params.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		args := make([]interface{}, len(params))
+		for i, p := range params {
+			v, err := decodeParam(p)
+			if err != nil {
+				return nil, fmt.Errorf("param %d: %w", i+1, err)
+			}
+			args[i] = v
+		}
+		return args, nil
+	case map[string]interface{}:
+		var names []string
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var args []interface{}
+		for _, name := range names {
+			v, err := decodeParam(params[name])
+			if err != nil {
+				return nil, fmt.Errorf("param %s: %w", name, err)
+			}
+			args = append(args, session.Named(name, v))
+		}
+		return args, nil
+	}
+	return nil, errors.New("params must be an array or an object")
+}
+
+func decodeParam(p interface{}) (interface{}, error) {
+	if n, ok := p.(json.Number); ok {
+		i, err := n.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is not an integer", session.ErrUnsupportedArgument, n)
+		}
+		return i, nil
+	}
+	return p, nil
+}
+
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+func toColumns(rows backend.Rows) []column {
+	columns := []column{}
+	for _, col := range rows.Columns() {
+		columns = append(columns, column{Name: col.Name, Type: col.Type.String()})
+	}
+	return columns
+}
+
+func toRow(rows backend.Rows) ([]interface{}, error) {
+	row := rows.Row()
+	values := make([]interface{}, len(row))
+	for i, cell := range row {
+		v, err := backend.CellValue(cell, rows.Columns()[i].Type)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func toResult(r *session.Result) (result, error) {
+	res := result{RowsAffected: r.RowsAffected}
+	if r.Rows != nil {
+		res.Columns = toColumns(r.Rows)
+		res.Rows = [][]interface{}{}
+		for r.Rows.Next() {
+			values, err := toRow(r.Rows)
+			if err != nil {
+				return result{}, err
+			}
+			res.Rows = append(res.Rows, values)
+		}
+		if err := r.Rows.Err(); err != nil {
+			return result{}, err
+		}
+	}
+	return res, nil
+}
+
+func writeNDJSON(w http.ResponseWriter, rs []*session.Result) {
+	w.Header().Set("Content-Type", ndjsonContentType)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	for _, r := range rs {
+		if r.Rows == nil {
+			enc.Encode(struct {
+				RowsAffected int64 `json:"rows_affected"`
+			}{r.RowsAffected})
+			continue
+		}
+
+		enc.Encode(struct {
+			Columns []column `json:"columns"`
+		}{toColumns(r.Rows)})
+		for i := 0; r.Rows.Next(); i++ {
+			values, err := toRow(r.Rows)
+			if err != nil {
+				encodeError(enc, err)
+				return
+			}
+			if err := enc.Encode(values); err != nil {
+				// The client went away
+				return
+			}
+			if flusher != nil && (i+1)%flushEvery == 0 {
+				flusher.Flush()
+			}
+		}
+		if err := r.Rows.Err(); err != nil {
+			encodeError(enc, err)
+			return
+		}
+	}
+}
+
+// encodeError reports an error in an NDJSON stream, its headers being gone.
+func encodeError(enc *json.Encoder, err error) {
+	enc.Encode(errorBody{Error: errorDetail{
+		Code:    sqlstate.Code(err),
+		Message: err.Error(),
+	}})
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	body := errorBody{Error: errorDetail{
+		Code:    sqlstate.Code(err),
+		Message: err.Error(),
+	}}
+
+	var parseErr *parser.ParseError
+	if errors.As(err, &parseErr) {
+		body.Error.Location = &location{Line: parseErr.Loc.Line, Col: parseErr.Loc.Col}
+		body.Error.Expected = parseErr.Expected
+		if parseErr.Actual != nil {
+			body.Error.Actual = parseErr.Actual.Value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
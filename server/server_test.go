@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		result string
+	}{
+		{
+			body:   `{"sql": "CREATE TABLE users (id INT, name TEXT);"}`,
+			status: http.StatusOK,
+			result: `{"results":[{"columns":null,"rows":null,"rows_affected":0}]}`,
+		},
+		{
+			body:   `{"sql": "INSERT INTO users VALUES ($1, $2);", "params": [1, "Phil"]}`,
+			status: http.StatusOK,
+			result: `{"results":[{"columns":null,"rows":null,"rows_affected":1}]}`,
+		},
+		{
+			body:   `{"sql": "INSERT INTO users VALUES (:id, :name);", "params": {"id": 2, "name": "Kate"}}`,
+			status: http.StatusOK,
+			result: `{"results":[{"columns":null,"rows":null,"rows_affected":1}]}`,
+		},
+		{
+			body:   `{"sql": "SELECT id, name FROM users;"}`,
+			status: http.StatusOK,
+			result: `{"results":[{"columns":[{"name":"id","type":"int"},{"name":"name","type":"text"}],"rows":[[1,"Phil"],[2,"Kate"]],"rows_affected":0}]}`,
+		},
+		{
+			body:   `{"sql": "SELECT id FROM users"}`,
+			status: http.StatusOK,
+			result: `{"results":[{"columns":[{"name":"id","type":"int"}],"rows":[[1],[2]],"rows_affected":0}]}`,
+		},
+		{
+			body:   `{"sql": "SELECT id FROM users SELECT 1"}`,
+			status: http.StatusBadRequest,
+			result: `{"error":{"code":"42601","message":"1:22: expected ';', got SELECT","location":{"line":0,"col":21},"expected":["';'"],"actual":"select"}}`,
+		},
+		{
+			body:   `{"sql": "SELECT id FROM nope;"}`,
+			status: http.StatusUnprocessableEntity,
+			result: `{"error":{"code":"42P01","message":"table does not exist"}}`,
+		},
+		{
+			body:   `{"sql": "SELECT 1 / (id - 2) FROM users;"}`,
+			status: http.StatusUnprocessableEntity,
+			result: `{"error":{"code":"22012","message":"division by zero"}}`,
+		},
+		{
+			body:   `{"sql": "INSERT INTO users VALUES ($1, $2);", "params": [1.5, "Phil"]}`,
+			status: http.StatusBadRequest,
+			result: `{"error":{"code":"42804","message":"param 1: unsupported argument type: 1.5 is not an integer"}}`,
+		},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Post(ts.URL+"/query", "application/json", strings.NewReader(test.body))
+		assert.Nil(t, err, test.body)
+
+		var body json.RawMessage
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body), test.body)
+		resp.Body.Close()
+
+		assert.Equal(t, test.status, resp.StatusCode, test.body)
+		assert.JSONEq(t, test.result, string(body), test.body)
+	}
+}
+
+func TestQueryEmpty(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	for _, sql := range []string{"", "-- hi"} {
+		body, err := json.Marshal(map[string]string{"sql": sql})
+		assert.Nil(t, err)
+
+		resp, err := http.Post(ts.URL+"/query", "application/json", bytes.NewReader(body))
+		assert.Nil(t, err, sql)
+		out, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err, sql)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, sql)
+		assert.JSONEq(t, `{"results":[]}`, string(out), sql)
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/query", bytes.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Accept", ndjsonContentType)
+		resp, err = http.DefaultClient.Do(req)
+		assert.Nil(t, err, sql)
+		out, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err, sql)
+		assert.Equal(t, http.StatusOK, resp.StatusCode, sql)
+		assert.Equal(t, "", string(out), sql)
+	}
+}
+
+func TestQueryNDJSON(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	body := `{"sql": "CREATE TABLE users (id INT, name TEXT); INSERT INTO users VALUES (1, 'Phil'); SELECT name FROM users;"}`
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/query", strings.NewReader(body))
+	assert.Nil(t, err)
+	req.Header.Set("Accept", ndjsonContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, ndjsonContentType, resp.Header.Get("Content-Type"))
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	assert.Equal(t, []string{
+		`{"rows_affected":0}`,
+		`{"rows_affected":1}`,
+		`{"columns":[{"name":"name","type":"text"}]}`,
+		`["Phil"]`,
+	}, lines)
+}
+
+func TestDump(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/query", "application/json", strings.NewReader(`{"sql": "CREATE TABLE users (id INT); INSERT INTO users VALUES (1);"}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/dump")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "-- maydb dump\n\nCREATE TABLE users (id INT);\n\nINSERT INTO users VALUES (1);\n", string(body))
+}
+
+func TestCancel(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	ts := httptest.NewServer(New(b))
+	defer ts.Close()
+
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		assert.Nil(t, err, body)
+		defer resp.Body.Close()
+		out, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err, body)
+		return resp.StatusCode, string(out)
+	}
+
+	post("/query", `{"sql": "CREATE TABLE t (i INT);"}`)
+	var rows [][]interface{}
+	for i := int64(0); i < 2000; i++ {
+		rows = append(rows, []interface{}{i})
+	}
+	assert.Nil(t, b.InsertValues(context.Background(), "t", []string{"i"}, rows))
+	slow := `{"sql": "SELECT count(*) FROM t a, t b, t c WHERE a.i + b.i = c.i;", "id": "slow"}`
+
+	type answer struct {
+		status int
+		body   string
+	}
+	done := make(chan answer)
+	go func() {
+		status, body := post("/query", slow)
+		done <- answer{status, body}
+	}()
+
+	// The query may not have started yet
+	canceled := false
+	for !canceled {
+		_, body := post("/cancel", `{"id": "slow"}`)
+		canceled = body == "{\"canceled\":true}\n"
+		time.Sleep(time.Millisecond)
+	}
+	got := <-done
+	assert.Equal(t, http.StatusUnprocessableEntity, got.status)
+	assert.JSONEq(t, `{"error":{"code":"57014","message":"canceling statement due to user request"}}`, got.body)
+
+	status, body := post("/cancel", `{"id": "slow"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"canceled":false}`, body)
+
+	// A client that goes away cancels its query
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(slow)).WithContext(ctx)
+	New(b).ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"57014"`)
+}
+
+func TestCopyFile(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.csv")
+	assert.Nil(t, os.WriteFile(secret, []byte("1\n"), 0o600))
+	out := filepath.Join(dir, "out.csv")
+
+	for _, sql := range []string{
+		"CREATE TABLE users (id INT);",
+		"COPY users FROM '" + secret + "';",
+		"COPY users TO '" + out + "';",
+	} {
+		req, err := json.Marshal(map[string]string{"sql": sql})
+		assert.Nil(t, err)
+		resp, err := http.Post(ts.URL+"/query", "application/json", bytes.NewReader(req))
+		assert.Nil(t, err, sql)
+		body, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err, sql)
+		resp.Body.Close()
+
+		if strings.HasPrefix(sql, "CREATE") {
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			continue
+		}
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, sql)
+		assert.JSONEq(t, `{"error":{"code":"42501","message":"COPY to or from a file is not allowed"}}`, string(body), sql)
+	}
+	_, err := os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStalledClient(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	s := New(b)
+	s.writeTimeout = 100 * time.Millisecond
+	ts := httptest.NewUnstartedServer(s)
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/query", "application/json", strings.NewReader(`{"sql": "CREATE TABLE t (i INT);"}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	var rows [][]interface{}
+	for i := int64(0); i < 1000; i++ {
+		rows = append(rows, []interface{}{i})
+	}
+	assert.Nil(t, b.InsertValues(context.Background(), "t", []string{"i"}, rows))
+
+	// A client that asks for far more rows than the socket buffers hold,
+	// and reads none of them
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(1024)
+	body := `{"sql": "SELECT a.i, b.i FROM t a, t b;"}`
+	fmt.Fprintf(conn, "POST /query HTTP/1.1\r\nHost: x\r\nAccept: %s\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", ndjsonContentType, len(body), body)
+
+	// It does not hold the backend for long
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		resp, err := http.Post(ts.URL+"/query", "application/json", strings.NewReader(`{"sql": "SELECT count(*) FROM t;"}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled client holds the backend")
+	}
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	ts := httptest.NewServer(New(backend.NewMemoryBacked()))
+	defer ts.Close()
+
+	sql := "SELECT 1;" + strings.Repeat(" ", maxBodySize)
+	for _, path := range []string{"/query", "/cancel"} {
+		body, err := json.Marshal(map[string]string{"sql": sql, "id": sql})
+		assert.Nil(t, err)
+		resp, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		assert.Nil(t, err, path)
+		out, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Nil(t, err, path)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, path)
+		assert.Contains(t, string(out), "request body larger than", path)
+	}
+}
@@ -0,0 +1,328 @@
+package session
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/token"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidCopyOption  = errors.New("invalid COPY option")
+	ErrCopyFileNotAllowed = errors.New("COPY to or from a file is not allowed")
+)
+
+// copyBatchSize is the number of rows COPY FROM hands to the backend at
+// once.
+const copyBatchSize = 1000
+
+// CopyError reports a row of a COPY FROM file that could not be loaded.
+// Line is 1-based and Column is empty when the whole row is at fault.
+type CopyError struct {
+	File   string
+	Line   int
+	Column string
+	Err    error
+}
+
+func (e *CopyError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: column %s: %v", e.File, e.Line, e.Column, e.Err)
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+type copyOptions struct {
+	delimiter rune
+	header    bool
+	// null is the text of NULL fields, the empty string by default. Only
+	// unquoted fields read as NULL, and COPY TO quotes the values that
+	// have this text, so that NULL and '' are told apart.
+	null string
+}
+
+func parseCopyOptions(options []*ast.CopyOption) (*copyOptions, error) {
+	opts := copyOptions{delimiter: ','}
+	seen := map[string]bool{}
+	for _, o := range options {
+		name := strings.ToLower(o.Name.Value)
+		if seen[name] {
+			return nil, fmt.Errorf("%w: %s given more than once", ErrInvalidCopyOption, name)
+		}
+		seen[name] = true
+
+		var value string
+		if o.Value != nil {
+			value = o.Value.Value
+		}
+
+		switch name {
+		case "format":
+			if !strings.EqualFold(value, "csv") {
+				return nil, fmt.Errorf("%w: unsupported format %q, only csv is", ErrInvalidCopyOption, value)
+			}
+		case "header":
+			switch strings.ToLower(value) {
+			case "", "true", "on", "1":
+				opts.header = true
+			case "false", "off", "0":
+				opts.header = false
+			default:
+				return nil, fmt.Errorf("%w: header requires a boolean", ErrInvalidCopyOption)
+			}
+		case "delimiter":
+			r, size := utf8.DecodeRuneInString(value)
+			if o.Value == nil || o.Value.Kind != token.StringKind || size != len(value) || r == '"' || r == '\r' || r == '\n' {
+				return nil, fmt.Errorf("%w: delimiter must be a single character", ErrInvalidCopyOption)
+			}
+			opts.delimiter = r
+		case "null":
+			if o.Value == nil || o.Value.Kind != token.StringKind {
+				return nil, fmt.Errorf("%w: null requires a string", ErrInvalidCopyOption)
+			}
+			opts.null = value
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCopyOption, name)
+		}
+	}
+	return &opts, nil
+}
+
+// copyColumns resolves the column list of a COPY statement, every column
+// of the table when there is none.
+func (s *Session) copyColumns(cp *ast.CopyStatement) ([]backend.Column, error) {
+	def, err := s.backend.DescribeTable(cp.Table.Value)
+	if err != nil {
+		return nil, err
+	}
+	if cp.Columns == nil {
+		return def.Columns, nil
+	}
+
+	var columns []backend.Column
+	for _, name := range cp.Columns {
+		found := false
+		for _, col := range def.Columns {
+			if col.Name == name.Value {
+				columns = append(columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", backend.ErrColumnDoesNotExist, name.Value)
+		}
+	}
+	return columns, nil
+}
+
+func (s *Session) copy(ctx context.Context, cp *ast.CopyStatement) (int64, error) {
+	if s.noCopyFiles {
+		return 0, ErrCopyFileNotAllowed
+	}
+	opts, err := parseCopyOptions(cp.Options)
+	if err != nil {
+		return 0, err
+	}
+	columns, err := s.copyColumns(cp)
+	if err != nil {
+		return 0, err
+	}
+	if cp.From {
+		return s.copyFrom(ctx, cp, columns, opts)
+	}
+	return s.copyTo(ctx, cp, columns, opts)
+}
+
+// copyFrom loads a CSV file into a table. Fields are converted straight to
+// values of their column type, without going through the parser.
+func (s *Session) copyFrom(ctx context.Context, cp *ast.CopyStatement, columns []backend.Column, opts *copyOptions) (int64, error) {
+	f, err := os.Open(cp.File.Value)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := newCSVReader(f, opts.delimiter, len(columns))
+
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = col.Name
+	}
+
+	var count int64
+	err = s.atomically(func() error {
+		if opts.header {
+			if _, err := r.read(); err != nil && err != io.EOF {
+				return copyReadError(cp.File.Value, err)
+			}
+		}
+
+		batch := make([][]interface{}, 0, copyBatchSize)
+		flush := func() error {
+			if err := s.backend.InsertValues(ctx, cp.Table.Value, names, batch); err != nil {
+				return err
+			}
+			count += int64(len(batch))
+			batch = batch[:0]
+			return nil
+		}
+
+		for {
+			record, err := r.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return copyReadError(cp.File.Value, err)
+			}
+
+			row := make([]interface{}, len(record))
+			for i, field := range record {
+				v, err := fieldValue(field, columns[i].Type, opts)
+				if err != nil {
+					return &CopyError{File: cp.File.Value, Line: field.line, Column: columns[i].Name, Err: err}
+				}
+				row[i] = v
+			}
+
+			batch = append(batch, row)
+			if len(batch) == copyBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return flush()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func copyReadError(file string, err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &CopyError{File: file, Line: parseErr.Line, Err: parseErr.Err}
+	}
+	return err
+}
+
+// fieldValue converts a CSV field to a value of the given type, as
+// backend.InsertValues takes them, nil for NULL.
+func fieldValue(f csvField, ct backend.ColumnType, opts *copyOptions) (interface{}, error) {
+	if !f.quoted && f.value == opts.null {
+		return nil, nil
+	}
+
+	field := f.value
+
+	switch ct {
+	case backend.IntType:
+		i, err := strconv.ParseInt(field, 10, 32)
+		if errors.Is(err, strconv.ErrRange) {
+			return nil, fmt.Errorf("%w: %s", backend.ErrIntegerOutOfRange, field)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q is not an integer", backend.ErrTypeMismatch, field)
+		}
+		return i, nil
+	case backend.TextType:
+		return field, nil
+	}
+	return nil, backend.ErrInvalidDataType
+}
+
+// copyTo writes the rows of a table to a CSV file.
+func (s *Session) copyTo(ctx context.Context, cp *ast.CopyStatement, columns []backend.Column, opts *copyOptions) (int64, error) {
+	slct := &ast.SelectStatement{From: []*ast.TableRef{{Name: cp.Table}}}
+	for _, col := range columns {
+		slct.Item = append(slct.Item, &ast.Expression{
+			Literal: &token.Token{Value: col.Name, Kind: token.IdentifierKind},
+			Kind:    ast.LiteralKind,
+		})
+	}
+	rows, err := s.backend.Select(ctx, slct)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	f, err := os.Create(cp.File.Value)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := newCSVWriter(f, opts.delimiter)
+
+	record := make([]csvField, len(columns))
+	if opts.header {
+		for i, col := range columns {
+			record[i] = csvField{value: col.Name}
+		}
+		w.write(record)
+	}
+	var n int64
+	for rows.Next() {
+		for i, cell := range rows.Row() {
+			v, err := backend.CellValue(cell, columns[i].Type)
+			if err != nil {
+				return 0, err
+			}
+			if v == nil {
+				record[i] = csvField{value: opts.null}
+				continue
+			}
+			value := fmt.Sprint(v)
+			record[i] = csvField{value: value, quoted: value == opts.null}
+		}
+		w.write(record)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := w.flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return n, rows.Close()
+}
+
+// atomically runs f in a transaction of its own, so that it either
+// succeeds or changes nothing. It runs f as is when the backend has no
+// transactions, or one is already in progress.
+func (s *Session) atomically(f func() error) error {
+	tx, ok := s.backend.(backend.Transactor)
+	if !ok {
+		return f()
+	}
+	if err := tx.Begin(); err != nil {
+		if errors.Is(err, backend.ErrTxInProgress) {
+			return f()
+		}
+		return err
+	}
+	if err := f(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,122 @@
+package session
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.csv")
+	out := filepath.Join(dir, "out.csv")
+	assert.Nil(t, os.WriteFile(in, []byte("name;id\n\"Phil; Jr\";1\nKate;-2\n"), 0o644))
+
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	rs, err := s.Exec(fmt.Sprintf("COPY users (name, id) FROM '%s' WITH (FORMAT csv, HEADER, DELIMITER ';');", in))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rs[0].RowsAffected)
+
+	rs, err = s.Exec(fmt.Sprintf("COPY users TO '%s' WITH (HEADER true);", out))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rs[0].RowsAffected)
+	data, err := os.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "id,name\n1,Phil; Jr\n-2,Kate\n", string(data))
+}
+
+func TestCopyNulls(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.csv")
+
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE t (id INT, name TEXT); INSERT INTO t VALUES (NULL, ''), (1, NULL), (2, '\\N');")
+	assert.Nil(t, err)
+
+	for i, test := range []struct {
+		options string
+		file    string
+	}{
+		{options: "", file: ",\"\"\n1,\n2,\\N\n"},
+		{options: " WITH (NULL '\\N')", file: "\\N,\n1,\\N\n2,\"\\N\"\n"},
+	} {
+		_, err := s.Exec(fmt.Sprintf("COPY t TO '%s'%s;", out, test.options))
+		assert.Nil(t, err, test.options)
+		data, err := os.ReadFile(out)
+		assert.Nil(t, err, test.options)
+		assert.Equal(t, test.file, string(data), test.options)
+
+		table := fmt.Sprintf("u%d", i)
+		_, err = s.Exec(fmt.Sprintf("CREATE TABLE %s (id INT, name TEXT);", table))
+		assert.Nil(t, err, test.options)
+		_, err = s.Exec(fmt.Sprintf("COPY %s FROM '%s'%s;", table, out, test.options))
+		assert.Nil(t, err, test.options)
+		rs, err := s.Exec(fmt.Sprintf("SELECT id, name FROM %s;", table))
+		assert.Nil(t, err, test.options)
+
+		var rows [][]interface{}
+		for _, row := range collect(t, rs[0]).Rows {
+			id, err := backend.CellValue(row[0], backend.IntType)
+			assert.Nil(t, err, test.options)
+			name, err := backend.CellValue(row[1], backend.TextType)
+			assert.Nil(t, err, test.options)
+			rows = append(rows, []interface{}{id, name})
+		}
+		assert.Equal(t, [][]interface{}{{nil, ""}, {int64(1), nil}, {int64(2), "\\N"}}, rows, test.options)
+	}
+}
+
+func TestCopyErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	badInt := write("bad_int.csv", "1,Phil\n2,Kate\nthree,Dan\n")
+	badCount := write("bad_count.csv", "1,Phil\n2\n")
+	nulls := write("nulls.csv", "\\N,Phil\n")
+
+	tests := []struct {
+		source string
+		err    error
+		line   int
+	}{
+		{source: fmt.Sprintf("COPY users FROM '%s';", badInt), err: backend.ErrTypeMismatch, line: 3},
+		{source: fmt.Sprintf("COPY users FROM '%s';", badCount), err: csv.ErrFieldCount, line: 2},
+		{source: fmt.Sprintf("COPY users FROM '%s' WITH (NULL '\\N');", nulls), err: backend.ErrNotNullViolation},
+		{source: fmt.Sprintf("COPY users FROM '%s' WITH (FORMAT binary);", badInt), err: ErrInvalidCopyOption},
+		{source: fmt.Sprintf("COPY users FROM '%s' WITH (DELIMITER ';;');", badInt), err: ErrInvalidCopyOption},
+		{source: fmt.Sprintf("COPY users FROM '%s' WITH (HEADER, HEADER);", badInt), err: ErrInvalidCopyOption},
+		{source: fmt.Sprintf("COPY users (age) FROM '%s';", badInt), err: backend.ErrColumnDoesNotExist},
+		{source: fmt.Sprintf("COPY users FROM '%s';", filepath.Join(dir, "missing.csv")), err: os.ErrNotExist},
+	}
+
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT NOT NULL, name TEXT);")
+	assert.Nil(t, err)
+
+	for _, test := range tests {
+		_, err := s.Exec(test.source)
+		assert.ErrorIs(t, err, test.err, test.source)
+
+		var copyErr *CopyError
+		if test.line > 0 && assert.True(t, errors.As(err, &copyErr), test.source) {
+			assert.Equal(t, test.line, copyErr.Line, test.source)
+		}
+	}
+
+	// Nothing was loaded by the failed statements, not even the rows
+	// before the bad one
+	rs, err := s.Exec("SELECT id FROM users;")
+	assert.Nil(t, err)
+	assert.Empty(t, collect(t, rs[0]).Rows)
+}
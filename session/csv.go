@@ -0,0 +1,151 @@
+package session
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// csvField is a field of a COPY file. Unlike encoding/csv, COPY tells
+// quoted fields from unquoted ones, as only an unquoted field reads as
+// NULL.
+type csvField struct {
+	value  string
+	quoted bool
+	// line is the 1-based line the field starts on.
+	line int
+}
+
+// csvReader reads CSV records as in RFC 4180, with the errors of
+// encoding/csv. Unlike encoding/csv, an empty line is a record of one
+// empty field.
+type csvReader struct {
+	r               *bufio.Reader
+	comma           rune
+	fieldsPerRecord int
+	line            int
+}
+
+func newCSVReader(r io.Reader, comma rune, fieldsPerRecord int) *csvReader {
+	return &csvReader{r: bufio.NewReader(r), comma: comma, fieldsPerRecord: fieldsPerRecord}
+}
+
+// readLine reads a line without its line ending, io.EOF once there are
+// none left.
+func (r *csvReader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	r.line++
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+func (r *csvReader) read() ([]csvField, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	start := r.line
+
+	var record []csvField
+	for {
+		field := csvField{line: r.line}
+		if strings.HasPrefix(line, `"`) {
+			field.quoted = true
+			var b strings.Builder
+			line = line[1:]
+			for {
+				i := strings.IndexByte(line, '"')
+				if i < 0 {
+					// The field goes on past the end of the line
+					b.WriteString(line)
+					b.WriteByte('\n')
+					if line, err = r.readLine(); err != nil {
+						if err == io.EOF {
+							return nil, &csv.ParseError{StartLine: start, Line: r.line, Err: csv.ErrQuote}
+						}
+						return nil, err
+					}
+					continue
+				}
+				b.WriteString(line[:i])
+				line = line[i+1:]
+				if strings.HasPrefix(line, `"`) {
+					b.WriteByte('"')
+					line = line[1:]
+					continue
+				}
+				break
+			}
+			field.value = b.String()
+			if line != "" && !strings.HasPrefix(line, string(r.comma)) {
+				return nil, &csv.ParseError{StartLine: start, Line: r.line, Err: csv.ErrQuote}
+			}
+		} else {
+			i := strings.IndexRune(line, r.comma)
+			if i < 0 {
+				i = len(line)
+			}
+			field.value = line[:i]
+			line = line[i:]
+			if strings.Contains(field.value, `"`) {
+				return nil, &csv.ParseError{StartLine: start, Line: r.line, Err: csv.ErrBareQuote}
+			}
+		}
+		record = append(record, field)
+
+		if line == "" {
+			break
+		}
+		line = line[utf8.RuneLen(r.comma):]
+	}
+
+	if len(record) != r.fieldsPerRecord {
+		return nil, &csv.ParseError{StartLine: start, Line: start, Err: csv.ErrFieldCount}
+	}
+	return record, nil
+}
+
+// csvWriter writes CSV records, quoting the fields that need it and the
+// ones asked to be.
+type csvWriter struct {
+	w     *bufio.Writer
+	comma rune
+}
+
+func newCSVWriter(w io.Writer, comma rune) *csvWriter {
+	return &csvWriter{w: bufio.NewWriter(w), comma: comma}
+}
+
+func (w *csvWriter) write(record []csvField) error {
+	for i, field := range record {
+		if i > 0 {
+			w.w.WriteRune(w.comma)
+		}
+		if !field.quoted && !w.needsQuotes(field.value) {
+			w.w.WriteString(field.value)
+			continue
+		}
+		w.w.WriteByte('"')
+		w.w.WriteString(strings.ReplaceAll(field.value, `"`, `""`))
+		w.w.WriteByte('"')
+	}
+	_, err := w.w.WriteString("\n")
+	return err
+}
+
+func (w *csvWriter) needsQuotes(field string) bool {
+	return strings.ContainsRune(field, w.comma) || strings.ContainsAny(field, "\"\r\n") ||
+		strings.HasPrefix(field, " ")
+}
+
+func (w *csvWriter) flush() error {
+	return w.w.Flush()
+}
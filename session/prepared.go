@@ -0,0 +1,578 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/token"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrMixedPlaceholders   = errors.New("cannot mix placeholder styles")
+	ErrInvalidPlaceholder  = errors.New("invalid placeholder")
+	ErrArgumentCount       = errors.New("wrong number of arguments")
+	ErrUnknownParameter    = errors.New("unknown parameter")
+	ErrMissingArgument     = errors.New("missing argument")
+	ErrArgumentType        = errors.New("argument does not match parameter type")
+	ErrUnsupportedArgument = errors.New("unsupported argument type")
+)
+
+// Param is a placeholder of a prepared statement. Every occurrence of the
+// same $n or :name shares one Param.
+type Param struct {
+	// Ordinal is the 1-based position of the argument bound to this
+	// parameter.
+	Ordinal int
+	// Name is set for :name placeholders.
+	Name string
+	// Type is only meaningful when Known, that is when it was declared in
+	// PREPARE or inferred from the column the parameter is compared with or
+	// inserted into.
+	Type  backend.ColumnType
+	Known bool
+}
+
+func (p Param) String() string {
+	if p.Name != "" {
+		return ":" + p.Name
+	}
+	return "$" + strconv.Itoa(p.Ordinal)
+}
+
+// NamedArg binds a value to a :name placeholder.
+type NamedArg struct {
+	Name  string
+	Value interface{}
+}
+
+func Named(name string, value interface{}) NamedArg {
+	return NamedArg{Name: name, Value: value}
+}
+
+// Prepared is a parsed statement list that can be executed many times.
+type Prepared struct {
+	session *Session
+	ast     *ast.Ast
+	params  []*Param
+	byExp   map[*ast.Expression]*Param
+}
+
+func (s *Session) prepare(a *ast.Ast, types []backend.ColumnType) (*Prepared, error) {
+	p := &Prepared{
+		session: s,
+		ast:     a,
+		byExp:   map[*ast.Expression]*Param{},
+	}
+
+	var style byte
+	positional := 0
+	numbered := map[int]*Param{}
+	named := map[string]*Param{}
+	for _, stmt := range a.Statements {
+		_, err := mapExpressions(stmt, func(exp *ast.Expression) (*ast.Expression, error) {
+			if exp.Kind != ast.PlaceholderKind {
+				return exp, nil
+			}
+
+			v := exp.Literal.Value
+			if style != 0 && style != v[0] {
+				return nil, ErrMixedPlaceholders
+			}
+			style = v[0]
+
+			var param *Param
+			switch v[0] {
+			case '?':
+				positional++
+				param = &Param{Ordinal: positional}
+				p.params = append(p.params, param)
+			case '$':
+				n, err := strconv.Atoi(v[1:])
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("%w: %s", ErrInvalidPlaceholder, v)
+				}
+				if param = numbered[n]; param == nil {
+					param = &Param{Ordinal: n}
+					numbered[n] = param
+					p.params = append(p.params, param)
+				}
+			case ':':
+				if param = named[v[1:]]; param == nil {
+					param = &Param{Ordinal: len(named) + 1, Name: v[1:]}
+					named[v[1:]] = param
+					p.params = append(p.params, param)
+				}
+			}
+			p.byExp[exp] = param
+			return exp, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill gaps such as the unused $2 in "$1, $3", and parameters that are
+	// declared but never referenced.
+	sort.Slice(p.params, func(i, j int) bool {
+		return p.params[i].Ordinal < p.params[j].Ordinal
+	})
+	count := len(types)
+	if len(p.params) > 0 && p.params[len(p.params)-1].Ordinal > count {
+		count = p.params[len(p.params)-1].Ordinal
+	}
+	params := make([]*Param, count)
+	for _, param := range p.params {
+		params[param.Ordinal-1] = param
+	}
+	for i := range params {
+		if params[i] == nil {
+			params[i] = &Param{Ordinal: i + 1}
+		}
+		if i < len(types) {
+			params[i].Type = types[i]
+			params[i].Known = true
+		}
+	}
+	p.params = params
+
+	p.inferTypes()
+	return p, nil
+}
+
+// inferTypes guesses the type of the parameters that were not declared from
+// where they are used. Tables that don't exist yet are skipped.
+func (p *Prepared) inferTypes() {
+	infer := func(exp *ast.Expression, ct backend.ColumnType) {
+		param, ok := p.byExp[exp]
+		if ok && !param.Known {
+			param.Type = ct
+			param.Known = true
+		}
+	}
+
+	for _, stmt := range p.ast.Statements {
+		switch stmt.Kind {
+		case ast.InsertKind:
+			inst := stmt.InsertStatement
+			def, err := p.session.backend.DescribeTable(inst.Table.Value)
+			if err != nil {
+				continue
+			}
+			if inst.OnConflict != nil {
+				for _, set := range inst.OnConflict.Set {
+					for _, col := range def.Columns {
+						if col.Name == set.Column.Value {
+							infer(set.Value, col.Type)
+						}
+					}
+				}
+			}
+			columns := def.Columns
+			if inst.Columns != nil {
+				columns = nil
+				for _, name := range inst.Columns {
+					for _, col := range def.Columns {
+						if col.Name == name.Value {
+							columns = append(columns, col)
+							break
+						}
+					}
+				}
+				if len(columns) != len(inst.Columns) {
+					continue
+				}
+			}
+			for _, values := range inst.Values {
+				for i, exp := range values {
+					if i < len(columns) {
+						infer(exp, columns[i].Type)
+					}
+				}
+			}
+			if inst.Select != nil {
+				p.inferSelect(inst.Select, infer)
+			}
+		case ast.SelectKind:
+			p.inferSelect(stmt.SelectStatement, infer)
+		case ast.ExplainKind:
+			if inner := stmt.ExplainStatement.Statement; inner.Kind == ast.SelectKind {
+				p.inferSelect(inner.SelectStatement, infer)
+			}
+		case ast.ExecuteKind:
+			target, ok := p.session.prepared[stmt.ExecuteStatement.Name.Value]
+			if !ok || stmt.ExecuteStatement.Args == nil {
+				continue
+			}
+			for i, exp := range *stmt.ExecuteStatement.Args {
+				if i < len(target.params) && target.params[i].Known {
+					infer(exp, target.params[i].Type)
+				}
+			}
+		}
+	}
+}
+
+// inferSelect infers the type of parameters compared with a column or a
+// literal, used in arithmetic, or given to LIMIT and OFFSET.
+func (p *Prepared) inferSelect(slct *ast.SelectStatement, infer func(*ast.Expression, backend.ColumnType)) {
+	type table struct {
+		name string
+		def  *backend.TableDefinition
+	}
+	var tables []table
+	for _, ref := range slct.From {
+		def, err := p.session.backend.DescribeTable(ref.Name.Value)
+		if err != nil {
+			continue
+		}
+		name := ref.Name.Value
+		if ref.Alias != nil {
+			name = ref.Alias.Value
+		}
+		tables = append(tables, table{name, def})
+	}
+
+	typeOf := func(exp *ast.Expression) (backend.ColumnType, bool) {
+		if exp.Kind != ast.LiteralKind {
+			return 0, false
+		}
+		switch exp.Literal.Kind {
+		case token.NumericKind:
+			return backend.IntType, true
+		case token.StringKind:
+			return backend.TextType, true
+		case token.IdentifierKind:
+			for _, t := range tables {
+				if exp.Table != nil && exp.Table.Value != t.name {
+					continue
+				}
+				for _, col := range t.def.Columns {
+					if col.Name == exp.Literal.Value {
+						return col.Type, true
+					}
+				}
+			}
+		}
+		return 0, false
+	}
+
+	var walk func(exp *ast.Expression)
+	walk = func(exp *ast.Expression) {
+		if exp == nil {
+			return
+		}
+		if exp.Kind == ast.BinaryKind {
+			left, right := exp.Args[0], exp.Args[1]
+			switch token.Symbol(exp.Literal.Value) {
+			case token.PlusSymbol, token.MinusSymbol, token.AsteriskSymbol, token.SlashSymbol, token.PercentSymbol:
+				infer(left, backend.IntType)
+				infer(right, backend.IntType)
+			default:
+				if ct, ok := typeOf(left); ok {
+					infer(right, ct)
+				}
+				if ct, ok := typeOf(right); ok {
+					infer(left, ct)
+				}
+			}
+		}
+		for _, arg := range exp.Args {
+			walk(arg)
+		}
+	}
+	for _, exp := range slct.Item {
+		walk(exp)
+	}
+	for _, ref := range slct.From {
+		walk(ref.On)
+	}
+	walk(slct.Where)
+	walk(slct.Having)
+	infer(slct.Limit, backend.IntType)
+	infer(slct.Offset, backend.IntType)
+}
+
+// Params returns the parameters in argument order.
+func (p *Prepared) Params() []Param {
+	params := make([]Param, len(p.params))
+	for i, param := range p.params {
+		params[i] = *param
+	}
+	return params
+}
+
+// Exec binds args to the parameters and executes the statements. Plain
+// arguments are bound by position, NamedArg arguments by name.
+func (p *Prepared) Exec(args ...interface{}) ([]*Result, error) {
+	return p.ExecContext(context.Background(), args...)
+}
+
+// ExecContext is Exec for statements that stop once ctx is done, rows
+// being read included.
+func (p *Prepared) ExecContext(ctx context.Context, args ...interface{}) ([]*Result, error) {
+	values := make([]*token.Token, len(p.params))
+	positional := 0
+	for _, arg := range args {
+		var param *Param
+		if na, ok := arg.(NamedArg); ok {
+			for _, candidate := range p.params {
+				if candidate.Name == na.Name {
+					param = candidate
+					break
+				}
+			}
+			if param == nil {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownParameter, na.Name)
+			}
+			arg = na.Value
+		} else {
+			if positional >= len(p.params) {
+				return nil, fmt.Errorf("%w: expected %d, got %d", ErrArgumentCount, len(p.params), len(args))
+			}
+			param = p.params[positional]
+			positional++
+		}
+
+		t, err := argToken(arg, param)
+		if err != nil {
+			return nil, err
+		}
+		values[param.Ordinal-1] = t
+	}
+
+	return p.exec(ctx, values)
+}
+
+// execExpressions binds the literal arguments of an EXECUTE statement.
+func (p *Prepared) execExpressions(ctx context.Context, args []*ast.Expression) ([]*Result, error) {
+	if len(args) != len(p.params) {
+		return nil, fmt.Errorf("%w: expected %d, got %d", ErrArgumentCount, len(p.params), len(args))
+	}
+
+	values := make([]*token.Token, len(p.params))
+	for i, exp := range args {
+		if exp.Kind != ast.LiteralKind || exp.Literal.Kind == token.IdentifierKind {
+			return nil, fmt.Errorf("%w: %s is not a literal", ErrArgumentType, exp.Literal.Value)
+		}
+		if err := checkToken(exp.Literal, p.params[i]); err != nil {
+			return nil, err
+		}
+		values[i] = exp.Literal
+	}
+
+	return p.exec(ctx, values)
+}
+
+func (p *Prepared) exec(ctx context.Context, values []*token.Token) ([]*Result, error) {
+	for i, v := range values {
+		if v == nil {
+			return nil, fmt.Errorf("%w: %s", ErrMissingArgument, p.params[i])
+		}
+	}
+
+	bound := &ast.Ast{}
+	for _, stmt := range p.ast.Statements {
+		b, err := mapExpressions(stmt, func(exp *ast.Expression) (*ast.Expression, error) {
+			param, ok := p.byExp[exp]
+			if !ok {
+				return exp, nil
+			}
+			return &ast.Expression{
+				Literal: values[param.Ordinal-1],
+				Kind:    ast.LiteralKind,
+			}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		bound.Statements = append(bound.Statements, b)
+	}
+
+	return p.session.execute(ctx, bound)
+}
+
+// argToken converts a Go value to the literal token it is bound as.
+func argToken(arg interface{}, param *Param) (*token.Token, error) {
+	t := token.Token{}
+	switch v := arg.(type) {
+	case nil:
+		t.Kind = token.KeywordKind
+		t.Value = string(token.NullKeyword)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		t.Kind = token.NumericKind
+		t.Value = fmt.Sprint(v)
+	case string:
+		t.Kind = token.StringKind
+		t.Value = v
+	case []byte:
+		t.Kind = token.StringKind
+		t.Value = string(v)
+	default:
+		return nil, fmt.Errorf("%w: %T for %s", ErrUnsupportedArgument, arg, param)
+	}
+
+	if err := checkToken(&t, param); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func checkToken(t *token.Token, param *Param) error {
+	if !param.Known || (t.Kind == token.KeywordKind && t.Value == string(token.NullKeyword)) {
+		return nil
+	}
+	if (param.Type == backend.IntType && t.Kind != token.NumericKind) ||
+		(param.Type == backend.TextType && t.Kind != token.StringKind) {
+		return fmt.Errorf("%w: %s expects %s, got %q", ErrArgumentType, param, param.Type, t.Value)
+	}
+	return nil
+}
+
+// mapExpressions returns a copy of stmt with every expression replaced by
+// the result of f. The body of a PREPARE statement is left alone, its
+// placeholders belong to the prepared statement.
+func mapExpressions(stmt *ast.Statement, mapOne func(*ast.Expression) (*ast.Expression, error)) (*ast.Statement, error) {
+	var mapList func(exps []*ast.Expression) ([]*ast.Expression, error)
+	// f also maps the operands of operators and function calls, and keeps
+	// the alias of SELECT items
+	f := func(exp *ast.Expression) (*ast.Expression, error) {
+		if len(exp.Args) == 0 {
+			m, err := mapOne(exp)
+			if err != nil || m == exp || exp.Alias == nil {
+				return m, err
+			}
+			c := *m
+			c.Alias = exp.Alias
+			return &c, nil
+		}
+		args, err := mapList(exp.Args)
+		if err != nil {
+			return nil, err
+		}
+		c := *exp
+		c.Args = args
+		return &c, nil
+	}
+	mapList = func(exps []*ast.Expression) ([]*ast.Expression, error) {
+		if exps == nil {
+			return nil, nil
+		}
+		mapped := make([]*ast.Expression, len(exps))
+		for i, exp := range exps {
+			m, err := f(exp)
+			if err != nil {
+				return nil, err
+			}
+			mapped[i] = m
+		}
+		return mapped, nil
+	}
+	mapOptional := func(exp *ast.Expression) (*ast.Expression, error) {
+		if exp == nil {
+			return nil, nil
+		}
+		return f(exp)
+	}
+	mapSelect := func(s *ast.SelectStatement) (*ast.SelectStatement, error) {
+		slct := *s
+		var err error
+		if slct.Item, err = mapList(s.Item); err != nil {
+			return nil, err
+		}
+		slct.From = make([]*ast.TableRef, len(s.From))
+		for i, ref := range s.From {
+			r := *ref
+			if r.On, err = mapOptional(ref.On); err != nil {
+				return nil, err
+			}
+			slct.From[i] = &r
+		}
+		for _, exp := range []**ast.Expression{&slct.Where, &slct.Having, &slct.Limit, &slct.Offset} {
+			if *exp, err = mapOptional(*exp); err != nil {
+				return nil, err
+			}
+		}
+		if slct.GroupBy, err = mapList(s.GroupBy); err != nil {
+			return nil, err
+		}
+		slct.OrderBy = make([]*ast.OrderTerm, len(s.OrderBy))
+		for i, term := range s.OrderBy {
+			exp, err := f(term.Expression)
+			if err != nil {
+				return nil, err
+			}
+			slct.OrderBy[i] = &ast.OrderTerm{Expression: exp, Desc: term.Desc}
+		}
+		return &slct, nil
+	}
+
+	c := *stmt
+	switch stmt.Kind {
+	case ast.InsertKind:
+		inst := *stmt.InsertStatement
+		inst.Values = make([][]*ast.Expression, len(stmt.InsertStatement.Values))
+		for i, values := range stmt.InsertStatement.Values {
+			mapped, err := mapList(values)
+			if err != nil {
+				return nil, err
+			}
+			inst.Values[i] = mapped
+		}
+		if inst.Select != nil {
+			slct, err := mapSelect(inst.Select)
+			if err != nil {
+				return nil, err
+			}
+			inst.Select = slct
+		}
+		if inst.Returning != nil {
+			returning, err := mapList(inst.Returning)
+			if err != nil {
+				return nil, err
+			}
+			inst.Returning = returning
+		}
+		if inst.OnConflict != nil {
+			oc := *inst.OnConflict
+			oc.Set = make([]*ast.SetClause, len(inst.OnConflict.Set))
+			for i, set := range inst.OnConflict.Set {
+				value, err := f(set.Value)
+				if err != nil {
+					return nil, err
+				}
+				oc.Set[i] = &ast.SetClause{Column: set.Column, Value: value}
+			}
+			inst.OnConflict = &oc
+		}
+		c.InsertStatement = &inst
+	case ast.SelectKind:
+		slct, err := mapSelect(stmt.SelectStatement)
+		if err != nil {
+			return nil, err
+		}
+		c.SelectStatement = slct
+	case ast.ExplainKind:
+		inner, err := mapExpressions(stmt.ExplainStatement.Statement, mapOne)
+		if err != nil {
+			return nil, err
+		}
+		explain := *stmt.ExplainStatement
+		explain.Statement = inner
+		c.ExplainStatement = &explain
+	case ast.ExecuteKind:
+		exec := *stmt.ExecuteStatement
+		if exec.Args != nil {
+			args, err := mapList(*exec.Args)
+			if err != nil {
+				return nil, err
+			}
+			exec.Args = &args
+		}
+		c.ExecuteStatement = &exec
+	}
+	return &c, nil
+}
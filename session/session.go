@@ -0,0 +1,291 @@
+// Package session executes parsed statements against a backend and keeps the
+// per-connection state, such as prepared statements, that outlives a single
+// statement.
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/nanjingblue/maydb/ast"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/parser"
+)
+
+var (
+	ErrPreparedStatementExists       = errors.New("prepared statement already exists")
+	ErrPreparedStatementDoesNotExist = errors.New("prepared statement does not exist")
+)
+
+type Session struct {
+	backend  backend.Backend
+	prepared map[string]*Prepared
+	settings backend.Settings
+	// noCopyFiles rejects COPY, whose file paths are on the machine the
+	// session runs on, for sessions of remote clients.
+	noCopyFiles bool
+}
+
+func New(b backend.Backend) *Session {
+	return &Session{
+		backend:  b,
+		prepared: map[string]*Prepared{},
+		settings: backend.DefaultSettings(),
+	}
+}
+
+func (s *Session) Backend() backend.Backend {
+	return s.backend
+}
+
+// DisableCopyFiles makes COPY fail with ErrCopyFileNotAllowed. Sessions of
+// clients that should not read or write the files of the server use it.
+func (s *Session) DisableCopyFiles() {
+	s.noCopyFiles = true
+}
+
+// Result is the outcome of a single statement. Rows is only set for
+// statements that return rows. Those of the last statement are computed as
+// they are read, and must be closed; those of the statements before it
+// were read before the next statement ran.
+type Result struct {
+	Kind         ast.AstKind
+	RowsAffected int64
+	Rows         backend.Rows
+}
+
+// Exec parses source, binds args to its placeholders and executes every
+// statement in it.
+func (s *Session) Exec(source string, args ...interface{}) ([]*Result, error) {
+	return s.ExecContext(context.Background(), source, args...)
+}
+
+// ExecContext is Exec for statements that stop once ctx is done, with
+// backend.ErrQueryCanceled, rows being read included. Canceling ctx is how
+// a client cancels a running statement.
+func (s *Session) ExecContext(ctx context.Context, source string, args ...interface{}) ([]*Result, error) {
+	p, err := s.Prepare(source)
+	if err != nil {
+		return nil, err
+	}
+	return p.ExecContext(ctx, args...)
+}
+
+// Prepare parses source so that it can be executed many times with
+// different arguments.
+func (s *Session) Prepare(source string) (*Prepared, error) {
+	a, err := parser.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	return s.prepare(a, nil)
+}
+
+func (s *Session) execute(ctx context.Context, a *ast.Ast) ([]*Result, error) {
+	var results []*Result
+	for i, stmt := range a.Statements {
+		r, err := s.executeTimed(ctx, stmt)
+		if err != nil {
+			return nil, err
+		}
+		if r.Rows != nil && i < len(a.Statements)-1 {
+			// The next statement may change what the rows would read
+			collected, err := backend.Collect(r.Rows)
+			if err != nil {
+				return nil, err
+			}
+			r.Rows = backend.ResultsRows(collected)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// executeTimed executes stmt, canceling it once statement_timeout
+// passes. The timeout covers the reading of its rows.
+func (s *Session) executeTimed(ctx context.Context, stmt *ast.Statement) (*Result, error) {
+	if s.settings.StatementTimeout <= 0 {
+		return s.executeStatement(ctx, stmt)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.settings.StatementTimeout)
+	r, err := s.executeStatement(ctx, stmt)
+	if err != nil || r.Rows == nil {
+		cancel()
+		return r, err
+	}
+	r.Rows = &timedRows{Rows: r.Rows, cancel: cancel}
+	return r, nil
+}
+
+// timedRows are rows read under a statement_timeout, whose timer stops
+// once they are closed.
+type timedRows struct {
+	backend.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+func (s *Session) executeStatement(ctx context.Context, stmt *ast.Statement) (*Result, error) {
+	if err := backend.ContextErr(ctx); err != nil {
+		return nil, err
+	}
+	r := &Result{Kind: stmt.Kind}
+	ctx = backend.WithSettings(ctx, s.settings)
+
+	switch stmt.Kind {
+	case ast.CreateTableKind:
+		if err := s.backend.CreateTable(stmt.CreateTableStatement); err != nil {
+			return nil, err
+		}
+	case ast.CreateSequenceKind:
+		if err := s.backend.CreateSequence(stmt.CreateSequenceStatement); err != nil {
+			return nil, err
+		}
+	case ast.InsertKind:
+		n, results, err := s.backend.Insert(ctx, stmt.InsertStatement)
+		if err != nil {
+			return nil, err
+		}
+		r.RowsAffected = n
+		if results != nil {
+			r.Rows = backend.ResultsRows(results)
+		}
+	case ast.SelectKind:
+		rows, err := s.backend.Select(ctx, stmt.SelectStatement)
+		if err != nil {
+			return nil, err
+		}
+		r.Rows = rows
+	case ast.ExplainKind:
+		results, err := s.backend.Explain(ctx, stmt.ExplainStatement)
+		if err != nil {
+			return nil, err
+		}
+		r.Rows = backend.ResultsRows(results)
+	case ast.AnalyzeKind:
+		if err := s.backend.Analyze(ctx, stmt.AnalyzeStatement); err != nil {
+			return nil, err
+		}
+	case ast.PrepareKind:
+		if err := s.prepareStatement(stmt.PrepareStatement); err != nil {
+			return nil, err
+		}
+	case ast.ExecuteKind:
+		return s.executePrepared(ctx, stmt.ExecuteStatement)
+	case ast.DeallocateKind:
+		if err := s.deallocate(stmt.DeallocateStatement); err != nil {
+			return nil, err
+		}
+	case ast.CopyKind:
+		n, err := s.copy(ctx, stmt.CopyStatement)
+		if err != nil {
+			return nil, err
+		}
+		r.RowsAffected = n
+	case ast.SetKind:
+		if err := s.set(stmt.SetStatement); err != nil {
+			return nil, err
+		}
+	case ast.ShowKind:
+		results, err := s.show(stmt.ShowStatement)
+		if err != nil {
+			return nil, err
+		}
+		r.Rows = backend.ResultsRows(results)
+	}
+	return r, nil
+}
+
+func (s *Session) set(set *ast.SetStatement) error {
+	switch {
+	case set.Name == nil:
+		s.settings = backend.DefaultSettings()
+		return nil
+	case set.Value == nil:
+		return s.settings.Reset(set.Name.Value)
+	}
+	return s.settings.Set(set.Name.Value, set.Value.Value)
+}
+
+// show returns the value of a setting as a single row, or a row per
+// setting with its name for SHOW ALL.
+func (s *Session) show(show *ast.ShowStatement) (*backend.Results, error) {
+	if show.Name != nil {
+		value, err := s.settings.Show(show.Name.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &backend.Results{
+			Columns: []backend.Column{{Type: backend.TextType, Name: show.Name.Value}},
+			Rows:    [][]backend.Cell{{backend.MemoryCell(value)}},
+		}, nil
+	}
+
+	results := &backend.Results{
+		Columns: []backend.Column{{Type: backend.TextType, Name: "name"}, {Type: backend.TextType, Name: "setting"}},
+		Rows:    [][]backend.Cell{},
+	}
+	for _, name := range backend.SettingNames() {
+		value, err := s.settings.Show(name)
+		if err != nil {
+			return nil, err
+		}
+		results.Rows = append(results.Rows, []backend.Cell{backend.MemoryCell(name), backend.MemoryCell(value)})
+	}
+	return results, nil
+}
+
+func (s *Session) prepareStatement(prep *ast.PrepareStatement) error {
+	if _, ok := s.prepared[prep.Name.Value]; ok {
+		return ErrPreparedStatementExists
+	}
+
+	var types []backend.ColumnType
+	for _, t := range prep.Types {
+		ct, err := backend.ParseColumnType(t.Value)
+		if err != nil {
+			return err
+		}
+		types = append(types, ct)
+	}
+
+	p, err := s.prepare(&ast.Ast{Statements: []*ast.Statement{prep.Statement}}, types)
+	if err != nil {
+		return err
+	}
+	s.prepared[prep.Name.Value] = p
+	return nil
+}
+
+func (s *Session) executePrepared(ctx context.Context, exec *ast.ExecuteStatement) (*Result, error) {
+	p, ok := s.prepared[exec.Name.Value]
+	if !ok {
+		return nil, ErrPreparedStatementDoesNotExist
+	}
+
+	var args []*ast.Expression
+	if exec.Args != nil {
+		args = *exec.Args
+	}
+	results, err := p.execExpressions(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+func (s *Session) deallocate(dealloc *ast.DeallocateStatement) error {
+	if dealloc.Name == nil {
+		s.prepared = map[string]*Prepared{}
+		return nil
+	}
+	if _, ok := s.prepared[dealloc.Name.Value]; !ok {
+		return ErrPreparedStatementDoesNotExist
+	}
+	delete(s.prepared, dealloc.Name.Value)
+	return nil
+}
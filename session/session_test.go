@@ -0,0 +1,351 @@
+package session
+
+import (
+	"context"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrepared(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		source string
+		args   []interface{}
+		params []Param
+	}{
+		{
+			source: "INSERT INTO users VALUES ($1, $2);",
+			args:   []interface{}{1, "Phil"},
+			params: []Param{
+				{Ordinal: 1, Type: backend.IntType, Known: true},
+				{Ordinal: 2, Type: backend.TextType, Known: true},
+			},
+		},
+		{
+			source: "INSERT INTO users VALUES (?, ?);",
+			args:   []interface{}{2, "Kate"},
+			params: []Param{
+				{Ordinal: 1, Type: backend.IntType, Known: true},
+				{Ordinal: 2, Type: backend.TextType, Known: true},
+			},
+		},
+		{
+			source: "INSERT INTO users VALUES (:id, :name);",
+			args:   []interface{}{Named("name", "Dan"), Named("id", 3)},
+			params: []Param{
+				{Ordinal: 1, Name: "id", Type: backend.IntType, Known: true},
+				{Ordinal: 2, Name: "name", Type: backend.TextType, Known: true},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		p, err := s.Prepare(test.source)
+		assert.Nil(t, err, test.source)
+		assert.Equal(t, test.params, p.Params(), test.source)
+
+		_, err = p.Exec(test.args...)
+		assert.Nil(t, err, test.source)
+	}
+
+	rs, err := s.Exec("SELECT name FROM users;")
+	assert.Nil(t, err)
+	var names []string
+	for _, row := range collect(t, rs[0]).Rows {
+		names = append(names, row[0].AsText())
+	}
+	assert.Equal(t, []string{"Phil", "Kate", "Dan"}, names)
+}
+
+func TestPreparedErrors(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	_, err = s.Prepare("INSERT INTO users VALUES ($1, ?);")
+	assert.ErrorIs(t, err, ErrMixedPlaceholders)
+
+	p, err := s.Prepare("INSERT INTO users VALUES ($1, $2);")
+	assert.Nil(t, err)
+	_, err = p.Exec("1", "Phil")
+	assert.ErrorIs(t, err, ErrArgumentType)
+	_, err = p.Exec(1)
+	assert.ErrorIs(t, err, ErrMissingArgument)
+	_, err = p.Exec(1, "Phil", 2)
+	assert.ErrorIs(t, err, ErrArgumentCount)
+}
+
+func TestPrepareStatement(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	_, err = s.Exec("PREPARE add (int, text) AS INSERT INTO users VALUES ($1, $2);")
+	assert.Nil(t, err)
+	_, err = s.Exec("EXECUTE add (1, 'Phil'); EXECUTE add (2, 'Kate');")
+	assert.Nil(t, err)
+	_, err = s.Exec("EXECUTE add ('3', 'Dan');")
+	assert.ErrorIs(t, err, ErrArgumentType)
+	_, err = s.Exec("PREPARE add AS SELECT id FROM users;")
+	assert.ErrorIs(t, err, ErrPreparedStatementExists)
+
+	_, err = s.Exec("DEALLOCATE add;")
+	assert.Nil(t, err)
+	_, err = s.Exec("EXECUTE add (3, 'Dan');")
+	assert.ErrorIs(t, err, ErrPreparedStatementDoesNotExist)
+
+	rs, err := s.Exec("SELECT id FROM users;")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(collect(t, rs[0]).Rows))
+}
+
+func TestPreparedInsert(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT);")
+	assert.Nil(t, err)
+
+	p, err := s.Prepare("INSERT INTO users (name, id) VALUES ($1, $2), ($3, 3) RETURNING id, name;")
+	assert.Nil(t, err)
+	assert.Equal(t, []Param{
+		{Ordinal: 1, Type: backend.TextType, Known: true},
+		{Ordinal: 2, Type: backend.IntType, Known: true},
+		{Ordinal: 3, Type: backend.TextType, Known: true},
+	}, p.Params())
+
+	rs, err := p.Exec("Phil", 1, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rs[0].RowsAffected)
+	results := collect(t, rs[0])
+	assert.Equal(t, 2, len(results.Rows))
+	assert.Equal(t, "Phil", results.Rows[0][1].AsText())
+	assert.True(t, results.Rows[1][1].IsNull())
+}
+
+func TestPreparedFunctionArgs(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE SEQUENCE ids START 7;")
+	assert.Nil(t, err)
+
+	rs, err := s.Exec("SELECT nextval($1);", "ids")
+	assert.Nil(t, err)
+	results := collect(t, rs[0])
+	assert.Equal(t, []backend.Column{{Type: backend.IntType, Name: "nextval"}}, results.Columns)
+	i, err := results.Rows[0][0].AsInt()
+	assert.Nil(t, err)
+	assert.Equal(t, int32(7), i)
+}
+
+func TestPreparedSelect(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE users (id INT, name TEXT); INSERT INTO users VALUES (1, 'Phil'), (2, 'Kate'), (3, 'Dan');")
+	assert.Nil(t, err)
+
+	p, err := s.Prepare("SELECT name, $3 AS tag FROM users WHERE id > $1 AND name <> $2 ORDER BY id LIMIT $4;")
+	assert.Nil(t, err)
+	assert.Equal(t, []Param{
+		{Ordinal: 1, Type: backend.IntType, Known: true},
+		{Ordinal: 2, Type: backend.TextType, Known: true},
+		{Ordinal: 3},
+		{Ordinal: 4, Type: backend.IntType, Known: true},
+	}, p.Params())
+
+	rs, err := p.Exec(1, "Kate", "x", 5)
+	assert.Nil(t, err)
+	results := collect(t, rs[0])
+	assert.Equal(t, "tag", results.Columns[1].Name)
+	assert.Equal(t, 1, len(results.Rows))
+	assert.Equal(t, "Dan", results.Rows[0][0].AsText())
+
+	rs, err = s.Exec("EXPLAIN SELECT name FROM users WHERE id = $1;", 2)
+	assert.Nil(t, err)
+	results = collect(t, rs[0])
+	assert.Equal(t, []backend.Column{{Type: backend.TextType, Name: "QUERY PLAN"}}, results.Columns)
+	assert.Equal(t, "        Filter: (id = 2)", results.Rows[len(results.Rows)-1][0].AsText())
+
+	rs, err = s.Exec("EXPLAIN (ANALYZE, FORMAT JSON) SELECT name FROM users WHERE id = $1;", 2)
+	assert.Nil(t, err)
+	results = collect(t, rs[0])
+	assert.Equal(t, 1, len(results.Rows))
+	assert.Contains(t, results.Rows[0][0].AsText(), `"Actual Rows": 1`)
+}
+
+func TestStreamedRows(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	rs, err := s.Exec("CREATE TABLE users (id INT); INSERT INTO users VALUES (1), (2); SELECT id FROM users; INSERT INTO users VALUES (3); SELECT id FROM users;")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(collect(t, rs[2]).Rows))
+	assert.Equal(t, 3, len(collect(t, rs[4]).Rows))
+}
+
+// collect reads the rows of r.
+func collect(t *testing.T, r *Result) *backend.Results {
+	results, err := backend.Collect(r.Rows)
+	assert.Nil(t, err)
+	return results
+}
+
+func TestSettings(t *testing.T) {
+	s := New(backend.NewMemoryBacked())
+	show := func(source string) [][]string {
+		rs, err := s.Exec(source)
+		assert.Nil(t, err, source)
+		var rows [][]string
+		for _, row := range collect(t, rs[0]).Rows {
+			var values []string
+			for _, cell := range row {
+				values = append(values, cell.AsText())
+			}
+			rows = append(rows, values)
+		}
+		return rows
+	}
+
+	assert.Equal(t, [][]string{{"2"}}, show("SHOW max_parallel_workers;"))
+	_, err := s.Exec("SET max_parallel_workers = 8;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"max_parallel_workers", "8"}, {"work_mem", "4MB"}, {"statement_timeout", "0"}}, show("SHOW ALL;"))
+	_, err = s.Exec("SET max_parallel_workers TO DEFAULT; SET max_parallel_workers TO '0';")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"0"}}, show("SHOW max_parallel_workers;"))
+	_, err = s.Exec("RESET max_parallel_workers;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"2"}}, show("SHOW max_parallel_workers;"))
+
+	// Sizes take units, and are kilobytes without one
+	_, err = s.Exec("SET work_mem = '64MB';")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"64MB"}}, show("SHOW work_mem;"))
+	_, err = s.Exec("SET work_mem = 1536;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"1536kB"}}, show("SHOW work_mem;"))
+
+	// Durations are milliseconds without a unit
+	_, err = s.Exec("SET statement_timeout = 1500;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"1500ms"}}, show("SHOW statement_timeout;"))
+	_, err = s.Exec("SET statement_timeout = '2min';")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"2min"}}, show("SHOW statement_timeout;"))
+	_, err = s.Exec("SET statement_timeout = '120s';")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"2min"}}, show("SHOW statement_timeout;"))
+
+	_, err = s.Exec("RESET ALL;")
+	assert.Nil(t, err)
+	assert.Equal(t, [][]string{{"4MB"}}, show("SHOW work_mem;"))
+	assert.Equal(t, [][]string{{"0"}}, show("SHOW statement_timeout;"))
+
+	_, err = s.Exec("SET max_parallel_workers = -1;")
+	assert.ErrorIs(t, err, backend.ErrInvalidSetting)
+	_, err = s.Exec("SET work_mem = '1kB';")
+	assert.ErrorIs(t, err, backend.ErrInvalidSetting)
+	_, err = s.Exec("SET statement_timeout = '5 fortnights';")
+	assert.ErrorIs(t, err, backend.ErrInvalidSetting)
+	_, err = s.Exec("SET statement_timeout = -1;")
+	assert.ErrorIs(t, err, backend.ErrInvalidSetting)
+	_, err = s.Exec("SET work_harder = on;")
+	assert.ErrorIs(t, err, backend.ErrUnknownSetting)
+	_, err = s.Exec("SHOW work_harder;")
+	assert.ErrorIs(t, err, backend.ErrUnknownSetting)
+}
+
+func TestSettingsPerSession(t *testing.T) {
+	b := backend.NewMemoryBacked()
+	s, other := New(b), New(b)
+	_, err := s.Exec("CREATE TABLE t (i INT);")
+	assert.Nil(t, err)
+	var rows [][]interface{}
+	for i := int64(0); i < 20000; i++ {
+		rows = append(rows, []interface{}{i})
+	}
+	assert.Nil(t, b.InsertValues(context.Background(), "t", []string{"i"}, rows))
+
+	// The SET of a session leaves the statements of the others alone
+	_, err = other.Exec("SET max_parallel_workers = 0;")
+	assert.Nil(t, err)
+	plan := func(s *Session) string {
+		rs, err := s.Exec("EXPLAIN SELECT i FROM t WHERE i > 5;")
+		assert.Nil(t, err)
+		var lines []string
+		for _, row := range collect(t, rs[0]).Rows {
+			lines = append(lines, row[0].AsText())
+		}
+		return strings.Join(lines, "\n")
+	}
+	assert.Contains(t, plan(s), "Gather")
+	assert.NotContains(t, plan(other), "Gather")
+	assert.Contains(t, plan(s), "Gather")
+}
+
+// slowSession returns a session with a table whose self joins take far
+// longer than a test.
+func slowSession(t *testing.T) *Session {
+	s := New(backend.NewMemoryBacked())
+	_, err := s.Exec("CREATE TABLE t (i INT);")
+	assert.Nil(t, err)
+	var rows [][]interface{}
+	for i := int64(0); i < 2000; i++ {
+		rows = append(rows, []interface{}{i})
+	}
+	assert.Nil(t, s.Backend().InsertValues(context.Background(), "t", []string{"i"}, rows))
+	return s
+}
+
+const slowQuery = "SELECT count(*) FROM t a, t b, t c WHERE a.i + b.i = c.i;"
+
+// readAll executes source with ctx and reads the rows of its last
+// statement, returning the first error.
+func readAll(ctx context.Context, s *Session, source string) error {
+	rs, err := s.ExecContext(ctx, source)
+	if err != nil {
+		return err
+	}
+	if rows := rs[len(rs)-1].Rows; rows != nil {
+		_, err = backend.Collect(rows)
+	}
+	return err
+}
+
+func TestStatementTimeout(t *testing.T) {
+	s := slowSession(t)
+	_, err := s.Exec("SET statement_timeout = '50ms';")
+	assert.Nil(t, err)
+
+	start := time.Now()
+	err = readAll(context.Background(), s, slowQuery)
+	assert.ErrorIs(t, err, backend.ErrStatementTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Statements before the last one are timed one by one
+	_, err = s.Exec("SELECT 1; " + slowQuery + " SELECT 2;")
+	assert.ErrorIs(t, err, backend.ErrStatementTimeout)
+
+	// Quick statements are not affected, but reading their rows counts
+	rs, err := s.Exec("SELECT count(*) FROM t;")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(collect(t, rs[0]).Rows))
+	rs, err = s.Exec("SELECT i FROM t;")
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = backend.Collect(rs[0].Rows)
+	assert.ErrorIs(t, err, backend.ErrStatementTimeout)
+
+	_, err = s.Exec("SET statement_timeout = 0;")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err = readAll(ctx, s, slowQuery)
+	assert.ErrorIs(t, err, backend.ErrQueryCanceled)
+
+	// Nothing runs once the context is done
+	_, err = s.ExecContext(ctx, "CREATE TABLE u (i INT);")
+	assert.ErrorIs(t, err, backend.ErrQueryCanceled)
+	_, err = s.Exec("SELECT * FROM u;")
+	assert.ErrorIs(t, err, backend.ErrTableDoesNotExist)
+}
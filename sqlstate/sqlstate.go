@@ -0,0 +1,123 @@
+// Package sqlstate maps errors to the five character SQLSTATE codes used by
+// PostgreSQL, so clients can tell error classes apart without parsing
+// messages.
+package sqlstate
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/nanjingblue/maydb/backend"
+	"github.com/nanjingblue/maydb/parser"
+	"github.com/nanjingblue/maydb/session"
+	"io/fs"
+)
+
+const (
+	SyntaxError                = "42601"
+	UndefinedTable             = "42P01"
+	DuplicateTable             = "42P07"
+	UndefinedColumn            = "42703"
+	DuplicateColumn            = "42701"
+	UndefinedObject            = "42704"
+	DatatypeMismatch           = "42804"
+	UndefinedParameter         = "42P02"
+	DuplicatePreparedStatement = "42P05"
+	InvalidPreparedStatement   = "26000"
+	NumericValueOutOfRange     = "22003"
+	NotNullViolation           = "23502"
+	UniqueViolation            = "23505"
+	InvalidTableDefinition     = "42P16"
+	InvalidColumnReference     = "42P10"
+	CardinalityViolation       = "21000"
+	UndefinedFunction          = "42883"
+	InvalidParameterValue      = "22023"
+	SequenceGeneratorLimit     = "2200H"
+	ObjectNotInPrerequisite    = "55000"
+	AmbiguousColumn            = "42702"
+	DuplicateAlias             = "42712"
+	GroupingError              = "42803"
+	InvalidRowCountInLimit     = "2201W"
+	DivisionByZero             = "22012"
+	BadCopyFileFormat          = "22P04"
+	UndefinedFile              = "58P01"
+	InsufficientPrivilege      = "42501"
+	ActiveTransaction          = "25001"
+	NoActiveTransaction        = "25P01"
+	FeatureNotSupported        = "0A000"
+	QueryCanceled              = "57014"
+	DataCorrupted              = "XX001"
+	InternalError              = "XX000"
+)
+
+var codes = []struct {
+	err  error
+	code string
+}{
+	{backend.ErrTableDoesNotExist, UndefinedTable},
+	{backend.ErrTableAlreadyExists, DuplicateTable},
+	{backend.ErrColumnDoesNotExist, UndefinedColumn},
+	{backend.ErrInvalidDataType, UndefinedObject},
+	{backend.ErrTypeMismatch, DatatypeMismatch},
+	{backend.ErrIntegerOutOfRange, NumericValueOutOfRange},
+	{backend.ErrMissingValues, SyntaxError},
+	{backend.ErrDuplicateColumn, DuplicateColumn},
+	{backend.ErrTooManyValues, SyntaxError},
+	{backend.ErrNotNullViolation, NotNullViolation},
+	{backend.ErrUniqueViolation, UniqueViolation},
+	{backend.ErrMultiplePrimaryKeys, InvalidTableDefinition},
+	{backend.ErrNoConflictConstraint, InvalidColumnReference},
+	{backend.ErrRowAffectedTwice, CardinalityViolation},
+	{backend.ErrMultipleDefaults, SyntaxError},
+	{backend.ErrSequenceDoesNotExist, UndefinedTable},
+	{backend.ErrSequenceAlreadyExists, DuplicateTable},
+	{backend.ErrSequenceExhausted, SequenceGeneratorLimit},
+	{backend.ErrSequenceMaxValue, SequenceGeneratorLimit},
+	{backend.ErrCurrvalNotDefined, ObjectNotInPrerequisite},
+	{backend.ErrInvalidIncrement, InvalidParameterValue},
+	{backend.ErrInvalidTableOption, InvalidParameterValue},
+	{backend.ErrUndefinedFunction, UndefinedFunction},
+	{backend.ErrAmbiguousColumn, AmbiguousColumn},
+	{backend.ErrDuplicateAlias, DuplicateAlias},
+	{backend.ErrGroupingError, GroupingError},
+	{backend.ErrInvalidAggregate, GroupingError},
+	{backend.ErrInvalidOrderPosition, InvalidColumnReference},
+	{backend.ErrNegativeLimit, InvalidRowCountInLimit},
+	{backend.ErrDivisionByZero, DivisionByZero},
+	{backend.ErrUnsupportedExpression, FeatureNotSupported},
+	{backend.ErrInvalidCell, DataCorrupted},
+	{backend.ErrTxInProgress, ActiveTransaction},
+	{backend.ErrNoTx, NoActiveTransaction},
+	{backend.ErrUnknownSetting, UndefinedObject},
+	{backend.ErrInvalidSetting, InvalidParameterValue},
+	{backend.ErrQueryCanceled, QueryCanceled},
+	{backend.ErrStatementTimeout, QueryCanceled},
+	{session.ErrPreparedStatementExists, DuplicatePreparedStatement},
+	{session.ErrPreparedStatementDoesNotExist, InvalidPreparedStatement},
+	{session.ErrMixedPlaceholders, SyntaxError},
+	{session.ErrInvalidPlaceholder, SyntaxError},
+	{session.ErrArgumentCount, SyntaxError},
+	{session.ErrUnknownParameter, UndefinedParameter},
+	{session.ErrMissingArgument, UndefinedParameter},
+	{session.ErrArgumentType, DatatypeMismatch},
+	{session.ErrUnsupportedArgument, DatatypeMismatch},
+	{session.ErrInvalidCopyOption, SyntaxError},
+	{session.ErrCopyFileNotAllowed, InsufficientPrivilege},
+	{csv.ErrFieldCount, BadCopyFileFormat},
+	{csv.ErrQuote, BadCopyFileFormat},
+	{csv.ErrBareQuote, BadCopyFileFormat},
+	{fs.ErrNotExist, UndefinedFile},
+}
+
+// Code returns the SQLSTATE of err, InternalError for unknown errors.
+func Code(err error) string {
+	var parseErr *parser.ParseError
+	if errors.As(err, &parseErr) {
+		return SyntaxError
+	}
+	for _, c := range codes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return InternalError
+}
@@ -19,16 +19,71 @@ const (
 	IntKeyword    Keyword = "int"
 	TextKeyword   Keyword = "text"
 	WhereKeyword  Keyword = "where"
+
+	PrepareKeyword    Keyword = "prepare"
+	ExecuteKeyword    Keyword = "execute"
+	DeallocateKeyword Keyword = "deallocate"
+	AllKeyword        Keyword = "all"
+
+	CopyKeyword Keyword = "copy"
+	ToKeyword   Keyword = "to"
+	WithKeyword Keyword = "with"
+
+	NullKeyword      Keyword = "null"
+	NotKeyword       Keyword = "not"
+	DefaultKeyword   Keyword = "default"
+	ReturningKeyword Keyword = "returning"
+
+	PrimaryKeyword    Keyword = "primary"
+	UniqueKeyword     Keyword = "unique"
+	ConstraintKeyword Keyword = "constraint"
+	OnKeyword         Keyword = "on"
+	UpdateKeyword     Keyword = "update"
+	SetKeyword        Keyword = "set"
+	SerialKeyword     Keyword = "serial"
+	BigserialKeyword  Keyword = "bigserial"
+	SequenceKeyword   Keyword = "sequence"
+
+	AndKeyword     Keyword = "and"
+	OrKeyword      Keyword = "or"
+	IsKeyword      Keyword = "is"
+	JoinKeyword    Keyword = "join"
+	InnerKeyword   Keyword = "inner"
+	GroupKeyword   Keyword = "group"
+	HavingKeyword  Keyword = "having"
+	OrderKeyword   Keyword = "order"
+	ByKeyword      Keyword = "by"
+	AscKeyword     Keyword = "asc"
+	DescKeyword    Keyword = "desc"
+	LimitKeyword   Keyword = "limit"
+	OffsetKeyword  Keyword = "offset"
+	ExplainKeyword Keyword = "explain"
+	AnalyzeKeyword Keyword = "analyze"
+
+	ShowKeyword  Keyword = "show"
+	ResetKeyword Keyword = "reset"
 )
 
 type Symbol string
 
 const (
-	SemicolonSymbol  Symbol = ";"
-	AsteriskSymbol   Symbol = "*"
-	CommaSymbol      Symbol = ","
-	LeftParenSymbol  Symbol = "("
-	RightParenSymbol Symbol = ")"
+	SemicolonSymbol     Symbol = ";"
+	AsteriskSymbol      Symbol = "*"
+	CommaSymbol         Symbol = ","
+	LeftParenSymbol     Symbol = "("
+	RightParenSymbol    Symbol = ")"
+	DotSymbol           Symbol = "."
+	EqualsSymbol        Symbol = "="
+	NotEqualsSymbol     Symbol = "<>"
+	BangEqualsSymbol    Symbol = "!="
+	LessSymbol          Symbol = "<"
+	LessEqualsSymbol    Symbol = "<="
+	GreaterSymbol       Symbol = ">"
+	GreaterEqualsSymbol Symbol = ">="
+	PlusSymbol          Symbol = "+"
+	MinusSymbol         Symbol = "-"
+	SlashSymbol         Symbol = "/"
+	PercentSymbol       Symbol = "%"
 )
 
 type TokenKind uint
@@ -39,6 +94,8 @@ const (
 	IdentifierKind
 	StringKind
 	NumericKind
+	// PlaceholderKind is a bind parameter: $1, ? or :name
+	PlaceholderKind
 )
 
 type Token struct {